@@ -5,25 +5,60 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/codegangsta/cli"
+	"github.com/litl/galaxy/commander"
 	gconfig "github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
 	"github.com/litl/galaxy/utils"
 )
 
+// The backup format version. Version 1 backups had no Version field, and only
+// held each app's name, version and config. Version 2 added the env backed
+// up, and each app's image ID, schema, pool assignments and runtime settings.
+// Version 3 added the container entrypoint, command, hosts and DNS servers,
+// and version 4 the host port mappings.
+const backupVersion = 4
+
 type backupData struct {
-	Time time.Time
+	Version int
+	Time    time.Time
+	// the env the backup was taken from
+	Env  string
 	Apps []*appCfg
 }
 
-// Serialized backup format
+// Serialized backup format. Virtual hosts and error pages are part of Env,
+// as VIRTUAL_HOST and VIRTUAL_HOST_<code>.
 type appCfg struct {
-	Name    string
-	Version string
-	Env     map[string]string
-	Ports   map[string]string
+	Name      string
+	Version   string
+	VersionID string `json:",omitempty"`
+	Env       map[string]string
+	Schema    gconfig.Schema `json:",omitempty"`
+
+	// Pools the app is assigned to
+	Pools []string `json:",omitempty"`
+
+	// Runtime settings by pool
+	Runtime map[string]*poolRuntime `json:",omitempty"`
+
+	EntryPoint []string             `json:",omitempty"`
+	Command    []string             `json:",omitempty"`
+	Hosts      []gconfig.HostsEntry `json:",omitempty"`
+	DNS        []string             `json:",omitempty"`
+
+	// Host port bindings, as hostPort:containerPort/protocol
+	PortMappings []string `json:",omitempty"`
+}
+
+type poolRuntime struct {
+	Processes   int
+	Memory      string `json:",omitempty"`
+	CPUShares   string `json:",omitempty"`
+	Maintenance bool   `json:",omitempty"`
 }
 
 // Backup app config to a file or STDOUT
@@ -36,7 +71,9 @@ func appBackup(c *cli.Context) {
 	}
 
 	backup := &backupData{
-		Time: time.Now(),
+		Version: backupVersion,
+		Time:    time.Now(),
+		Env:     env,
 	}
 
 	toBackup := c.Args()
@@ -54,7 +91,7 @@ func appBackup(c *cli.Context) {
 
 	errCount := 0
 	for _, app := range toBackup {
-		data, err := getAppBackup(app, env)
+		data, err := getAppBackup(app, env, c.Bool("reveal"))
 		if err != nil {
 			// log errors and continue
 			log.Errorf("ERROR: %s [%s]", err, app)
@@ -85,7 +122,10 @@ func appBackup(c *cli.Context) {
 	os.Stdout.Write(j)
 }
 
-func getAppBackup(app, env string) (*appCfg, error) {
+// getAppBackup returns an app's config for a backup. Secret values stay
+// encrypted, so they can be restored with the same keyring, unless reveal is
+// set.
+func getAppBackup(app, env string, reveal bool) (*appCfg, error) {
 	svcCfg, err := configStore.GetApp(app, env)
 	if err != nil {
 		return nil, err
@@ -95,10 +135,52 @@ func getAppBackup(app, env string) (*appCfg, error) {
 		return nil, fmt.Errorf("app not found")
 	}
 
+	appEnv := map[string]string{}
+	for k, v := range svcCfg.Env() {
+		if v != "" {
+			appEnv[k] = v
+		}
+	}
+
+	if reveal {
+		appEnv, err = gconfig.DecryptEnv(nil, appEnv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pools, err := configStore.ListAssignedPools(env, app)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(pools)
+
 	backup := &appCfg{
-		Name:    app,
-		Version: svcCfg.Version(),
-		Env:     svcCfg.Env(),
+		Name:       app,
+		Version:    svcCfg.Version(),
+		VersionID:  svcCfg.VersionID(),
+		Env:        appEnv,
+		Schema:     svcCfg.GetSchema(),
+		Pools:      pools,
+		Runtime:    make(map[string]*poolRuntime),
+		EntryPoint: svcCfg.GetEntryPoint(),
+		Command:    svcCfg.GetCommand(),
+		Hosts:      svcCfg.GetHosts(),
+		DNS:        svcCfg.GetDNS(),
+	}
+
+	for _, m := range svcCfg.GetPortMappings() {
+		backup.PortMappings = append(backup.PortMappings, m.String())
+	}
+	sort.Strings(backup.PortMappings)
+
+	for _, pool := range svcCfg.RuntimePools() {
+		backup.Runtime[pool] = &poolRuntime{
+			Processes:   svcCfg.GetProcesses(pool),
+			Memory:      svcCfg.GetMemory(pool),
+			CPUShares:   svcCfg.GetCPUShares(pool),
+			Maintenance: svcCfg.GetMaintenanceMode(pool),
+		}
 	}
 	return backup, nil
 }
@@ -129,8 +211,24 @@ func appRestore(c *cli.Context) {
 		log.Fatal(err)
 	}
 
+	if backup.Version > backupVersion {
+		log.Fatalf("ERROR: backup format v%d is newer than this version of galaxy supports (v%d)", backup.Version, backupVersion)
+	}
+
 	fmt.Println("Found backup from ", backup.Time)
 
+	// restore into the env the backup came from, unless another one is given
+	env := utils.GalaxyEnv(c)
+	if env == "" {
+		env = backup.Env
+	}
+	if env == "" {
+		log.Fatal("ERROR: env is required.  Pass --env or set GALAXY_ENV")
+	}
+	if backup.Env != "" && backup.Env != env {
+		fmt.Printf("Restoring apps from %s into %s\n", backup.Env, env)
+	}
+
 	var toRestore []*appCfg
 
 	if apps := c.Args(); len(apps) > 0 {
@@ -152,12 +250,14 @@ func appRestore(c *cli.Context) {
 		toRestore = backup.Apps
 	}
 
+	dryRun := c.Bool("dry-run")
+
 	// check for conflicts
 	// NOTE: there is still a race here if an app is created after this check
-	if !c.Bool("force") {
+	if !c.Bool("force") && !dryRun {
 		needForce := false
 		for _, bkup := range toRestore {
-			exists, err := configStore.AppExists(bkup.Name, utils.GalaxyEnv(c))
+			exists, err := configStore.AppExists(bkup.Name, env)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -173,7 +273,7 @@ func appRestore(c *cli.Context) {
 
 	loggedErr := false
 	for _, bkup := range toRestore {
-		if err := restoreApp(bkup, utils.GalaxyEnv(c)); err != nil {
+		if err := restoreApp(bkup, env, backup.Version, dryRun); err != nil {
 			log.Errorf("%s", err)
 			loggedErr = true
 		}
@@ -185,31 +285,137 @@ func appRestore(c *cli.Context) {
 	}
 }
 
-func restoreApp(bkup *appCfg, env string) error {
-	fmt.Println("restoring", bkup.Name)
+// backupSettings returns the settings in a backup, for updating an app to
+// match it. Config missing from the backup is unset. Settings that weren't in
+// older backup versions are left alone.
+func backupSettings(svcCfg gconfig.App, bkup *appCfg, version int) *commander.AppSettings {
+	env := bkup.Env
+	if env == nil {
+		env = map[string]string{}
+	}
 
-	var svcCfg gconfig.App
+	schema := bkup.Schema
+	if schema == nil {
+		schema = gconfig.Schema{}
+	}
+
+	settings := &commander.AppSettings{
+		Version: &bkup.Version,
+		Env:     env,
+		Schema:  schema,
+		Runtime: make(map[string]*commander.PoolSettings),
+	}
+
+	// the image ID only means something for its own image, so clear it if
+	// the backup has a different image without one
+	if bkup.VersionID != "" || svcCfg.Version() != bkup.Version {
+		settings.VersionID = &bkup.VersionID
+	}
+
+	if version >= 3 {
+		settings.EntryPoint = append([]string{}, bkup.EntryPoint...)
+		settings.Command = append([]string{}, bkup.Command...)
+		settings.Hosts = append([]gconfig.HostsEntry{}, bkup.Hosts...)
+		settings.DNS = append([]string{}, bkup.DNS...)
+	}
+
+	if version >= 4 {
+		settings.PortMappings = []gconfig.PortMapping{}
+		for _, p := range bkup.PortMappings {
+			m, err := commander.ParsePortMapping(p)
+			if err != nil {
+				log.Warnf("WARN: %s: %s", bkup.Name, err)
+				continue
+			}
+			settings.PortMappings = append(settings.PortMappings, m)
+		}
+	}
+
+	for pool, rt := range bkup.Runtime {
+		settings.Runtime[pool] = &commander.PoolSettings{
+			Processes:   &rt.Processes,
+			Memory:      &rt.Memory,
+			CPUShares:   &rt.CPUShares,
+			Maintenance: &rt.Maintenance,
+		}
+	}
+	return settings
+}
+
+func restoreApp(bkup *appCfg, env string, version int, dryRun bool) error {
+	fmt.Println("restoring", bkup.Name)
 
 	exists, err := configStore.AppExists(bkup.Name, env)
 	if err != nil {
 		return err
 	}
 
+	var svcCfg gconfig.App
 	if exists {
 		svcCfg, err = configStore.GetApp(bkup.Name, env)
 		if err != nil {
 			return err
 		}
+	} else {
+		fmt.Printf("  create %s\n", bkup.Name)
+		svcCfg = configStore.NewAppConfig(bkup.Name, "")
+		if !dryRun {
+			if _, err := configStore.CreateApp(bkup.Name, env); err != nil {
+				return err
+			}
+		}
 	}
 
-	if svcCfg == nil {
-		svcCfg = configStore.NewAppConfig(bkup.Name, bkup.Version)
+	assigned, err := configStore.ListAssignedPools(env, bkup.Name)
+	if err != nil {
+		return err
 	}
 
-	for k, v := range bkup.Env {
-		svcCfg.EnvSet(k, v)
+	toAssign := []string{}
+	for _, pool := range bkup.Pools {
+		if utils.StringInSlice(pool, assigned) {
+			continue
+		}
+
+		exists, err := configStore.PoolExists(env, pool)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("pool %s does not exist in %s", pool, env)
+		}
+		toAssign = append(toAssign, pool)
+	}
+
+	// stored like a manifest, so the config is checked and a new image is
+	// recorded as a release
+	var changes []string
+	if dryRun {
+		changes = commander.ApplyAppSettings(svcCfg, backupSettings(svcCfg, bkup, version))
+	} else {
+		changes, err = commander.UpdateAppSettings(configStore, bkup.Name, env, toAssign, func(cfg gconfig.App) (*commander.AppSettings, error) {
+			return backupSettings(cfg, bkup, version), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, change := range changes {
+		fmt.Printf("  %s\n", change)
+	}
+	for _, pool := range toAssign {
+		fmt.Printf("  assign to %s\n", pool)
 	}
 
-	_, err = configStore.UpdateApp(svcCfg, env)
-	return err
+	if dryRun {
+		return nil
+	}
+
+	for _, pool := range toAssign {
+		if _, err := configStore.AssignApp(bkup.Name, env, pool); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -2,86 +2,38 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 
+	"github.com/litl/galaxy/commander"
 	"github.com/litl/galaxy/config"
 )
 
-type dumpConfig struct {
-	Pools   []string
-	Hosts   []config.HostInfo
-	Configs []config.AppDefinition
-	Regs    []config.ServiceRegistration
-}
-
 // Dump everything related to a single environment from galaxy to stdout,
-// including current runtime config, hosts, IPs etc.
+// including current runtime config, assignments, hosts, IPs etc.
 // This isn't really useful other than to sync between config backends, but we
 // can probably convert this to a better backup once we stabilize the code some
 // more.
-func dump(env string) {
-	envDump := &dumpConfig{
-		Configs: []config.AppDefinition{},
-		Regs:    []config.ServiceRegistration{},
-	}
-
-	pools, err := configStore.ListPools(env)
+// Secret values are dumped encrypted, unless reveal is set.
+func dump(env string, reveal bool) {
+	envDump, err := commander.DumpEnv(configStore, env)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	envDump.Pools = pools
-
-	for _, pool := range pools {
-		hosts, err := configStore.ListHosts(env, pool)
-		if err != nil {
-			log.Fatal(err)
-		}
-		for _, host := range hosts {
-			host.Pool = pool
-			envDump.Hosts = append(envDump.Hosts, host)
+	if reveal {
+		for i := range envDump.Configs {
+			ad := &envDump.Configs[i]
+			ad.Environment, err = config.DecryptEnv(nil, ad.Environment)
+			if err != nil {
+				log.Fatalf("%s: %s", ad.Name(), err)
+			}
 		}
 	}
 
-	apps, err := configStore.ListApps(env)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	for _, app := range apps {
-		// AppDefinition is intended to be serializable itself
-		if ad, ok := app.(*config.AppDefinition); ok {
-			envDump.Configs = append(envDump.Configs, *ad)
-			continue
-		}
-
-		// otherwise, manually convert the App to an AppDefinition
-		ad := config.AppDefinition{
-			AppName:     app.Name(),
-			Image:       app.Version(),
-			ImageID:     app.VersionID(),
-			Environment: app.Env(),
-		}
-
-		for _, pool := range app.RuntimePools() {
-			ad.SetProcesses(pool, app.GetProcesses(pool))
-			ad.SetMemory(pool, app.GetMemory(pool))
-			ad.SetCPUShares(pool, app.GetCPUShares(pool))
-		}
-
-		envDump.Configs = append(envDump.Configs, ad)
-	}
-
-	// The registrations are temporary, but dump them anyway, so we can try and
-	// convert an environment by keeping the runtime config in sync.
-	regs, err := configStore.ListRegistrations(env)
-	if err != nil {
-		log.Fatal(err)
-	}
-	envDump.Regs = append(envDump.Regs, regs...)
-
 	js, err := json.MarshalIndent(envDump, "", "  ")
 	if err != nil {
 		log.Fatal(err)
@@ -91,45 +43,67 @@ func dump(env string) {
 }
 
 // Restore everything we can from a Galaxy dump on stdin.
-// This probably will panic if not using consul
 func restore(env string) {
 	js, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	envDump := dumpConfig{}
-	err = json.Unmarshal(js, &envDump)
+	envDump := &commander.EnvDump{}
+	err = json.Unmarshal(js, envDump)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, pool := range envDump.Pools {
-		_, err := configStore.CreatePool(env, pool)
-		if err != nil {
-			log.Println(err)
+	// older dumps only have the assignments that were kept in the app
+	// definitions
+	if envDump.Assignments == nil {
+		envDump.Assignments = make(map[string][]string)
+		for _, ad := range envDump.Configs {
+			for _, as := range ad.Assignments {
+				envDump.Assignments[as.Pool] = append(envDump.Assignments[as.Pool], ad.Name())
+			}
 		}
 	}
 
-	for _, appDef := range envDump.Configs {
-		_, err := configStore.UpdateApp(&appDef, env)
-		if err != nil {
-			log.Println(err)
-		}
+	err = commander.RestoreEnv(configStore, env, envDump)
+	if err != nil {
+		log.Fatal(err)
 	}
+}
 
-	for _, hostInfo := range envDump.Hosts {
-		err := configStore.UpdateHost(env, pool, hostInfo)
-		if err != nil {
-			log.Println(err)
-		}
+// Copy an environment from one registry to another, e.g. to move from redis
+// to consul, and check that everything made it.
+func migrate(args []string) {
+	var from, to, migrateEnv string
+	var dryRun bool
+	migrateFs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	migrateFs.StringVar(&from, "from", registryURL, "Registry URL to copy from")
+	migrateFs.StringVar(&to, "to", "", "Registry URL to copy to")
+	migrateFs.StringVar(&migrateEnv, "env", env, "Environment to copy")
+	migrateFs.BoolVar(&dryRun, "dry-run", false, "Only show what would change")
+	migrateFs.Usage = func() {
+		fmt.Println("Usage: commander migrate -from URL -to URL -env ENV [-dry-run]")
+		migrateFs.PrintDefaults()
 	}
+	migrateFs.Parse(args)
 
-	for _, reg := range envDump.Regs {
-		err := configStore.Backend.RegisterService(env, reg.Pool, &reg)
-		if err != nil {
-			log.Println(err)
-		}
+	if from == "" || to == "" || migrateEnv == "" {
+		migrateFs.Usage()
+		os.Exit(1)
+	}
+
+	if from == to {
+		log.Fatal("ERROR: -from and -to are the same registry")
 	}
 
+	src := config.NewStore(config.DefaultTTL, from)
+	dst := config.NewStore(config.DefaultTTL, to)
+	defer flushWebhooks(dst)
+
+	err := commander.Migrate(src, dst, migrateEnv, dryRun)
+	if err != nil {
+		flushWebhooks(dst)
+		log.Fatalf("ERROR: Unable to migrate %s: %s", migrateEnv, err)
+	}
 }
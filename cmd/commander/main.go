@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	golog "log"
@@ -38,15 +39,39 @@ var (
 	buildVersion   string
 	configStore    *config.Store
 	serviceRuntime *runtime.ServiceRuntime
-	workerChans    map[string]chan string
+	workerChans    map[string]chan appCommand
 	wg             sync.WaitGroup
 	signalsChan    chan os.Signal
+
+	// watchCtx is cancelled to stop watching for config changes on exit
+	watchCtx  context.Context
+	stopWatch context.CancelFunc
 )
 
+// how long a command waits for the webhooks it caused to be sent
+const webhookFlushTimeout = 10 * time.Second
+
+// flushWebhooks waits for queued webhooks to be sent before the command
+// exits, since they're sent in the background.
+func flushWebhooks(store *config.Store) {
+	if !store.FlushWebhooks(webhookFlushTimeout) {
+		log.Warnf("WARN: Gave up waiting for webhooks to be sent")
+	}
+}
+
+// fatalf exits with an error, after sending the webhooks queued so far,
+// since the command may have changed something before it failed.
+func fatalf(format string, args ...interface{}) {
+	if configStore != nil {
+		flushWebhooks(configStore)
+	}
+	log.Fatalf(format, args...)
+}
+
 func initOrDie() {
 
 	if registryURL == "" {
-		log.Fatalf("ERROR: Registry URL not specified. Use '-registry redis://127.0.0.1:6379' or set 'GALAXY_REGISTRY_URL'")
+		fatalf("ERROR: Registry URL not specified. Use '-registry redis://127.0.0.1:6379' or set 'GALAXY_REGISTRY_URL'")
 	}
 
 	configStore = config.NewStore(config.DefaultTTL, registryURL)
@@ -55,19 +80,21 @@ func initOrDie() {
 
 	apps, err := configStore.ListAssignments(env, pool)
 	if err != nil {
-		log.Fatalf("ERROR: Could not retrieve service configs for /%s/%s: %s", env, pool, err)
+		fatalf("ERROR: Could not retrieve service configs for /%s/%s: %s", env, pool, err)
 	}
 
-	workerChans = make(map[string]chan string)
+	workerChans = make(map[string]chan appCommand)
 	for _, app := range apps {
 		appCfg, err := configStore.GetApp(app, env)
 		if err != nil {
-			log.Fatalf("ERROR: Could not retrieve service config for /%s/%s: %s", env, pool, err)
+			fatalf("ERROR: Could not retrieve service config for /%s/%s: %s", env, pool, err)
 		}
 
-		workerChans[appCfg.Name()] = make(chan string)
+		workerChans[appCfg.Name()] = make(chan appCommand)
 	}
 
+	watchCtx, stopWatch = context.WithCancel(context.Background())
+
 	signalsChan = make(chan os.Signal, 1)
 	signal.Notify(signalsChan, os.Interrupt, os.Kill, syscall.SIGTERM)
 	go deregisterHost(signalsChan)
@@ -76,11 +103,11 @@ func initOrDie() {
 func ensureEnv() {
 	envs, err := configStore.ListEnvs()
 	if err != nil {
-		log.Fatalf("ERROR: Could not check envs: %s", err)
+		fatalf("ERROR: Could not check envs: %s", err)
 	}
 
 	if strings.TrimSpace(env) == "" {
-		log.Fatalf("ERROR: Need an env.  Use '-env <env>'. Existing envs are: %s.", strings.Join(envs, ","))
+		fatalf("ERROR: Need an env.  Use '-env <env>'. Existing envs are: %s.", strings.Join(envs, ","))
 	}
 }
 
@@ -88,14 +115,24 @@ func ensurePool() {
 
 	pools, err := configStore.ListPools(env)
 	if err != nil {
-		log.Fatalf("ERROR: Could not check pools: %s", err)
+		fatalf("ERROR: Could not check pools: %s", err)
 	}
 
 	if strings.TrimSpace(pool) == "" {
-		log.Fatalf("ERROR: Need a pool.  Use '-pool <pool>'. Existing pools are: %s", strings.Join(pools, ","))
+		fatalf("ERROR: Need a pool.  Use '-pool <pool>'. Existing pools are: %s", strings.Join(pools, ","))
 	}
 }
 
+// sharedConfigScope returns the pool for the -env-wide or -pool-wide config
+// flags, and whether either was given.
+func sharedConfigScope(envWide, poolWide bool) (string, bool) {
+	if poolWide {
+		ensurePool()
+		return pool, true
+	}
+	return "", envWide
+}
+
 func pullImageAsync(appCfg config.App, errChan chan error) {
 	// err logged via pullImage
 	_, err := pullImage(appCfg)
@@ -117,25 +154,28 @@ func pullImage(appCfg config.App) (*docker.Image, error) {
 	return image, nil
 }
 
-func startService(appCfg config.App, logStatus bool) {
+// startService runs the desired number of containers for the app on this
+// host, and returns the first error, if any.
+func startService(appCfg config.App, logStatus bool) error {
 
 	desired, err := commander.Balanced(configStore, hostIP, appCfg.Name(), env, pool)
 	if err != nil {
 		log.Errorf("ERROR: Could not determine instance count: %s", err)
-		return
+		return err
 	}
 
 	running, err := serviceRuntime.InstanceCount(appCfg.Name(), strconv.FormatInt(appCfg.ID(), 10))
 	if err != nil {
 		log.Errorf("ERROR: Could not determine running instance count: %s", err)
-		return
+		return err
 	}
 
+	var failed error
 	for i := 0; i < desired-running; i++ {
 		container, err := serviceRuntime.Start(env, pool, appCfg)
 		if err != nil {
 			log.Errorf("ERROR: Could not start containers: %s", err)
-			return
+			return err
 		}
 
 		log.Printf("Started %s version %s as %s\n", appCfg.Name(), appCfg.Version(), container.ID[0:12])
@@ -143,35 +183,39 @@ func startService(appCfg config.App, logStatus bool) {
 		err = serviceRuntime.StopOldVersion(appCfg, 1)
 		if err != nil {
 			log.Errorf("ERROR: Could not stop containers: %s", err)
+			failed = err
 		}
 	}
 
 	running, err = serviceRuntime.InstanceCount(appCfg.Name(), strconv.FormatInt(appCfg.ID(), 10))
 	if err != nil {
 		log.Errorf("ERROR: Could not determine running instance count: %s", err)
-		return
+		return err
 	}
 
 	for i := 0; i < running-desired; i++ {
 		err := serviceRuntime.Stop(appCfg)
 		if err != nil {
 			log.Errorf("ERROR: Could not stop container: %s", err)
+			failed = err
 		}
 	}
 
 	err = serviceRuntime.StopOldVersion(appCfg, -1)
 	if err != nil {
 		log.Errorf("ERROR: Could not stop old containers: %s", err)
+		failed = err
 	}
 
 	// check the image version, and log any inconsistencies
 	inspectImage(appCfg)
+	return failed
 }
 
 func heartbeatHost() {
 	_, err := configStore.CreatePool(pool, env)
 	if err != nil {
-		log.Fatalf("ERROR: Unabled to create pool %s: %s", pool, err)
+		fatalf("ERROR: Unabled to create pool %s: %s", pool, err)
 	}
 
 	defer wg.Done()
@@ -186,9 +230,13 @@ func heartbeatHost() {
 
 func deregisterHost(signals chan os.Signal) {
 	<-signals
+	stopWatch()
 	configStore.DeleteHost(env, pool, config.HostInfo{
 		HostIP: hostIP,
 	})
+
+	// Unregister exits
+	flushWebhooks(configStore)
 	discovery.Unregister(serviceRuntime, configStore, env, pool, hostIP, shuttleAddr)
 	os.Exit(0)
 }
@@ -220,10 +268,63 @@ func inspectImage(appCfg config.App) {
 	}
 }
 
-func restartContainers(app string, cmdChan chan string) {
+// appCommand tells an app's worker to "deploy" or "restart" the app, for the
+// change in event. Commands sent at startup have no event.
+type appCommand struct {
+	cmd   string
+	event config.ChangeEvent
+}
+
+// ackChange records how this host handled a change to an app, so app:deploy
+// and app:restart can wait for every host, and tells the env's webhooks if it
+// failed. seq is the last logged change the worker has handled, which may be
+// later than the command's own.
+func ackChange(app string, cmd appCommand, seq int64, appCfg config.App, err error) {
+	if cmd.event.Kind == "" {
+		return
+	}
+
+	if err != nil {
+		event := config.WebhookEvent{
+			Event:   config.WebhookFailed,
+			Env:     env,
+			App:     app,
+			Pool:    pool,
+			HostIP:  hostIP,
+			Message: fmt.Sprintf("%s failed: %s", cmd.cmd, err),
+		}
+		if appCfg != nil {
+			event.Version = appCfg.Version()
+		}
+		configStore.NotifyWebhooks(event)
+	}
+
+	ack := &config.ChangeAck{
+		HostIP: hostIP,
+		App:    app,
+		Seq:    seq,
+		Time:   time.Now().UTC(),
+	}
+	if appCfg != nil {
+		ack.ID = appCfg.ID()
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+
+	if err := configStore.AckChange(env, pool, ack); err != nil {
+		log.Errorf("ERROR: Could not ack %s change to %s: %s", cmd.event.Kind, app, err)
+	}
+}
+
+func restartContainers(app string, cmdChan chan appCommand) {
 	defer wg.Done()
 	logOnce := true
 
+	// the last logged change handled, since changes found by polling have no
+	// Seq of their own
+	seq := int64(0)
+
 	ticker := time.NewTicker(10 * time.Second)
 
 	for {
@@ -231,10 +332,14 @@ func restartContainers(app string, cmdChan chan string) {
 		select {
 
 		case cmd := <-cmdChan:
+			if cmd.event.Seq > seq {
+				seq = cmd.event.Seq
+			}
 
 			assigned, err := appAssigned(app)
 			if err != nil {
 				log.Errorf("ERROR: Error retrieving assignments for %s: %s", app, err)
+				ackChange(app, cmd, seq, nil, err)
 				if !loop {
 					return
 				}
@@ -248,6 +353,7 @@ func restartContainers(app string, cmdChan chan string) {
 			appCfg, err := configStore.GetApp(app, env)
 			if err != nil {
 				log.Errorf("ERROR: Error retrieving service config for %s: %s", app, err)
+				ackChange(app, cmd, seq, nil, err)
 				if !loop {
 					return
 				}
@@ -255,29 +361,32 @@ func restartContainers(app string, cmdChan chan string) {
 			}
 
 			if appCfg.Version() == "" {
+				ackChange(app, cmd, seq, appCfg, nil)
 				if !loop {
 					return
 				}
 				continue
 			}
 
-			if cmd == "deploy" {
+			if cmd.cmd == "deploy" {
 				_, err = pullImage(appCfg)
 				if err != nil {
 					log.Errorf("ERROR: Error pulling image for %s: %s", app, err)
+					ackChange(app, cmd, seq, appCfg, err)
 					if !loop {
 						return
 					}
 					continue
 				}
-				startService(appCfg, logOnce)
+				err = startService(appCfg, logOnce)
 			}
 
-			if cmd == "restart" {
-				err := serviceRuntime.Stop(appCfg)
+			if cmd.cmd == "restart" {
+				err = serviceRuntime.Stop(appCfg)
 				if err != nil {
 					log.Errorf("ERROR: Could not stop %s: %s",
 						appCfg.Version(), err)
+					ackChange(app, cmd, seq, appCfg, err)
 					if !loop {
 						return
 					}
@@ -285,8 +394,13 @@ func restartContainers(app string, cmdChan chan string) {
 					startService(appCfg, logOnce)
 					continue
 				}
+
+				// start it again now rather than on the next tick, so the
+				// ack means it's running
+				err = startService(appCfg, logOnce)
 			}
 
+			ackChange(app, cmd, seq, appCfg, err)
 			logOnce = false
 		case <-ticker.C:
 
@@ -331,10 +445,13 @@ func monitorService(changedConfigs chan *config.ConfigChange) {
 
 	for {
 
-		var changedConfig *config.ConfigChange
 		select {
 
-		case changedConfig = <-changedConfigs:
+		case changedConfig, ok := <-changedConfigs:
+			if !ok {
+				// the watch was stopped
+				return
+			}
 
 			if changedConfig.Error != nil {
 				log.Errorf("ERROR: Error watching changes: %s", changedConfig.Error)
@@ -361,21 +478,22 @@ func monitorService(changedConfigs chan *config.ConfigChange) {
 			ch, ok := workerChans[changedConfig.AppConfig.Name()]
 			if !ok {
 				name := changedConfig.AppConfig.Name()
-				ch := make(chan string)
+				ch := make(chan appCommand)
 				workerChans[name] = ch
 				wg.Add(1)
 				go restartContainers(name, ch)
-				ch <- "deploy"
+				ch <- appCommand{cmd: "deploy", event: changedConfig.Event}
 
 				log.Printf("Started new worker for %s\n", name)
 				continue
 			}
 
-			if changedConfig.Restart {
+			switch changedConfig.Event.Kind {
+			case config.ChangeRestart, config.ChangeAssign:
 				log.Printf("Restarting %s", changedConfig.AppConfig.Name())
-				ch <- "restart"
-			} else {
-				ch <- "deploy"
+				ch <- appCommand{cmd: "restart", event: changedConfig.Event}
+			default:
+				ch <- appCommand{cmd: "deploy", event: changedConfig.Event}
 			}
 		}
 	}
@@ -402,19 +520,30 @@ func main() {
 		println("   app:create      Create an app")
 		println("   app:deploy      Deploy an app")
 		println("   app:delete      Delete an app")
+		println("   app:releases    List the releases of an app")
 		println("   app:restart     Restart an app")
+		println("   app:rollback    Roll back an app to an earlier release")
 		println("   app:run         Run a command within an app on this host")
 		println("   app:shell       Run a shell within an app on this host")
 		println("   app:start       Starts one or more apps")
 		println("   app:stop        Stops one or more apps")
 		println("   app:unassign    Unassign an app from a pool")
 		println("   config          List config for an app")
+		println("   config:export   Export config values for an app")
 		println("   config:get      Get config values for an app")
+		println("   config:import   Import config values for an app from a file")
+		println("   config:schema   Show or set the config schema for an app")
 		println("   config:set      Set config values for an app")
 		println("   config:unset    Unset config values for an app")
+		println("   config:validate Check the config for an app against its schema")
 		println("   runtime         List container runtime policies")
 		println("   runtime:set     Set container runtime policies")
 		println("   hosts           List hosts in an env and pool")
+		println("   audit           List the changes made to apps, pools and config")
+		println("   webhooks        List the webhooks for an env")
+		println("   webhook:add     Send events in an env to a URL")
+		println("   webhook:remove  Stop sending events to a URL")
+		println("   migrate         Copy an env from one registry to another")
 		println("\nOptions:\n")
 		flag.PrintDefaults()
 	}
@@ -439,20 +568,32 @@ func main() {
 		os.Exit(1)
 	}
 
+	// migrate uses its own registries
+	if flag.Args()[0] == "migrate" {
+		migrate(flag.Args()[1:])
+		return
+	}
+
 	initOrDie()
+	defer flushWebhooks(configStore)
 
 	switch flag.Args()[0] {
 	case "dump":
-		if flag.NArg() < 2 {
-			fmt.Println("Usage: commander dump ENV")
+		var reveal bool
+		dumpFs := flag.NewFlagSet("dump", flag.ExitOnError)
+		dumpFs.BoolVar(&reveal, "reveal", false, "Dump secret values decrypted")
+		dumpFs.Parse(flag.Args()[1:])
+
+		if dumpFs.NArg() < 1 {
+			fmt.Println("Usage: commander dump [-reveal] ENV")
 			os.Exit(1)
 		}
-		dump(flag.Arg(1))
+		dump(dumpFs.Arg(0), reveal)
 		return
 
 	case "restore":
 		if flag.NArg() < 2 {
-			fmt.Println("Usage: commander dump ENV FILE")
+			fmt.Println("Usage: commander restore ENV < FILE")
 			os.Exit(1)
 		}
 		restore(flag.Arg(1))
@@ -484,7 +625,7 @@ func main() {
 		appFs.Parse(flag.Args()[1:])
 		err := commander.AppList(configStore, env)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 
@@ -508,7 +649,7 @@ func main() {
 
 		err := commander.AppAssign(configStore, appFs.Args()[0], env, pool)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 	case "app:create":
@@ -530,7 +671,7 @@ func main() {
 
 		err := commander.AppCreate(configStore, appFs.Args()[0], env)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 
@@ -553,14 +694,18 @@ func main() {
 
 		err := commander.AppDelete(configStore, appFs.Args()[0], env)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 
 	case "app:deploy":
+		var wait bool
+		var timeout time.Duration
 		appFs := flag.NewFlagSet("app:delete", flag.ExitOnError)
+		appFs.BoolVar(&wait, "wait", false, "Wait for every host to deploy it")
+		appFs.DurationVar(&timeout, "timeout", 5*time.Minute, "How long to wait for the hosts")
 		appFs.Usage = func() {
-			println("Usage: commander app:deploy [-force] <app> <version>\n")
+			println("Usage: commander app:deploy [-force] [-wait [-timeout 5m]] <app> <version>\n")
 			println("    Deploy an app in an environment\n")
 			println("Options:\n")
 			appFs.PrintDefaults()
@@ -574,16 +719,70 @@ func main() {
 			os.Exit(1)
 		}
 
-		err := commander.AppDeploy(configStore, serviceRuntime, appFs.Args()[0], env, appFs.Args()[1])
+		if !wait {
+			timeout = 0
+		}
+
+		err := commander.AppDeploy(configStore, serviceRuntime, appFs.Args()[0], env, appFs.Args()[1], timeout)
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+		return
+
+	case "app:releases":
+		appFs := flag.NewFlagSet("app:releases", flag.ExitOnError)
+		appFs.Usage = func() {
+			println("Usage: commander app:releases <app>\n")
+			println("    List the releases of an app in an environment\n")
+			println("Options:\n")
+			appFs.PrintDefaults()
+		}
+		appFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if appFs.NArg() != 1 {
+			appFs.Usage()
+			os.Exit(1)
+		}
+
+		err := commander.AppReleases(configStore, appFs.Args()[0], env)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
+		}
+		return
+
+	case "app:rollback":
+		appFs := flag.NewFlagSet("app:rollback", flag.ExitOnError)
+		appFs.Usage = func() {
+			println("Usage: commander app:rollback <app> [<release>]\n")
+			println("    Redeploy the image and config of an earlier release. Defaults to the previous release.\n")
+			println("Options:\n")
+			appFs.PrintDefaults()
+		}
+		appFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if appFs.NArg() < 1 || appFs.NArg() > 2 {
+			appFs.Usage()
+			os.Exit(1)
+		}
+
+		err := commander.AppRollback(configStore, appFs.Args()[0], env, appFs.Arg(1))
+		if err != nil {
+			fatalf("ERROR: %s", err)
 		}
 		return
 
 	case "app:restart":
+		var wait bool
+		var timeout time.Duration
 		appFs := flag.NewFlagSet("app:restart", flag.ExitOnError)
+		appFs.BoolVar(&wait, "wait", false, "Wait for every host to restart it")
+		appFs.DurationVar(&timeout, "timeout", 5*time.Minute, "How long to wait for the hosts")
 		appFs.Usage = func() {
-			println("Usage: commander app:restart <app>\n")
+			println("Usage: commander app:restart [-wait [-timeout 5m]] <app>\n")
 			println("    Restart an app in an environment\n")
 			println("Options:\n")
 			appFs.PrintDefaults()
@@ -597,9 +796,13 @@ func main() {
 			os.Exit(1)
 		}
 
-		err := commander.AppRestart(configStore, appFs.Args()[0], env)
+		if !wait {
+			timeout = 0
+		}
+
+		err := commander.AppRestart(configStore, appFs.Args()[0], env, timeout)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 
@@ -620,9 +823,9 @@ func main() {
 			os.Exit(1)
 		}
 
-		err := commander.AppRun(configStore, serviceRuntime, appFs.Args()[0], env, appFs.Args()[1:])
+		err := commander.AppRun(configStore, serviceRuntime, appFs.Args()[0], env, pool, appFs.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 
@@ -646,7 +849,7 @@ func main() {
 
 		err := commander.AppShell(configStore, serviceRuntime, appFs.Args()[0], env, pool)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 
@@ -666,7 +869,7 @@ func main() {
 		if len(apps) == 0 {
 			acs, err := configStore.ListApps(env)
 			if err != nil {
-				log.Fatalf("ERROR: Unable to list apps: %s", err)
+				fatalf("ERROR: Unable to list apps: %s", err)
 			}
 			for _, ac := range acs {
 				apps = append(apps, ac.Name())
@@ -690,7 +893,7 @@ func main() {
 
 		err := discovery.Status(serviceRuntime, configStore, env, pool, hostIP)
 		if err != nil {
-			log.Fatalf("ERROR: Unable to list app status: %s", err)
+			fatalf("ERROR: Unable to list app status: %s", err)
 		}
 		return
 
@@ -709,7 +912,7 @@ func main() {
 		for _, app := range apps {
 			err := serviceRuntime.StopAllMatching(app)
 			if err != nil {
-				log.Fatalf("ERROR: Unable able to stop all containers: %s", err)
+				fatalf("ERROR: Unable able to stop all containers: %s", err)
 			}
 		}
 		if len(apps) > 0 {
@@ -718,7 +921,7 @@ func main() {
 
 		err := serviceRuntime.StopAll(env)
 		if err != nil {
-			log.Fatalf("ERROR: Unable able to stop all containers: %s", err)
+			fatalf("ERROR: Unable able to stop all containers: %s", err)
 		}
 		return
 	case "app:unassign":
@@ -741,7 +944,7 @@ func main() {
 
 		err := commander.AppUnassign(configStore, appFs.Args()[0], env, pool)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 
@@ -755,7 +958,7 @@ func main() {
 		}
 		err := hostFs.Parse(flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: Bad command line options: %s", err)
+			fatalf("ERROR: Bad command line options: %s", err)
 		}
 
 		ensureEnv()
@@ -763,12 +966,118 @@ func main() {
 
 		err = commander.HostsList(configStore, env, pool)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
+		}
+		return
+	case "audit":
+		var app, since, until string
+		auditFs := flag.NewFlagSet("audit", flag.ExitOnError)
+		auditFs.StringVar(&app, "app", "", "Only list changes to this app")
+		auditFs.StringVar(&since, "since", "", "List changes since a time, date or duration ago (24h)")
+		auditFs.StringVar(&until, "until", "", "List changes before a time, date or duration ago")
+		auditFs.Usage = func() {
+			println("Usage: commander audit [-app <app>] [-since <time>] [-until <time>]\n")
+			println("    List the changes made in an env, or in every env\n")
+			println("Options:\n")
+			auditFs.PrintDefaults()
+		}
+		auditFs.Parse(flag.Args()[1:])
+
+		sinceTime, err := commander.ParseAuditTime(since)
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+		untilTime, err := commander.ParseAuditTime(until)
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+
+		err = commander.Audit(configStore, env, app, sinceTime, untilTime)
+		if err != nil {
+			fatalf("ERROR: %s", err)
 		}
 		return
+
+	case "webhooks":
+		hookFs := flag.NewFlagSet("webhooks", flag.ExitOnError)
+		hookFs.Usage = func() {
+			println("Usage: commander webhooks\n")
+			println("    List the webhooks for an env\n")
+			println("Options:\n")
+			hookFs.PrintDefaults()
+		}
+		hookFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		err := commander.WebhookList(configStore, env)
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+		return
+
+	case "webhook:add":
+		var secret, events string
+		hookFs := flag.NewFlagSet("webhook:add", flag.ExitOnError)
+		hookFs.StringVar(&secret, "secret", "", "Secret to sign requests with, generated if not set")
+		hookFs.StringVar(&events, "events", "", "Comma separated events to send, all of them if not set")
+		hookFs.Usage = func() {
+			println("Usage: commander webhook:add [-secret <secret>] [-events deploy,crash,...] <url>\n")
+			println("    Send events in an env to a URL as JSON POSTs\n")
+			println("    Events: " + strings.Join(config.WebhookEvents, ", ") + "\n")
+			println("Options:\n")
+			hookFs.PrintDefaults()
+		}
+		hookFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if hookFs.NArg() != 1 {
+			hookFs.Usage()
+			os.Exit(1)
+		}
+
+		eventList := []string{}
+		if events != "" {
+			eventList = strings.Split(events, ",")
+		}
+
+		err := commander.WebhookAdd(configStore, env, hookFs.Arg(0), secret, eventList)
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+		return
+
+	case "webhook:remove":
+		hookFs := flag.NewFlagSet("webhook:remove", flag.ExitOnError)
+		hookFs.Usage = func() {
+			println("Usage: commander webhook:remove <url>\n")
+			println("    Stop sending events in an env to a URL\n")
+			println("Options:\n")
+			hookFs.PrintDefaults()
+		}
+		hookFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if hookFs.NArg() != 1 {
+			hookFs.Usage()
+			os.Exit(1)
+		}
+
+		err := commander.WebhookRemove(configStore, env, hookFs.Arg(0))
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+		return
+
 	case "config":
+		var reveal, envWide, poolWide bool
 		configFs := flag.NewFlagSet("config", flag.ExitOnError)
-		usage := "Usage: commander config <app>"
+		configFs.BoolVar(&reveal, "reveal", false, "Show secret values")
+		configFs.BoolVar(&envWide, "env-wide", false, "List the config shared by the env")
+		configFs.BoolVar(&poolWide, "pool-wide", false, "List the config shared by the pool")
+		usage := "Usage: commander config [options] <app>"
 		configFs.Usage = func() {
 			println(usage)
 			println("    List config values for an app\n")
@@ -777,11 +1086,19 @@ func main() {
 		}
 		err := configFs.Parse(flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: Bad command line options: %s", err)
+			fatalf("ERROR: Bad command line options: %s", err)
 		}
 
 		ensureEnv()
 
+		if sharedPool, shared := sharedConfigScope(envWide, poolWide); shared {
+			err = commander.SharedConfigList(configStore, env, sharedPool, reveal)
+			if err != nil {
+				fatalf("ERROR: %s", err)
+			}
+			return
+		}
+
 		if configFs.NArg() != 1 {
 			log.Error("ERROR: Missing app name argument")
 			log.Printf("Usage: %s", usage)
@@ -789,22 +1106,24 @@ func main() {
 		}
 		app := configFs.Args()[0]
 
-		err = commander.ConfigList(configStore, app, env)
+		err = commander.ConfigList(configStore, app, env, reveal)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 	case "config:get":
+		var reveal bool
 		configFs := flag.NewFlagSet("config:get", flag.ExitOnError)
+		configFs.BoolVar(&reveal, "reveal", false, "Show secret values")
 		configFs.Usage = func() {
-			println("Usage: commander config <app> KEY [KEY]*\n")
+			println("Usage: commander config:get [options] <app> KEY [KEY]*\n")
 			println("    Get config values for an app\n")
 			println("Options:\n")
 			configFs.PrintDefaults()
 		}
 		err := configFs.Parse(flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: Bad command line options: %s", err)
+			fatalf("ERROR: Bad command line options: %s", err)
 		}
 
 		ensureEnv()
@@ -816,26 +1135,39 @@ func main() {
 		}
 		app := configFs.Args()[0]
 
-		err = commander.ConfigGet(configStore, app, env, configFs.Args()[1:])
+		err = commander.ConfigGet(configStore, app, env, configFs.Args()[1:], reveal)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 	case "config:set":
+		var secret, envWide, poolWide bool
 		configFs := flag.NewFlagSet("config:set", flag.ExitOnError)
+		configFs.BoolVar(&secret, "secret", false, "Encrypt the values with the local keyring")
+		configFs.BoolVar(&envWide, "env-wide", false, "Set config for every app in the env")
+		configFs.BoolVar(&poolWide, "pool-wide", false, "Set config for every app in the pool")
 		configFs.Usage = func() {
-			println("Usage: commander config <app> KEY=VALUE [KEY=VALUE]*\n")
+			println("Usage: commander config:set [options] <app> KEY=VALUE [KEY=VALUE]*")
+			println("       commander config:set [options] -env-wide|-pool-wide KEY=VALUE [KEY=VALUE]*\n")
 			println("    Set config values for an app\n")
 			println("Options:\n")
 			configFs.PrintDefaults()
 		}
 		err := configFs.Parse(flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: Bad command line options: %s", err)
+			fatalf("ERROR: Bad command line options: %s", err)
 		}
 
 		ensureEnv()
 
+		if sharedPool, shared := sharedConfigScope(envWide, poolWide); shared {
+			err = commander.SharedConfigSet(configStore, env, sharedPool, configFs.Args(), secret)
+			if err != nil {
+				fatalf("ERROR: %s", err)
+			}
+			return
+		}
+
 		if configFs.NArg() == 0 {
 			log.Errorf("ERROR: Missing app name")
 			configFs.Usage()
@@ -843,26 +1175,38 @@ func main() {
 		}
 		app := configFs.Args()[0]
 
-		err = commander.ConfigSet(configStore, app, env, configFs.Args()[1:])
+		err = commander.ConfigSet(configStore, app, env, configFs.Args()[1:], secret)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 	case "config:unset":
+		var envWide, poolWide bool
 		configFs := flag.NewFlagSet("config:unset", flag.ExitOnError)
+		configFs.BoolVar(&envWide, "env-wide", false, "Unset config for every app in the env")
+		configFs.BoolVar(&poolWide, "pool-wide", false, "Unset config for every app in the pool")
 		configFs.Usage = func() {
-			println("Usage: commander config <app> KEY [KEY]*\n")
+			println("Usage: commander config:unset [options] <app> KEY [KEY]*")
+			println("       commander config:unset [options] -env-wide|-pool-wide KEY [KEY]*\n")
 			println("    Unset config values for an app\n")
 			println("Options:\n")
 			configFs.PrintDefaults()
 		}
 		err := configFs.Parse(flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: Bad command line options: %s", err)
+			fatalf("ERROR: Bad command line options: %s", err)
 		}
 
 		ensureEnv()
 
+		if sharedPool, shared := sharedConfigScope(envWide, poolWide); shared {
+			err = commander.SharedConfigUnset(configStore, env, sharedPool, configFs.Args())
+			if err != nil {
+				fatalf("ERROR: %s", err)
+			}
+			return
+		}
+
 		if configFs.NArg() == 0 {
 			log.Errorf("ERROR: Missing app name")
 			configFs.Usage()
@@ -872,7 +1216,126 @@ func main() {
 
 		err = commander.ConfigUnset(configStore, app, env, configFs.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
+		}
+		return
+	case "config:import":
+		var file, format string
+		var replace bool
+		configFs := flag.NewFlagSet("config:import", flag.ExitOnError)
+		configFs.StringVar(&file, "file", "", "File to import (default stdin)")
+		configFs.StringVar(&format, "format", "", "File format: dotenv or json (default from the file name)")
+		configFs.BoolVar(&replace, "replace", false, "Unset config missing from the file")
+		configFs.Usage = func() {
+			println("Usage: commander config:import [options] <app>\n")
+			println("    Import config values for an app from a dotenv or JSON file\n")
+			println("Options:\n")
+			configFs.PrintDefaults()
+		}
+		err := configFs.Parse(flag.Args()[1:])
+		if err != nil {
+			fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+
+		if configFs.NArg() != 1 {
+			log.Errorf("ERROR: Missing app name")
+			configFs.Usage()
+			os.Exit(1)
+		}
+		app := configFs.Args()[0]
+
+		err = commander.ConfigImport(configStore, app, env, file, format, replace)
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+		return
+	case "config:export":
+		var format string
+		var reveal bool
+		configFs := flag.NewFlagSet("config:export", flag.ExitOnError)
+		configFs.StringVar(&format, "format", commander.FormatDotenv, "Output format: dotenv, json or shell")
+		configFs.BoolVar(&reveal, "reveal", false, "Export secret values decrypted")
+		configFs.Usage = func() {
+			println("Usage: commander config:export [options] <app>\n")
+			println("    Export config values for an app\n")
+			println("Options:\n")
+			configFs.PrintDefaults()
+		}
+		err := configFs.Parse(flag.Args()[1:])
+		if err != nil {
+			fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+
+		if configFs.NArg() != 1 {
+			log.Errorf("ERROR: Missing app name")
+			configFs.Usage()
+			os.Exit(1)
+		}
+		app := configFs.Args()[0]
+
+		err = commander.ConfigExport(configStore, app, env, format, reveal)
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+		return
+	case "config:schema":
+		var file string
+		configFs := flag.NewFlagSet("config:schema", flag.ExitOnError)
+		configFs.StringVar(&file, "file", "", "JSON schema to set")
+		configFs.Usage = func() {
+			println("Usage: commander config:schema [options] <app>\n")
+			println("    Show or set the config schema for an app\n")
+			println("Options:\n")
+			configFs.PrintDefaults()
+		}
+		err := configFs.Parse(flag.Args()[1:])
+		if err != nil {
+			fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+
+		if configFs.NArg() != 1 {
+			log.Errorf("ERROR: Missing app name")
+			configFs.Usage()
+			os.Exit(1)
+		}
+		app := configFs.Args()[0]
+
+		err = commander.ConfigSchema(configStore, app, env, file)
+		if err != nil {
+			fatalf("ERROR: %s", err)
+		}
+		return
+	case "config:validate":
+		configFs := flag.NewFlagSet("config:validate", flag.ExitOnError)
+		configFs.Usage = func() {
+			println("Usage: commander config:validate <app>\n")
+			println("    Check the config for an app against its schema\n")
+			println("Options:\n")
+			configFs.PrintDefaults()
+		}
+		err := configFs.Parse(flag.Args()[1:])
+		if err != nil {
+			fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+
+		if configFs.NArg() != 1 {
+			log.Errorf("ERROR: Missing app name")
+			configFs.Usage()
+			os.Exit(1)
+		}
+		app := configFs.Args()[0]
+
+		err = commander.ConfigValidate(configStore, app, env)
+		if err != nil {
+			fatalf("ERROR: %s", err)
 		}
 		return
 
@@ -886,7 +1349,7 @@ func main() {
 		}
 		err := runtimeFs.Parse(flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: Bad command line options: %s", err)
+			fatalf("ERROR: Bad command line options: %s", err)
 		}
 
 		app := ""
@@ -896,7 +1359,7 @@ func main() {
 
 		err = commander.RuntimeList(configStore, app, env, pool)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 		return
 
@@ -907,6 +1370,8 @@ func main() {
 		var vhost string
 		var port string
 		var maint string
+		var entryPoint, cmd string
+		var addHosts, dnsServers, publish utils.SliceVar
 		runtimeFs := flag.NewFlagSet("runtime:set", flag.ExitOnError)
 		runtimeFs.IntVar(&ps, "ps", 0, "Number of instances to run across all hosts")
 		runtimeFs.StringVar(&m, "m", "", "Memory limit (format: <number><optional unit>, where unit = b, k, m or g)")
@@ -914,9 +1379,16 @@ func main() {
 		runtimeFs.StringVar(&vhost, "vhost", "", "Virtual host for HTTP routing")
 		runtimeFs.StringVar(&port, "port", "", "Service port for service discovery")
 		runtimeFs.StringVar(&maint, "maint", "", "Enable or disable maintenance mode")
+		runtimeFs.StringVar(&entryPoint, "entrypoint", "", "Container entrypoint, space separated or a JSON list")
+		runtimeFs.StringVar(&cmd, "cmd", "", "Container command, space separated or a JSON list")
+		runtimeFs.Var(&addHosts, "add-host", "Add an /etc/hosts entry (host:ip). Can be repeated")
+		runtimeFs.Var(&dnsServers, "dns", "DNS server for the app's containers. Can be repeated")
+		runtimeFs.Var(&publish, "publish", "Bind a host port to a container port (hostPort:containerPort[/udp]). Can be repeated")
 
 		runtimeFs.Usage = func() {
-			println("Usage: commander runtime:set [-ps 1] [-m 100m] [-c 512] [-vhost x.y.z] [-port 8000] [-maint false] <app>\n")
+			println("Usage: commander runtime:set [-ps 1] [-m 100m] [-c 512] [-vhost x.y.z] [-port 8000] [-maint false]")
+			println("                             [-entrypoint /bin/app] [-cmd 'serve -v'] [-add-host db:10.0.0.2] [-dns 10.0.0.53]")
+			println("                             [-publish 80:8000] <app>\n")
 			println("    Set container runtime policies\n")
 			println("Options:\n")
 			runtimeFs.PrintDefaults()
@@ -924,7 +1396,7 @@ func main() {
 
 		err := runtimeFs.Parse(flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: Bad command line options: %s", err)
+			fatalf("ERROR: Bad command line options: %s", err)
 		}
 
 		ensureEnv()
@@ -942,23 +1414,59 @@ func main() {
 
 		_, err = utils.ParseMemory(m)
 		if err != nil {
-			log.Fatalf("ERROR: Bad memory option %s: %s", m, err)
+			fatalf("ERROR: Bad memory option %s: %s", m, err)
 		}
 
-		updated, err := commander.RuntimeSet(configStore, app, env, pool, commander.RuntimeOptions{
+		options := commander.RuntimeOptions{
 			Ps:              ps,
 			Memory:          m,
 			CPUShares:       c,
 			VirtualHost:     vhost,
 			Port:            port,
 			MaintenanceMode: maint,
-		})
+		}
+
+		if entryPoint != "" {
+			options.EntryPoint, err = commander.ParseCommand(entryPoint)
+			if err != nil {
+				fatalf("ERROR: %s", err)
+			}
+		}
+
+		if cmd != "" {
+			options.Command, err = commander.ParseCommand(cmd)
+			if err != nil {
+				fatalf("ERROR: %s", err)
+			}
+		}
+
+		for _, h := range addHosts {
+			entry, err := commander.ParseHostsEntry(h)
+			if err != nil {
+				fatalf("ERROR: %s", err)
+			}
+			options.Hosts = append(options.Hosts, entry)
+		}
+
+		if len(dnsServers) > 0 {
+			options.DNS = dnsServers
+		}
+
+		for _, p := range publish {
+			mapping, err := commander.ParsePortMapping(p)
+			if err != nil {
+				fatalf("ERROR: %s", err)
+			}
+			options.PortMappings = append(options.PortMappings, mapping)
+		}
+
+		updated, err := commander.RuntimeSet(configStore, app, env, pool, options)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 
 		if !updated {
-			log.Fatalf("ERROR: Failed to set runtime options.")
+			fatalf("ERROR: Failed to set runtime options.")
 		}
 
 		if pool != "" {
@@ -970,16 +1478,26 @@ func main() {
 
 	case "runtime:unset":
 		var ps, m, c, port bool
+		var entryPoint, cmd, allHosts, dnsServers, allPorts bool
 		var vhost string
+		var removeHosts, unpublish utils.SliceVar
 		runtimeFs := flag.NewFlagSet("runtime:unset", flag.ExitOnError)
 		runtimeFs.BoolVar(&ps, "ps", false, "Number of instances to run across all hosts")
 		runtimeFs.BoolVar(&m, "m", false, "Memory limit")
 		runtimeFs.BoolVar(&c, "c", false, "CPU shares (relative weight)")
 		runtimeFs.StringVar(&vhost, "vhost", "", "Virtual host for HTTP routing")
 		runtimeFs.BoolVar(&port, "port", false, "Service port for service discovery")
+		runtimeFs.BoolVar(&entryPoint, "entrypoint", false, "Container entrypoint")
+		runtimeFs.BoolVar(&cmd, "cmd", false, "Container command")
+		runtimeFs.Var(&removeHosts, "host", "Remove the /etc/hosts entry for a host. Can be repeated")
+		runtimeFs.BoolVar(&allHosts, "hosts", false, "All /etc/hosts entries")
+		runtimeFs.BoolVar(&dnsServers, "dns", false, "DNS servers")
+		runtimeFs.Var(&unpublish, "publish", "Remove the host port bound to a container port (containerPort[/udp]). Can be repeated")
+		runtimeFs.BoolVar(&allPorts, "ports", false, "All host port bindings")
 
 		runtimeFs.Usage = func() {
-			println("Usage: commander runtime:unset [-ps] [-m] [-c] [-vhost x.y.z] [-port] <app>\n")
+			println("Usage: commander runtime:unset [-ps] [-m] [-c] [-vhost x.y.z] [-port] [-entrypoint] [-cmd] [-host db] [-hosts] [-dns]")
+			println("                               [-publish 8000] [-ports] <app>\n")
 			println("    Reset and removes container runtime policies to defaults\n")
 			println("Options:\n")
 			runtimeFs.PrintDefaults()
@@ -987,7 +1505,7 @@ func main() {
 
 		err := runtimeFs.Parse(flag.Args()[1:])
 		if err != nil {
-			log.Fatalf("ERROR: Bad command line options: %s", err)
+			fatalf("ERROR: Bad command line options: %s", err)
 		}
 
 		ensureEnv()
@@ -1022,13 +1540,43 @@ func main() {
 			options.Port = "-"
 		}
 
+		if entryPoint {
+			options.EntryPoint = []string{}
+		}
+
+		if cmd {
+			options.Command = []string{}
+		}
+
+		for _, h := range removeHosts {
+			options.Hosts = append(options.Hosts, config.HostsEntry{Host: h})
+		}
+		if allHosts {
+			options.Hosts = []config.HostsEntry{}
+		}
+
+		if dnsServers {
+			options.DNS = []string{}
+		}
+
+		for _, p := range unpublish {
+			mapping := config.PortMapping{ContainerPort: p}
+			if sep := strings.Index(p, "/"); sep >= 0 {
+				mapping.ContainerPort, mapping.Network = p[:sep], p[sep+1:]
+			}
+			options.PortMappings = append(options.PortMappings, mapping)
+		}
+		if allPorts {
+			options.PortMappings = []config.PortMapping{}
+		}
+
 		updated, err := commander.RuntimeUnset(configStore, app, env, pool, options)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 
 		if !updated {
-			log.Fatalf("ERROR: Failed to set runtime options.")
+			fatalf("ERROR: Failed to set runtime options.")
 		}
 
 		if pool != "" {
@@ -1065,7 +1613,7 @@ func main() {
 
 		err := commander.PoolCreate(configStore, env, pool)
 		if err != nil {
-			log.Fatalf("ERROR: Could not create pool: %s", err)
+			fatalf("ERROR: Could not create pool: %s", err)
 		}
 		fmt.Println("created pool:", pool)
 		return
@@ -1089,7 +1637,7 @@ func main() {
 
 		err := commander.PoolDelete(configStore, env, pool)
 		if err != nil {
-			log.Fatalf("ERROR: Could not delete pool: %s", err)
+			fatalf("ERROR: Could not delete pool: %s", err)
 			return
 		}
 
@@ -1119,7 +1667,7 @@ func main() {
 		if len(apps) == 0 || utils.StringInSlice(app, apps) {
 			wg.Add(1)
 			go restartContainers(app, ch)
-			ch <- "deploy"
+			ch <- appCommand{cmd: "deploy"}
 		}
 	}
 
@@ -1128,10 +1676,8 @@ func main() {
 		go heartbeatHost()
 
 		go discovery.Register(serviceRuntime, configStore, env, pool, hostIP, shuttleAddr)
-		cancelChan := make(chan struct{})
-		// do we need to cancel ever?
 
-		restartChan := configStore.Watch(env, cancelChan)
+		restartChan := configStore.Watch(watchCtx, env)
 		monitorService(restartChan)
 	}
 
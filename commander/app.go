@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
@@ -112,53 +113,85 @@ func AppDelete(configStore *config.Store, app, env string) error {
 	return nil
 }
 
-func AppDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, version string) error {
-	log.Printf("Pulling image %s...", version)
+// ImageResolver makes sure an image is available, and returns its ID
+type ImageResolver func(image string) (string, error)
 
-	image, err := serviceRuntime.PullImage(version, "")
-	if image == nil || err != nil {
-		return fmt.Errorf("unable to pull %s. Has it been released yet?", version)
-	}
+// PullImages returns an ImageResolver that pulls each image with docker, so
+// that nothing is deployed before it has been released.
+func PullImages(serviceRuntime *runtime.ServiceRuntime) ImageResolver {
+	return func(version string) (string, error) {
+		log.Printf("Pulling image %s...", version)
 
-	svcCfg, err := configStore.GetApp(app, env)
-	if err != nil {
-		return fmt.Errorf("unable to deploy app: %s.", err)
+		image, err := serviceRuntime.PullImage(version, "")
+		if image == nil || err != nil {
+			return "", fmt.Errorf("unable to pull %s. Has it been released yet?", version)
+		}
+		return utils.StripSHA(image.ID), nil
 	}
+}
 
-	if svcCfg == nil {
-		return fmt.Errorf("app %s does not exist. Create it first.", app)
+// AppDeploy deploys a new version of an app. If wait isn't zero, it waits up
+// to that long for every host running the app to deploy it.
+func AppDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, version string, wait time.Duration) error {
+	imageID, err := PullImages(serviceRuntime)(version)
+	if err != nil {
+		return err
 	}
 
-	svcCfg.SetVersion(version)
-	svcCfg.SetVersionID(utils.StripSHA(image.ID))
+	svcCfg, updated, err := updateApp(configStore, app, env, askOnConflict, func(svcCfg config.App) (bool, error) {
+		// don't deploy on top of a broken config
+		if err := validateConfig(configStore, svcCfg, env); err != nil {
+			return false, err
+		}
 
-	updated, err := configStore.UpdateApp(svcCfg, env)
+		svcCfg.SetVersion(version)
+		svcCfg.SetVersionID(imageID)
+		return true, nil
+	})
 	if err != nil {
 		return fmt.Errorf("could not store version: %s", err)
 	}
 	if !updated {
 		return fmt.Errorf("%s NOT deployed.", version)
 	}
-	log.Printf("Deployed %s.\n", version)
-	return nil
+
+	release, err := recordRelease(configStore, svcCfg, env)
+	if err != nil {
+		// the deploy itself succeeded
+		log.Warnf("WARN: Unable to record release: %s", err)
+		log.Printf("Deployed %s.\n", version)
+	} else {
+		log.Printf("Deployed %s as release %d.\n", version, release.ID)
+	}
+
+	if wait == 0 {
+		return nil
+	}
+	return WaitForDeploy(configStore, app, env, wait)
 }
 
-func AppRestart(Store *config.Store, app, env string) error {
-	err := Store.NotifyRestart(app, env)
+// AppRestart restarts an app on every host. If wait isn't zero, it waits up
+// to that long for the hosts to restart it.
+func AppRestart(Store *config.Store, app, env string, wait time.Duration) error {
+	seq, err := Store.NotifyRestart(app, env)
 	if err != nil {
 		return fmt.Errorf("could not restart %s: %s", app, err)
 	}
-	return nil
+
+	if wait == 0 {
+		return nil
+	}
+	return WaitForRestart(Store, app, env, seq, wait)
 }
 
-func AppRun(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env string, args []string) error {
+func AppRun(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, pool string, args []string) error {
 	appCfg, err := configStore.GetApp(app, env)
 	if err != nil {
 		return fmt.Errorf("unable to run command: %s.", err)
 
 	}
 
-	_, err = serviceRuntime.RunCommand(env, appCfg, args)
+	_, err = serviceRuntime.RunCommand(env, pool, appCfg, args)
 	if err != nil {
 		return fmt.Errorf("could not start container: %s", err)
 	}
@@ -193,6 +226,12 @@ func AppAssign(configStore *config.Store, app, env, pool string) error {
 		log.Warnf("WARN: Pool %s does not exist.", pool)
 	}
 
+	if cfg, err := configStore.GetApp(app, env); err == nil {
+		if err := checkHostPorts(configStore, cfg, env, []string{pool}); err != nil {
+			return err
+		}
+	}
+
 	created, err := configStore.AssignApp(app, env, pool)
 
 	if err != nil {
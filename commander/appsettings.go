@@ -0,0 +1,210 @@
+package commander
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+)
+
+// AppSettings is what an app's stored settings should be, as read from a
+// backup, a manifest or another env. Settings that are nil are left alone.
+type AppSettings struct {
+	Version   *string
+	VersionID *string
+
+	// Env replaces the app's config. Variables missing from it are unset.
+	Env    map[string]string
+	Schema config.Schema
+
+	EntryPoint   []string
+	Command      []string
+	Hosts        []config.HostsEntry
+	DNS          []string
+	PortMappings []config.PortMapping
+
+	// Runtime settings by pool
+	Runtime map[string]*PoolSettings
+}
+
+type PoolSettings struct {
+	Processes   *int
+	Memory      *string
+	CPUShares   *string
+	Maintenance *bool
+}
+
+func diffValue(v string) string {
+	if config.IsSecret(v) {
+		return config.Masked
+	}
+	return strconv.Quote(v)
+}
+
+// unset CPU shares are "" or "0", depending on the backend
+func cpuShares(cpu string) string {
+	if cpu == "" {
+		return "0"
+	}
+	return cpu
+}
+
+// ApplyAppSettings updates cfg to match the settings, and describes each
+// change.
+func ApplyAppSettings(cfg config.App, s *AppSettings) []string {
+	changes := []string{}
+	prefix := fmt.Sprintf("app %s", cfg.Name())
+
+	if s.Version != nil && cfg.Version() != *s.Version {
+		changes = append(changes, fmt.Sprintf("~ %s: version %s (was %q)", prefix, *s.Version, cfg.Version()))
+		cfg.SetVersion(*s.Version)
+	}
+
+	if s.VersionID != nil && cfg.VersionID() != *s.VersionID {
+		changes = append(changes, fmt.Sprintf("~ %s: version ID %s (was %q)", prefix, *s.VersionID, cfg.VersionID()))
+		cfg.SetVersionID(*s.VersionID)
+	}
+
+	if s.Env != nil {
+		keys := []string{}
+		for k, v := range cfg.Env() {
+			if v != "" && s.Env[k] == "" {
+				keys = append(keys, k)
+			}
+		}
+		for k, v := range s.Env {
+			if v != "" && cfg.EnvGet(k) != v {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			old, v := cfg.EnvGet(k), s.Env[k]
+			switch {
+			case v == "":
+				changes = append(changes, fmt.Sprintf("- %s: %s", prefix, k))
+			case old == "":
+				changes = append(changes, fmt.Sprintf("+ %s: %s=%s", prefix, k, diffValue(v)))
+			default:
+				changes = append(changes, fmt.Sprintf("~ %s: %s=%s (was %s)", prefix, k, diffValue(v), diffValue(old)))
+			}
+			cfg.EnvSet(k, v)
+		}
+	}
+
+	if s.Schema != nil && cfg.GetSchema().String() != s.Schema.String() {
+		changes = append(changes, fmt.Sprintf("~ %s: schema %s", prefix, s.Schema))
+		cfg.SetSchema(s.Schema)
+	}
+
+	if s.EntryPoint != nil && fmt.Sprint(cfg.GetEntryPoint()) != fmt.Sprint(s.EntryPoint) {
+		changes = append(changes, fmt.Sprintf("~ %s: entrypoint %q (was %q)", prefix, s.EntryPoint, cfg.GetEntryPoint()))
+		cfg.SetEntryPoint(s.EntryPoint)
+	}
+
+	if s.Command != nil && fmt.Sprint(cfg.GetCommand()) != fmt.Sprint(s.Command) {
+		changes = append(changes, fmt.Sprintf("~ %s: command %q (was %q)", prefix, s.Command, cfg.GetCommand()))
+		cfg.SetCommand(s.Command)
+	}
+
+	if s.Hosts != nil && fmt.Sprint(cfg.GetHosts()) != fmt.Sprint(s.Hosts) {
+		changes = append(changes, fmt.Sprintf("~ %s: hosts %v (was %v)", prefix, s.Hosts, cfg.GetHosts()))
+		cfg.SetHosts(s.Hosts)
+	}
+
+	if s.DNS != nil && fmt.Sprint(cfg.GetDNS()) != fmt.Sprint(s.DNS) {
+		changes = append(changes, fmt.Sprintf("~ %s: dns %q (was %q)", prefix, s.DNS, cfg.GetDNS()))
+		cfg.SetDNS(s.DNS)
+	}
+
+	if s.PortMappings != nil {
+		ports, was := portList(s.PortMappings), portList(cfg.GetPortMappings())
+		if fmt.Sprint(ports) != fmt.Sprint(was) {
+			changes = append(changes, fmt.Sprintf("~ %s: ports %v (was %v)", prefix, ports, was))
+			cfg.SetPortMappings(s.PortMappings)
+		}
+	}
+
+	pools := []string{}
+	for pool := range s.Runtime {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		rt := s.Runtime[pool]
+		if rt == nil {
+			continue
+		}
+		poolPrefix := fmt.Sprintf("%s: pool %s", prefix, pool)
+
+		if rt.Processes != nil && cfg.GetProcesses(pool) != *rt.Processes {
+			changes = append(changes, fmt.Sprintf("~ %s ps=%d (was %d)", poolPrefix, *rt.Processes, cfg.GetProcesses(pool)))
+			cfg.SetProcesses(pool, *rt.Processes)
+		}
+
+		if rt.Memory != nil && cfg.GetMemory(pool) != *rt.Memory {
+			changes = append(changes, fmt.Sprintf("~ %s memory=%s (was %q)", poolPrefix, *rt.Memory, cfg.GetMemory(pool)))
+			cfg.SetMemory(pool, *rt.Memory)
+		}
+
+		if rt.CPUShares != nil && cpuShares(cfg.GetCPUShares(pool)) != cpuShares(*rt.CPUShares) {
+			changes = append(changes, fmt.Sprintf("~ %s cpu=%s (was %q)", poolPrefix, *rt.CPUShares, cfg.GetCPUShares(pool)))
+			cfg.SetCPUShares(pool, *rt.CPUShares)
+		}
+
+		if rt.Maintenance != nil && cfg.GetMaintenanceMode(pool) != *rt.Maintenance {
+			changes = append(changes, fmt.Sprintf("~ %s maintenance=%t", poolPrefix, *rt.Maintenance))
+			cfg.SetMaintenanceMode(pool, *rt.Maintenance)
+		}
+	}
+	return changes
+}
+
+// UpdateAppSettings updates a stored app to match the settings returned for
+// its current config, which is read again if someone else updates the app
+// first. The new config is validated, and its host ports are checked in the
+// pools it's assigned to, along with pools it's about to be. A new image is
+// recorded as a release, like app:deploy. It returns the changes stored.
+func UpdateAppSettings(configStore *config.Store, app, env string, pools []string, settings func(cfg config.App) (*AppSettings, error)) ([]string, error) {
+	changes := []string{}
+	newImage := false
+	cfg, updated, err := updateApp(configStore, app, env, retryOnConflict, func(cfg config.App) (bool, error) {
+		s, err := settings(cfg)
+		if err != nil {
+			return false, err
+		}
+
+		newImage = s.Version != nil && cfg.Version() != *s.Version
+		changes = ApplyAppSettings(cfg, s)
+		if len(changes) == 0 {
+			return false, nil
+		}
+
+		if err := validateConfig(configStore, cfg, env); err != nil {
+			return false, err
+		}
+
+		assigned, err := configStore.ListAssignedPools(env, app)
+		if err != nil {
+			return false, err
+		}
+		if err := checkHostPorts(configStore, cfg, env, append(assigned, pools...)); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil || !updated {
+		return nil, err
+	}
+
+	if newImage {
+		if _, err := recordRelease(configStore, cfg, env); err != nil {
+			log.Warnf("WARN: Unable to record release for %s: %s", app, err)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,86 @@
+package commander
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/litl/galaxy/config"
+)
+
+func TestApplyAppSettings(t *testing.T) {
+	cfg := &config.AppDefinition{AppName: "app", Image: "app:1", ImageID: "abc", Environment: map[string]string{}}
+	cfg.EnvSet("KEEP", "1")
+	cfg.EnvSet("GONE", "1")
+	cfg.SetCommand([]string{"serve"})
+	cfg.SetCPUShares("web", "")
+
+	version, processes, cpu := "app:2", 2, "0"
+	changes := ApplyAppSettings(cfg, &AppSettings{
+		Version: &version,
+		Env:     map[string]string{"KEEP": "1", "NEW": "2"},
+		Runtime: map[string]*PoolSettings{
+			"web": {Processes: &processes, CPUShares: &cpu},
+		},
+	})
+
+	want := []string{
+		`~ app app: version app:2 (was "app:1")`,
+		"- app app: GONE",
+		`+ app app: NEW="2"`,
+		"~ app app: pool web ps=2 (was -1)",
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("ApplyAppSettings() = %q, want %q", changes, want)
+	}
+
+	// settings that aren't given are left alone
+	if cfg.VersionID() != "abc" || len(cfg.GetCommand()) != 1 || cfg.EnvGet("GONE") != "" {
+		t.Fatalf("ApplyAppSettings() left %s %q %v, want the ID and command kept", cfg.VersionID(), cfg.GetCommand(), cfg.Env())
+	}
+
+	if changes := ApplyAppSettings(cfg, &AppSettings{Command: []string{}}); len(changes) != 1 || len(cfg.GetCommand()) != 0 {
+		t.Fatalf("ApplyAppSettings() = %q, want the command cleared", changes)
+	}
+}
+
+func TestUpdateAppSettings(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	version, versionID := "app:2", "abc"
+	settings := func(env map[string]string) func(cfg config.App) (*AppSettings, error) {
+		return func(cfg config.App) (*AppSettings, error) {
+			return &AppSettings{
+				Version:   &version,
+				VersionID: &versionID,
+				Env:       env,
+				Schema:    config.Schema{"GALAXY_PORT": {Type: "int"}},
+			}, nil
+		}
+	}
+
+	// rejected by the schema it brings
+	if _, err := UpdateAppSettings(s, "app", "dev", nil, settings(map[string]string{"GALAXY_PORT": "80OO"})); err == nil {
+		t.Fatalf("UpdateAppSettings(%q) = %v, want schema error", "GALAXY_PORT=80OO", err)
+	}
+	if cfg, _ := s.GetApp("app", "dev"); cfg.Version() != "" {
+		t.Fatalf("Version() = %q, want the rejected settings not stored", cfg.Version())
+	}
+
+	changes, err := UpdateAppSettings(s, "app", "dev", nil, settings(map[string]string{"GALAXY_PORT": "8000"}))
+	if len(changes) == 0 || err != nil {
+		t.Fatalf("UpdateAppSettings() = %v, %v, want changes", changes, err)
+	}
+
+	// the new image is a release
+	releases, _ := s.ListReleases("app", "dev")
+	if len(releases) != 1 || releases[0].Version != "app:2" {
+		t.Fatalf("ListReleases() = %v, want one release of app:2", releases)
+	}
+
+	// and nothing is stored when nothing changes
+	changes, err = UpdateAppSettings(s, "app", "dev", nil, settings(map[string]string{"GALAXY_PORT": "8000"}))
+	if len(changes) != 0 || err != nil {
+		t.Fatalf("UpdateAppSettings() = %v, %v, want no changes", changes, err)
+	}
+}
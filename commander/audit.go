@@ -0,0 +1,83 @@
+package commander
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/ryanuber/columnize"
+)
+
+// ParseAuditTime reads a time for the audit command, either as a duration
+// before now, like "24h", or as an RFC3339 time or a date. An empty string
+// is the zero time.
+func ParseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use a duration like 24h, a date or an RFC3339 time", s)
+}
+
+// Audit lists the changes made in env, or in every env if it's empty. Only
+// the changes to app are listed, unless it's empty, and only those from since
+// up to until, unless they're zero.
+func Audit(configStore *config.Store, env, app string, since, until time.Time) error {
+	envs := []string{env}
+
+	if env == "" {
+		var err error
+		envs, err = configStore.ListEnvs()
+		if err != nil {
+			return err
+		}
+	}
+
+	columns := []string{"TIME | ENV | USER | HOST | ACTION | APP | POOL | CHANGE"}
+
+	for _, env := range envs {
+		entries, err := configStore.ListAudit(env, app, since, until)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			changes := []string{}
+			for _, c := range e.Changes {
+				changes = append(changes, c.String())
+			}
+			if len(changes) == 0 {
+				changes = append(changes, "")
+			}
+
+			// one line for each field changed, with the entry on the first
+			columns = append(columns, strings.Join([]string{
+				e.Time.Local().Format(time.RFC3339),
+				e.Env,
+				e.User,
+				e.Host,
+				e.Action,
+				e.App,
+				e.Pool,
+				changes[0],
+			}, " | "))
+
+			for _, c := range changes[1:] {
+				columns = append(columns, strings.Join(append(make([]string, 7), c), " | "))
+			}
+		}
+	}
+
+	fmt.Println(columnize.SimpleFormat(columns))
+	return nil
+}
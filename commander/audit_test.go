@@ -0,0 +1,31 @@
+package commander
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAuditTime(t *testing.T) {
+	if got, err := ParseAuditTime(""); !got.IsZero() || err != nil {
+		t.Fatalf("ParseAuditTime(%q) = %v, %v, want the zero time", "", got, err)
+	}
+
+	got, err := ParseAuditTime("24h")
+	if err != nil || time.Since(got) < 24*time.Hour || time.Since(got) > 25*time.Hour {
+		t.Fatalf("ParseAuditTime(%q) = %v, %v, want a day ago", "24h", got, err)
+	}
+
+	want := time.Date(2015, 3, 1, 12, 30, 0, 0, time.UTC)
+	if got, err := ParseAuditTime("2015-03-01T12:30:00Z"); !got.Equal(want) || err != nil {
+		t.Fatalf("ParseAuditTime() = %v, %v, want %v", got, err, want)
+	}
+
+	want = time.Date(2015, 3, 1, 0, 0, 0, 0, time.Local)
+	if got, err := ParseAuditTime("2015-03-01"); !got.Equal(want) || err != nil {
+		t.Fatalf("ParseAuditTime() = %v, %v, want %v", got, err, want)
+	}
+
+	if _, err := ParseAuditTime("yesterday"); err == nil {
+		t.Fatalf("ParseAuditTime(%q) = %v, want an error", "yesterday", err)
+	}
+}
@@ -11,7 +11,43 @@ import (
 	"github.com/litl/galaxy/log"
 )
 
-func ConfigList(configStore *config.Store, app, env string) error {
+// displayEnv returns an app's config for printing, with the secrets masked,
+// or decrypted if reveal is set.
+func displayEnv(env map[string]string, reveal bool) (map[string]string, error) {
+	if reveal {
+		return config.DecryptEnv(nil, env)
+	}
+
+	masked := make(map[string]string, len(env))
+	for k, v := range env {
+		if config.IsSecret(v) {
+			v = config.Masked
+		}
+		masked[k] = v
+	}
+	return masked, nil
+}
+
+// secretKeyring loads the keyring for encrypting new secrets, creating one
+// the first time a secret is set.
+func secretKeyring() (*config.Keyring, error) {
+	path := config.DefaultKeyringPath()
+
+	keyring, err := config.LoadKeyring(path)
+	if err == nil || !os.IsNotExist(err) {
+		return keyring, err
+	}
+
+	keyring, err = config.CreateKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created keyring %s. Copy it to every host running apps with secrets.\n", path)
+	return keyring, nil
+}
+
+func ConfigList(configStore *config.Store, app, env string, reveal bool) error {
 
 	cfg, err := configStore.GetApp(app, env)
 	if err != nil {
@@ -22,8 +58,13 @@ func ConfigList(configStore *config.Store, app, env string) error {
 		return fmt.Errorf("unable to list config for %s.", app)
 	}
 
+	appEnv, err := displayEnv(cfg.Env(), reveal)
+	if err != nil {
+		return err
+	}
+
 	keys := sort.StringSlice{"ENV"}
-	for k, _ := range cfg.Env() {
+	for k, _ := range appEnv {
 		keys = append(keys, k)
 	}
 
@@ -34,37 +75,40 @@ func ConfigList(configStore *config.Store, app, env string) error {
 			log.Printf("%s=%s\n", k, env)
 			continue
 		}
-		fmt.Printf("%s=%s\n", k, cfg.Env()[k])
+		fmt.Printf("%s=%s\n", k, appEnv[k])
 	}
 
 	return nil
 }
 
-func ConfigSet(configStore *config.Store, app, env string, envVars []string) error {
+// parseConfigVars parses KEY=VALUE arguments, or lines from stdin if there
+// are none. Secret values are encrypted with the local keyring.
+func parseConfigVars(envVars []string, secret bool) ([]string, map[string]string, error) {
 
 	if len(envVars) == 0 {
 		bytes, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
-			return err
+			return nil, nil, err
 
 		}
 		envVars = strings.Split(string(bytes), "\n")
 	}
 
 	if len(envVars) == 0 {
-		return fmt.Errorf("no config values specified.")
+		return nil, nil, fmt.Errorf("no config values specified.")
 	}
 
-	svcCfg, err := configStore.GetApp(app, env)
-	if err != nil {
-		return fmt.Errorf("unable to set config: %s.", err)
-	}
-
-	if svcCfg == nil {
-		svcCfg = configStore.NewAppConfig(app, "")
+	var keyring *config.Keyring
+	if secret {
+		var err error
+		keyring, err = secretKeyring()
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load keyring: %s", err)
+		}
 	}
 
-	updated := false
+	keys := []string{}
+	values := map[string]string{}
 	for _, arg := range envVars {
 
 		if strings.TrimSpace(arg) == "" {
@@ -72,7 +116,7 @@ func ConfigSet(configStore *config.Store, app, env string, envVars []string) err
 		}
 
 		if !strings.Contains(arg, "=") {
-			return fmt.Errorf("bad config variable format: %s", arg)
+			return nil, nil, fmt.Errorf("bad config variable format: %s", arg)
 		}
 
 		sep := strings.Index(arg, "=")
@@ -83,36 +127,103 @@ func ConfigSet(configStore *config.Store, app, env string, envVars []string) err
 			continue
 		}
 
-		log.Printf("%s=%s\n", k, v)
-		svcCfg.EnvSet(k, v)
-		updated = true
+		if secret {
+			log.Printf("%s=%s\n", k, config.Masked)
+
+			var err error
+			v, err = keyring.Encrypt(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to encrypt %s: %s", k, err)
+			}
+		} else {
+			log.Printf("%s=%s\n", k, v)
+		}
+
+		keys = append(keys, k)
+		values[k] = v
 	}
+	return keys, values, nil
+}
 
-	if !updated {
+// ConfigSet sets config values for an app. Secret values are encrypted with
+// the local keyring before they're stored.
+func ConfigSet(configStore *config.Store, app, env string, envVars []string, secret bool) error {
+
+	// values piped in have used up stdin, so there's no asking. Setting
+	// them again on the fresh config is safe, since only they're changed.
+	policy := askOnConflict
+	if len(envVars) == 0 {
+		policy = retryOnConflict
+	}
+
+	_, values, err := parseConfigVars(envVars, secret)
+	if err != nil {
+		return err
+	}
+
+	return setConfig(configStore, app, env, values, false, policy)
+}
+
+// setConfig stores config values for an app. With replace set, any other
+// config the app has is unset.
+func setConfig(configStore *config.Store, app, env string, values map[string]string, replace bool, policy conflictPolicy) error {
+	if len(values) == 0 && !replace {
 		return fmt.Errorf("configuration NOT changed for %s", app)
 	}
 
-	updated, err = configStore.UpdateApp(svcCfg, env)
+	svcCfg, updated, err := updateApp(configStore, app, env, policy, func(cfg config.App) (bool, error) {
+		changed := false
+		if replace {
+			for k, v := range cfg.Env() {
+				if _, ok := values[k]; !ok && v != "" {
+					log.Printf("%s\n", k)
+					cfg.EnvSet(k, "")
+					changed = true
+				}
+			}
+		}
+
+		for k, v := range values {
+			if cfg.EnvGet(k) != v {
+				cfg.EnvSet(k, v)
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := validateConfig(configStore, cfg, env); err != nil {
+				return false, err
+			}
+		}
+		return changed, nil
+	})
 	if err != nil {
 		return fmt.Errorf("unable to set config: %s.", err)
 	}
 
+	// nothing to write, so don't restart the app
 	if !updated {
-		return fmt.Errorf("configuration NOT changed for %s", app)
+		log.Printf("Configuration unchanged for %s.\n", app)
+		return nil
 	}
 	log.Printf("Configuration changed for %s. v%d\n", app, svcCfg.ID())
 	return nil
 }
 
-func ConfigGet(configStore *config.Store, app, env string, envVars []string) error {
+func ConfigGet(configStore *config.Store, app, env string, envVars []string, reveal bool) error {
 
 	cfg, err := configStore.GetApp(app, env)
 	if err != nil {
 		return err
 	}
 
+	appEnv, err := displayEnv(cfg.Env(), reveal)
+	if err != nil {
+		return err
+	}
+
 	for _, arg := range envVars {
-		fmt.Printf("%s=%s\n", strings.ToUpper(arg), cfg.Env()[strings.ToUpper(arg)])
+		fmt.Printf("%s=%s\n", strings.ToUpper(arg), appEnv[strings.ToUpper(arg)])
 	}
 	return nil
 }
@@ -123,38 +234,113 @@ func ConfigUnset(configStore *config.Store, app, env string, envVars []string) e
 		return fmt.Errorf("no config values specified.")
 	}
 
-	svcCfg, err := configStore.GetApp(app, env)
-	if err != nil {
-		return fmt.Errorf("unable to unset config: %s.", err)
-	}
+	svcCfg, updated, err := updateApp(configStore, app, env, askOnConflict, func(cfg config.App) (bool, error) {
+		changed := false
+		for _, arg := range envVars {
+			k := strings.ToUpper(strings.TrimSpace(arg))
+			if k == "ENV" || cfg.EnvGet(k) == "" {
+				log.Warnf("%s cannot be unset.", k)
+				continue
+			}
+
+			log.Printf("%s\n", k)
+			cfg.EnvSet(k, "")
+			changed = true
+		}
 
-	updated := false
-	for _, arg := range envVars {
-		k := strings.ToUpper(strings.TrimSpace(arg))
-		if k == "ENV" || svcCfg.EnvGet(k) == "" {
-			log.Warnf("%s cannot be unset.", k)
-			continue
+		if changed {
+			if err := validateConfig(configStore, cfg, env); err != nil {
+				return false, err
+			}
 		}
+		return changed, nil
+	})
+	if err != nil {
+		return fmt.Errorf("ERROR: Unable to unset config: %s.", err)
 
-		log.Printf("%s\n", k)
-		svcCfg.EnvSet(strings.ToUpper(arg), "")
-		updated = true
 	}
 
 	if !updated {
 		return fmt.Errorf("Configuration NOT changed for %s", app)
+
+	}
+	log.Printf("Configuration changed for %s. v%d.\n", app, svcCfg.ID())
+	return nil
+}
+
+// scopeName describes where shared config is set
+func scopeName(env, pool string) string {
+	if pool == "" {
+		return fmt.Sprintf("env %s", env)
 	}
+	return fmt.Sprintf("pool %s in %s", pool, env)
+}
 
-	updated, err = configStore.UpdateApp(svcCfg, env)
+// SharedConfigList lists the config shared by every app in an env, or in a
+// pool if pool isn't empty.
+func SharedConfigList(configStore *config.Store, env, pool string, reveal bool) error {
+	shared, err := configStore.GetSharedConfig(env, pool)
 	if err != nil {
-		return fmt.Errorf("ERROR: Unable to unset config: %s.", err)
+		return err
+	}
 
+	shared, err = displayEnv(shared, reveal)
+	if err != nil {
+		return err
 	}
 
-	if !updated {
-		return fmt.Errorf("Configuration NOT changed for %s", app)
+	keys := sort.StringSlice{}
+	for k := range shared {
+		keys = append(keys, k)
+	}
+	keys.Sort()
 
+	for _, k := range keys {
+		fmt.Printf("%s=%s\n", k, shared[k])
+	}
+	return nil
+}
+
+// SharedConfigSet sets config values for every app in an env, or in a pool
+// if pool isn't empty. An app's own config takes precedence over the pool's,
+// which takes precedence over the env's.
+func SharedConfigSet(configStore *config.Store, env, pool string, envVars []string, secret bool) error {
+	_, values, err := parseConfigVars(envVars, secret)
+	if err != nil {
+		return err
+	}
+
+	if len(values) == 0 {
+		return fmt.Errorf("configuration NOT changed for %s", scopeName(env, pool))
+	}
+
+	return updateSharedConfig(configStore, env, pool, values)
+}
+
+func SharedConfigUnset(configStore *config.Store, env, pool string, envVars []string) error {
+	if len(envVars) == 0 {
+		return fmt.Errorf("no config values specified.")
+	}
+
+	values := map[string]string{}
+	for _, arg := range envVars {
+		k := strings.ToUpper(strings.TrimSpace(arg))
+		log.Printf("%s\n", k)
+		values[k] = ""
+	}
+
+	return updateSharedConfig(configStore, env, pool, values)
+}
+
+func updateSharedConfig(configStore *config.Store, env, pool string, values map[string]string) error {
+	restarted, err := configStore.UpdateSharedConfig(env, pool, values)
+	if err != nil {
+		return fmt.Errorf("unable to update config: %s", err)
+	}
+
+	log.Printf("Configuration changed for %s.\n", scopeName(env, pool))
+	if len(restarted) > 0 {
+		log.Printf("Restarting %s\n", strings.Join(restarted, ", "))
 	}
-	log.Printf("Configuration changed for %s. v%d.\n", app, svcCfg.ID())
 	return nil
 }
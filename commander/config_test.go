@@ -0,0 +1,124 @@
+package commander
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/litl/galaxy/config"
+)
+
+func TestConfigSetSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("GALAXY_KEYRING", filepath.Join(dir, "keyring"))
+	defer os.Unsetenv("GALAXY_KEYRING")
+
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	err = ConfigSet(s, "app", "dev", []string{"DATABASE_URL=postgres://user:pass@db/app"}, true)
+	if err != nil {
+		t.Fatalf("ConfigSet() = %v, want %v", err, nil)
+	}
+
+	cfg, _ := s.GetApp("app", "dev")
+	stored := cfg.EnvGet("DATABASE_URL")
+	if !config.IsSecret(stored) {
+		t.Fatalf("EnvGet(%q) = %q, want an encrypted value", "DATABASE_URL", stored)
+	}
+
+	masked, _ := displayEnv(cfg.Env(), false)
+	if masked["DATABASE_URL"] != config.Masked {
+		t.Fatalf("displayEnv() = %q, want %q", masked["DATABASE_URL"], config.Masked)
+	}
+
+	revealed, err := displayEnv(cfg.Env(), true)
+	if err != nil || revealed["DATABASE_URL"] != "postgres://user:pass@db/app" {
+		t.Fatalf("displayEnv(reveal) = %q, %v, want %q", revealed["DATABASE_URL"], err, "postgres://user:pass@db/app")
+	}
+}
+
+func TestConfigSchemaEnforced(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	updateApp(s, "app", "dev", retryOnConflict, func(cfg config.App) (bool, error) {
+		cfg.EnvSet("DATABASE_URL", "postgres://db/app")
+		cfg.SetSchema(config.Schema{
+			"DATABASE_URL": {Required: true, Type: "url"},
+			"GALAXY_PORT":  {Type: "int"},
+		})
+		return true, nil
+	})
+
+	if err := ConfigSet(s, "app", "dev", []string{"GALAXY_PORT=80OO"}, false); err == nil {
+		t.Fatalf("ConfigSet(%q) = %v, want schema error", "GALAXY_PORT=80OO", err)
+	}
+
+	if err := ConfigUnset(s, "app", "dev", []string{"DATABASE_URL"}); err == nil {
+		t.Fatalf("ConfigUnset(%q) = %v, want schema error", "DATABASE_URL", err)
+	}
+
+	cfg, _ := s.GetApp("app", "dev")
+	if cfg.EnvGet("GALAXY_PORT") != "" || cfg.EnvGet("DATABASE_URL") == "" {
+		t.Fatalf("GetApp() = %v, want the rejected changes not stored", cfg.Env())
+	}
+
+	if err := ConfigSet(s, "app", "dev", []string{"GALAXY_PORT=8000"}, false); err != nil {
+		t.Fatalf("ConfigSet(%q) = %v, want %v", "GALAXY_PORT=8000", err, nil)
+	}
+
+	// a required value can come from the shared config
+	s.UpdateSharedConfig("dev", "", map[string]string{"DATABASE_URL": "postgres://shared/app"})
+	if err := ConfigUnset(s, "app", "dev", []string{"DATABASE_URL"}); err != nil {
+		t.Fatalf("ConfigUnset(%q) = %v, want %v", "DATABASE_URL", err, nil)
+	}
+
+	if err := ConfigValidate(s, "app", "dev"); err != nil {
+		t.Fatalf("ConfigValidate() = %v, want %v", err, nil)
+	}
+}
+
+func TestConfigSetFromStdinRetries(t *testing.T) {
+	stdin, err := ioutil.TempFile("", "galaxy-stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdin.Name())
+	stdin.WriteString("FOO=bar\n")
+	stdin.Seek(0, 0)
+
+	defer func(f *os.File) { os.Stdin = f }(os.Stdin)
+	os.Stdin = stdin
+
+	// stdin is used up, so there's nothing to answer with
+	defer func(c func(string) bool) { Confirm = c }(Confirm)
+	Confirm = func(string) bool {
+		t.Fatal("Confirm() called, want an automatic retry")
+		return false
+	}
+
+	s, b := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	// someone else gets there first, once
+	b.UpdateAppFunc = func(svcCfg config.App, env string) (bool, error) {
+		b.UpdateAppFunc = nil
+		return false, config.StaleConfig
+	}
+
+	if err := ConfigSet(s, "app", "dev", nil, false); err != nil {
+		t.Fatalf("ConfigSet() = %v, want %v", err, nil)
+	}
+
+	cfg, _ := s.GetApp("app", "dev")
+	if cfg.EnvGet("FOO") != "bar" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "FOO", cfg.EnvGet("FOO"), "bar")
+	}
+}
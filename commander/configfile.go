@@ -0,0 +1,244 @@
+package commander
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+)
+
+// config file formats for import and export
+const (
+	FormatDotenv = "dotenv"
+	FormatJSON   = "json"
+	FormatShell  = "shell"
+)
+
+// parseDotenv reads KEY=VALUE lines. Values may be quoted: single quotes are
+// taken literally, double quotes allow \n, \t, \" and \\ escapes, and either
+// may span several lines. Lines starting with # are comments, as is anything
+// after a " #" following an unquoted value. A leading "export " is ignored,
+// so shell exports can be read too.
+func parseDotenv(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNum := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+
+		sep := strings.Index(line, "=")
+		if sep < 1 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNum)
+		}
+
+		key := strings.TrimSpace(line[:sep])
+		if strings.ContainsAny(key, " \t'\"") {
+			return nil, fmt.Errorf("line %d: invalid key %q", lineNum, key)
+		}
+
+		value := strings.TrimLeft(line[sep+1:], " \t")
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = value[:comment]
+			}
+			values[strings.ToUpper(key)] = strings.TrimSpace(value)
+			continue
+		}
+
+		// quoted values continue until the closing quote, which may be on a
+		// later line. Like sh, quoted parts and escaped characters right next
+		// to each other are joined, so 'it'\''s' is read as it's.
+		rest := value
+		var unquoted bytes.Buffer
+		for rest != "" {
+			if rest[0] == '\\' && len(rest) > 1 {
+				unquoted.WriteByte(rest[1])
+				rest = rest[2:]
+				continue
+			}
+
+			if rest[0] != '"' && rest[0] != '\'' {
+				break
+			}
+
+			quote := rest[0]
+			rest = rest[1:]
+			closed := false
+			for !closed {
+				for j := 0; j < len(rest); j++ {
+					c := rest[j]
+					if c == quote {
+						closed = true
+						rest = rest[j+1:]
+						break
+					}
+
+					if c == '\\' && quote == '"' && j+1 < len(rest) {
+						j++
+						switch rest[j] {
+						case 'n':
+							unquoted.WriteByte('\n')
+						case 't':
+							unquoted.WriteByte('\t')
+						default:
+							unquoted.WriteByte(rest[j])
+						}
+						continue
+					}
+					unquoted.WriteByte(c)
+				}
+
+				if closed {
+					break
+				}
+
+				i++
+				if i >= len(lines) {
+					return nil, fmt.Errorf("line %d: unterminated quoted value", lineNum)
+				}
+				unquoted.WriteByte('\n')
+				rest = lines[i]
+			}
+		}
+
+		rest = strings.TrimSpace(rest)
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("line %d: unexpected text after quoted value", lineNum)
+		}
+
+		values[strings.ToUpper(key)] = unquoted.String()
+	}
+	return values, nil
+}
+
+func parseConfigJSON(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	if err := json.NewDecoder(r).Decode(&values); err != nil {
+		return nil, err
+	}
+
+	upper := map[string]string{}
+	for k, v := range values {
+		upper[strings.ToUpper(k)] = v
+	}
+	return upper, nil
+}
+
+// formatConfig writes config values in one of the export formats, sorted by
+// key.
+func formatConfig(w io.Writer, values map[string]string, format string) error {
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := bufio.NewWriter(w)
+	switch format {
+	case FormatJSON:
+		js, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(js)
+		buf.WriteString("\n")
+	case FormatDotenv, "":
+		replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%s=\"%s\"\n", k, replacer.Replace(values[k]))
+		}
+	case FormatShell:
+		for _, k := range keys {
+			fmt.Fprintf(buf, "export %s='%s'\n", k, strings.Replace(values[k], "'", `'\''`, -1))
+		}
+	default:
+		return fmt.Errorf("unknown format %q: use %s, %s or %s", format, FormatDotenv, FormatJSON, FormatShell)
+	}
+	return buf.Flush()
+}
+
+// ConfigImport sets an app's config from a dotenv or JSON file, or stdin if
+// fileName is empty. With replace set, config missing from the file is
+// unset.
+func ConfigImport(configStore *config.Store, app, env, fileName, format string, replace bool) error {
+	var r io.Reader = os.Stdin
+	if fileName != "" {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+
+		if format == "" && strings.ToLower(filepath.Ext(fileName)) == ".json" {
+			format = FormatJSON
+		}
+	}
+
+	var values map[string]string
+	var err error
+	switch format {
+	case FormatJSON:
+		values, err = parseConfigJSON(r)
+	case FormatDotenv, FormatShell, "":
+		values, err = parseDotenv(r)
+	default:
+		err = fmt.Errorf("unknown format %q: use %s or %s", format, FormatDotenv, FormatJSON)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read config: %s", err)
+	}
+
+	if _, ok := values["ENV"]; ok {
+		log.Warnf("ENV cannot be updated.")
+		delete(values, "ENV")
+	}
+
+	// imports are often scripted, and the file says what the config should be
+	return setConfig(configStore, app, env, values, replace, retryOnConflict)
+}
+
+// ConfigExport writes an app's config to stdout. Secret values are written
+// encrypted, so the file can be imported again, unless reveal is set.
+func ConfigExport(configStore *config.Store, app, env, format string, reveal bool) error {
+	cfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{}
+	for k, v := range cfg.Env() {
+		if v != "" {
+			values[k] = v
+		}
+	}
+
+	if reveal {
+		values, err = config.DecryptEnv(nil, values)
+		if err != nil {
+			return err
+		}
+	}
+
+	return formatConfig(os.Stdout, values, format)
+}
@@ -0,0 +1,124 @@
+package commander
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDotenv = `# database
+DATABASE_URL=postgres://db/app  # the primary
+export GREETING="hello world"
+SINGLE='$HOME \n stays'
+JOINED='it'\''s "here"'
+ESCAPED="say \"hi\"\tthen\\leave"
+lower=case
+EMPTY=
+
+CERT="-----BEGIN-----
+abc
+-----END-----"
+`
+
+func TestParseDotenv(t *testing.T) {
+	values, err := parseDotenv(strings.NewReader(testDotenv))
+	if err != nil {
+		t.Fatalf("parseDotenv() = %v, want %v", err, nil)
+	}
+
+	expected := map[string]string{
+		"DATABASE_URL": "postgres://db/app",
+		"GREETING":     "hello world",
+		"SINGLE":       `$HOME \n stays`,
+		"JOINED":       `it's "here"`,
+		"ESCAPED":      "say \"hi\"\tthen\\leave",
+		"LOWER":        "case",
+		"EMPTY":        "",
+		"CERT":         "-----BEGIN-----\nabc\n-----END-----",
+	}
+
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("parseDotenv() = %q, want %q", values, expected)
+	}
+}
+
+func TestParseDotenvErrors(t *testing.T) {
+	for _, input := range []string{
+		"NOVALUE",
+		"A=\"unterminated\nstill going",
+		"A=\"quoted\" trailing",
+		"BAD KEY=1",
+	} {
+		if _, err := parseDotenv(strings.NewReader(input)); err == nil {
+			t.Errorf("parseDotenv(%q) = %v, want error", input, err)
+		}
+	}
+}
+
+func TestFormatConfigRoundTrip(t *testing.T) {
+	values := map[string]string{
+		"A": "plain",
+		"B": "with space and 'quotes' and \"doubles\"",
+		"C": "multi\nline\\value",
+	}
+
+	for _, format := range []string{FormatDotenv, FormatShell, FormatJSON} {
+		var buf bytes.Buffer
+		if err := formatConfig(&buf, values, format); err != nil {
+			t.Fatalf("formatConfig(%q) = %v, want %v", format, err, nil)
+		}
+
+		var parsed map[string]string
+		var err error
+		if format == FormatJSON {
+			parsed, err = parseConfigJSON(&buf)
+		} else {
+			parsed, err = parseDotenv(&buf)
+		}
+
+		if err != nil || !reflect.DeepEqual(parsed, values) {
+			t.Fatalf("parse(formatConfig(%q)) = %q, %v, want %q", format, parsed, err, values)
+		}
+	}
+
+	if err := formatConfig(ioutil.Discard, values, "yaml"); err == nil {
+		t.Fatalf("formatConfig(%q) = %v, want error", "yaml", err)
+	}
+}
+
+func TestConfigImportReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, ".env")
+	ioutil.WriteFile(file, []byte("FOO=\"new value\"\nBAR=bar\n"), 0600)
+
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+	ConfigSet(s, "app", "dev", []string{"FOO=old", "STALE=gone"}, false)
+
+	if err := ConfigImport(s, "app", "dev", file, "", false); err != nil {
+		t.Fatalf("ConfigImport() = %v, want %v", err, nil)
+	}
+
+	cfg, _ := s.GetApp("app", "dev")
+	if cfg.EnvGet("FOO") != "new value" || cfg.EnvGet("BAR") != "bar" || cfg.EnvGet("STALE") != "gone" {
+		t.Fatalf("ConfigImport() left %v, want FOO, BAR and STALE", cfg.Env())
+	}
+
+	if err := ConfigImport(s, "app", "dev", file, "", true); err != nil {
+		t.Fatalf("ConfigImport(replace) = %v, want %v", err, nil)
+	}
+
+	cfg, _ = s.GetApp("app", "dev")
+	if cfg.EnvGet("STALE") != "" || cfg.EnvGet("FOO") != "new value" {
+		t.Fatalf("ConfigImport(replace) left %v, want STALE unset", cfg.Env())
+	}
+}
@@ -0,0 +1,426 @@
+package commander
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+/*
+A manifest declares the apps in an env, so the env can be kept in version
+control and changed by review instead of by running commands:
+
+	env = "prod"
+	pools = ["web", "worker"]
+
+	[apps.api]
+	image = "registry/api:1.2"
+	pools = ["web"]
+
+	[apps.api.config]
+	DATABASE_URL = "postgres://db/api"
+
+	[apps.api.runtime.web]
+	ps = 2
+	memory = "512m"
+
+	[apps.api.hosts]
+	db = "10.0.0.2"
+
+	[apps.statsd]
+	ports = ["8125:8125/udp"]
+
+Only what's declared is managed: an app without a config table keeps its
+config, and runtime settings that are left out aren't changed. Apps and
+pools missing from the manifest are left alone.
+*/
+type Manifest struct {
+	Env   string                  `toml:"env"`
+	Pools []string                `toml:"pools"`
+	Apps  map[string]*ManifestApp `toml:"apps"`
+}
+
+type ManifestApp struct {
+	Image string `toml:"image"`
+
+	// Pools the app is assigned to. If set, the app is unassigned from any
+	// other pool.
+	Pools []string `toml:"pools"`
+
+	// Config replaces the app's config if set. Secret values can be copied
+	// encrypted from config:export.
+	Config map[string]string `toml:"config"`
+
+	// Runtime settings by pool
+	Runtime map[string]*ManifestRuntime `toml:"runtime"`
+
+	// Container settings, which are left alone when not set. Hosts maps
+	// host names to addresses, and Ports lists host port bindings as
+	// hostPort:containerPort[/udp].
+	EntryPoint []string          `toml:"entrypoint"`
+	Command    []string          `toml:"command"`
+	Hosts      map[string]string `toml:"hosts"`
+	DNS        []string          `toml:"dns"`
+	Ports      []string          `toml:"ports"`
+
+	portMappings []config.PortMapping
+}
+
+type ManifestRuntime struct {
+	Ps          *int   `toml:"ps"`
+	Memory      string `toml:"memory"`
+	CPUShares   string `toml:"cpu"`
+	Maintenance *bool  `toml:"maintenance"`
+}
+
+// LoadManifest reads a TOML manifest. Config names are upper-cased.
+func LoadManifest(fileName string) (*Manifest, error) {
+	m := &Manifest{}
+	if _, err := toml.DecodeFile(fileName, m); err != nil {
+		return nil, err
+	}
+
+	for name, app := range m.Apps {
+		if app == nil {
+			m.Apps[name] = &ManifestApp{}
+			continue
+		}
+
+		for _, p := range app.Ports {
+			mapping, err := ParsePortMapping(p)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			app.portMappings = append(app.portMappings, mapping)
+		}
+
+		if app.Config == nil {
+			continue
+		}
+
+		appConfig := make(map[string]string, len(app.Config))
+		for k, v := range app.Config {
+			k = strings.ToUpper(k)
+			if k == "ENV" {
+				return nil, fmt.Errorf("%s: ENV cannot be set", name)
+			}
+			appConfig[k] = v
+		}
+		app.Config = appConfig
+	}
+	return m, nil
+}
+
+// manifestImages pulls the images in a manifest, once each
+type manifestImages struct {
+	resolve ImageResolver
+	ids     map[string]string
+}
+
+func newManifestImages(resolve ImageResolver) *manifestImages {
+	return &manifestImages{
+		resolve: resolve,
+		ids:     make(map[string]string),
+	}
+}
+
+// id returns the ID of an image, pulling it the first time
+func (m *manifestImages) id(image string) (string, error) {
+	if id, ok := m.ids[image]; ok {
+		return id, nil
+	}
+
+	id, err := m.resolve(image)
+	if err != nil {
+		return "", err
+	}
+	m.ids[image] = id
+	return id, nil
+}
+
+// applyManifestApp updates cfg to match the manifest, and describes each
+// change.
+func applyManifestApp(cfg config.App, app *ManifestApp, images *manifestImages) ([]string, error) {
+	settings, err := manifestSettings(cfg, app, images)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyAppSettings(cfg, settings), nil
+}
+
+// manifestSettings returns the settings in the manifest for an app with the
+// config cfg.
+func manifestSettings(cfg config.App, app *ManifestApp, images *manifestImages) (*AppSettings, error) {
+	settings := &AppSettings{
+		Env:        app.Config,
+		EntryPoint: app.EntryPoint,
+		Command:    app.Command,
+		DNS:        app.DNS,
+		Runtime:    make(map[string]*PoolSettings),
+	}
+
+	if app.Image != "" {
+		settings.Version = &app.Image
+
+		// like app:deploy, a new image has to be pulled, and is run by its ID
+		if cfg.Version() != app.Image || cfg.VersionID() == "" {
+			id, err := images.id(app.Image)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", cfg.Name(), err)
+			}
+			settings.VersionID = &id
+		}
+	}
+
+	if app.Hosts != nil {
+		hostNames := []string{}
+		for host := range app.Hosts {
+			hostNames = append(hostNames, host)
+		}
+		sort.Strings(hostNames)
+
+		settings.Hosts = []config.HostsEntry{}
+		for _, host := range hostNames {
+			settings.Hosts = append(settings.Hosts, config.HostsEntry{Host: host, Address: app.Hosts[host]})
+		}
+	}
+
+	if app.Ports != nil {
+		settings.PortMappings = append([]config.PortMapping{}, app.portMappings...)
+	}
+
+	for pool, rt := range app.Runtime {
+		if rt == nil {
+			continue
+		}
+
+		poolSettings := &PoolSettings{
+			Processes:   rt.Ps,
+			Maintenance: rt.Maintenance,
+		}
+		if rt.Memory != "" {
+			poolSettings.Memory = &rt.Memory
+		}
+		if rt.CPUShares != "" {
+			poolSettings.CPUShares = &rt.CPUShares
+		}
+		settings.Runtime[pool] = poolSettings
+	}
+	return settings, nil
+}
+
+// planStep is one call to the config store, and the changes it makes
+type planStep struct {
+	changes []string
+	apply   func() error
+}
+
+// planManifest works out the steps needed to bring env in line with the
+// manifest. New images are pulled to check they exist and to find their IDs.
+func planManifest(configStore *config.Store, env string, m *Manifest, images *manifestImages) ([]planStep, error) {
+	steps := []planStep{}
+
+	pools, err := configStore.ListPools(env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pool := range m.Pools {
+		if utils.StringInSlice(pool, pools) {
+			continue
+		}
+
+		pool := pool
+		pools = append(pools, pool)
+		steps = append(steps, planStep{
+			changes: []string{fmt.Sprintf("+ pool %s", pool)},
+			apply: func() error {
+				_, err := configStore.CreatePool(pool, env)
+				return err
+			},
+		})
+	}
+
+	names := []string{}
+	for name := range m.Apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		name, app := name, m.Apps[name]
+
+		for _, pool := range app.Pools {
+			if !utils.StringInSlice(pool, pools) {
+				return nil, fmt.Errorf("%s: pool %s doesn't exist in %s", name, pool, env)
+			}
+		}
+
+		exists, err := configStore.AppExists(name, env)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := configStore.NewAppConfig(name, "")
+		assigned := []string{}
+		if exists {
+			cfg, err = configStore.GetApp(name, env)
+			if err != nil {
+				return nil, err
+			}
+
+			assigned, err = configStore.ListAssignedPools(env, name)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			steps = append(steps, planStep{
+				changes: []string{fmt.Sprintf("+ app %s", name)},
+				apply: func() error {
+					_, err := configStore.CreateApp(name, env)
+					return err
+				},
+			})
+		}
+
+		changes, err := applyManifestApp(cfg, app, images)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(changes) > 0 {
+			steps = append(steps, planStep{
+				changes: changes,
+				apply: func() error {
+					return applyManifestUpdate(configStore, env, name, app, images)
+				},
+			})
+		}
+
+		for _, pool := range app.Pools {
+			if utils.StringInSlice(pool, assigned) {
+				continue
+			}
+
+			pool := pool
+			steps = append(steps, planStep{
+				changes: []string{fmt.Sprintf("+ assign %s to %s", name, pool)},
+				apply: func() error {
+					_, err := configStore.AssignApp(name, env, pool)
+					return err
+				},
+			})
+		}
+
+		if app.Pools == nil {
+			continue
+		}
+
+		for _, pool := range assigned {
+			if utils.StringInSlice(pool, app.Pools) {
+				continue
+			}
+
+			pool := pool
+			steps = append(steps, planStep{
+				changes: []string{fmt.Sprintf("- unassign %s from %s", name, pool)},
+				apply: func() error {
+					_, err := configStore.UnassignApp(name, env, pool)
+					return err
+				},
+			})
+		}
+	}
+	return steps, nil
+}
+
+// applyManifestUpdate stores the manifest's changes to an app. A new image is
+// recorded as a release, like app:deploy.
+func applyManifestUpdate(configStore *config.Store, env, name string, app *ManifestApp, images *manifestImages) error {
+	_, err := UpdateAppSettings(configStore, name, env, app.Pools, func(cfg config.App) (*AppSettings, error) {
+		return manifestSettings(cfg, app, images)
+	})
+	return err
+}
+
+// manifestEnv returns the env a manifest applies to
+func manifestEnv(m *Manifest, env string) (string, error) {
+	switch {
+	case m.Env == "" && env == "":
+		return "", fmt.Errorf("env is required.  Set env in the manifest or pass --env")
+	case m.Env == "":
+		return env, nil
+	case env != "" && env != m.Env:
+		return "", fmt.Errorf("the manifest is for %s, not %s", m.Env, env)
+	}
+	return m.Env, nil
+}
+
+func printPlan(steps []planStep) {
+	for _, step := range steps {
+		for _, change := range step.changes {
+			fmt.Println(change)
+		}
+	}
+}
+
+// ManifestPlan shows what applying a manifest would change. Images are
+// resolved to IDs with resolve.
+func ManifestPlan(configStore *config.Store, env string, m *Manifest, resolve ImageResolver) error {
+	env, err := manifestEnv(m, env)
+	if err != nil {
+		return err
+	}
+
+	steps, err := planManifest(configStore, env, m, newManifestImages(resolve))
+	if err != nil {
+		return err
+	}
+
+	if len(steps) == 0 {
+		log.Printf("No changes. %s matches the manifest.\n", env)
+		return nil
+	}
+
+	printPlan(steps)
+	return nil
+}
+
+// ManifestApply makes the changes needed for an env to match a manifest,
+// after showing them. Unless yes is set, the changes have to be confirmed.
+// Images are resolved to IDs with resolve, so they must exist.
+func ManifestApply(configStore *config.Store, env string, m *Manifest, yes bool, resolve ImageResolver) error {
+	env, err := manifestEnv(m, env)
+	if err != nil {
+		return err
+	}
+
+	steps, err := planManifest(configStore, env, m, newManifestImages(resolve))
+	if err != nil {
+		return err
+	}
+
+	if len(steps) == 0 {
+		log.Printf("No changes. %s matches the manifest.\n", env)
+		return nil
+	}
+
+	printPlan(steps)
+	if !yes && !Confirm(fmt.Sprintf("Apply these changes to %s?", env)) {
+		return fmt.Errorf("nothing applied")
+	}
+
+	for i, step := range steps {
+		if err := step.apply(); err != nil {
+			return fmt.Errorf("%s: %s (%d of %d steps applied)", step.changes[0], err, i, len(steps))
+		}
+	}
+
+	log.Printf("Applied %d changes to %s.\n", len(steps), env)
+	return nil
+}
@@ -0,0 +1,158 @@
+package commander
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeManifest(t *testing.T, dir, manifest string) *Manifest {
+	fileName := filepath.Join(dir, "env.toml")
+	if err := ioutil.WriteFile(fileName, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadManifest(fileName)
+	if err != nil {
+		t.Fatalf("LoadManifest() = %v, want %v", err, nil)
+	}
+	return m
+}
+
+// testImages resolves every image but "missing:v1" to a fake ID
+func testImages(pulled *[]string) ImageResolver {
+	return func(image string) (string, error) {
+		*pulled = append(*pulled, image)
+		if image == "missing:v1" {
+			return "", fmt.Errorf("unable to pull %s", image)
+		}
+		return "id-" + image, nil
+	}
+}
+
+func TestManifestApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, _ := NewTestStore()
+	s.CreatePool("worker", "dev")
+	s.CreateApp("api", "dev")
+	s.AssignApp("api", "dev", "worker")
+
+	m := writeManifest(t, dir, `
+env = "dev"
+pools = ["web"]
+
+[apps.api]
+image = "api:v2"
+pools = ["web"]
+
+[apps.api.config]
+database_url = "postgres://db/api"
+
+[apps.api.runtime.web]
+ps = 2
+memory = "512m"
+
+[apps.cron]
+image = "cron:v1"
+`)
+
+	pulled := []string{}
+	steps, err := planManifest(s, "dev", m, newManifestImages(testImages(&pulled)))
+	if err != nil {
+		t.Fatalf("planManifest() = %v, want %v", err, nil)
+	}
+
+	want := [][]string{
+		{"+ pool web"},
+		{
+			`~ app api: version api:v2 (was "")`,
+			`~ app api: version ID id-api:v2 (was "")`,
+			`+ app api: DATABASE_URL="postgres://db/api"`,
+			"~ app api: pool web ps=2 (was -1)",
+			`~ app api: pool web memory=512m (was "")`,
+		},
+		{"+ assign api to web"},
+		{"- unassign api from worker"},
+		{"+ app cron"},
+		{
+			`~ app cron: version cron:v1 (was "")`,
+			`~ app cron: version ID id-cron:v1 (was "")`,
+		},
+	}
+
+	if len(steps) != len(want) {
+		t.Fatalf("planManifest() = %d steps, want %d", len(steps), len(want))
+	}
+	for i, step := range steps {
+		if len(step.changes) != len(want[i]) {
+			t.Fatalf("step %d = %q, want %q", i, step.changes, want[i])
+		}
+		for j := range want[i] {
+			if step.changes[j] != want[i][j] {
+				t.Fatalf("step %d = %q, want %q", i, step.changes, want[i])
+			}
+		}
+	}
+
+	if err := ManifestApply(s, "", m, true, testImages(&pulled)); err != nil {
+		t.Fatalf("ManifestApply() = %v, want %v", err, nil)
+	}
+
+	cfg, _ := s.GetApp("api", "dev")
+	if cfg.Version() != "api:v2" || cfg.VersionID() != "id-api:v2" || cfg.EnvGet("DATABASE_URL") != "postgres://db/api" || cfg.GetProcesses("web") != 2 {
+		t.Fatalf("GetApp() = %s %v ps=%d, want api:v2 with config and ps=2", cfg.Version(), cfg.Env(), cfg.GetProcesses("web"))
+	}
+
+	pools, _ := s.ListAssignedPools("dev", "api")
+	if len(pools) != 1 || pools[0] != "web" {
+		t.Fatalf("ListAssignedPools() = %v, want %v", pools, []string{"web"})
+	}
+
+	releases, _ := s.ListReleases("cron", "dev")
+	if len(releases) != 1 || releases[0].Version != "cron:v1" {
+		t.Fatalf("ListReleases() = %v, want one release of cron:v1", releases)
+	}
+
+	// images that are already deployed aren't pulled again
+	pulled = nil
+	steps, err = planManifest(s, "dev", m, newManifestImages(testImages(&pulled)))
+	if err != nil || len(steps) != 0 || len(pulled) != 0 {
+		t.Fatalf("planManifest() = %d steps, %v after apply, pulling %v, want none", len(steps), err, pulled)
+	}
+
+	if err := ManifestPlan(s, "prod", m, testImages(&pulled)); err == nil {
+		t.Fatalf("ManifestPlan(%q) = %v, want an env mismatch error", "prod", err)
+	}
+}
+
+func TestManifestMissingImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, _ := NewTestStore()
+	m := writeManifest(t, dir, `
+env = "dev"
+
+[apps.api]
+image = "missing:v1"
+`)
+
+	pulled := []string{}
+	if err := ManifestApply(s, "", m, true, testImages(&pulled)); err == nil {
+		t.Fatalf("ManifestApply() = %v, want an error for an image that can't be pulled", err)
+	}
+
+	if exists, _ := s.AppExists("api", "dev"); exists {
+		t.Fatalf("AppExists(%q) = %t after a failed plan, want %t", "api", exists, false)
+	}
+}
@@ -0,0 +1,454 @@
+package commander
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// EnvDump holds everything stored for a single environment, in a form that
+// can be written out as JSON and loaded into any config backend.
+type EnvDump struct {
+	Pools   []string
+	Hosts   []config.HostInfo
+	Configs []config.AppDefinition
+	Regs    []config.ServiceRegistration
+
+	// Assignments lists the apps assigned to each pool
+	Assignments map[string][]string
+
+	// Shared config by pool, with the env-wide config under ""
+	Shared map[string]map[string]string
+}
+
+// appDefinition converts any App to an AppDefinition, which is intended to be
+// serializable itself.
+func appDefinition(app config.App) config.AppDefinition {
+	if ad, ok := app.(*config.AppDefinition); ok {
+		dumped := *ad
+		dumped.Environment = make(map[string]string)
+		for k, v := range ad.Environment {
+			dumped.Environment[k] = v
+		}
+		return dumped
+	}
+
+	ad := config.AppDefinition{
+		AppName:     app.Name(),
+		Image:       app.Version(),
+		ImageID:     app.VersionID(),
+		Environment: make(map[string]string),
+		Schema:      app.GetSchema(),
+	}
+
+	for k, v := range app.Env() {
+		if v != "" {
+			ad.Environment[k] = v
+		}
+	}
+
+	ad.EntryPoint = app.GetEntryPoint()
+	ad.Command = app.GetCommand()
+	ad.Hosts = app.GetHosts()
+	ad.DNS = app.GetDNS()
+	ad.PortMappings = app.GetPortMappings()
+
+	for _, pool := range app.RuntimePools() {
+		ad.SetProcesses(pool, app.GetProcesses(pool))
+		ad.SetMemory(pool, app.GetMemory(pool))
+		ad.SetCPUShares(pool, app.GetCPUShares(pool))
+		ad.SetMaintenanceMode(pool, app.GetMaintenanceMode(pool))
+	}
+	return ad
+}
+
+// DumpEnv reads everything related to an environment from the config store.
+// Secret values are left encrypted.
+func DumpEnv(configStore *config.Store, env string) (*EnvDump, error) {
+	envDump := &EnvDump{
+		Hosts:       []config.HostInfo{},
+		Configs:     []config.AppDefinition{},
+		Regs:        []config.ServiceRegistration{},
+		Assignments: make(map[string][]string),
+		Shared:      make(map[string]map[string]string),
+	}
+
+	pools, err := configStore.ListPools(env)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(pools)
+	envDump.Pools = pools
+
+	shared, err := configStore.GetSharedConfig(env, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(shared) > 0 {
+		envDump.Shared[""] = shared
+	}
+
+	for _, pool := range pools {
+		hosts, err := configStore.ListHosts(env, pool)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			host.Pool = pool
+			envDump.Hosts = append(envDump.Hosts, host)
+		}
+
+		assigned, err := configStore.ListAssignments(env, pool)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(assigned)
+		envDump.Assignments[pool] = assigned
+
+		shared, err := configStore.GetSharedConfig(env, pool)
+		if err != nil {
+			return nil, err
+		}
+		if len(shared) > 0 {
+			envDump.Shared[pool] = shared
+		}
+	}
+
+	apps, err := configStore.ListApps(env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range apps {
+		envDump.Configs = append(envDump.Configs, appDefinition(app))
+	}
+
+	// The registrations are temporary, but dump them anyway, so we can try and
+	// convert an environment by keeping the runtime config in sync.
+	regs, err := configStore.ListRegistrations(env)
+	if err != nil {
+		return nil, err
+	}
+	envDump.Regs = append(envDump.Regs, regs...)
+
+	return envDump, nil
+}
+
+// definitionSettings returns the settings in ad, for updating an app to
+// match it.
+func definitionSettings(ad *config.AppDefinition) *AppSettings {
+	env := ad.Environment
+	if env == nil {
+		env = map[string]string{}
+	}
+
+	schema := ad.GetSchema()
+	if schema == nil {
+		schema = config.Schema{}
+	}
+
+	settings := &AppSettings{
+		Version:      &ad.Image,
+		VersionID:    &ad.ImageID,
+		Env:          env,
+		Schema:       schema,
+		EntryPoint:   append([]string{}, ad.EntryPoint...),
+		Command:      append([]string{}, ad.Command...),
+		Hosts:        append([]config.HostsEntry{}, ad.Hosts...),
+		DNS:          append([]string{}, ad.DNS...),
+		PortMappings: append([]config.PortMapping{}, ad.PortMappings...),
+		Runtime:      make(map[string]*PoolSettings),
+	}
+
+	for _, as := range ad.Assignments {
+		as := as
+		cpu := strconv.Itoa(as.CPU)
+		settings.Runtime[as.Pool] = &PoolSettings{
+			Processes:   &as.Instances,
+			Memory:      &as.Memory,
+			CPUShares:   &cpu,
+			Maintenance: &as.MaintenanceMode,
+		}
+	}
+	return settings
+}
+
+// RestoreEnv loads an EnvDump into the config store. Anything already stored
+// is updated to match the dump, but nothing is removed.
+func RestoreEnv(configStore *config.Store, env string, envDump *EnvDump) error {
+	for _, pool := range envDump.Pools {
+		if _, err := configStore.CreatePool(pool, env); err != nil {
+			return fmt.Errorf("unable to create pool %s: %s", pool, err)
+		}
+	}
+
+	for pool, values := range envDump.Shared {
+		current, err := configStore.GetSharedConfig(env, pool)
+		if err != nil {
+			return err
+		}
+
+		update := map[string]string{}
+		for k, v := range values {
+			if current[k] != v {
+				update[k] = v
+			}
+		}
+		if len(update) == 0 {
+			continue
+		}
+
+		if _, err := configStore.UpdateSharedConfig(env, pool, update); err != nil {
+			return fmt.Errorf("unable to update config for %s: %s", scopeName(env, pool), err)
+		}
+	}
+
+	for i := range envDump.Configs {
+		appDef := &envDump.Configs[i]
+		if appDef.Environment == nil {
+			appDef.Environment = make(map[string]string)
+		}
+
+		if _, err := configStore.CreateApp(appDef.Name(), env); err != nil {
+			return fmt.Errorf("unable to create %s: %s", appDef.Name(), err)
+		}
+
+		_, _, err := updateApp(configStore, appDef.Name(), env, retryOnConflict, func(cfg config.App) (bool, error) {
+			return len(ApplyAppSettings(cfg, definitionSettings(appDef))) > 0, nil
+		})
+		if err != nil {
+			return fmt.Errorf("unable to update %s: %s", appDef.Name(), err)
+		}
+	}
+
+	for pool, apps := range envDump.Assignments {
+		assigned, err := configStore.ListAssignments(env, pool)
+		if err != nil {
+			return err
+		}
+
+		for _, app := range apps {
+			if utils.StringInSlice(app, assigned) {
+				continue
+			}
+
+			if _, err := configStore.AssignApp(app, env, pool); err != nil {
+				return fmt.Errorf("unable to assign %s to %s: %s", app, pool, err)
+			}
+		}
+	}
+
+	for _, hostInfo := range envDump.Hosts {
+		if err := configStore.UpdateHost(env, hostInfo.Pool, hostInfo); err != nil {
+			return fmt.Errorf("unable to update host %s: %s", hostInfo.HostIP, err)
+		}
+	}
+
+	for i := range envDump.Regs {
+		reg := envDump.Regs[i]
+		if err := configStore.Backend.RegisterService(env, reg.Pool, &reg); err != nil {
+			return fmt.Errorf("unable to register %s: %s", reg.Name, err)
+		}
+	}
+	return nil
+}
+
+// containerSettings describes an app's entrypoint, command, hosts, DNS
+// servers and port mappings, for comparing them.
+func containerSettings(cfg config.App) string {
+	return fmt.Sprintf("entrypoint=%q cmd=%q hosts=%v dns=%q ports=%v", cfg.GetEntryPoint(), cfg.GetCommand(),
+		cfg.GetHosts(), cfg.GetDNS(), portList(cfg.GetPortMappings()))
+}
+
+// runtimeSummary describes the runtime settings for an app in a pool, with
+// unset values shown the same way for every backend.
+func runtimeSummary(ad *config.AppDefinition, pool string) string {
+	as := config.AppAssignment{Instances: -1}
+	for _, a := range ad.Assignments {
+		if a.Pool == pool {
+			as = a
+		}
+	}
+	return fmt.Sprintf("instances=%d memory=%q cpu=%d maint=%t", as.Instances, as.Memory, as.CPU, as.MaintenanceMode)
+}
+
+// diffVars lists the variables in from that are missing or different in to
+func diffVars(prefix string, from, to map[string]string) []string {
+	keys := []string{}
+	for k, v := range from {
+		if v != "" && to[k] != v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []string{}
+	for _, k := range keys {
+		if to[k] == "" {
+			changes = append(changes, fmt.Sprintf("+ %s: %s=%s", prefix, k, diffValue(from[k])))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("~ %s: %s=%s (was %s)", prefix, k, diffValue(from[k]), diffValue(to[k])))
+	}
+	return changes
+}
+
+// DiffEnv lists what has to change for to to match from. Apps, pools and
+// registrations that are only in to aren't listed, since restoring never
+// removes them.
+func DiffEnv(from, to *EnvDump) []string {
+	changes := []string{}
+
+	for _, pool := range from.Pools {
+		if !utils.StringInSlice(pool, to.Pools) {
+			changes = append(changes, fmt.Sprintf("+ pool %s", pool))
+		}
+	}
+
+	scopes := []string{}
+	for pool := range from.Shared {
+		scopes = append(scopes, pool)
+	}
+	sort.Strings(scopes)
+	for _, pool := range scopes {
+		scope := "env config"
+		if pool != "" {
+			scope = fmt.Sprintf("pool %s config", pool)
+		}
+		changes = append(changes, diffVars(scope, from.Shared[pool], to.Shared[pool])...)
+	}
+
+	existing := map[string]*config.AppDefinition{}
+	for i := range to.Configs {
+		existing[to.Configs[i].Name()] = &to.Configs[i]
+	}
+
+	for i := range from.Configs {
+		ad := &from.Configs[i]
+		current, ok := existing[ad.Name()]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("+ app %s", ad.Name()))
+			current = &config.AppDefinition{AppName: ad.Name()}
+		}
+		prefix := fmt.Sprintf("app %s", ad.Name())
+
+		if current.Image != ad.Image {
+			changes = append(changes, fmt.Sprintf("~ %s: version %s (was %q)", prefix, ad.Image, current.Image))
+		}
+		if current.ImageID != ad.ImageID {
+			changes = append(changes, fmt.Sprintf("~ %s: version ID %s (was %q)", prefix, ad.ImageID, current.ImageID))
+		}
+
+		changes = append(changes, diffVars(prefix, ad.Environment, current.Environment)...)
+		for k, v := range current.Environment {
+			if v != "" && ad.Environment[k] == "" {
+				changes = append(changes, fmt.Sprintf("- %s: %s", prefix, k))
+			}
+		}
+
+		if current.GetSchema().String() != ad.GetSchema().String() {
+			changes = append(changes, fmt.Sprintf("~ %s: schema %s", prefix, ad.GetSchema()))
+		}
+
+		if want := containerSettings(ad); containerSettings(current) != want {
+			changes = append(changes, fmt.Sprintf("~ %s: %s", prefix, want))
+		}
+
+		for _, as := range ad.Assignments {
+			want := runtimeSummary(ad, as.Pool)
+			if got := runtimeSummary(current, as.Pool); got != want {
+				changes = append(changes, fmt.Sprintf("~ %s: pool %s %s (was %s)", prefix, as.Pool, want, got))
+			}
+		}
+	}
+
+	pools := []string{}
+	for pool := range from.Assignments {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	for _, pool := range pools {
+		for _, app := range from.Assignments[pool] {
+			if !utils.StringInSlice(app, to.Assignments[pool]) {
+				changes = append(changes, fmt.Sprintf("+ assign %s to %s", app, pool))
+			}
+		}
+	}
+
+	hosts := map[config.HostInfo]bool{}
+	for _, host := range to.Hosts {
+		hosts[host] = true
+	}
+	for _, host := range from.Hosts {
+		if !hosts[host] {
+			changes = append(changes, fmt.Sprintf("+ host %s in %s", host.HostIP, host.Pool))
+		}
+	}
+
+	regKey := func(r config.ServiceRegistration) string {
+		return fmt.Sprintf("%s %s on %s:%s", r.Pool, r.Name, r.ExternalIP, r.ExternalPort)
+	}
+	regs := map[string]bool{}
+	for _, reg := range to.Regs {
+		regs[regKey(reg)+reg.ContainerID] = true
+	}
+	for _, reg := range from.Regs {
+		if !regs[regKey(reg)+reg.ContainerID] {
+			changes = append(changes, fmt.Sprintf("+ registration %s", regKey(reg)))
+		}
+	}
+
+	return changes
+}
+
+// Migrate copies an environment from one config store to another, and checks
+// that the copy matches. With dryRun set, it only prints what would change.
+func Migrate(from, to *config.Store, env string, dryRun bool) error {
+	src, err := DumpEnv(from, env)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %s", env, err)
+	}
+
+	dst, err := DumpEnv(to, env)
+	if err != nil {
+		return fmt.Errorf("unable to read %s from the destination: %s", env, err)
+	}
+
+	changes := DiffEnv(src, dst)
+	if len(changes) == 0 {
+		log.Printf("%s is already up to date.\n", env)
+		return nil
+	}
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	if err := RestoreEnv(to, env, src); err != nil {
+		return err
+	}
+
+	// read it all back to make sure nothing was lost on the way
+	dst, err = DumpEnv(to, env)
+	if err != nil {
+		return fmt.Errorf("unable to verify %s: %s", env, err)
+	}
+
+	if remaining := DiffEnv(src, dst); len(remaining) > 0 {
+		for _, change := range remaining {
+			log.Errorf("ERROR: not migrated: %s", change)
+		}
+		return fmt.Errorf("%d differences remain after migrating %s", len(remaining), env)
+	}
+
+	log.Printf("Migrated %s.\n", env)
+	return nil
+}
@@ -0,0 +1,217 @@
+package commander
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+	"github.com/litl/galaxy/config"
+)
+
+// newBoltStore returns a store kept in a temporary file
+func newBoltStore(t *testing.T) (*config.Store, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := config.NewBoltBackend(filepath.Join(dir, "registry.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return &config.Store{Backend: b}, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// newEtcdStore returns a store backed by an embedded etcd server
+func newEtcdStore(t *testing.T) (*config.Store, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := []int{}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+
+	clientURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", ports[0]))
+	peerURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", ports[1]))
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("unable to start embedded etcd: %s", err)
+	}
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		server.Close()
+		os.RemoveAll(dir)
+		t.Skip("embedded etcd took too long to start")
+	}
+
+	b, err := config.NewEtcdBackend([]string{clientURL.String()})
+	if err != nil {
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return &config.Store{Backend: b}, func() {
+		b.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src, _ := NewTestStore()
+	testMigrate(t, src)
+}
+
+// The other backends store registrations differently, so check they're
+// read back with their pool.
+func TestMigrateFromBolt(t *testing.T) {
+	src, cleanup := newBoltStore(t)
+	defer cleanup()
+	testMigrate(t, src)
+}
+
+func TestMigrateFromEtcd(t *testing.T) {
+	src, cleanup := newEtcdStore(t)
+	defer cleanup()
+	testMigrate(t, src)
+}
+
+func testMigrate(t *testing.T, src *config.Store) {
+	dst, _ := NewTestStore()
+
+	src.CreatePool("web", "dev")
+	src.CreateApp("app", "dev")
+	src.AssignApp("app", "dev", "web")
+	src.UpdateSharedConfig("dev", "", map[string]string{"REGION": "east"})
+	src.UpdateSharedConfig("dev", "web", map[string]string{"WORKERS": "4"})
+	src.UpdateHost("dev", "web", config.HostInfo{HostIP: "10.0.0.1"})
+
+	updateApp(src, "app", "dev", retryOnConflict, func(cfg config.App) (bool, error) {
+		cfg.SetVersion("app:v1")
+		cfg.EnvSet("FOO", "bar")
+		cfg.SetSchema(config.Schema{"FOO": {Required: true}})
+		cfg.SetProcesses("web", 2)
+		cfg.SetMemory("web", "512m")
+		cfg.SetMaintenanceMode("web", true)
+		return true, nil
+	})
+
+	src.Backend.RegisterService("dev", "web", &config.ServiceRegistration{
+		Name:          "app",
+		ExternalIP:    "10.0.0.1",
+		ExternalPort:  "49153",
+		ContainerID:   "0123456789abcdef",
+		ContainerName: "app_1",
+	})
+
+	if err := Migrate(src, dst, "dev", true); err != nil {
+		t.Fatalf("Migrate(dryRun) = %v, want %v", err, nil)
+	}
+
+	if exists, _ := dst.AppExists("app", "dev"); exists {
+		t.Fatalf("AppExists() = %v after a dry run, want %v", exists, false)
+	}
+
+	if err := Migrate(src, dst, "dev", false); err != nil {
+		t.Fatalf("Migrate() = %v, want %v", err, nil)
+	}
+
+	cfg, err := dst.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Version() != "app:v1" || cfg.EnvGet("FOO") != "bar" || cfg.GetSchema()["FOO"].Required != true {
+		t.Fatalf("GetApp() = %s %v %v, want %s FOO=bar with a schema", cfg.Version(), cfg.Env(), cfg.GetSchema(), "app:v1")
+	}
+
+	if cfg.GetProcesses("web") != 2 || cfg.GetMemory("web") != "512m" || !cfg.GetMaintenanceMode("web") {
+		t.Fatalf("runtime = %d %s %v, want 2 512m true", cfg.GetProcesses("web"), cfg.GetMemory("web"), cfg.GetMaintenanceMode("web"))
+	}
+
+	assigned, _ := dst.ListAssignments("dev", "web")
+	if len(assigned) != 1 || assigned[0] != "app" {
+		t.Fatalf("ListAssignments() = %v, want %v", assigned, []string{"app"})
+	}
+
+	shared, _ := dst.GetSharedConfig("dev", "web")
+	if shared["WORKERS"] != "4" {
+		t.Fatalf("GetSharedConfig() = %v, want WORKERS=4", shared)
+	}
+
+	regs, _ := dst.ListRegistrations("dev")
+	if len(regs) != 1 || regs[0].ExternalPort != "49153" || regs[0].Pool != "web" {
+		t.Fatalf("ListRegistrations() = %v, want one registration in web", regs)
+	}
+
+	srcDump, _ := DumpEnv(src, "dev")
+	dstDump, _ := DumpEnv(dst, "dev")
+	if changes := DiffEnv(srcDump, dstDump); len(changes) > 0 {
+		t.Fatalf("DiffEnv() = %v, want no changes", changes)
+	}
+}
+
+func TestDiffEnv(t *testing.T) {
+	from := &EnvDump{
+		Pools: []string{"web"},
+		Configs: []config.AppDefinition{
+			{AppName: "app", Image: "app:v2", Environment: map[string]string{"FOO": "new"}},
+		},
+		Assignments: map[string][]string{"web": {"app"}},
+	}
+	to := &EnvDump{
+		Configs: []config.AppDefinition{
+			{AppName: "app", Image: "app:v1", Environment: map[string]string{"FOO": "old", "BAR": "gone"}},
+			{AppName: "other", Image: "other:v1"},
+		},
+	}
+
+	want := []string{
+		"+ pool web",
+		`~ app app: version app:v2 (was "app:v1")`,
+		`~ app app: FOO="new" (was "old")`,
+		"- app app: BAR",
+		"+ assign app to web",
+	}
+
+	changes := DiffEnv(from, to)
+	if len(changes) != len(want) {
+		t.Fatalf("DiffEnv() = %q, want %q", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("DiffEnv() = %q, want %q", changes, want)
+		}
+	}
+}
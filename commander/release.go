@@ -0,0 +1,151 @@
+package commander
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/ryanuber/columnize"
+)
+
+// recordRelease adds the app's current image and environment to its release
+// history.
+func recordRelease(configStore *config.Store, cfg config.App, env string) (*config.Release, error) {
+	release := &config.Release{
+		Version:   cfg.Version(),
+		VersionID: cfg.VersionID(),
+		Env:       map[string]string{},
+		Created:   time.Now().UTC(),
+		User:      currentUser(),
+	}
+
+	for k, v := range cfg.Env() {
+		if v != "" {
+			release.Env[k] = v
+		}
+	}
+
+	release.Host, _ = os.Hostname()
+
+	err := configStore.AddRelease(cfg.Name(), env, release)
+	return release, err
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func AppReleases(configStore *config.Store, app, env string) error {
+	cfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return err
+	}
+
+	releases, err := configStore.ListReleases(app, env)
+	if err != nil {
+		return err
+	}
+
+	columns := []string{"RELEASE | VERSION | IMAGE ID | CREATED | USER | HOST"}
+
+	// newest first
+	for i := len(releases) - 1; i >= 0; i-- {
+		r := releases[i]
+
+		id := strconv.FormatInt(r.ID, 10)
+		if r.Version == cfg.Version() && r.VersionID == cfg.VersionID() && i == len(releases)-1 {
+			id += "*"
+		}
+
+		versionID := r.VersionID
+		if len(versionID) > 12 {
+			versionID = versionID[:12]
+		}
+
+		columns = append(columns, strings.Join([]string{
+			id,
+			r.Version,
+			versionID,
+			r.Created.Local().Format(time.RFC3339),
+			r.User,
+			r.Host,
+		}, " | "))
+	}
+
+	fmt.Println(columnize.SimpleFormat(columns))
+	return nil
+}
+
+// AppRollback redeploys the image and environment from an earlier release.
+// With no release given, it rolls back to the one before the latest.
+func AppRollback(configStore *config.Store, app, env, release string) error {
+	releases, err := configStore.ListReleases(app, env)
+	if err != nil {
+		return err
+	}
+
+	var target *config.Release
+	if release == "" {
+		if len(releases) < 2 {
+			return fmt.Errorf("no previous release of %s to roll back to", app)
+		}
+		target = &releases[len(releases)-2]
+	} else {
+		id, err := strconv.ParseInt(strings.TrimPrefix(release, "v"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid release: %s", release)
+		}
+
+		for i := range releases {
+			if releases[i].ID == id {
+				target = &releases[i]
+			}
+		}
+
+		if target == nil {
+			return fmt.Errorf("release %d of %s not found", id, app)
+		}
+	}
+
+	svcCfg, updated, err := updateApp(configStore, app, env, retryOnConflict, func(cfg config.App) (bool, error) {
+		cfg.SetVersion(target.Version)
+		cfg.SetVersionID(target.VersionID)
+
+		for k := range cfg.Env() {
+			if _, ok := target.Env[k]; !ok {
+				cfg.EnvSet(k, "")
+			}
+		}
+
+		for k, v := range target.Env {
+			if cfg.EnvGet(k) != v {
+				cfg.EnvSet(k, v)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not roll back: %s", err)
+	}
+
+	if !updated {
+		return fmt.Errorf("%s NOT rolled back.", app)
+	}
+
+	rollback, err := recordRelease(configStore, svcCfg, env)
+	if err != nil {
+		log.Warnf("WARN: Unable to record release: %s", err)
+		rollback = &config.Release{}
+	}
+
+	log.Printf("Rolled back %s to release %d (%s) as release %d.\n", app, target.ID, target.Version, rollback.ID)
+	return nil
+}
@@ -0,0 +1,60 @@
+package commander
+
+import (
+	"testing"
+
+	"github.com/litl/galaxy/config"
+)
+
+func deployForTest(t *testing.T, s *config.Store, version string, env map[string]string) {
+	cfg, _, err := updateApp(s, "app", "dev", retryOnConflict, func(cfg config.App) (bool, error) {
+		cfg.SetVersion(version)
+		for k, v := range env {
+			cfg.EnvSet(k, v)
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := recordRelease(s, cfg, "dev"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppRollback(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	deployForTest(t, s, "app:v1", map[string]string{"FOO": "one"})
+	deployForTest(t, s, "app:v2", map[string]string{"FOO": "two", "BAR": "new"})
+
+	if err := AppRollback(s, "app", "dev", ""); err != nil {
+		t.Fatalf("AppRollback() = %v, want %v", err, nil)
+	}
+
+	cfg, _ := s.GetApp("app", "dev")
+	if cfg.Version() != "app:v1" || cfg.EnvGet("FOO") != "one" || cfg.EnvGet("BAR") != "" {
+		t.Fatalf("GetApp() = %s %v, want %s FOO=one", cfg.Version(), cfg.Env(), "app:v1")
+	}
+
+	// the rollback is a release too
+	releases, _ := s.ListReleases("app", "dev")
+	if len(releases) != 3 || releases[2].Version != "app:v1" {
+		t.Fatalf("ListReleases() = %v, want 3 releases ending with %s", releases, "app:v1")
+	}
+
+	if err := AppRollback(s, "app", "dev", "2"); err != nil {
+		t.Fatalf("AppRollback(%q) = %v, want %v", "2", err, nil)
+	}
+
+	cfg, _ = s.GetApp("app", "dev")
+	if cfg.Version() != "app:v2" || cfg.EnvGet("BAR") != "new" {
+		t.Fatalf("GetApp() = %s %v, want %s BAR=new", cfg.Version(), cfg.Env(), "app:v2")
+	}
+
+	if err := AppRollback(s, "app", "dev", "9"); err == nil {
+		t.Fatalf("AppRollback(%q) = %v, want error", "9", err)
+	}
+}
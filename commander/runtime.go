@@ -1,7 +1,9 @@
 package commander
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -17,6 +19,110 @@ type RuntimeOptions struct {
 	VirtualHost     string
 	Port            string
 	MaintenanceMode string
+
+	// Container settings for the app in every pool. These are left alone
+	// when nil.
+	EntryPoint []string
+	Command    []string
+	Hosts      []config.HostsEntry
+	DNS        []string
+
+	// Host ports bound to container ports. A mapping replaces any other for
+	// the same container port.
+	PortMappings []config.PortMapping
+}
+
+// ParseCommand reads a command or entrypoint, either as a JSON list or
+// separated by spaces.
+func ParseCommand(cmd string) ([]string, error) {
+	cmd = strings.TrimSpace(cmd)
+	if !strings.HasPrefix(cmd, "[") {
+		return strings.Fields(cmd), nil
+	}
+
+	var args []string
+	if err := json.Unmarshal([]byte(cmd), &args); err != nil {
+		return nil, fmt.Errorf("bad command %s: %s", cmd, err)
+	}
+	return args, nil
+}
+
+// ParseHostsEntry reads an /etc/hosts entry in docker's host:ip format.
+func ParseHostsEntry(entry string) (config.HostsEntry, error) {
+	sep := strings.Index(entry, ":")
+	if sep < 1 || sep == len(entry)-1 {
+		return config.HostsEntry{}, fmt.Errorf("bad host entry %s: use host:ip", entry)
+	}
+	return config.HostsEntry{Host: entry[:sep], Address: entry[sep+1:]}, nil
+}
+
+// ParsePortMapping reads a port mapping like docker's -p flag, as
+// hostPort:containerPort, with an optional /tcp or /udp.
+func ParsePortMapping(mapping string) (config.PortMapping, error) {
+	bad := fmt.Errorf("bad port mapping %s: use hostPort:containerPort[/udp]", mapping)
+
+	ports, network := mapping, "tcp"
+	if sep := strings.Index(mapping, "/"); sep >= 0 {
+		ports, network = mapping[:sep], strings.ToLower(mapping[sep+1:])
+	}
+	if network != "tcp" && network != "udp" {
+		return config.PortMapping{}, bad
+	}
+
+	parts := strings.Split(ports, ":")
+	if len(parts) != 2 {
+		return config.PortMapping{}, bad
+	}
+	for _, p := range parts {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return config.PortMapping{}, bad
+		}
+	}
+
+	return config.PortMapping{
+		HostPort:      parts[0],
+		ContainerPort: parts[1],
+		Network:       network,
+	}, nil
+}
+
+// checkHostPorts returns an error if another app assigned to one of the
+// pools already maps one of the app's host ports, since they would conflict
+// on every host in the pool.
+func checkHostPorts(configStore *config.Store, cfg config.App, env string, pools []string) error {
+	claimed := map[string]bool{}
+	for _, m := range cfg.GetPortMappings() {
+		claimed[m.HostPort+"/"+m.Protocol()] = true
+	}
+	if len(claimed) == 0 {
+		return nil
+	}
+
+	for _, pool := range pools {
+		apps, err := configStore.ListAssignments(env, pool)
+		if err != nil {
+			return err
+		}
+
+		for _, app := range apps {
+			if app == cfg.Name() {
+				continue
+			}
+
+			other, err := configStore.GetApp(app, env)
+			if err != nil {
+				return err
+			}
+
+			for _, m := range other.GetPortMappings() {
+				port := m.HostPort + "/" + m.Protocol()
+				if claimed[port] {
+					return fmt.Errorf("host port %s is already used by %s in pool %s", port, app, pool)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 func RuntimeList(configStore *config.Store, app, env, pool string) error {
@@ -77,70 +183,175 @@ func RuntimeList(configStore *config.Store, app, env, pool string) error {
 
 func RuntimeSet(configStore *config.Store, app, env, pool string, options RuntimeOptions) (bool, error) {
 
-	cfg, err := configStore.GetApp(app, env)
-	if err != nil {
-		return false, err
+	maint := false
+	if options.MaintenanceMode != "" {
+		var err error
+		maint, err = strconv.ParseBool(options.MaintenanceMode)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	if options.Ps != 0 && options.Ps != cfg.GetProcesses(pool) {
-		cfg.SetProcesses(pool, options.Ps)
-	}
+	_, updated, err := updateApp(configStore, app, env, askOnConflict, func(cfg config.App) (bool, error) {
+		if options.Ps != 0 && options.Ps != cfg.GetProcesses(pool) {
+			cfg.SetProcesses(pool, options.Ps)
+		}
 
-	if options.Memory != "" && options.Memory != cfg.GetMemory(pool) {
-		cfg.SetMemory(pool, options.Memory)
-	}
+		if options.Memory != "" && options.Memory != cfg.GetMemory(pool) {
+			cfg.SetMemory(pool, options.Memory)
+		}
 
-	vhosts := []string{}
-	vhostsFromEnv := cfg.Env()["VIRTUAL_HOST"]
-	if vhostsFromEnv != "" {
-		vhosts = strings.Split(cfg.Env()["VIRTUAL_HOST"], ",")
-	}
+		vhosts := []string{}
+		vhostsFromEnv := cfg.Env()["VIRTUAL_HOST"]
+		if vhostsFromEnv != "" {
+			vhosts = strings.Split(cfg.Env()["VIRTUAL_HOST"], ",")
+		}
 
-	if options.VirtualHost != "" && !utils.StringInSlice(options.VirtualHost, vhosts) {
-		vhosts = append(vhosts, options.VirtualHost)
-		cfg.EnvSet("VIRTUAL_HOST", strings.Join(vhosts, ","))
-	}
+		if options.VirtualHost != "" && !utils.StringInSlice(options.VirtualHost, vhosts) {
+			vhosts = append(vhosts, options.VirtualHost)
+			cfg.EnvSet("VIRTUAL_HOST", strings.Join(vhosts, ","))
+		}
 
-	if options.Port != "" {
-		cfg.EnvSet("GALAXY_PORT", options.Port)
-	}
+		if options.Port != "" {
+			cfg.EnvSet("GALAXY_PORT", options.Port)
+		}
 
-	if options.MaintenanceMode != "" {
-		b, err := strconv.ParseBool(options.MaintenanceMode)
-		if err != nil {
-			return false, err
+		if options.MaintenanceMode != "" {
+			cfg.SetMaintenanceMode(pool, maint)
 		}
 
-		cfg.SetMaintenanceMode(pool, b)
-	}
+		if options.EntryPoint != nil {
+			cfg.SetEntryPoint(options.EntryPoint)
+		}
+
+		if options.Command != nil {
+			cfg.SetCommand(options.Command)
+		}
 
-	return configStore.UpdateApp(cfg, env)
+		if len(options.Hosts) > 0 {
+			// replace any entry for the same host
+			hosts := options.Hosts
+			for _, entry := range cfg.GetHosts() {
+				added := false
+				for _, h := range options.Hosts {
+					added = added || h.Host == entry.Host
+				}
+				if !added {
+					hosts = append(hosts, entry)
+				}
+			}
+			cfg.SetHosts(hosts)
+		}
+
+		if options.DNS != nil {
+			cfg.SetDNS(options.DNS)
+		}
+
+		if len(options.PortMappings) > 0 {
+			mappings := options.PortMappings
+			for _, m := range cfg.GetPortMappings() {
+				added := false
+				for _, p := range options.PortMappings {
+					added = added || samePort(p, m)
+				}
+				if !added {
+					mappings = append(mappings, m)
+				}
+			}
+			cfg.SetPortMappings(mappings)
+
+			pools, err := configStore.ListAssignedPools(env, app)
+			if err != nil {
+				return false, err
+			}
+			if err := checkHostPorts(configStore, cfg, env, pools); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	return updated, err
 }
 
 func RuntimeUnset(configStore *config.Store, app, env, pool string, options RuntimeOptions) (bool, error) {
 
-	cfg, err := configStore.GetApp(app, env)
-	if err != nil {
-		return false, err
-	}
+	_, updated, err := updateApp(configStore, app, env, askOnConflict, func(cfg config.App) (bool, error) {
+		if options.Ps != 0 {
+			cfg.SetProcesses(pool, -1)
+		}
 
-	if options.Ps != 0 {
-		cfg.SetProcesses(pool, -1)
-	}
+		if options.Memory != "" {
+			cfg.SetMemory(pool, "")
+		}
 
-	if options.Memory != "" {
-		cfg.SetMemory(pool, "")
-	}
+		vhosts := strings.Split(cfg.Env()["VIRTUAL_HOST"], ",")
+		if options.VirtualHost != "" && utils.StringInSlice(options.VirtualHost, vhosts) {
+			vhosts = utils.RemoveStringInSlice(options.VirtualHost, vhosts)
+			cfg.EnvSet("VIRTUAL_HOST", strings.Join(vhosts, ","))
+		}
 
-	vhosts := strings.Split(cfg.Env()["VIRTUAL_HOST"], ",")
-	if options.VirtualHost != "" && utils.StringInSlice(options.VirtualHost, vhosts) {
-		vhosts = utils.RemoveStringInSlice(options.VirtualHost, vhosts)
-		cfg.EnvSet("VIRTUAL_HOST", strings.Join(vhosts, ","))
-	}
+		if options.Port != "" {
+			cfg.EnvSet("GALAXY_PORT", "")
+		}
 
-	if options.Port != "" {
-		cfg.EnvSet("GALAXY_PORT", "")
+		if options.EntryPoint != nil {
+			cfg.SetEntryPoint(nil)
+		}
+
+		if options.Command != nil {
+			cfg.SetCommand(nil)
+		}
+
+		// remove the listed hosts, or all of them if none are listed
+		if options.Hosts != nil {
+			hosts := []config.HostsEntry{}
+			for _, entry := range cfg.GetHosts() {
+				removed := len(options.Hosts) == 0
+				for _, h := range options.Hosts {
+					removed = removed || h.Host == entry.Host
+				}
+				if !removed {
+					hosts = append(hosts, entry)
+				}
+			}
+			cfg.SetHosts(hosts)
+		}
+
+		if options.DNS != nil {
+			cfg.SetDNS(nil)
+		}
+
+		// remove the listed container ports, or all of them if none are listed
+		if options.PortMappings != nil {
+			mappings := []config.PortMapping{}
+			for _, m := range cfg.GetPortMappings() {
+				removed := len(options.PortMappings) == 0
+				for _, p := range options.PortMappings {
+					removed = removed || samePort(p, m)
+				}
+				if !removed {
+					mappings = append(mappings, m)
+				}
+			}
+			cfg.SetPortMappings(mappings)
+		}
+		return true, nil
+	})
+	return updated, err
+}
+
+// portList formats port mappings like docker's -p flag, sorted so they can
+// be compared.
+func portList(mappings []config.PortMapping) []string {
+	ports := []string{}
+	for _, m := range mappings {
+		ports = append(ports, m.String())
 	}
+	sort.Strings(ports)
+	return ports
+}
 
-	return configStore.UpdateApp(cfg, env)
+// samePort returns true if both mappings are for the same container port
+func samePort(a, b config.PortMapping) bool {
+	return a.ContainerPort == b.ContainerPort && a.Protocol() == b.Protocol()
 }
@@ -0,0 +1,122 @@
+package commander
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/litl/galaxy/config"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		cmd  string
+		want []string
+	}{
+		{"serve -v", []string{"serve", "-v"}},
+		{`["sh", "-c", "echo hi"]`, []string{"sh", "-c", "echo hi"}},
+	} {
+		got, err := ParseCommand(tc.cmd)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("ParseCommand(%q) = %q, %v, want %q", tc.cmd, got, err, tc.want)
+		}
+	}
+
+	if _, err := ParseHostsEntry("db"); err == nil {
+		t.Fatalf("ParseHostsEntry(%q) = %v, want error", "db", err)
+	}
+}
+
+func TestRuntimeSetContainerSettings(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	_, err := RuntimeSet(s, "app", "dev", "", RuntimeOptions{
+		EntryPoint: []string{"/bin/app"},
+		Hosts:      []config.HostsEntry{{Host: "db", Address: "10.0.0.2"}, {Host: "cache", Address: "10.0.0.3"}},
+		DNS:        []string{"10.0.0.53"},
+	})
+	if err != nil {
+		t.Fatalf("RuntimeSet() = %v, want %v", err, nil)
+	}
+
+	// a new address for the same host replaces the old one
+	RuntimeSet(s, "app", "dev", "", RuntimeOptions{
+		Hosts: []config.HostsEntry{{Host: "db", Address: "10.0.0.4"}},
+	})
+
+	cfg, _ := s.GetApp("app", "dev")
+	want := []config.HostsEntry{{Host: "db", Address: "10.0.0.4"}, {Host: "cache", Address: "10.0.0.3"}}
+	if !reflect.DeepEqual(cfg.GetHosts(), want) {
+		t.Fatalf("GetHosts() = %v, want %v", cfg.GetHosts(), want)
+	}
+	if !reflect.DeepEqual(cfg.GetEntryPoint(), []string{"/bin/app"}) || !reflect.DeepEqual(cfg.GetDNS(), []string{"10.0.0.53"}) {
+		t.Fatalf("GetEntryPoint(), GetDNS() = %v, %v, want [/bin/app], [10.0.0.53]", cfg.GetEntryPoint(), cfg.GetDNS())
+	}
+
+	RuntimeUnset(s, "app", "dev", "", RuntimeOptions{
+		EntryPoint: []string{},
+		Hosts:      []config.HostsEntry{{Host: "cache"}},
+	})
+
+	cfg, _ = s.GetApp("app", "dev")
+	if cfg.GetEntryPoint() != nil || len(cfg.GetHosts()) != 1 || cfg.GetHosts()[0].Host != "db" {
+		t.Fatalf("after RuntimeUnset() = %v, %v, want no entrypoint and only db", cfg.GetEntryPoint(), cfg.GetHosts())
+	}
+}
+
+func TestParsePortMapping(t *testing.T) {
+	for _, tc := range []struct {
+		mapping string
+		want    string
+	}{
+		{"80:8000", "80:8000/tcp"},
+		{"8125:8125/udp", "8125:8125/udp"},
+		{"8000", ""},
+		{"80:8000/sctp", ""},
+		{"80:http", ""},
+	} {
+		got, err := ParsePortMapping(tc.mapping)
+		if tc.want == "" {
+			if err == nil {
+				t.Fatalf("ParsePortMapping(%q) = %v, want error", tc.mapping, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tc.want {
+			t.Fatalf("ParsePortMapping(%q) = %v, %v, want %v", tc.mapping, got, err, tc.want)
+		}
+	}
+}
+
+func TestRuntimeSetPortConflict(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreatePool("web", "dev")
+	for _, app := range []string{"api", "admin"} {
+		s.CreateApp(app, "dev")
+		s.AssignApp(app, "dev", "web")
+	}
+
+	mapping, _ := ParsePortMapping("80:8000")
+	_, err := RuntimeSet(s, "api", "dev", "", RuntimeOptions{PortMappings: []config.PortMapping{mapping}})
+	if err != nil {
+		t.Fatalf("RuntimeSet() = %v, want %v", err, nil)
+	}
+
+	_, err = RuntimeSet(s, "admin", "dev", "", RuntimeOptions{PortMappings: []config.PortMapping{mapping}})
+	if err == nil {
+		t.Fatalf("RuntimeSet() = %v, want host port conflict", err)
+	}
+
+	// the same port number over udp doesn't conflict
+	mapping, _ = ParsePortMapping("80:8000/udp")
+	_, err = RuntimeSet(s, "admin", "dev", "", RuntimeOptions{PortMappings: []config.PortMapping{mapping}})
+	if err != nil {
+		t.Fatalf("RuntimeSet() = %v, want %v", err, nil)
+	}
+
+	RuntimeUnset(s, "api", "dev", "", RuntimeOptions{PortMappings: []config.PortMapping{{ContainerPort: "8000"}}})
+	cfg, _ := s.GetApp("api", "dev")
+	if len(cfg.GetPortMappings()) != 0 {
+		t.Fatalf("GetPortMappings() = %v, want none", cfg.GetPortMappings())
+	}
+}
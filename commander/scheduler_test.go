@@ -27,6 +27,9 @@ func setup(t *testing.T, desired int, hosts []string) *config.Store {
 	}
 
 	ac.SetProcesses("web", desired)
+	if updated, err := s.UpdateApp(ac, "dev"); !updated || err != nil {
+		t.Errorf("Failed to update app: %s", err)
+	}
 
 	b.ListHostsFunc = func(env, pool string) ([]config.HostInfo, error) {
 		ret := []config.HostInfo{}
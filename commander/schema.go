@@ -0,0 +1,111 @@
+package commander
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+)
+
+// validateConfig checks an app's config against its schema, along with the
+// shared config for every pool it's assigned to.
+func validateConfig(configStore *config.Store, cfg config.App, env string) error {
+	schema := cfg.GetSchema()
+	if len(schema) == 0 {
+		return nil
+	}
+
+	pools, err := configStore.ListAssignedPools(env, cfg.Name())
+	if err != nil {
+		return err
+	}
+
+	if len(pools) == 0 {
+		pools = []string{""}
+	}
+
+	for _, pool := range pools {
+		appEnv, err := configStore.AppEnv(cfg, env, pool)
+		if err != nil {
+			return err
+		}
+
+		if err := schema.Validate(appEnv); err != nil {
+			if pool != "" {
+				return fmt.Errorf("%s (in pool %s)", err, pool)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigValidate checks an app's current config against its schema.
+func ConfigValidate(configStore *config.Store, app, env string) error {
+	cfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.GetSchema()) == 0 {
+		log.Printf("%s has no config schema.\n", app)
+		return nil
+	}
+
+	if err := validateConfig(configStore, cfg, env); err != nil {
+		return err
+	}
+
+	log.Printf("Configuration for %s is valid.\n", app)
+	return nil
+}
+
+// ConfigSchema prints an app's schema, or replaces it with the one in
+// fileName.
+func ConfigSchema(configStore *config.Store, app, env, fileName string) error {
+	if fileName == "" {
+		cfg, err := configStore.GetApp(app, env)
+		if err != nil {
+			return err
+		}
+
+		js, err := json.MarshalIndent(cfg.GetSchema(), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(js))
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	schema, err := config.ParseSchema(data)
+	if err != nil {
+		return fmt.Errorf("invalid schema: %s", err)
+	}
+
+	cfg, updated, err := updateApp(configStore, app, env, askOnConflict, func(cfg config.App) (bool, error) {
+		cfg.SetSchema(schema)
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set schema: %s", err)
+	}
+
+	if !updated {
+		return fmt.Errorf("schema NOT changed for %s", app)
+	}
+	log.Printf("Schema changed for %s.\n", app)
+
+	// the schema applies to the next change, so only warn about the config
+	// that's already there
+	if err := validateConfig(configStore, cfg, env); err != nil {
+		log.Warnf("WARN: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package commander
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+)
+
+// Confirm asks the user a yes/no question, and defaults to no.
+// It can be replaced when there's no terminal to ask.
+var Confirm = func(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// conflictPolicy says what updateApp does when someone else updated the app
+// between loading and storing it.
+type conflictPolicy int
+
+const (
+	// ask whether to retry against the fresh config
+	askOnConflict conflictPolicy = iota
+
+	// retry without asking. Only for changes that work out their edit from
+	// the config they're given, so a retry can't undo the other update.
+	retryOnConflict
+)
+
+// how many times retryOnConflict tries before giving up
+const maxConflictRetries = 5
+
+// updateApp loads the current config for an app, applies change, and stores
+// it. If someone else updated the app in the meantime, the change is retried
+// against the fresh config as the policy says.
+// change returns false if there was nothing to update.
+func updateApp(configStore *config.Store, app, env string, policy conflictPolicy, change func(cfg config.App) (bool, error)) (config.App, bool, error) {
+	for attempt := 1; ; attempt++ {
+		cfg, err := configStore.GetApp(app, env)
+		if err != nil {
+			return nil, false, err
+		}
+
+		changed, err := change(cfg)
+		if !changed || err != nil {
+			return cfg, false, err
+		}
+
+		updated, err := configStore.UpdateApp(cfg, env)
+		if err != config.StaleConfig {
+			return cfg, updated, err
+		}
+
+		switch policy {
+		case retryOnConflict:
+			if attempt < maxConflictRetries {
+				log.Warnf("WARN: %s was changed by someone else while it was being updated. Retrying.", app)
+				continue
+			}
+			return cfg, false, fmt.Errorf("%s kept being changed by someone else", app)
+		default:
+			log.Warnf("WARN: %s was changed by someone else while it was being updated.", app)
+			if !Confirm("Retry against the current config?") {
+				return cfg, false, fmt.Errorf("%s was changed by someone else", app)
+			}
+		}
+	}
+}
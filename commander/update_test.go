@@ -0,0 +1,103 @@
+package commander
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/litl/galaxy/config"
+)
+
+// concurrentSet returns a change func that, on its first call, has someone
+// else update the app before our update is stored.
+func concurrentSet(t *testing.T, s *config.Store, calls *int) func(cfg config.App) (bool, error) {
+	return func(cfg config.App) (bool, error) {
+		*calls++
+		if *calls == 1 {
+			other, _ := s.GetApp("app", "dev")
+			other.EnvSet("OTHER", "1")
+			if updated, err := s.UpdateApp(other, "dev"); !updated || err != nil {
+				t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+			}
+		}
+		cfg.EnvSet("MINE", "1")
+		return true, nil
+	}
+}
+
+func TestUpdateAppRetry(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	defer func(c func(string) bool) { Confirm = c }(Confirm)
+	asked := 0
+	Confirm = func(string) bool {
+		asked++
+		return true
+	}
+
+	calls := 0
+	_, updated, err := updateApp(s, "app", "dev", askOnConflict, concurrentSet(t, s, &calls))
+	if !updated || err != nil {
+		t.Fatalf("updateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	if calls != 2 || asked != 1 {
+		t.Fatalf("updateApp() applied change %d times and asked %d times, want %d, %d", calls, asked, 2, 1)
+	}
+
+	cfg, _ := s.GetApp("app", "dev")
+	if cfg.EnvGet("OTHER") != "1" || cfg.EnvGet("MINE") != "1" {
+		t.Fatalf("Env() = %v, want both updates", cfg.Env())
+	}
+}
+
+func TestUpdateAppConflictDeclined(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	defer func(c func(string) bool) { Confirm = c }(Confirm)
+	Confirm = func(string) bool { return false }
+
+	calls := 0
+	_, updated, err := updateApp(s, "app", "dev", askOnConflict, concurrentSet(t, s, &calls))
+	if updated || err == nil {
+		t.Fatalf("updateApp() = %t, %v, want %t, error", updated, err, false)
+	}
+
+	cfg, _ := s.GetApp("app", "dev")
+	if cfg.EnvGet("MINE") != "" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "MINE", cfg.EnvGet("MINE"), "")
+	}
+}
+
+func TestUpdateAppRetryWithoutAsking(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+
+	defer func(c func(string) bool) { Confirm = c }(Confirm)
+	Confirm = func(string) bool {
+		t.Fatal("Confirm() called, want an automatic retry")
+		return false
+	}
+
+	calls := 0
+	_, updated, err := updateApp(s, "app", "dev", retryOnConflict, concurrentSet(t, s, &calls))
+	if !updated || err != nil || calls != 2 {
+		t.Fatalf("updateApp() = %t, %v after %d calls, want %t, %v after %d", updated, err, calls, true, nil, 2)
+	}
+
+	// someone else always gets there first
+	calls = 0
+	_, updated, err = updateApp(s, "app", "dev", retryOnConflict, func(cfg config.App) (bool, error) {
+		calls++
+		other, _ := s.GetApp("app", "dev")
+		other.EnvSet("OTHER", fmt.Sprintf("%d", calls))
+		s.UpdateApp(other, "dev")
+
+		cfg.EnvSet("MINE", "2")
+		return true, nil
+	})
+	if updated || err == nil || calls != maxConflictRetries {
+		t.Fatalf("updateApp() = %t, %v after %d calls, want %t, error after %d", updated, err, calls, false, maxConflictRetries)
+	}
+}
@@ -0,0 +1,127 @@
+package commander
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+)
+
+// how often the hosts' acks are checked while waiting
+var ackPollInterval = time.Second
+
+// hostAck is a host's answer to a change, nil if it hasn't answered yet
+type hostAck struct {
+	pool   string
+	hostIP string
+	ack    *config.ChangeAck
+}
+
+// hostAcks returns the answer from every host in every pool the app is
+// assigned to, where handled says if an ack is for the change waited on.
+func hostAcks(configStore *config.Store, app, env string, handled func(ack config.ChangeAck) bool) ([]hostAck, error) {
+	pools, err := configStore.ListAssignedPools(env, app)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(pools)
+
+	answers := []hostAck{}
+	for _, pool := range pools {
+		hosts, err := configStore.ListHosts(env, pool)
+		if err != nil {
+			return nil, err
+		}
+
+		acks, err := configStore.ListAcks(env, pool, app)
+		if err != nil {
+			return nil, err
+		}
+
+		hostIPs := []string{}
+		for _, host := range hosts {
+			hostIPs = append(hostIPs, host.HostIP)
+		}
+		sort.Strings(hostIPs)
+
+		for _, hostIP := range hostIPs {
+			answer := hostAck{pool: pool, hostIP: hostIP}
+			for i := range acks {
+				if acks[i].HostIP == hostIP && handled(acks[i]) {
+					answer.ack = &acks[i]
+				}
+			}
+			answers = append(answers, answer)
+		}
+	}
+	return answers, nil
+}
+
+// waitForHosts waits until every host running the app has handled a change,
+// or the timeout passes, and reports the hosts that failed or didn't answer.
+func waitForHosts(configStore *config.Store, app, env string, timeout time.Duration, handled func(ack config.ChangeAck) bool) error {
+	deadline := time.Now().Add(timeout)
+
+	var answers []hostAck
+	for {
+		var err error
+		answers, err = hostAcks(configStore, app, env, handled)
+		if err != nil {
+			return err
+		}
+
+		pending := 0
+		for _, answer := range answers {
+			if answer.ack == nil {
+				pending++
+			}
+		}
+
+		if pending == 0 || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(ackPollInterval)
+	}
+
+	failed := 0
+	for _, answer := range answers {
+		switch {
+		case answer.ack == nil:
+			log.Errorf("ERROR: %s (%s): no answer after %s", answer.hostIP, answer.pool, timeout)
+			failed++
+		case answer.ack.Error != "":
+			log.Errorf("ERROR: %s (%s): %s", answer.hostIP, answer.pool, answer.ack.Error)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d hosts did not update %s", failed, len(answers), app)
+	}
+	log.Printf("%d hosts updated %s.\n", len(answers), app)
+	return nil
+}
+
+// WaitForDeploy waits until every host running the app is running its
+// current config.
+func WaitForDeploy(configStore *config.Store, app, env string, timeout time.Duration) error {
+	appCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return err
+	}
+
+	id := appCfg.ID()
+	return waitForHosts(configStore, app, env, timeout, func(ack config.ChangeAck) bool {
+		return ack.ID >= id
+	})
+}
+
+// WaitForRestart waits until every host running the app has handled the
+// restart with the given Seq.
+func WaitForRestart(configStore *config.Store, app, env string, seq int64, timeout time.Duration) error {
+	return waitForHosts(configStore, app, env, timeout, func(ack config.ChangeAck) bool {
+		return ack.Seq >= seq
+	})
+}
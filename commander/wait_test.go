@@ -0,0 +1,81 @@
+package commander
+
+import (
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/config"
+)
+
+func setupWait(t *testing.T, hosts ...string) *config.Store {
+	ackPollInterval = 10 * time.Millisecond
+
+	s, _ := NewTestStore()
+	if _, err := s.CreateApp("app", "dev"); err != nil {
+		t.Fatalf("CreateApp() = %v, want %v", err, nil)
+	}
+	if _, err := s.CreatePool("web", "dev"); err != nil {
+		t.Fatalf("CreatePool() = %v, want %v", err, nil)
+	}
+	if _, err := s.AssignApp("app", "dev", "web"); err != nil {
+		t.Fatalf("AssignApp() = %v, want %v", err, nil)
+	}
+
+	for _, host := range hosts {
+		s.UpdateHost("dev", "web", config.HostInfo{HostIP: host})
+	}
+	return s
+}
+
+func TestWaitForRestart(t *testing.T) {
+	s := setupWait(t, "10.0.0.1", "10.0.0.2")
+
+	seq, err := s.NotifyRestart("app", "dev")
+	if err != nil {
+		t.Fatalf("NotifyRestart() = %v, want %v", err, nil)
+	}
+
+	// an ack for an earlier change doesn't count
+	s.AckChange("dev", "web", &config.ChangeAck{HostIP: "10.0.0.2", App: "app", Seq: seq - 1})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.AckChange("dev", "web", &config.ChangeAck{HostIP: "10.0.0.1", App: "app", Seq: seq})
+		s.AckChange("dev", "web", &config.ChangeAck{HostIP: "10.0.0.2", App: "app", Seq: seq})
+	}()
+
+	if err := WaitForRestart(s, "app", "dev", seq, time.Second); err != nil {
+		t.Fatalf("WaitForRestart() = %v, want %v", err, nil)
+	}
+}
+
+func TestWaitForDeployFailures(t *testing.T) {
+	s := setupWait(t, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+	app, _ := s.GetApp("app", "dev")
+	app.SetVersion("app:2")
+	s.UpdateApp(app, "dev")
+	app, _ = s.GetApp("app", "dev")
+
+	s.AckChange("dev", "web", &config.ChangeAck{HostIP: "10.0.0.1", App: "app", ID: app.ID()})
+	s.AckChange("dev", "web", &config.ChangeAck{HostIP: "10.0.0.2", App: "app", ID: app.ID(), Error: "pull failed"})
+
+	// 10.0.0.3 never answers
+	answers, err := hostAcks(s, "app", "dev", func(ack config.ChangeAck) bool {
+		return ack.ID >= app.ID()
+	})
+	if len(answers) != 3 || err != nil {
+		t.Fatalf("hostAcks() = %v, %v, want 3 hosts", answers, err)
+	}
+	if answers[2].hostIP != "10.0.0.3" || answers[2].ack != nil {
+		t.Fatalf("hostAcks() = %v, want no answer from 10.0.0.3", answers[2])
+	}
+
+	start := time.Now()
+	if err := WaitForDeploy(s, "app", "dev", 100*time.Millisecond); err == nil {
+		t.Fatalf("WaitForDeploy() = %v, want an error", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("WaitForDeploy() returned before the timeout")
+	}
+}
@@ -0,0 +1,79 @@
+package commander
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+	"github.com/ryanuber/columnize"
+)
+
+func WebhookList(configStore *config.Store, env string) error {
+	hooks, err := configStore.ListWebhooks(env)
+	if err != nil {
+		return err
+	}
+
+	columns := []string{"URL | EVENTS | SIGNED"}
+	for _, hook := range hooks {
+		events := "all"
+		if len(hook.Events) > 0 {
+			events = strings.Join(hook.Events, ",")
+		}
+
+		signed := "no"
+		if hook.Secret != "" {
+			signed = "yes"
+		}
+
+		columns = append(columns, strings.Join([]string{hook.URL, events, signed}, " | "))
+	}
+
+	fmt.Println(columnize.SimpleFormat(columns))
+	return nil
+}
+
+// WebhookAdd adds a webhook to env for the given events, or for all of them
+// if there are none. A secret is generated if one isn't given, and printed so
+// the receiver can check the signatures.
+func WebhookAdd(configStore *config.Store, env, hookURL, secret string, events []string) error {
+	u, err := url.Parse(hookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", hookURL)
+	}
+
+	for _, event := range events {
+		if !utils.StringInSlice(event, config.WebhookEvents) {
+			return fmt.Errorf("unknown event %q: use %s", event, strings.Join(config.WebhookEvents, ", "))
+		}
+	}
+
+	if secret == "" {
+		secret, err = config.NewWebhookSecret()
+		if err != nil {
+			return err
+		}
+		log.Printf("Requests are signed with the secret %s\n", secret)
+	}
+
+	return configStore.AddWebhook(env, config.Webhook{
+		URL:    hookURL,
+		Secret: secret,
+		Events: events,
+	})
+}
+
+func WebhookRemove(configStore *config.Store, env, hookURL string) error {
+	removed, err := configStore.RemoveWebhook(env, hookURL)
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		return fmt.Errorf("no webhook for %s in %s", hookURL, env)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package commander
+
+import (
+	"testing"
+
+	"github.com/litl/galaxy/config"
+)
+
+func TestWebhookAdd(t *testing.T) {
+	s, _ := NewTestStore()
+
+	for _, tc := range []struct {
+		url    string
+		events []string
+	}{
+		{"chat.example.com/hook", nil},
+		{"ftp://chat.example.com/hook", nil},
+		{"https://chat.example.com/hook", []string{"deploy", "explode"}},
+	} {
+		if err := WebhookAdd(s, "dev", tc.url, "", tc.events); err == nil {
+			t.Fatalf("WebhookAdd(%q, %v) = %v, want an error", tc.url, tc.events, err)
+		}
+	}
+
+	if err := WebhookAdd(s, "dev", "https://chat.example.com/hook", "", []string{config.WebhookDeploy}); err != nil {
+		t.Fatalf("WebhookAdd() = %v, want %v", err, nil)
+	}
+
+	// adding the same URL again replaces it
+	if err := WebhookAdd(s, "dev", "https://chat.example.com/hook", "sekrit", nil); err != nil {
+		t.Fatalf("WebhookAdd() = %v, want %v", err, nil)
+	}
+
+	hooks, err := s.ListWebhooks("dev")
+	if err != nil || len(hooks) != 1 || hooks[0].Secret != "sekrit" || len(hooks[0].Events) != 0 {
+		t.Fatalf("ListWebhooks() = %v, %v, want one hook for every event", hooks, err)
+	}
+
+	if err := WebhookRemove(s, "dev", "https://chat.example.com/hook"); err != nil {
+		t.Fatalf("WebhookRemove() = %v, want %v", err, nil)
+	}
+	if err := WebhookRemove(s, "dev", "https://chat.example.com/hook"); err == nil {
+		t.Fatalf("WebhookRemove() = %v, want an error for a missing hook", err)
+	}
+}
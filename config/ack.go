@@ -0,0 +1,34 @@
+package config
+
+import (
+	"time"
+)
+
+// ChangeAck is recorded by an agent after it handles a change to an app, so
+// whoever made the change can tell when every host has converged. Only the
+// latest ack from each host is kept.
+type ChangeAck struct {
+	HostIP string `json:"host_ip"`
+	App    string `json:"app"`
+
+	// Seq of the last logged change handled, 0 if none has been
+	Seq int64 `json:"seq,omitempty"`
+
+	// ID of the app's config the host applied, or tried to
+	ID int64 `json:"id"`
+
+	// Error is set if the host couldn't apply the change
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// AckChange records that the host in ack handled a change to an app in
+// env/pool, replacing its previous ack.
+func (s *Store) AckChange(env, pool string, ack *ChangeAck) error {
+	return s.Backend.AckChange(env, pool, ack)
+}
+
+// ListAcks returns the latest ack from each host in env/pool for an app.
+func (s *Store) ListAcks(env, pool, app string) ([]ChangeAck, error) {
+	return s.Backend.ListAcks(env, pool, app)
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -30,6 +32,18 @@ type App interface {
 	GetCPUShares(pool string) string
 	SetMaintenanceMode(pool string, maint bool)
 	GetMaintenanceMode(pool string) bool
+	GetSchema() Schema
+	SetSchema(schema Schema)
+	GetEntryPoint() []string
+	SetEntryPoint(entryPoint []string)
+	GetCommand() []string
+	SetCommand(cmd []string)
+	GetHosts() []HostsEntry
+	SetHosts(hosts []HostsEntry)
+	GetDNS() []string
+	SetDNS(dns []string)
+	GetPortMappings() []PortMapping
+	SetPortMappings(mappings []PortMapping)
 }
 
 type AppConfig struct {
@@ -40,6 +54,10 @@ type AppConfig struct {
 	environmentVMap *utils.VersionedMap
 	portsVMap       *utils.VersionedMap
 	runtimeVMap     *utils.VersionedMap
+
+	// ID of the stored config when this was loaded, to detect conflicting
+	// updates. Zero if it was never stored.
+	configIndex int64
 }
 
 func NewAppConfig(app, version string) App {
@@ -124,8 +142,47 @@ func (s *AppConfig) ClearPorts() {
 	}
 }
 
-func (s *AppConfig) AddPort(port, portType string) {
-	s.portsVMap.Set(port, portType)
+// The port mappings are kept in the ports map, as the host port keyed by
+// container port and protocol, e.g. "8000/tcp" => "80".
+func (s *AppConfig) GetPortMappings() []PortMapping {
+	ports := s.Ports()
+	keys := []string{}
+	for k := range ports {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mappings := []PortMapping{}
+	for _, k := range keys {
+		parts := strings.SplitN(k, "/", 2)
+		mapping := PortMapping{
+			HostPort:      ports[k],
+			ContainerPort: parts[0],
+		}
+		if len(parts) == 2 {
+			mapping.Network = parts[1]
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+func (s *AppConfig) SetPortMappings(mappings []PortMapping) {
+	ports := map[string]string{}
+	for _, m := range mappings {
+		ports[m.ContainerPort+"/"+m.Protocol()] = m.HostPort
+	}
+
+	for _, k := range s.portsVMap.Keys() {
+		if _, ok := ports[k]; !ok && s.portsVMap.Get(k) != "" {
+			s.portsVMap.SetVersion(k, "", s.nextID())
+		}
+	}
+	for k, v := range ports {
+		if s.portsVMap.Get(k) != v {
+			s.portsVMap.SetVersion(k, v, s.nextID())
+		}
+	}
 }
 
 func (s *AppConfig) ID() int64 {
@@ -208,3 +265,70 @@ func (s *AppConfig) GetMaintenanceMode(pool string) bool {
 	maint, _ := strconv.ParseBool(s.runtimeVMap.Get(key))
 	return maint
 }
+
+// the schema is kept with the version, as JSON
+func (s *AppConfig) GetSchema() Schema {
+	schema, _ := ParseSchema([]byte(s.versionVMap.Get("schema")))
+	return schema
+}
+
+func (s *AppConfig) SetSchema(schema Schema) {
+	s.versionVMap.SetVersion("schema", schema.String(), s.nextID())
+}
+
+// The container settings are kept with the version too, as JSON lists. An
+// empty list is stored as "", so the image defaults are used.
+func (s *AppConfig) getJSON(key string, v interface{}) {
+	if js := s.versionVMap.Get(key); js != "" {
+		json.Unmarshal([]byte(js), v)
+	}
+}
+
+func (s *AppConfig) setJSON(key string, v interface{}, empty bool) {
+	js := ""
+	if !empty {
+		b, _ := json.Marshal(v)
+		js = string(b)
+	}
+	s.versionVMap.SetVersion(key, js, s.nextID())
+}
+
+func (s *AppConfig) GetEntryPoint() []string {
+	var entryPoint []string
+	s.getJSON("entrypoint", &entryPoint)
+	return entryPoint
+}
+
+func (s *AppConfig) SetEntryPoint(entryPoint []string) {
+	s.setJSON("entrypoint", entryPoint, len(entryPoint) == 0)
+}
+
+func (s *AppConfig) GetCommand() []string {
+	var cmd []string
+	s.getJSON("command", &cmd)
+	return cmd
+}
+
+func (s *AppConfig) SetCommand(cmd []string) {
+	s.setJSON("command", cmd, len(cmd) == 0)
+}
+
+func (s *AppConfig) GetHosts() []HostsEntry {
+	var hosts []HostsEntry
+	s.getJSON("hosts", &hosts)
+	return hosts
+}
+
+func (s *AppConfig) SetHosts(hosts []HostsEntry) {
+	s.setJSON("hosts", hosts, len(hosts) == 0)
+}
+
+func (s *AppConfig) GetDNS() []string {
+	var dns []string
+	s.getJSON("dns", &dns)
+	return dns
+}
+
+func (s *AppConfig) SetDNS(dns []string) {
+	s.setJSON("dns", dns, len(dns) == 0)
+}
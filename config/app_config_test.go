@@ -1,6 +1,7 @@
 package config
 
 import (
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -121,3 +122,59 @@ func TestIDAlwaysIncrements(t *testing.T) {
 	}
 	id = sc.ID()
 }
+
+func TestContainerSettings(t *testing.T) {
+	sc := NewAppConfig("foo", "")
+
+	if sc.GetEntryPoint() != nil || sc.GetCommand() != nil || sc.GetHosts() != nil || sc.GetDNS() != nil {
+		t.Fatalf("Expected no container settings by default")
+	}
+
+	id := sc.ID()
+	sc.SetEntryPoint([]string{"/bin/app"})
+	sc.SetCommand([]string{"serve", "--port", "8000"})
+	sc.SetHosts([]HostsEntry{{Address: "10.0.0.2", Host: "db"}})
+	sc.SetDNS([]string{"10.0.0.53"})
+	if sc.ID() <= id {
+		t.Fatalf("Expected version to increment")
+	}
+
+	if cmd := sc.GetCommand(); !reflect.DeepEqual(cmd, []string{"serve", "--port", "8000"}) {
+		t.Fatalf("GetCommand() = %v, want %v", cmd, []string{"serve", "--port", "8000"})
+	}
+
+	if hosts := sc.GetHosts(); len(hosts) != 1 || hosts[0].Host != "db" || hosts[0].Address != "10.0.0.2" {
+		t.Fatalf("GetHosts() = %v, want db at 10.0.0.2", hosts)
+	}
+
+	sc.SetEntryPoint(nil)
+	if ep := sc.GetEntryPoint(); ep != nil {
+		t.Fatalf("GetEntryPoint() = %v, want %v", ep, nil)
+	}
+}
+
+func TestPortMappings(t *testing.T) {
+	sc := NewAppConfig("foo", "")
+
+	id := sc.ID()
+	sc.SetPortMappings([]PortMapping{
+		{HostPort: "80", ContainerPort: "8000"},
+		{HostPort: "8125", ContainerPort: "8125", Network: "udp"},
+	})
+	if sc.ID() <= id {
+		t.Fatalf("Expected version to increment")
+	}
+
+	want := []PortMapping{
+		{HostPort: "80", ContainerPort: "8000", Network: "tcp"},
+		{HostPort: "8125", ContainerPort: "8125", Network: "udp"},
+	}
+	if got := sc.GetPortMappings(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetPortMappings() = %v, want %v", got, want)
+	}
+
+	sc.SetPortMappings(want[1:])
+	if got := sc.GetPortMappings(); !reflect.DeepEqual(got, want[1:]) {
+		t.Fatalf("GetPortMappings() = %v, want %v", got, want[1:])
+	}
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/log"
+)
+
+// AuditEntry records a change made through the Store. Entries are only ever
+// added to an env's audit log, never changed or removed.
+type AuditEntry struct {
+	Time time.Time
+
+	// who made the change, and from where
+	User string
+	Host string
+
+	// Action is what was done, such as "app:deploy" or "pool:create"
+	Action string
+	Env    string
+	App    string
+	Pool   string
+
+	// Changes lists the fields that changed, by name
+	Changes []AuditChange
+}
+
+// AuditChange is a field's value before and after a change. Secret values
+// are masked, and a value that was or became unset is empty.
+type AuditChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+func (c AuditChange) String() string {
+	return fmt.Sprintf("%s: %q -> %q", c.Field, c.Before, c.After)
+}
+
+// auditKey formats an entry's time so the keys sort in time order
+func auditKey(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+// auditIdentity returns the user making changes from this process, and the
+// host. Tests replace it.
+var auditIdentity = func() (string, string) {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	host, _ := os.Hostname()
+	return name, host
+}
+
+// appFields flattens the parts of an app's config worth auditing into named
+// values, so two configs can be compared field by field.
+func appFields(app App) map[string]string {
+	fields := map[string]string{}
+	if app == nil {
+		return fields
+	}
+
+	fields["version"] = app.Version()
+	fields["version_id"] = app.VersionID()
+	fields["entrypoint"] = strings.Join(app.GetEntryPoint(), " ")
+	fields["command"] = strings.Join(app.GetCommand(), " ")
+	fields["dns"] = strings.Join(app.GetDNS(), ",")
+
+	for k, v := range app.Env() {
+		fields["env."+k] = v
+	}
+
+	hosts := []string{}
+	for _, h := range app.GetHosts() {
+		hosts = append(hosts, h.Host+":"+h.Address)
+	}
+	fields["hosts"] = strings.Join(hosts, ",")
+
+	ports := []string{}
+	for _, m := range app.GetPortMappings() {
+		ports = append(ports, m.String())
+	}
+	fields["ports"] = strings.Join(ports, ",")
+
+	if schema := app.GetSchema(); len(schema) > 0 {
+		js, _ := json.Marshal(schema)
+		fields["schema"] = string(js)
+	}
+
+	for _, pool := range app.RuntimePools() {
+		fields["processes."+pool] = strconv.Itoa(app.GetProcesses(pool))
+		fields["memory."+pool] = app.GetMemory(pool)
+		fields["cpu."+pool] = app.GetCPUShares(pool)
+		if app.GetMaintenanceMode(pool) {
+			fields["maintenance."+pool] = "true"
+		}
+	}
+	return fields
+}
+
+// diffFields lists the fields whose values differ, sorted by name
+func diffFields(before, after map[string]string) []AuditChange {
+	names := []string{}
+	for name, v := range before {
+		if after[name] != v {
+			names = append(names, name)
+		}
+	}
+	for name, v := range after {
+		if _, ok := before[name]; !ok && v != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []AuditChange{}
+	for _, name := range names {
+		change := AuditChange{Field: name, Before: before[name], After: after[name]}
+		if IsSecret(change.Before) {
+			change.Before = Masked
+		}
+		if IsSecret(change.After) {
+			change.After = Masked
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// audit adds an entry for a change to the env's audit log. The change has
+// already been made by then, so failing to record it is only logged.
+func (s *Store) audit(action, env, app, pool string, changes []AuditChange) {
+	entry := &AuditEntry{
+		Time:    time.Now().UTC(),
+		Action:  action,
+		Env:     env,
+		App:     app,
+		Pool:    pool,
+		Changes: changes,
+	}
+	entry.User, entry.Host = auditIdentity()
+	if err := s.Backend.AddAuditEntry(env, entry); err != nil {
+		log.Warnf("WARN: Unable to record %s in the audit log for %s: %s", action, env, err)
+	}
+}
+
+// ListAudit returns the audit log for env, oldest first. Only the entries
+// for app are returned, unless it's empty, and only those from since up to
+// until, unless they're zero.
+func (s *Store) ListAudit(env, app string, since, until time.Time) ([]AuditEntry, error) {
+	if since.IsZero() {
+		since = time.Unix(0, 0)
+	}
+	if until.IsZero() {
+		until = time.Unix(0, math.MaxInt64)
+	}
+
+	entries, err := s.Backend.ListAuditEntries(env, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	if app == "" {
+		return entries, nil
+	}
+
+	matched := []AuditEntry{}
+	for _, entry := range entries {
+		if entry.App == app {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStoreAudit(t *testing.T) {
+	defer func(identity func() (string, string)) {
+		auditIdentity = identity
+	}(auditIdentity)
+	auditIdentity = func() (string, string) {
+		return "alice", "laptop"
+	}
+
+	s, _ := NewTestStore()
+	assertPoolCreated(t, s, "web")
+	assertAppCreated(t, s, "app")
+	assertAppCreated(t, s, "other")
+
+	app, _ := s.GetApp("app", "dev")
+	app.EnvSet("LOG_LEVEL", "debug")
+	app.SetProcesses("web", 2)
+	s.UpdateApp(app, "dev")
+
+	app, _ = s.GetApp("app", "dev")
+	app.SetProcesses("web", 0)
+	s.UpdateApp(app, "dev")
+
+	s.AssignApp("app", "dev", "web")
+	s.UpdateSharedConfig("dev", "", map[string]string{"STATSD_HOST": "statsd"})
+
+	// the agents' heartbeat doesn't fill the log
+	s.CreatePool("web", "dev")
+
+	entries, err := s.ListAudit("dev", "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("ListAudit() = %v, want %v", err, nil)
+	}
+
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+		if entry.User != "alice" || entry.Host != "laptop" || entry.Env != "dev" || entry.Time.IsZero() {
+			t.Fatalf("ListAudit() = %+v, want alice@laptop in dev", entry)
+		}
+	}
+	want := []string{"pool:create", "app:create", "app:create", "app:config", "app:runtime", "app:assign", "config:shared"}
+	if !reflect.DeepEqual(actions, want) {
+		t.Fatalf("ListAudit() = %v, want %v", actions, want)
+	}
+
+	wantChanges := []AuditChange{
+		{Field: "env.LOG_LEVEL", After: "debug"},
+		{Field: "processes.web", After: "2"},
+	}
+	if changes := entries[3].Changes; !reflect.DeepEqual(changes, wantChanges) {
+		t.Fatalf("ListAudit() changes = %v, want %v", changes, wantChanges)
+	}
+
+	// scaled to zero
+	wantChanges = []AuditChange{{Field: "processes.web", Before: "2", After: "0"}}
+	if changes := entries[4].Changes; !reflect.DeepEqual(changes, wantChanges) {
+		t.Fatalf("ListAudit() changes = %v, want %v", changes, wantChanges)
+	}
+
+	entries, err = s.ListAudit("dev", "other", time.Time{}, time.Time{})
+	if len(entries) != 1 || err != nil || entries[0].Action != "app:create" {
+		t.Fatalf("ListAudit(%q) = %v, %v, want its creation", "other", entries, err)
+	}
+
+	entries, err = s.ListAudit("dev", "", time.Now().Add(time.Hour), time.Time{})
+	if len(entries) != 0 || err != nil {
+		t.Fatalf("ListAudit(since an hour from now) = %v, %v, want none", entries, err)
+	}
+}
+
+// a backend that can't write to the audit log
+type noAuditBackend struct {
+	*MemoryBackend
+}
+
+func (b noAuditBackend) AddAuditEntry(env string, entry *AuditEntry) error {
+	return errors.New("audit log unavailable")
+}
+
+func TestStoreAuditFailure(t *testing.T) {
+	s, b := NewTestStore()
+	s.Backend = noAuditBackend{b}
+	assertPoolCreated(t, s, "web")
+	assertAppCreated(t, s, "app")
+
+	// the changes are made and notified all the same
+	app, _ := s.GetApp("app", "dev")
+	app.EnvSet("LOG_LEVEL", "debug")
+	if updated, err := s.UpdateApp(app, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+	if assigned, err := s.AssignApp("app", "dev", "web"); !assigned || err != nil {
+		t.Fatalf("AssignApp() = %t, %v, want %t, %v", assigned, err, true, nil)
+	}
+	if unassigned, err := s.UnassignApp("app", "dev", "web"); !unassigned || err != nil {
+		t.Fatalf("UnassignApp() = %t, %v, want %t, %v", unassigned, err, true, nil)
+	}
+	if deleted, err := s.DeleteApp("app", "dev"); !deleted || err != nil {
+		t.Fatalf("DeleteApp() = %t, %v, want %t, %v", deleted, err, true, nil)
+	}
+
+	changes, err := b.ListChanges("dev", 0)
+	if err != nil {
+		t.Fatalf("ListChanges() = %v, want %v", err, nil)
+	}
+	kinds := []ChangeKind{}
+	for _, change := range changes {
+		kinds = append(kinds, change.Kind)
+	}
+	want := []ChangeKind{ChangeConfig, ChangeAssign, ChangeAssign, ChangeDelete}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("ListChanges() = %v, want %v", kinds, want)
+	}
+}
+
+func TestDiffFieldsMasksSecrets(t *testing.T) {
+	secret := secretPrefix + "c2VjcmV0"
+	changes := diffFields(map[string]string{"env.DB": "plain", "env.SAME": "x"},
+		map[string]string{"env.DB": secret, "env.SAME": "x"})
+	want := []AuditChange{{Field: "env.DB", Before: "plain", After: Masked}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("diffFields() = %v, want %v", changes, want)
+	}
+}
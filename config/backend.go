@@ -1,14 +1,40 @@
 package config
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StaleConfig is returned by UpdateApp when the app was changed by someone
+// else since it was loaded.
+var StaleConfig = fmt.Errorf("app config changed since it was loaded")
+
 type Backend interface {
 	// Apps
 	AppExists(app, env string) (bool, error)
 	CreateApp(app, env string) (bool, error)
 	ListApps(env string) ([]App, error)
 	GetApp(app, env string) (App, error)
+	// UpdateApp stores the app, unless it was changed after svcCfg was
+	// loaded, in which case it returns StaleConfig.
 	UpdateApp(svcCfg App, env string) (bool, error)
 	DeleteApp(svcCfg App, env string) (bool, error)
 
+	// Releases
+	// AddRelease stores a release with the next ID for the app, and sets
+	// release.ID. Only the newest MaxReleases are kept.
+	AddRelease(app, env string, release *Release) error
+	// ListReleases returns an app's releases, oldest first
+	ListReleases(app, env string) ([]Release, error)
+
+	// Shared config
+	// GetSharedConfig returns the config shared by every app in an env, or
+	// by the apps in a pool if pool isn't empty.
+	GetSharedConfig(env, pool string) (map[string]string, error)
+	// UpdateSharedConfig sets shared config values, removing any set to ""
+	UpdateSharedConfig(env, pool string, values map[string]string) error
+
 	// Pools
 	AssignApp(app, env, pool string) (bool, error)
 	UnassignApp(app, env, pool string) (bool, error)
@@ -25,8 +51,34 @@ type Backend interface {
 	ListHosts(env, pool string) ([]HostInfo, error)
 	DeleteHost(env, pool string, host HostInfo) error
 
+	// Change log
+	// AddChange appends a change to the env's log, and sets its Seq
+	AddChange(env string, event *ChangeEvent) error
+	// ListChanges returns the env's logged changes after seq, oldest first
+	ListChanges(env string, after int64) ([]ChangeEvent, error)
+
+	// Acks
+	// AckChange stores the latest ack from a host in env/pool for an app
+	AckChange(env, pool string, ack *ChangeAck) error
+	// ListAcks returns the latest ack from each host in env/pool for an app
+	ListAcks(env, pool, app string) ([]ChangeAck, error)
+
+	// Audit log
+	// AddAuditEntry appends an entry to the env's audit log
+	AddAuditEntry(env string, entry *AuditEntry) error
+	// ListAuditEntries returns the env's audit entries from since up to
+	// until, oldest first
+	ListAuditEntries(env string, since, until time.Time) ([]AuditEntry, error)
+
+	// Webhooks
+	GetWebhooks(env string) ([]Webhook, error)
+	// SetWebhooks replaces the env's webhooks
+	SetWebhooks(env string, hooks []Webhook) error
+
 	//Pub/Sub
-	Subscribe(key string) chan string
+	// Subscribe delivers notifications for key until ctx is cancelled, and
+	// then closes the channel.
+	Subscribe(ctx context.Context, key string) chan string
 	Notify(key, value string) (int, error)
 
 	// Registration
@@ -0,0 +1,670 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/utils"
+)
+
+// testClock replaces time.Now in backends that check expiration themselves
+type testClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Now()}
+}
+
+func (c *testClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *testClock) add(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// backendFactory returns a new empty Backend, and a function to clean it up.
+// The clock is nil if the backend's TTLs can't be controlled by the test.
+type backendFactory func(t *testing.T) (b Backend, clock *testClock, cleanup func())
+
+// every backend must pass the same suite
+var backendTests = []struct {
+	name string
+	test func(t *testing.T, b Backend, clock *testClock, env string)
+}{
+	{"AppCRUD", testBackendAppCRUD},
+	{"StaleUpdate", testBackendStaleUpdate},
+	{"Releases", testBackendReleases},
+	{"ChangeLog", testBackendChangeLog},
+	{"Acks", testBackendAcks},
+	{"Audit", testBackendAudit},
+	{"Webhooks", testBackendWebhooks},
+	{"SharedConfig", testBackendSharedConfig},
+	{"AssignIdempotent", testBackendAssignIdempotent},
+	{"ListPools", testBackendListPools},
+	{"HostTTL", testBackendHostTTL},
+	{"Registrations", testBackendRegistrations},
+	{"NotifySubscribe", testBackendNotifySubscribe},
+}
+
+func runBackendSuite(t *testing.T, factory backendFactory) {
+	for _, bt := range backendTests {
+		b, clock, cleanup := factory(t)
+
+		// use a new env for every test, since some backends can't be emptied
+		env := fmt.Sprintf("test%d", time.Now().UnixNano())
+
+		t.Logf("running %s", bt.name)
+		bt.test(t, b, clock, env)
+		cleanup()
+	}
+}
+
+// deleteApp creates and deletes an app, which must only remove the app
+func deleteApp(t *testing.T, b Backend, env, name string) {
+	b.CreateApp(name, env)
+	app, err := b.GetApp(name, env)
+	if err != nil {
+		t.Fatalf("GetApp(%q) = %v, want %v", name, err, nil)
+	}
+	if deleted, err := b.DeleteApp(app, env); !deleted || err != nil {
+		t.Fatalf("DeleteApp(%q) = %t, %v, want %t, %v", name, deleted, err, true, nil)
+	}
+}
+
+func testBackendAppCRUD(t *testing.T, b Backend, clock *testClock, env string) {
+	if exists, err := b.AppExists("app", env); exists || err != nil {
+		t.Fatalf("AppExists(%q) = %t, %v, want %t, %v", "app", exists, err, false, nil)
+	}
+
+	if _, err := b.GetApp("app", env); err != UnknownApp {
+		t.Fatalf("GetApp(%q) = %v, want %v", "app", err, UnknownApp)
+	}
+
+	if created, err := b.CreateApp("app", env); !created || err != nil {
+		t.Fatalf("CreateApp(%q) = %t, %v, want %t, %v", "app", created, err, true, nil)
+	}
+
+	if exists, err := b.AppExists("app", env); !exists || err != nil {
+		t.Fatalf("AppExists(%q) = %t, %v, want %t, %v", "app", exists, err, true, nil)
+	}
+
+	app, err := b.GetApp("app", env)
+	if err != nil || app.Name() != "app" {
+		t.Fatalf("GetApp(%q) = %v, %v, want %q, %v", "app", app, err, "app", nil)
+	}
+
+	app.EnvSet("FOO", "bar")
+	app.SetVersion("registry/app:1")
+
+	if updated, err := b.UpdateApp(app, env); !updated || err != nil {
+		t.Fatalf("UpdateApp(%q) = %t, %v, want %t, %v", "app", updated, err, true, nil)
+	}
+
+	app, err = b.GetApp("app", env)
+	if err != nil {
+		t.Fatalf("GetApp(%q) = %v, want %v", "app", err, nil)
+	}
+
+	if app.EnvGet("FOO") != "bar" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "FOO", app.EnvGet("FOO"), "bar")
+	}
+
+	if app.Version() != "registry/app:1" {
+		t.Fatalf("Version() = %q, want %q", app.Version(), "registry/app:1")
+	}
+
+	b.CreateApp("other", env)
+	apps, err := b.ListApps(env)
+	if len(apps) != 2 || err != nil {
+		t.Fatalf("ListApps() = %d, %v, want %d, %v", len(apps), err, 2, nil)
+	}
+
+	if deleted, err := b.DeleteApp(app, env); !deleted || err != nil {
+		t.Fatalf("DeleteApp(%q) = %t, %v, want %t, %v", "app", deleted, err, true, nil)
+	}
+
+	if exists, err := b.AppExists("app", env); exists || err != nil {
+		t.Fatalf("AppExists(%q) = %t, %v, want %t, %v", "app", exists, err, false, nil)
+	}
+
+	if _, err := b.GetApp("app", env); err != UnknownApp {
+		t.Fatalf("GetApp(%q) = %v, want %v", "app", err, UnknownApp)
+	}
+}
+
+func testBackendStaleUpdate(t *testing.T, b Backend, clock *testClock, env string) {
+	b.CreateApp("app", env)
+
+	first, _ := b.GetApp("app", env)
+	second, _ := b.GetApp("app", env)
+
+	first.EnvSet("FOO", "first")
+	if updated, err := b.UpdateApp(first, env); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	second.EnvSet("FOO", "second")
+	if updated, err := b.UpdateApp(second, env); updated || err != StaleConfig {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, false, StaleConfig)
+	}
+
+	app, _ := b.GetApp("app", env)
+	if app.EnvGet("FOO") != "first" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "FOO", app.EnvGet("FOO"), "first")
+	}
+
+	// retrying against the fresh config succeeds
+	app.EnvSet("FOO", "second")
+	if updated, err := b.UpdateApp(app, env); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+}
+
+func testBackendReleases(t *testing.T, b Backend, clock *testClock, env string) {
+	b.CreateApp("app", env)
+
+	for i := 1; i <= MaxReleases+2; i++ {
+		release := &Release{
+			Version: fmt.Sprintf("app:v%d", i),
+			Env:     map[string]string{"FOO": "bar"},
+		}
+		if err := b.AddRelease("app", env, release); err != nil || release.ID != int64(i) {
+			t.Fatalf("AddRelease() = %d, %v, want %d, %v", release.ID, err, i, nil)
+		}
+	}
+
+	// only the newest are kept, oldest first
+	releases, err := b.ListReleases("app", env)
+	if len(releases) != MaxReleases || err != nil {
+		t.Fatalf("ListReleases() = %d, %v, want %d, %v", len(releases), err, MaxReleases, nil)
+	}
+
+	last := releases[len(releases)-1]
+	if releases[0].ID != 3 || last.ID != MaxReleases+2 || last.Version != fmt.Sprintf("app:v%d", MaxReleases+2) {
+		t.Fatalf("ListReleases() = %d..%d, want %d..%d", releases[0].ID, last.ID, 3, MaxReleases+2)
+	}
+
+	if last.Env["FOO"] != "bar" {
+		t.Fatalf("Release.Env = %v, want FOO=bar", last.Env)
+	}
+
+	// releases go with the app
+	app, _ := b.GetApp("app", env)
+	b.DeleteApp(app, env)
+	releases, err = b.ListReleases("app", env)
+	if len(releases) != 0 || err != nil {
+		t.Fatalf("ListReleases() = %v, %v, want none", releases, err)
+	}
+}
+
+func testBackendChangeLog(t *testing.T, b Backend, clock *testClock, env string) {
+	if changes, err := b.ListChanges(env, 0); len(changes) != 0 || err != nil {
+		t.Fatalf("ListChanges() = %v, %v, want none", changes, err)
+	}
+
+	for i := 1; i <= MaxChanges+2; i++ {
+		event := &ChangeEvent{Kind: ChangeRestart, App: "app", Env: env}
+		if err := b.AddChange(env, event); err != nil || event.Seq != int64(i) {
+			t.Fatalf("AddChange() = %d, %v, want %d, %v", event.Seq, err, i, nil)
+		}
+	}
+
+	// only the newest are kept, oldest first
+	changes, err := b.ListChanges(env, 0)
+	if len(changes) != MaxChanges || err != nil {
+		t.Fatalf("ListChanges() = %d, %v, want %d, %v", len(changes), err, MaxChanges, nil)
+	}
+
+	last := changes[len(changes)-1]
+	if changes[0].Seq != 3 || last.Seq != MaxChanges+2 || last.Kind != ChangeRestart || last.App != "app" {
+		t.Fatalf("ListChanges() = %d..%d, want %d..%d", changes[0].Seq, last.Seq, 3, MaxChanges+2)
+	}
+
+	changes, err = b.ListChanges(env, MaxChanges)
+	if len(changes) != 2 || err != nil || changes[0].Seq != MaxChanges+1 {
+		t.Fatalf("ListChanges(%d) = %v, %v, want the last 2", MaxChanges, changes, err)
+	}
+
+	// neither the log nor its sequence is removed with an app of the same name
+	deleteApp(t, b, env, "changes")
+	deleteApp(t, b, env, "change_id")
+	event := &ChangeEvent{Kind: ChangeRestart, App: "app", Env: env}
+	if err := b.AddChange(env, event); err != nil || event.Seq != MaxChanges+3 {
+		t.Fatalf("AddChange() = %d, %v, want %d, %v", event.Seq, err, MaxChanges+3, nil)
+	}
+	if changes, err := b.ListChanges(env, 0); len(changes) != MaxChanges || err != nil {
+		t.Fatalf("ListChanges() = %d, %v, want %d, %v", len(changes), err, MaxChanges, nil)
+	}
+}
+
+func testBackendAcks(t *testing.T, b Backend, clock *testClock, env string) {
+	if acks, err := b.ListAcks(env, "web", "app"); len(acks) != 0 || err != nil {
+		t.Fatalf("ListAcks() = %v, %v, want none", acks, err)
+	}
+
+	for _, ack := range []*ChangeAck{
+		{HostIP: "10.0.0.1", App: "app", Seq: 1, ID: 5},
+		{HostIP: "10.0.0.2", App: "app", Seq: 1, ID: 5, Error: "pull failed"},
+		{HostIP: "10.0.0.1", App: "app", Seq: 2, ID: 6},
+		{HostIP: "10.0.0.1", App: "other", Seq: 3, ID: 7},
+	} {
+		if err := b.AckChange(env, "web", ack); err != nil {
+			t.Fatalf("AckChange(%v) = %v, want %v", ack, err, nil)
+		}
+	}
+
+	// only the latest from each host
+	acks, err := b.ListAcks(env, "web", "app")
+	if len(acks) != 2 || err != nil {
+		t.Fatalf("ListAcks() = %v, %v, want 2 acks", acks, err)
+	}
+
+	byHost := map[string]ChangeAck{}
+	for _, ack := range acks {
+		byHost[ack.HostIP] = ack
+	}
+	if ack := byHost["10.0.0.1"]; ack.Seq != 2 || ack.ID != 6 || ack.Error != "" {
+		t.Fatalf("ListAcks() = %v, want seq 2 from 10.0.0.1", ack)
+	}
+	if ack := byHost["10.0.0.2"]; ack.Seq != 1 || ack.Error != "pull failed" {
+		t.Fatalf("ListAcks() = %v, want the error from 10.0.0.2", ack)
+	}
+
+	if acks, err := b.ListAcks(env, "worker", "app"); len(acks) != 0 || err != nil {
+		t.Fatalf("ListAcks(%q) = %v, %v, want none", "worker", acks, err)
+	}
+}
+
+func testBackendAudit(t *testing.T, b Backend, clock *testClock, env string) {
+	start := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, action := range []string{"app:create", "app:deploy", "app:deploy", "app:delete"} {
+		// the two deploys happen at the same time
+		at := start.Add(time.Duration(i) * time.Minute)
+		if i == 2 {
+			at = start.Add(time.Minute)
+		}
+
+		entry := &AuditEntry{Time: at, User: "alice", Action: action, Env: env, App: "app"}
+		if err := b.AddAuditEntry(env, entry); err != nil {
+			t.Fatalf("AddAuditEntry(%s) = %v, want %v", action, err, nil)
+		}
+	}
+
+	entries, err := b.ListAuditEntries(env, start, start.Add(time.Hour))
+	if len(entries) != 4 || err != nil {
+		t.Fatalf("ListAuditEntries() = %v, %v, want 4 entries", entries, err)
+	}
+	if entries[0].Action != "app:create" || entries[3].Action != "app:delete" || entries[0].User != "alice" {
+		t.Fatalf("ListAuditEntries() = %v, want oldest first", entries)
+	}
+
+	// from the first deploy, up to the delete
+	entries, err = b.ListAuditEntries(env, start.Add(time.Minute), start.Add(3*time.Minute))
+	if len(entries) != 2 || err != nil || entries[0].Action != "app:deploy" || entries[1].Action != "app:deploy" {
+		t.Fatalf("ListAuditEntries() = %v, %v, want the 2 deploys", entries, err)
+	}
+
+	// it isn't removed with an app of the same name
+	deleteApp(t, b, env, "audit")
+	if entries, err := b.ListAuditEntries(env, start, start.Add(time.Hour)); len(entries) != 4 || err != nil {
+		t.Fatalf("ListAuditEntries() = %v, %v, want 4 entries", entries, err)
+	}
+}
+
+func testBackendWebhooks(t *testing.T, b Backend, clock *testClock, env string) {
+	if hooks, err := b.GetWebhooks(env); len(hooks) != 0 || err != nil {
+		t.Fatalf("GetWebhooks() = %v, %v, want none", hooks, err)
+	}
+
+	want := []Webhook{
+		{URL: "https://chat.example.com/hook", Secret: "sekrit", Events: []string{WebhookDeploy}},
+		{URL: "https://incidents.example.com/galaxy"},
+	}
+	if err := b.SetWebhooks(env, want); err != nil {
+		t.Fatalf("SetWebhooks() = %v, want %v", err, nil)
+	}
+
+	hooks, err := b.GetWebhooks(env)
+	if err != nil || len(hooks) != 2 || hooks[0].URL != want[0].URL || hooks[0].Secret != "sekrit" ||
+		len(hooks[0].Events) != 1 || hooks[1].URL != want[1].URL || len(hooks[1].Events) != 0 {
+		t.Fatalf("GetWebhooks() = %v, %v, want %v", hooks, err, want)
+	}
+
+	if err := b.SetWebhooks(env, want[1:]); err != nil {
+		t.Fatalf("SetWebhooks() = %v, want %v", err, nil)
+	}
+	if hooks, err := b.GetWebhooks(env); len(hooks) != 1 || err != nil || hooks[0].URL != want[1].URL {
+		t.Fatalf("GetWebhooks() = %v, %v, want %v", hooks, err, want[1:])
+	}
+
+	// they aren't removed with an app of the same name
+	deleteApp(t, b, env, "webhooks")
+	if hooks, err := b.GetWebhooks(env); len(hooks) != 1 || err != nil {
+		t.Fatalf("GetWebhooks() = %v, %v, want %v", hooks, err, want[1:])
+	}
+}
+
+func testBackendSharedConfig(t *testing.T, b Backend, clock *testClock, env string) {
+	if shared, err := b.GetSharedConfig(env, ""); len(shared) != 0 || err != nil {
+		t.Fatalf("GetSharedConfig(%q) = %v, %v, want empty", "", shared, err)
+	}
+
+	if err := b.UpdateSharedConfig(env, "", map[string]string{"STATSD_HOST": "statsd", "SENTRY_DSN": "dsn"}); err != nil {
+		t.Fatalf("UpdateSharedConfig(%q) = %v, want %v", "", err, nil)
+	}
+
+	if err := b.UpdateSharedConfig(env, "web", map[string]string{"STATSD_HOST": "web-statsd"}); err != nil {
+		t.Fatalf("UpdateSharedConfig(%q) = %v, want %v", "web", err, nil)
+	}
+
+	// unset one, and leave the other alone
+	if err := b.UpdateSharedConfig(env, "", map[string]string{"SENTRY_DSN": ""}); err != nil {
+		t.Fatalf("UpdateSharedConfig(%q) = %v, want %v", "", err, nil)
+	}
+
+	shared, err := b.GetSharedConfig(env, "")
+	if len(shared) != 1 || shared["STATSD_HOST"] != "statsd" || err != nil {
+		t.Fatalf("GetSharedConfig(%q) = %v, %v, want STATSD_HOST=statsd", "", shared, err)
+	}
+
+	shared, err = b.GetSharedConfig(env, "web")
+	if len(shared) != 1 || shared["STATSD_HOST"] != "web-statsd" || err != nil {
+		t.Fatalf("GetSharedConfig(%q) = %v, %v, want STATSD_HOST=web-statsd", "web", shared, err)
+	}
+
+	// it isn't removed with an app of the same name
+	deleteApp(t, b, env, "shared")
+	if shared, err := b.GetSharedConfig(env, ""); len(shared) != 1 || err != nil {
+		t.Fatalf("GetSharedConfig(%q) = %v, %v, want STATSD_HOST=statsd", "", shared, err)
+	}
+}
+
+func testBackendAssignIdempotent(t *testing.T, b Backend, clock *testClock, env string) {
+	b.CreateApp("app", env)
+
+	if assigned, err := b.AssignApp("app", env, "web"); !assigned || err != nil {
+		t.Fatalf("AssignApp(%q) = %t, %v, want %t, %v", "app", assigned, err, true, nil)
+	}
+
+	if assigned, err := b.AssignApp("app", env, "web"); assigned || err != nil {
+		t.Fatalf("AssignApp(%q) again = %t, %v, want %t, %v", "app", assigned, err, false, nil)
+	}
+
+	apps, err := b.ListAssignments(env, "web")
+	if len(apps) != 1 || apps[0] != "app" || err != nil {
+		t.Fatalf("ListAssignments(%q) = %v, %v, want %v, %v", "web", apps, err, []string{"app"}, nil)
+	}
+
+	if removed, err := b.UnassignApp("app", env, "web"); !removed || err != nil {
+		t.Fatalf("UnassignApp(%q) = %t, %v, want %t, %v", "app", removed, err, true, nil)
+	}
+
+	if removed, err := b.UnassignApp("app", env, "web"); removed || err != nil {
+		t.Fatalf("UnassignApp(%q) again = %t, %v, want %t, %v", "app", removed, err, false, nil)
+	}
+
+	if removed, err := b.UnassignApp("missing", env, "web"); removed || err != nil {
+		t.Fatalf("UnassignApp(%q) = %t, %v, want %t, %v", "missing", removed, err, false, nil)
+	}
+
+	apps, err = b.ListAssignments(env, "web")
+	if len(apps) != 0 || err != nil {
+		t.Fatalf("ListAssignments(%q) = %v, %v, want none", "web", apps, err)
+	}
+}
+
+func testBackendListPools(t *testing.T, b Backend, clock *testClock, env string) {
+	for _, pool := range []string{"web", "batch"} {
+		if created, err := b.CreatePool(env, pool); !created || err != nil {
+			t.Fatalf("CreatePool(%q) = %t, %v, want %t, %v", pool, created, err, true, nil)
+		}
+	}
+
+	if created, err := b.CreatePool(env, "web"); created || err != nil {
+		t.Fatalf("CreatePool(%q) again = %t, %v, want %t, %v", "web", created, err, false, nil)
+	}
+
+	// pools in other envs aren't listed
+	otherEnv := env + "other"
+	b.CreatePool(otherEnv, "worker")
+	defer b.DeletePool(otherEnv, "worker")
+
+	pools, err := b.ListPools(env)
+	sort.Strings(pools)
+	if len(pools) != 2 || pools[0] != "batch" || pools[1] != "web" || err != nil {
+		t.Fatalf("ListPools() = %v, %v, want %v, %v", pools, err, []string{"batch", "web"}, nil)
+	}
+
+	envs, err := b.ListEnvs()
+	if !utils.StringInSlice(env, envs) || err != nil {
+		t.Fatalf("ListEnvs() = %v, %v, want %q listed", envs, err, env)
+	}
+
+	b.DeletePool(env, "batch")
+	pools, err = b.ListPools(env)
+	if len(pools) != 1 || pools[0] != "web" || err != nil {
+		t.Fatalf("ListPools() = %v, %v, want %v, %v", pools, err, []string{"web"}, nil)
+	}
+	b.DeletePool(env, "web")
+}
+
+func testBackendHostTTL(t *testing.T, b Backend, clock *testClock, env string) {
+	host := HostInfo{HostIP: "10.0.0.1"}
+	if err := b.UpdateHost(env, "web", host); err != nil {
+		t.Fatalf("UpdateHost() = %v, want %v", err, nil)
+	}
+
+	hosts, err := b.ListHosts(env, "web")
+	if len(hosts) != 1 || hosts[0].HostIP != host.HostIP || err != nil {
+		t.Fatalf("ListHosts() = %v, %v, want %v, %v", hosts, err, []HostInfo{host}, nil)
+	}
+
+	hosts, err = b.ListHosts(env, "batch")
+	if len(hosts) != 0 || err != nil {
+		t.Fatalf("ListHosts(%q) = %v, %v, want none", "batch", hosts, err)
+	}
+
+	if clock != nil {
+		// a heartbeat within the TTL keeps the host alive
+		clock.add(time.Duration(DefaultTTL/2) * time.Second)
+		b.UpdateHost(env, "web", host)
+		clock.add(time.Duration(DefaultTTL/2+1) * time.Second)
+
+		hosts, _ = b.ListHosts(env, "web")
+		if len(hosts) != 1 {
+			t.Fatalf("ListHosts() = %d after heartbeat, want %d", len(hosts), 1)
+		}
+
+		clock.add(time.Duration(DefaultTTL) * time.Second)
+		hosts, _ = b.ListHosts(env, "web")
+		if len(hosts) != 0 {
+			t.Fatalf("ListHosts() = %d after TTL, want %d", len(hosts), 0)
+		}
+	}
+
+	b.UpdateHost(env, "web", host)
+	if err := b.DeleteHost(env, "web", host); err != nil {
+		t.Fatalf("DeleteHost() = %v, want %v", err, nil)
+	}
+
+	hosts, _ = b.ListHosts(env, "web")
+	if len(hosts) != 0 {
+		t.Fatalf("ListHosts() = %d after DeleteHost, want %d", len(hosts), 0)
+	}
+}
+
+func testBackendRegistrations(t *testing.T, b Backend, clock *testClock, env string) {
+	containerID := "0123456789abcdef0123456789abcdef"
+	reg := &ServiceRegistration{
+		Name:         "app",
+		ExternalIP:   "10.0.0.1",
+		ExternalPort: "49153",
+		ContainerID:  containerID,
+	}
+	if clock != nil {
+		reg.Expires = clock.now().Add(time.Duration(DefaultTTL) * time.Second)
+	}
+
+	if err := b.RegisterService(env, "web", reg); err != nil {
+		t.Fatalf("RegisterService() = %v, want %v", err, nil)
+	}
+
+	existing, err := b.GetServiceRegistration(env, "web", "10.0.0.1", "app", containerID)
+	if existing == nil || err != nil {
+		t.Fatalf("GetServiceRegistration() = %v, %v, want registration", existing, err)
+	}
+
+	if existing.ContainerID != containerID || existing.ExternalPort != "49153" {
+		t.Fatalf("GetServiceRegistration() = %s:%s, want %s:%s",
+			existing.ContainerID, existing.ExternalPort, containerID, "49153")
+	}
+
+	existing, err = b.GetServiceRegistration(env, "batch", "10.0.0.1", "app", containerID)
+	if existing != nil || err != nil {
+		t.Fatalf("GetServiceRegistration(%q) = %v, %v, want %v, %v", "batch", existing, err, nil, nil)
+	}
+
+	regs, err := b.ListRegistrations(env)
+	if len(regs) != 1 || err != nil {
+		t.Fatalf("ListRegistrations() = %d, %v, want %d, %v", len(regs), err, 1, nil)
+	}
+
+	if regs[0].Name != "app" || regs[0].Pool != "web" || regs[0].ContainerID != containerID {
+		t.Fatalf("ListRegistrations() = %s/%s/%s, want %s/%s/%s",
+			regs[0].Name, regs[0].Pool, regs[0].ContainerID, "app", "web", containerID)
+	}
+
+	// a container that only shares the short ID isn't the same registration
+	otherID := containerID[:12] + "ffffffffffffffffffff"
+	existing, err = b.UnregisterService(env, "web", "10.0.0.1", "app", otherID)
+	if existing != nil || err != nil {
+		t.Fatalf("UnregisterService(%q) = %v, %v, want %v, %v", otherID, existing, err, nil, nil)
+	}
+
+	existing, err = b.UnregisterService(env, "web", "10.0.0.1", "app", containerID)
+	if existing == nil || existing.ContainerID != containerID || err != nil {
+		t.Fatalf("UnregisterService() = %v, %v, want registration", existing, err)
+	}
+
+	existing, err = b.GetServiceRegistration(env, "web", "10.0.0.1", "app", containerID)
+	if existing != nil || err != nil {
+		t.Fatalf("GetServiceRegistration() = %v, %v, want %v, %v", existing, err, nil, nil)
+	}
+
+	if clock == nil {
+		return
+	}
+
+	b.RegisterService(env, "web", reg)
+	clock.add(time.Duration(DefaultTTL+1) * time.Second)
+
+	regs, _ = b.ListRegistrations(env)
+	if len(regs) != 0 {
+		t.Fatalf("ListRegistrations() = %d after TTL, want %d", len(regs), 0)
+	}
+}
+
+func testBackendNotifySubscribe(t *testing.T, b Backend, clock *testClock, env string) {
+	key := "galaxy-" + env
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := b.Subscribe(ctx, key)
+
+	// Some backends need a moment to establish the subscription. Keep
+	// notifying until something arrives, since a missed notification before
+	// the subscription is ready isn't an error.
+	timeout := time.After(10 * time.Second)
+	for {
+		if _, err := b.Notify(key, "restart app"); err != nil {
+			t.Fatalf("Notify() = %v, want %v", err, nil)
+		}
+
+		select {
+		case msg := <-msgs:
+			if msg != "restart app" {
+				t.Fatalf("Subscribe() = %q, want %q", msg, "restart app")
+			}
+			return
+		case <-time.After(500 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for notification")
+		}
+	}
+}
+
+func TestMemoryBackendSuite(t *testing.T) {
+	runBackendSuite(t, func(t *testing.T) (Backend, *testClock, func()) {
+		clock := newTestClock()
+		b := NewMemoryBackend()
+		b.now = clock.now
+		return b, clock, func() {}
+	})
+}
+
+func TestBoltBackendSuite(t *testing.T) {
+	runBackendSuite(t, func(t *testing.T) (Backend, *testClock, func()) {
+		clock := newTestClock()
+		b, cleanup := newTestBoltBackend(t)
+		b.now = clock.now
+		return b, clock, cleanup
+	})
+}
+
+func TestEtcdBackendSuite(t *testing.T) {
+	runBackendSuite(t, func(t *testing.T) (Backend, *testClock, func()) {
+		b, cleanup := newTestEtcdBackend(t)
+		return b, nil, cleanup
+	})
+}
+
+// The redis and consul suites need a running server, e.g.
+//   GALAXY_TEST_REDIS_URL=redis://127.0.0.1:6379
+//   GALAXY_TEST_CONSUL=1 (using the usual CONSUL_HTTP_ADDR)
+func TestRedisBackendSuite(t *testing.T) {
+	redisURL := os.Getenv("GALAXY_TEST_REDIS_URL")
+	if redisURL == "" {
+		t.Skip("GALAXY_TEST_REDIS_URL not set")
+	}
+
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runBackendSuite(t, func(t *testing.T) (Backend, *testClock, func()) {
+		b, err := NewRedisBackend(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, nil, func() {}
+	})
+}
+
+func TestConsulBackendSuite(t *testing.T) {
+	if os.Getenv("GALAXY_TEST_CONSUL") == "" {
+		t.Skip("GALAXY_TEST_CONSUL not set")
+	}
+
+	// keep the tests out of any real galaxy tree
+	u, _ := url.Parse("consul:///galaxytest")
+	runBackendSuite(t, func(t *testing.T) (Backend, *testClock, func()) {
+		b, err := NewConsulBackend(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, nil, func() {}
+	})
+}
@@ -0,0 +1,945 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+/*
+BoltBackend keeps all state in a single local file, for hosts that run
+without any external registry. The keys mirror the consul tree:
+	apps/env/app_name
+	releases/env/app_name/release_id
+	shared/env
+	shared/env/pool_name
+	pools/env/pool_name
+	hosts/env/pool/host_ip
+	services/env/pool/host_ip/service_name/container_id
+
+The database is only opened for the duration of each operation, so that the
+commander agent and the cli can share the same file.
+
+Hosts and services are stored with an expiration time, and are ignored once
+they expire. Expired entries are removed when new ones are written.
+
+Notifications are appended to an events bucket, and delivered to
+subscribers in this process by polling the file while there are any.
+*/
+type BoltBackend struct {
+	Path string
+
+	pubSub
+
+	// events are polled for while anyone is subscribed
+	pollMu    sync.Mutex
+	polling   bool
+	lastEvent uint64
+
+	// used to check expiration, so tests can control the clock
+	now func() time.Time
+}
+
+var (
+	boltData   = []byte("galaxy")
+	boltEvents = []byte("events")
+)
+
+const (
+	// how long to wait for another process to release the database
+	boltTimeout = 5 * time.Second
+
+	// how often subscribers check for new events
+	boltPollInterval = time.Second
+
+	// number of events kept for subscribers to catch up on
+	boltMaxEvents = 1024
+)
+
+// boltEntry wraps values that expire
+type boltEntry struct {
+	Expires time.Time
+	Value   json.RawMessage
+}
+
+type boltEvent struct {
+	Key   string
+	Value string
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	b := &BoltBackend{
+		Path: path,
+		now:  time.Now,
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltTimeout})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltData); err != nil {
+			return err
+		}
+
+		events, err := tx.CreateBucketIfNotExists(boltEvents)
+		if err != nil {
+			return err
+		}
+
+		// only deliver events sent after we started
+		b.lastEvent = events.Sequence()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *BoltBackend) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(b.Path, 0600, &bolt.Options{Timeout: boltTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func (b *BoltBackend) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(b.Path, 0600, &bolt.Options{Timeout: boltTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// scan calls fn for every key under prefix. The keys are collected first, so
+// fn may delete them.
+func scan(bucket *bolt.Bucket, prefix string, fn func(key string, value []byte) error) error {
+	p := []byte(prefix + "/")
+
+	keys := [][]byte{}
+	values := [][]byte{}
+	c := bucket.Cursor()
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, append([]byte{}, v...))
+	}
+
+	for i := range keys {
+		if err := fn(string(keys[i]), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return the unique path elements directly under prefix
+func children(bucket *bolt.Bucket, prefix string) ([]string, error) {
+	names := []string{}
+	err := scan(bucket, prefix, func(key string, value []byte) error {
+		name := strings.SplitN(strings.TrimPrefix(key, prefix+"/"), "/", 2)[0]
+		if name != "" && !utils.StringInSlice(name, names) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (b *BoltBackend) putEntry(bucket *bolt.Bucket, key string, expires time.Time, value interface{}) error {
+	js, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	entry, err := json.Marshal(boltEntry{Expires: expires, Value: js})
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), entry)
+}
+
+// getEntry decodes an unexpired entry into value, returning false if it
+// doesn't exist or has expired.
+func (b *BoltBackend) getEntry(data []byte, value interface{}) (time.Time, bool, error) {
+	entry := boltEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry.Expires, false, err
+	}
+
+	if !entry.Expires.After(b.now()) {
+		return entry.Expires, false, nil
+	}
+
+	if err := json.Unmarshal(entry.Value, value); err != nil {
+		return entry.Expires, false, err
+	}
+	return entry.Expires, true, nil
+}
+
+// remove all expired entries under prefix
+func (b *BoltBackend) expire(bucket *bolt.Bucket, prefix string) error {
+	return scan(bucket, prefix, func(key string, value []byte) error {
+		entry := boltEntry{}
+		if err := json.Unmarshal(value, &entry); err != nil || entry.Expires.After(b.now()) {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func getAppDefinition(bucket *bolt.Bucket, app, env string) (*AppDefinition, error) {
+	js := bucket.Get([]byte(path.Join("apps", env, app)))
+	if js == nil {
+		return nil, UnknownApp
+	}
+
+	ad := &AppDefinition{}
+	err := json.Unmarshal(js, ad)
+	if err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// store the app if it hasn't changed since it was loaded, recording the
+// sequence of this write as the ConfigIndex
+func putAppDefinition(bucket *bolt.Bucket, ad *AppDefinition, env string) error {
+	key := []byte(path.Join("apps", env, ad.Name()))
+
+	existing := &AppDefinition{}
+	if js := bucket.Get(key); js != nil {
+		if err := json.Unmarshal(js, existing); err != nil {
+			return err
+		}
+	}
+
+	if existing.ConfigIndex != ad.ConfigIndex {
+		return StaleConfig
+	}
+
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	stored := *ad
+	stored.ConfigIndex = int64(seq)
+
+	js, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.Put(key, js); err != nil {
+		return err
+	}
+
+	ad.ConfigIndex = stored.ConfigIndex
+	return nil
+}
+
+func (b *BoltBackend) AppExists(app, env string) (bool, error) {
+	exists := false
+	err := b.view(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(boltData).Get([]byte(path.Join("apps", env, app))) != nil
+		return nil
+	})
+	return exists, err
+}
+
+func (b *BoltBackend) CreateApp(app, env string) (bool, error) {
+	emptyConfig := &AppDefinition{
+		AppName:     app,
+		Environment: make(map[string]string),
+	}
+
+	return b.UpdateApp(emptyConfig, env)
+}
+
+func (b *BoltBackend) ListApps(env string) ([]App, error) {
+	apps := []App{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltData), path.Join("apps", env), func(key string, value []byte) error {
+			ad := &AppDefinition{}
+			err := json.Unmarshal(value, ad)
+			if err != nil {
+				log.Warnf("WARN: Unable to decode AppDefinition for %s: %s", key, err)
+				return nil
+			}
+			apps = append(apps, ad)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+func (b *BoltBackend) GetApp(app, env string) (App, error) {
+	var ad *AppDefinition
+	err := b.view(func(tx *bolt.Tx) error {
+		var err error
+		ad, err = getAppDefinition(tx.Bucket(boltData), app, env)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+func (b *BoltBackend) UpdateApp(app App, env string) (bool, error) {
+	ad := app.(*AppDefinition)
+
+	err := b.update(func(tx *bolt.Tx) error {
+		return putAppDefinition(tx.Bucket(boltData), ad, env)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *BoltBackend) DeleteApp(app App, env string) (bool, error) {
+	deleted := false
+	err := b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		key := []byte(path.Join("apps", env, app.Name()))
+		if bucket.Get(key) == nil {
+			return nil
+		}
+		deleted = true
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+
+		return scan(bucket, path.Join("releases", env, app.Name()), func(key string, value []byte) error {
+			return bucket.Delete([]byte(key))
+		})
+	})
+	return deleted, err
+}
+
+func (b *BoltBackend) AddRelease(app, env string, release *Release) error {
+	prefix := path.Join("releases", env, app)
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+
+		// the keys sort by ID, so the last one is the newest
+		keys := []string{}
+		last := Release{}
+		err := scan(bucket, prefix, func(key string, value []byte) error {
+			keys = append(keys, key)
+			return json.Unmarshal(value, &last)
+		})
+		if err != nil {
+			return err
+		}
+
+		stored := copyRelease(*release)
+		stored.ID = last.ID + 1
+
+		js, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		if err := bucket.Put([]byte(path.Join(prefix, releaseKey(stored.ID))), js); err != nil {
+			return err
+		}
+
+		for len(keys) >= MaxReleases {
+			if err := bucket.Delete([]byte(keys[0])); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+
+		release.ID = stored.ID
+		return nil
+	})
+}
+
+func (b *BoltBackend) ListReleases(app, env string) ([]Release, error) {
+	releases := []Release{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltData), path.Join("releases", env, app), func(key string, value []byte) error {
+			release := Release{}
+			if err := json.Unmarshal(value, &release); err != nil {
+				return err
+			}
+			releases = append(releases, release)
+			return nil
+		})
+	})
+	return releases, err
+}
+
+func (b *BoltBackend) AddChange(env string, event *ChangeEvent) error {
+	prefix := path.Join("changes", env)
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+
+		// the keys sort by Seq, so the last one is the newest
+		keys := []string{}
+		err := scan(bucket, prefix, func(key string, value []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		stored := *event
+		stored.Seq = 1
+		if len(keys) > 0 {
+			last, err := strconv.ParseInt(path.Base(keys[len(keys)-1]), 10, 64)
+			if err != nil {
+				return err
+			}
+			stored.Seq = last + 1
+		}
+
+		js, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		if err := bucket.Put([]byte(path.Join(prefix, changeKey(stored.Seq))), js); err != nil {
+			return err
+		}
+
+		for len(keys) >= MaxChanges {
+			if err := bucket.Delete([]byte(keys[0])); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+
+		event.Seq = stored.Seq
+		return nil
+	})
+}
+
+func (b *BoltBackend) ListChanges(env string, after int64) ([]ChangeEvent, error) {
+	changes := []ChangeEvent{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltData), path.Join("changes", env), func(key string, value []byte) error {
+			if path.Base(key) <= changeKey(after) {
+				return nil
+			}
+
+			event := ChangeEvent{}
+			if err := json.Unmarshal(value, &event); err != nil {
+				return err
+			}
+			changes = append(changes, event)
+			return nil
+		})
+	})
+	return changes, err
+}
+
+func (b *BoltBackend) AckChange(env, pool string, ack *ChangeAck) error {
+	js, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+
+	return b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltData).Put([]byte(path.Join("acks", env, pool, ack.App, ack.HostIP)), js)
+	})
+}
+
+func (b *BoltBackend) ListAcks(env, pool, app string) ([]ChangeAck, error) {
+	acks := []ChangeAck{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltData), path.Join("acks", env, pool, app), func(key string, value []byte) error {
+			ack := ChangeAck{}
+			if err := json.Unmarshal(value, &ack); err != nil {
+				return err
+			}
+			acks = append(acks, ack)
+			return nil
+		})
+	})
+	return acks, err
+}
+
+func (b *BoltBackend) AddAuditEntry(env string, entry *AuditEntry) error {
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+
+		// entries made at the same time are moved apart
+		t := entry.Time
+		for bucket.Get([]byte(path.Join("audit", env, auditKey(t)))) != nil {
+			t = t.Add(time.Nanosecond)
+		}
+		return bucket.Put([]byte(path.Join("audit", env, auditKey(t))), js)
+	})
+}
+
+func (b *BoltBackend) ListAuditEntries(env string, since, until time.Time) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltData), path.Join("audit", env), func(key string, value []byte) error {
+			if path.Base(key) < auditKey(since) || path.Base(key) >= auditKey(until) {
+				return nil
+			}
+
+			entry := AuditEntry{}
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (b *BoltBackend) GetWebhooks(env string) ([]Webhook, error) {
+	hooks := []Webhook{}
+	err := b.view(func(tx *bolt.Tx) error {
+		js := tx.Bucket(boltData).Get([]byte(path.Join("webhooks", env)))
+		if js == nil {
+			return nil
+		}
+		return json.Unmarshal(js, &hooks)
+	})
+	return hooks, err
+}
+
+func (b *BoltBackend) SetWebhooks(env string, hooks []Webhook) error {
+	js, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+
+	return b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltData).Put([]byte(path.Join("webhooks", env)), js)
+	})
+}
+
+func getSharedConfig(bucket *bolt.Bucket, env, pool string) (map[string]string, error) {
+	shared := map[string]string{}
+	js := bucket.Get([]byte(path.Join("shared", env, pool)))
+	if js == nil {
+		return shared, nil
+	}
+
+	err := json.Unmarshal(js, &shared)
+	return shared, err
+}
+
+func (b *BoltBackend) GetSharedConfig(env, pool string) (map[string]string, error) {
+	var shared map[string]string
+	err := b.view(func(tx *bolt.Tx) error {
+		var err error
+		shared, err = getSharedConfig(tx.Bucket(boltData), env, pool)
+		return err
+	})
+	return shared, err
+}
+
+func (b *BoltBackend) UpdateSharedConfig(env, pool string, values map[string]string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		shared, err := getSharedConfig(bucket, env, pool)
+		if err != nil {
+			return err
+		}
+
+		js, err := json.Marshal(applySharedConfig(shared, values))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(path.Join("shared", env, pool)), js)
+	})
+}
+
+func (b *BoltBackend) AssignApp(app, env, pool string) (bool, error) {
+	assigned := false
+	err := b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		ad, err := getAppDefinition(bucket, app, env)
+		if err != nil {
+			return err
+		}
+
+		for _, a := range ad.Assignments {
+			if a.Pool == pool {
+				return nil
+			}
+		}
+
+		// FIXME: Instances is hard-coded at -1 to match old behavior
+		ad.Assignments = append(ad.Assignments, AppAssignment{Pool: pool, Instances: -1})
+		assigned = true
+		return putAppDefinition(bucket, ad, env)
+	})
+	return assigned, err
+}
+
+func (b *BoltBackend) UnassignApp(app, env, pool string) (bool, error) {
+	removed := false
+	err := b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		ad, err := getAppDefinition(bucket, app, env)
+		if err == UnknownApp {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := range ad.Assignments {
+			if ad.Assignments[i].Pool == pool {
+				ad.Assignments = append(ad.Assignments[:i], ad.Assignments[i+1:]...)
+				removed = true
+				return putAppDefinition(bucket, ad, env)
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (b *BoltBackend) ListAssignments(env, pool string) ([]string, error) {
+	apps, err := b.ListApps(env)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned := []string{}
+	for _, app := range apps {
+		for _, a := range app.(*AppDefinition).Assignments {
+			if a.Pool == pool {
+				assigned = append(assigned, app.Name())
+			}
+		}
+	}
+	return assigned, nil
+}
+
+func (b *BoltBackend) CreatePool(env, pool string) (bool, error) {
+	created := false
+	err := b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		key := []byte(path.Join("pools", env, pool))
+		if bucket.Get(key) != nil {
+			return nil
+		}
+
+		created = true
+		return bucket.Put(key, []byte{})
+	})
+	if err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+func (b *BoltBackend) DeletePool(env, pool string) (bool, error) {
+	err := b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltData).Delete([]byte(path.Join("pools", env, pool)))
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *BoltBackend) ListPools(env string) ([]string, error) {
+	var pools []string
+	err := b.view(func(tx *bolt.Tx) error {
+		var err error
+		pools, err = children(tx.Bucket(boltData), path.Join("pools", env))
+		return err
+	})
+	return pools, err
+}
+
+func (b *BoltBackend) ListEnvs() ([]string, error) {
+	envs := []string{}
+	err := b.view(func(tx *bolt.Tx) error {
+		for _, prefix := range []string{"apps", "pools"} {
+			names, err := children(tx.Bucket(boltData), prefix)
+			if err != nil {
+				return err
+			}
+
+			for _, env := range names {
+				if !utils.StringInSlice(env, envs) {
+					envs = append(envs, env)
+				}
+			}
+		}
+		return nil
+	})
+	return envs, err
+}
+
+func (b *BoltBackend) UpdateHost(env, pool string, host HostInfo) error {
+	expires := b.now().UTC().Add(time.Duration(DefaultTTL) * time.Second)
+
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		if err := b.expire(bucket, path.Join("hosts", env)); err != nil {
+			return err
+		}
+		return b.putEntry(bucket, path.Join("hosts", env, pool, host.HostIP), expires, host)
+	})
+}
+
+func (b *BoltBackend) ListHosts(env, pool string) ([]HostInfo, error) {
+	hosts := []HostInfo{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(boltData), path.Join("hosts", env, pool), func(key string, value []byte) error {
+			host := HostInfo{}
+			_, ok, err := b.getEntry(value, &host)
+			if err != nil {
+				log.Warnf("WARN: Unable to decode host %s: %s", key, err)
+				return nil
+			}
+
+			if ok {
+				host.HostIP = path.Base(key)
+				hosts = append(hosts, host)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func (b *BoltBackend) DeleteHost(env, pool string, host HostInfo) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltData).Delete([]byte(path.Join("hosts", env, pool, host.HostIP)))
+	})
+}
+
+func (b *BoltBackend) Notify(key, value string) (int, error) {
+	event, err := json.Marshal(boltEvent{Key: key, Value: value})
+	if err != nil {
+		return 0, err
+	}
+
+	err = b.update(func(tx *bolt.Tx) error {
+		events := tx.Bucket(boltEvents)
+		seq, err := events.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		if seq > boltMaxEvents {
+			events.Delete(boltSeqKey(seq - boltMaxEvents))
+		}
+		return events.Put(boltSeqKey(seq), event)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (b *BoltBackend) Subscribe(ctx context.Context, key string) chan string {
+	ch := b.subscribe(ctx, key)
+
+	b.pollMu.Lock()
+	defer b.pollMu.Unlock()
+
+	if !b.polling {
+		// only deliver events sent after we subscribed, even if an earlier
+		// poller saw fewer
+		err := b.view(func(tx *bolt.Tx) error {
+			b.lastEvent = tx.Bucket(boltEvents).Sequence()
+			return nil
+		})
+		if err != nil {
+			log.Errorf("ERROR: Unable to read events from %s: %s", b.Path, err)
+		}
+
+		b.polling = true
+		go b.pollEvents()
+	}
+	return ch
+}
+
+// deliver new events from the file to our subscribers, until there are none
+func (b *BoltBackend) pollEvents() {
+	for {
+		time.Sleep(boltPollInterval)
+
+		b.pollMu.Lock()
+		if b.subscribers() == 0 {
+			b.polling = false
+			b.pollMu.Unlock()
+			return
+		}
+		b.pollMu.Unlock()
+
+		events := []boltEvent{}
+		err := b.view(func(tx *bolt.Tx) error {
+			c := tx.Bucket(boltEvents).Cursor()
+			for k, v := c.Seek(boltSeqKey(b.lastEvent + 1)); k != nil; k, v = c.Next() {
+				event := boltEvent{}
+				if err := json.Unmarshal(v, &event); err != nil {
+					log.Warnf("WARN: Unable to decode event %d: %s", binary.BigEndian.Uint64(k), err)
+				} else {
+					events = append(events, event)
+				}
+				b.lastEvent = binary.BigEndian.Uint64(k)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("ERROR: Unable to read events from %s: %s", b.Path, err)
+		}
+
+		for _, event := range events {
+			b.publish(event.Key, event.Value)
+		}
+	}
+}
+
+func boltSeqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+func (b *BoltBackend) RegisterService(env, pool string, reg *ServiceRegistration) error {
+	key := path.Join("services", env, pool, reg.ExternalIP, reg.Name, reg.ContainerID[0:12])
+
+	expires := reg.Expires
+	if expires.IsZero() {
+		expires = b.now().UTC().Add(time.Duration(DefaultTTL) * time.Second)
+	}
+
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		if err := b.expire(bucket, path.Join("services", env)); err != nil {
+			return err
+		}
+		return b.putEntry(bucket, key, expires, reg)
+	})
+}
+
+func (b *BoltBackend) UnregisterService(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
+	key := path.Join("services", env, pool, hostIP, name, containerID[0:12])
+
+	var registration *ServiceRegistration
+	err := b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+
+		var err error
+		registration, err = b.getRegistration(bucket, key)
+		if err != nil || registration == nil {
+			return err
+		}
+
+		if registration.ContainerID != containerID {
+			registration = nil
+			return nil
+		}
+
+		return bucket.Delete([]byte(key))
+	})
+	return registration, err
+}
+
+func (b *BoltBackend) getRegistration(bucket *bolt.Bucket, key string) (*ServiceRegistration, error) {
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return nil, nil
+	}
+
+	registration := &ServiceRegistration{
+		Path: key,
+	}
+
+	expires, ok, err := b.getEntry(value, registration)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	registration.Expires = expires
+	return registration, nil
+}
+
+func (b *BoltBackend) GetServiceRegistration(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
+	key := path.Join("services", env, pool, hostIP, name, containerID[0:12])
+
+	var registration *ServiceRegistration
+	err := b.view(func(tx *bolt.Tx) error {
+		var err error
+		registration, err = b.getRegistration(tx.Bucket(boltData), key)
+		return err
+	})
+	return registration, err
+}
+
+func (b *BoltBackend) ListRegistrations(env string) ([]ServiceRegistration, error) {
+	prefix := path.Join("services", env)
+
+	regList := []ServiceRegistration{}
+	err := b.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		return scan(bucket, prefix, func(key string, value []byte) error {
+			// pool/host_ip/service_name/container_id
+			parts := strings.Split(strings.TrimPrefix(key, prefix+"/"), "/")
+			if len(parts) != 4 {
+				return nil
+			}
+
+			reg, err := b.getRegistration(bucket, key)
+			if err != nil {
+				log.Warnf("WARN: Unable to decode registration %s: %s", key, err)
+				return nil
+			}
+
+			if reg != nil {
+				reg.Pool = parts[0]
+				regList = append(regList, *reg)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return regList, nil
+}
+
+// Required for the interface, but not used by bolt
+func (b *BoltBackend) connect()   {}
+func (b *BoltBackend) reconnect() {}
+
+var _ Backend = &BoltBackend{}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBoltBackend(t *testing.T) (*BoltBackend, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBoltBackend(filepath.Join(dir, "registry.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return b, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltApps(t *testing.T) {
+	b, cleanup := newTestBoltBackend(t)
+	defer cleanup()
+
+	created, err := b.CreateApp("app", "dev")
+	if !created || err != nil {
+		t.Fatalf("CreateApp(%q) = %t, %v, want %t, %v", "app", created, err, true, nil)
+	}
+
+	app, err := b.GetApp("app", "dev")
+	if err != nil {
+		t.Fatalf("GetApp(%q) = %v, want %v", "app", err, nil)
+	}
+
+	createdID := app.ID()
+	app.EnvSet("FOO", "bar")
+	b.UpdateApp(app, "dev")
+
+	updated, err := b.GetApp("app", "dev")
+	if err != nil || updated.EnvGet("FOO") != "bar" {
+		t.Fatalf("EnvGet(%q) = %q, %v, want %q, %v", "FOO", updated.EnvGet("FOO"), err, "bar", nil)
+	}
+
+	if updated.ID() <= createdID {
+		t.Fatalf("ID() = %d, want greater than %d", updated.ID(), createdID)
+	}
+
+	assigned, err := b.AssignApp("app", "dev", "web")
+	if !assigned || err != nil {
+		t.Fatalf("AssignApp(%q) = %t, %v, want %t, %v", "app", assigned, err, true, nil)
+	}
+
+	apps, err := b.ListAssignments("dev", "web")
+	if len(apps) != 1 || apps[0] != "app" || err != nil {
+		t.Fatalf("ListAssignments() = %v, %v, want %v, %v", apps, err, []string{"app"}, nil)
+	}
+
+	deleted, err := b.DeleteApp(app, "dev")
+	if !deleted || err != nil {
+		t.Fatalf("DeleteApp(%q) = %t, %v, want %t, %v", "app", deleted, err, true, nil)
+	}
+
+	_, err = b.GetApp("app", "dev")
+	if err != UnknownApp {
+		t.Fatalf("GetApp(%q) = %v, want %v", "app", err, UnknownApp)
+	}
+}
+
+func TestBoltExpiry(t *testing.T) {
+	b, cleanup := newTestBoltBackend(t)
+	defer cleanup()
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.UpdateHost("dev", "web", HostInfo{HostIP: "10.0.0.1"})
+
+	containerID := "0123456789abcdef0123"
+	b.RegisterService("dev", "web", &ServiceRegistration{
+		Name:        "app",
+		ExternalIP:  "10.0.0.1",
+		ContainerID: containerID,
+	})
+
+	hosts, _ := b.ListHosts("dev", "web")
+	if len(hosts) != 1 {
+		t.Fatalf("ListHosts() = %d, want %d", len(hosts), 1)
+	}
+
+	regs, _ := b.ListRegistrations("dev")
+	if len(regs) != 1 || regs[0].Pool != "web" {
+		t.Fatalf("ListRegistrations() = %v, want 1 registration in pool %q", regs, "web")
+	}
+
+	now = now.Add(time.Duration(DefaultTTL+1) * time.Second)
+
+	hosts, _ = b.ListHosts("dev", "web")
+	if len(hosts) != 0 {
+		t.Fatalf("ListHosts() = %d, want %d", len(hosts), 0)
+	}
+
+	reg, err := b.GetServiceRegistration("dev", "web", "10.0.0.1", "app", containerID)
+	if reg != nil || err != nil {
+		t.Fatalf("GetServiceRegistration() = %v, %v, want %v, %v", reg, err, nil, nil)
+	}
+}
+
+func TestBoltNotify(t *testing.T) {
+	b, cleanup := newTestBoltBackend(t)
+	defer cleanup()
+
+	msgs := b.Subscribe(context.Background(), "galaxy-dev")
+
+	// a second backend on the same file, like the cli and the agent
+	other, err := NewBoltBackend(b.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := other.Notify("galaxy-dev", "restart app"); err != nil {
+		t.Fatalf("Notify() = %v, want %v", err, nil)
+	}
+
+	select {
+	case msg := <-msgs:
+		if msg != "restart app" {
+			t.Fatalf("Subscribe() = %q, want %q", msg, "restart app")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for notification")
+	}
+}
+
+func TestBoltStopsPolling(t *testing.T) {
+	b, cleanup := newTestBoltBackend(t)
+	defer cleanup()
+
+	polling := func() bool {
+		b.pollMu.Lock()
+		defer b.pollMu.Unlock()
+		return b.polling
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Subscribe(ctx, "galaxy-dev")
+	if !polling() {
+		t.Fatal("Subscribe() didn't start polling for events")
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for polling() {
+		if time.Now().After(deadline) {
+			t.Fatal("still polling for events after the last subscriber left")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// subscribing again starts a new poller
+	msgs := b.Subscribe(context.Background(), "galaxy-dev")
+	if _, err := b.Notify("galaxy-dev", "restart app"); err != nil {
+		t.Fatalf("Notify() = %v, want %v", err, nil)
+	}
+
+	select {
+	case msg := <-msgs:
+		if msg != "restart app" {
+			t.Fatalf("Subscribe() = %q, want %q", msg, "restart app")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for notification")
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 // AppDefintiion contains all the configuration needed to run a container
@@ -45,6 +46,9 @@ type AppDefinition struct {
 	// The environment passed to the container
 	Environment map[string]string
 
+	// Schema the environment is checked against before it's changed
+	Schema Schema
+
 	// Resources are assigned per logical group, e.g. Pool
 	// TODO: This seems awkward -- apps don't know about the env they are
 	//       assigned to, but they need to know about the pools.
@@ -79,6 +83,19 @@ type PortMapping struct {
 	ErrorPages map[int]string
 }
 
+// Protocol returns the mapping's network, tcp if it isn't set
+func (p PortMapping) Protocol() string {
+	if p.Network == "" {
+		return "tcp"
+	}
+	return strings.ToLower(p.Network)
+}
+
+// String formats the mapping like docker's -p flag, e.g. 80:8000/tcp
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%s:%s/%s", p.HostPort, p.ContainerPort, p.Protocol())
+}
+
 // AppAssignment provides the location and resource limits for an app to run
 type AppAssignment struct {
 	//  We currently only assign to Pools
@@ -200,6 +217,57 @@ func (a *AppDefinition) GetMaintenanceMode(pool string) bool {
 	return a.Assignments[i].MaintenanceMode
 }
 
+func (a *AppDefinition) GetSchema() Schema {
+	if a.Schema == nil {
+		return Schema{}
+	}
+	return a.Schema
+}
+
+func (a *AppDefinition) SetSchema(schema Schema) {
+	a.Schema = schema
+}
+
+func (a *AppDefinition) GetEntryPoint() []string {
+	return a.EntryPoint
+}
+
+func (a *AppDefinition) SetEntryPoint(entryPoint []string) {
+	a.EntryPoint = entryPoint
+}
+
+func (a *AppDefinition) GetCommand() []string {
+	return a.Command
+}
+
+func (a *AppDefinition) SetCommand(cmd []string) {
+	a.Command = cmd
+}
+
+func (a *AppDefinition) GetHosts() []HostsEntry {
+	return a.Hosts
+}
+
+func (a *AppDefinition) SetHosts(hosts []HostsEntry) {
+	a.Hosts = hosts
+}
+
+func (a *AppDefinition) GetDNS() []string {
+	return a.DNS
+}
+
+func (a *AppDefinition) SetDNS(dns []string) {
+	a.DNS = dns
+}
+
+func (a *AppDefinition) GetPortMappings() []PortMapping {
+	return a.PortMappings
+}
+
+func (a *AppDefinition) SetPortMappings(mappings []PortMapping) {
+	a.PortMappings = mappings
+}
+
 // TODO: This is to make it easier to refactor in this new config.
 //       Might want to rework this once we define what the semantics of the
 //       Assignments are.
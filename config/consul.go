@@ -1,14 +1,19 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"path"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
 
 	consul "github.com/hashicorp/consul/api"
 )
@@ -16,21 +21,27 @@ import (
 /*
 TODO: logging!
 
-TODO: use CAS operations so that we don't have any races between
-      configuration changes
-
 The consul tree looks like:
 	galaxy/apps/env/app_name
+	galaxy/releases/env/app_name/release_id
+	galaxy/shared/env
+	galaxy/shared/env/pool_name
 	galaxy/pools/env/pool_name
 	galaxy/hosts/env/pool/host_ip
 	galaxy/services/env/pool/host_ip/service_name/container_id
 
+"galaxy" is the default prefix, which can be changed in the registry URL:
+	consul://[token@]host:port[/prefix][?dc=dc1&scheme=https&ttl=15s]
+
 The Methods for ConsulBackend are tentatively defined here to satisfy the
 confing.Backend interface, and may not be appropriate
 */
 type ConsulBackend struct {
 	client *consul.Client
 
+	// root of the galaxy tree, and the name of our session
+	prefix string
+
 	// We always need a session to set the TTL for keys
 	sessionID string
 
@@ -43,27 +54,90 @@ type ConsulBackend struct {
 
 var UnknownApp = fmt.Errorf("unkown app")
 
-func NewConsulBackend() *ConsulBackend {
-	client, err := consul.NewClient(consul.DefaultConfig())
+const (
+	defaultConsulPrefix     = "galaxy"
+	defaultConsulSessionTTL = 15 * time.Second
+)
+
+// parseConsulURL returns the client config, key prefix and session TTL from
+// a consul registry URL. Anything missing from the URL keeps the consul
+// defaults, including the CONSUL_HTTP_* environment variables.
+func parseConsulURL(u *url.URL) (*consul.Config, string, time.Duration, error) {
+	config := consul.DefaultConfig()
+	if u.Host != "" {
+		config.Address = u.Host
+	}
+
+	query := u.Query()
+	if scheme := query.Get("scheme"); scheme != "" {
+		if scheme != "http" && scheme != "https" {
+			return nil, "", 0, fmt.Errorf("invalid scheme %s", scheme)
+		}
+		config.Scheme = scheme
+	}
+
+	if dc := query.Get("dc"); dc != "" {
+		config.Datacenter = dc
+	}
+
+	if u.User != nil {
+		config.Token = u.User.Username()
+	}
+	if token := query.Get("token"); token != "" {
+		config.Token = token
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = defaultConsulPrefix
+	}
+
+	ttl := defaultConsulSessionTTL
+	if query.Get("ttl") != "" {
+		var err error
+		ttl, err = time.ParseDuration(query.Get("ttl"))
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("invalid ttl: %s", err)
+		}
+
+		// the limits consul puts on session TTLs
+		if ttl < 10*time.Second || ttl > 24*time.Hour {
+			return nil, "", 0, fmt.Errorf("ttl %s must be between 10s and 24h", ttl)
+		}
+	}
+
+	return config, prefix, ttl, nil
+}
+
+func NewConsulBackend(u *url.URL) (*ConsulBackend, error) {
+	config, prefix, ttl, err := parseConsulURL(u)
 	if err != nil {
-		// this shouldn't ever error with the default config
-		panic(err)
+		return nil, err
+	}
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, err
 	}
 
 	node, err := client.Agent().NodeName()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
+	// Each galaxy tree gets its own session, so separate clusters sharing a
+	// consul don't expire each other's keys.
+	sessionName := strings.Replace(prefix, "/", "-", -1)
+
 	// find an existing galaxy session if one exists, or create a new one
 	sessions, _, err := client.Session().Node(node, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	var session *consul.SessionEntry
 	for _, s := range sessions {
-		if s.Name == "galaxy" {
+		if s.Name == sessionName {
 			session = s
 			break
 		}
@@ -81,30 +155,40 @@ func NewConsulBackend() *ConsulBackend {
 	// no existing session, so create a new one
 	if session == nil {
 		session = &consul.SessionEntry{
-			Name:     "galaxy",
+			Name:     sessionName,
 			Behavior: "delete",
-			TTL:      "15s",
+			TTL:      ttl.String(),
 		}
 
 		session.ID, _, err = client.Session().Create(session, nil)
 		if err != nil {
 			// we can't continue without a session for key TTLs
-			log.Fatal(err)
+			return nil, err
 		}
 	}
 
 	// keep our session alive in the background
 	done := make(chan struct{})
-	go client.Session().RenewPeriodic("10s", session.ID, nil, done)
+	go client.Session().RenewPeriodic(ttl.String(), session.ID, nil, done)
 
 	return &ConsulBackend{
 		client:    client,
+		prefix:    prefix,
 		sessionID: session.ID,
 		done:      done,
 		seen: &eventCache{
 			seen: make(map[string]uint64),
 		},
+	}, nil
+}
+
+// eventName namespaces events outside the default tree, so clusters sharing
+// a consul don't see each other's notifications.
+func (c *ConsulBackend) eventName(key string) string {
+	if c.prefix == defaultConsulPrefix {
+		return key
 	}
+	return strings.Replace(c.prefix, "/", "-", -1) + "-" + key
 }
 
 // Check that an app exists and has a config
@@ -126,7 +210,7 @@ func (c *ConsulBackend) AppExists(app, env string) (bool, error) {
 // Create and save an empty AppDefinition for a new app
 func (c *ConsulBackend) CreateApp(app, env string) (bool, error) {
 	kvp := &consul.KVPair{}
-	kvp.Key = path.Join("galaxy", "apps", env, app)
+	kvp.Key = path.Join(c.prefix, "apps", env, app)
 
 	// TODO: intit this in one place
 	emptyConfig := &AppDefinition{
@@ -150,29 +234,29 @@ func (c *ConsulBackend) CreateApp(app, env string) (bool, error) {
 
 // List all apps in an environment
 func (c *ConsulBackend) ListApps(env string) ([]App, error) {
-	key := path.Join("galaxy", "apps", env)
+	key := path.Join(c.prefix, "apps", env)
 	kvPairs, _, err := c.client.KV().List(key, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	apps := make([]App, len(kvPairs))
-	for i, kvp := range kvPairs {
+	apps := []App{}
+	for _, kvp := range kvPairs {
 		ad := &AppDefinition{}
 		err := json.Unmarshal(kvp.Value, ad)
 		if err != nil {
-			log.Println("error decoding AppDefinition for %s: %s", kvp.Key, err.Error())
+			log.Warnf("WARN: Unable to decode AppDefinition for %s: %s", kvp.Key, err)
 			continue
 		}
 		ad.ConfigIndex = int64(kvp.ModifyIndex)
-		apps[i] = App(ad)
+		apps = append(apps, ad)
 	}
 	return apps, nil
 }
 
 // Retrieve the current config for an application
 func (c *ConsulBackend) GetApp(app, env string) (App, error) {
-	key := path.Join("galaxy", "apps", env, app)
+	key := path.Join(c.prefix, "apps", env, app)
 	kvp, _, err := c.client.KV().Get(key, nil)
 	if err != nil {
 		return nil, err
@@ -192,11 +276,17 @@ func (c *ConsulBackend) GetApp(app, env string) (App, error) {
 	return ad, nil
 }
 
-// Update the current configuration for an app
+// Update the current configuration for an app, only if it hasn't been
+// modified since we loaded it.
+// The new ModifyIndex isn't returned by a CAS, so the app needs to be loaded
+// again before it can be updated again.
 func (c *ConsulBackend) UpdateApp(app App, env string) (bool, error) {
 	ad := app.(*AppDefinition)
-	key := path.Join("galaxy", "apps", env, ad.Name())
-	kvp := &consul.KVPair{Key: key}
+	key := path.Join(c.prefix, "apps", env, ad.Name())
+	kvp := &consul.KVPair{
+		Key:         key,
+		ModifyIndex: uint64(ad.ConfigIndex),
+	}
 
 	var err error
 	kvp.Value, err = json.Marshal(ad)
@@ -204,25 +294,336 @@ func (c *ConsulBackend) UpdateApp(app App, env string) (bool, error) {
 		return false, err
 	}
 
-	_, err = c.client.KV().Put(kvp, nil)
+	ok, _, err := c.client.KV().CAS(kvp, nil)
 	if err != nil {
 		return false, err
 	}
+
+	if !ok {
+		return false, StaleConfig
+	}
 	return true, nil
 }
 
 // Delete the configuration for an app
 // FIXME: Why does this take an App? Everything else takes a string
 func (c *ConsulBackend) DeleteApp(app App, env string) (bool, error) {
-	key := path.Join("galaxy", "apps", env, app.Name())
+	key := path.Join(c.prefix, "apps", env, app.Name())
 	_, err := c.client.KV().Delete(key, nil)
 	if err != nil {
 		return false, err
 	}
 
+	_, err = c.client.KV().DeleteTree(path.Join(c.prefix, "releases", env, app.Name())+"/", nil)
+	if err != nil {
+		return false, err
+	}
+
 	return true, nil
 }
 
+// Store a release under the next ID for the app.
+func (c *ConsulBackend) AddRelease(app, env string, release *Release) error {
+	prefix := path.Join(c.prefix, "releases", env, app) + "/"
+	for {
+		// the keys are returned in order, so the last one is the newest
+		keys, _, err := c.client.KV().Keys(prefix, "", nil)
+		if err != nil {
+			return err
+		}
+
+		stored := copyRelease(*release)
+		stored.ID = 1
+		if len(keys) > 0 {
+			last, err := strconv.ParseInt(path.Base(keys[len(keys)-1]), 10, 64)
+			if err != nil {
+				return err
+			}
+			stored.ID = last + 1
+		}
+
+		kvp := &consul.KVPair{
+			Key: prefix + releaseKey(stored.ID),
+		}
+		kvp.Value, err = json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		// a ModifyIndex of 0 only writes the key if it doesn't exist, in case
+		// someone else added the same release ID first
+		ok, _, err := c.client.KV().CAS(kvp, nil)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		for i := 0; len(keys)-i >= MaxReleases; i++ {
+			if _, err := c.client.KV().Delete(keys[i], nil); err != nil {
+				return err
+			}
+		}
+
+		release.ID = stored.ID
+		return nil
+	}
+}
+
+// List an app's releases, oldest first
+func (c *ConsulBackend) ListReleases(app, env string) ([]Release, error) {
+	kvPairs, _, err := c.client.KV().List(path.Join(c.prefix, "releases", env, app)+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := []Release{}
+	for _, kvp := range kvPairs {
+		release := Release{}
+		if err := json.Unmarshal(kvp.Value, &release); err != nil {
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releases, nil
+}
+
+// Store a change under the next Seq for the env, like a release. Since the
+// next Seq is only claimed once the last one exists, changes become visible
+// in order.
+func (c *ConsulBackend) AddChange(env string, event *ChangeEvent) error {
+	prefix := path.Join(c.prefix, "changes", env) + "/"
+	for {
+		// the keys are returned in order, so the last one is the newest
+		keys, _, err := c.client.KV().Keys(prefix, "", nil)
+		if err != nil {
+			return err
+		}
+
+		stored := *event
+		stored.Seq = 1
+		if len(keys) > 0 {
+			last, err := strconv.ParseInt(path.Base(keys[len(keys)-1]), 10, 64)
+			if err != nil {
+				return err
+			}
+			stored.Seq = last + 1
+		}
+
+		kvp := &consul.KVPair{
+			Key: prefix + changeKey(stored.Seq),
+		}
+		kvp.Value, err = json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		ok, _, err := c.client.KV().CAS(kvp, nil)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		for i := 0; len(keys)-i >= MaxChanges; i++ {
+			if _, err := c.client.KV().Delete(keys[i], nil); err != nil {
+				return err
+			}
+		}
+
+		event.Seq = stored.Seq
+		return nil
+	}
+}
+
+// List the changes after a Seq, oldest first. Only the keys are listed, so
+// the changes already seen aren't read again.
+func (c *ConsulBackend) ListChanges(env string, after int64) ([]ChangeEvent, error) {
+	prefix := path.Join(c.prefix, "changes", env) + "/"
+	keys, _, err := c.client.KV().Keys(prefix, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []ChangeEvent{}
+	for _, key := range keys {
+		if path.Base(key) <= changeKey(after) {
+			continue
+		}
+
+		kvp, _, err := c.client.KV().Get(key, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// trimmed since the keys were listed
+		if kvp == nil {
+			continue
+		}
+
+		event := ChangeEvent{}
+		if err := json.Unmarshal(kvp.Value, &event); err != nil {
+			return nil, err
+		}
+		changes = append(changes, event)
+	}
+	return changes, nil
+}
+
+func (c *ConsulBackend) AckChange(env, pool string, ack *ChangeAck) error {
+	js, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+
+	kvp := &consul.KVPair{
+		Key:   path.Join(c.prefix, "acks", env, pool, ack.App, ack.HostIP),
+		Value: js,
+	}
+	_, err = c.client.KV().Put(kvp, nil)
+	return err
+}
+
+func (c *ConsulBackend) ListAcks(env, pool, app string) ([]ChangeAck, error) {
+	kvPairs, _, err := c.client.KV().List(path.Join(c.prefix, "acks", env, pool, app)+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	acks := []ChangeAck{}
+	for _, kvp := range kvPairs {
+		ack := ChangeAck{}
+		if err := json.Unmarshal(kvp.Value, &ack); err != nil {
+			return nil, err
+		}
+		acks = append(acks, ack)
+	}
+	return acks, nil
+}
+
+// Audit entries are keyed by time. The key is only created if it doesn't
+// exist, so entries made at the same time are moved apart.
+func (c *ConsulBackend) AddAuditEntry(env string, entry *AuditEntry) error {
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	for t := entry.Time; ; t = t.Add(time.Nanosecond) {
+		kvp := &consul.KVPair{
+			Key:   path.Join(c.prefix, "audit", env, auditKey(t)),
+			Value: js,
+		}
+
+		ok, _, err := c.client.KV().CAS(kvp, nil)
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+func (c *ConsulBackend) ListAuditEntries(env string, since, until time.Time) ([]AuditEntry, error) {
+	kvPairs, _, err := c.client.KV().List(path.Join(c.prefix, "audit", env)+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	for _, kvp := range kvPairs {
+		key := path.Base(kvp.Key)
+		if key < auditKey(since) || key >= auditKey(until) {
+			continue
+		}
+
+		entry := AuditEntry{}
+		if err := json.Unmarshal(kvp.Value, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (c *ConsulBackend) GetWebhooks(env string) ([]Webhook, error) {
+	hooks := []Webhook{}
+	kvp, _, err := c.client.KV().Get(path.Join(c.prefix, "webhooks", env), nil)
+	if err != nil || kvp == nil {
+		return hooks, err
+	}
+
+	err = json.Unmarshal(kvp.Value, &hooks)
+	return hooks, err
+}
+
+func (c *ConsulBackend) SetWebhooks(env string, hooks []Webhook) error {
+	js, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+
+	kvp := &consul.KVPair{
+		Key:   path.Join(c.prefix, "webhooks", env),
+		Value: js,
+	}
+	_, err = c.client.KV().Put(kvp, nil)
+	return err
+}
+
+func (c *ConsulBackend) getSharedConfig(key string) (map[string]string, uint64, error) {
+	kvp, _, err := c.client.KV().Get(key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	shared := map[string]string{}
+	if kvp == nil {
+		return shared, 0, nil
+	}
+
+	err = json.Unmarshal(kvp.Value, &shared)
+	return shared, kvp.ModifyIndex, err
+}
+
+// Get the config shared by an env, or a pool if one is given
+func (c *ConsulBackend) GetSharedConfig(env, pool string) (map[string]string, error) {
+	shared, _, err := c.getSharedConfig(path.Join(c.prefix, "shared", env, pool))
+	return shared, err
+}
+
+// Update the shared config for an env or pool, retrying if someone else
+// changed it at the same time.
+func (c *ConsulBackend) UpdateSharedConfig(env, pool string, values map[string]string) error {
+	key := path.Join(c.prefix, "shared", env, pool)
+	for {
+		shared, index, err := c.getSharedConfig(key)
+		if err != nil {
+			return err
+		}
+
+		kvp := &consul.KVPair{
+			Key:         key,
+			ModifyIndex: index,
+		}
+		kvp.Value, err = json.Marshal(applySharedConfig(shared, values))
+		if err != nil {
+			return err
+		}
+
+		ok, _, err := c.client.KV().CAS(kvp, nil)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return nil
+		}
+	}
+}
+
 // Add a pool assignment for this app, and update the config.
 // The pool need not exist, it just won't run until there is a corresponding
 // pool.
@@ -236,7 +637,7 @@ func (c *ConsulBackend) AssignApp(app, env, pool string) (bool, error) {
 	// return early if we're already assigned to this pool
 	for i := range ad.Assignments {
 		if ad.Assignments[i].Pool == pool {
-			return true, nil
+			return false, nil
 		}
 	}
 
@@ -250,6 +651,9 @@ func (c *ConsulBackend) AssignApp(app, env, pool string) (bool, error) {
 func (c *ConsulBackend) UnassignApp(app, env, pool string) (bool, error) {
 	found := false
 	appCfg, err := c.GetApp(app, env)
+	if err == UnknownApp {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
@@ -297,18 +701,20 @@ func (c *ConsulBackend) ListAssignments(env, pool string) ([]string, error) {
 // Pool are just an empty Key/Value pair, to signify that this pool has been
 // purposely created.
 func (c *ConsulBackend) CreatePool(env, pool string) (bool, error) {
-	key := path.Join("galaxy", "pools", env, pool)
-	kvp := &consul.KVPair{Key: key}
-	_, err := c.client.KV().Put(kvp, nil)
+	key := path.Join(c.prefix, "pools", env, pool)
+
+	// a CAS at index 0 only writes the key if it doesn't exist yet
+	kvp := &consul.KVPair{Key: key, ModifyIndex: 0}
+	created, _, err := c.client.KV().CAS(kvp, nil)
 	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return created, nil
 }
 
 // Delete the pool entry
 func (c *ConsulBackend) DeletePool(env, pool string) (bool, error) {
-	key := path.Join("galaxy", "pools", env, pool)
+	key := path.Join(c.prefix, "pools", env, pool)
 	_, err := c.client.KV().DeleteTree(key, nil)
 	if err != nil {
 		return false, err
@@ -318,7 +724,7 @@ func (c *ConsulBackend) DeletePool(env, pool string) (bool, error) {
 
 // List all pools in an environment
 func (c *ConsulBackend) ListPools(env string) ([]string, error) {
-	prefix := path.Join("galaxy", "pools", env) + "/"
+	prefix := path.Join(c.prefix, "pools", env) + "/"
 	keys, _, err := c.client.KV().Keys(prefix, "/", nil)
 	if err != nil {
 		return nil, err
@@ -331,16 +737,22 @@ func (c *ConsulBackend) ListPools(env string) ([]string, error) {
 	return pools, nil
 }
 
+// List all envs with apps or pools
 func (c *ConsulBackend) ListEnvs() ([]string, error) {
-	prefix := path.Join("galaxy", "apps") + "/"
-	keys, _, err := c.client.KV().Keys(prefix, "/", nil)
-	if err != nil {
-		return nil, err
-	}
+	envs := []string{}
+	for _, tree := range []string{"apps", "pools"} {
+		prefix := path.Join(c.prefix, tree) + "/"
+		keys, _, err := c.client.KV().Keys(prefix, "/", nil)
+		if err != nil {
+			return nil, err
+		}
 
-	envs := make([]string, len(keys))
-	for i, key := range keys {
-		envs[i] = path.Base(key)
+		for _, key := range keys {
+			env := path.Base(key)
+			if !utils.StringInSlice(env, envs) {
+				envs = append(envs, env)
+			}
+		}
 	}
 
 	return envs, nil
@@ -351,7 +763,7 @@ func (c *ConsulBackend) ListEnvs() ([]string, error) {
 //       Rename appropriately to reflect that this only adds a host, and
 //       there's nothing to update.
 func (c *ConsulBackend) UpdateHost(env, pool string, host HostInfo) error {
-	key := path.Join("galaxy", "hosts", env, pool, host.HostIP)
+	key := path.Join(c.prefix, "hosts", env, pool, host.HostIP)
 	// lookup the SessionID of this host
 	kvp, _, err := c.client.KV().Get(key, nil)
 	if err != nil {
@@ -387,7 +799,7 @@ func (c *ConsulBackend) UpdateHost(env, pool string, host HostInfo) error {
 }
 
 func (c *ConsulBackend) ListHosts(env, pool string) ([]HostInfo, error) {
-	prefix := path.Join("galaxy", "hosts", env, pool) + "/"
+	prefix := path.Join(c.prefix, "hosts", env, pool) + "/"
 	keys, _, err := c.client.KV().Keys(prefix, "/", nil)
 	if err != nil {
 		return nil, err
@@ -401,7 +813,7 @@ func (c *ConsulBackend) ListHosts(env, pool string) ([]HostInfo, error) {
 }
 
 func (c *ConsulBackend) DeleteHost(env, pool string, host HostInfo) error {
-	key := path.Join("galaxy", "hosts", env, pool, host.HostIP)
+	key := path.Join(c.prefix, "hosts", env, pool, host.HostIP)
 	_, err := c.client.KV().Delete(key, nil)
 	return err
 }
@@ -410,7 +822,7 @@ func (c *ConsulBackend) DeleteHost(env, pool string, host HostInfo) error {
 //        backend either.
 func (c *ConsulBackend) Notify(key, value string) (int, error) {
 	event := &consul.UserEvent{
-		Name:    key,
+		Name:    c.eventName(key),
 		Payload: []byte(value),
 	}
 
@@ -421,24 +833,31 @@ func (c *ConsulBackend) Notify(key, value string) (int, error) {
 	return 1, nil
 }
 
-func (c *ConsulBackend) Subscribe(key string) chan string {
+func (c *ConsulBackend) Subscribe(ctx context.Context, key string) chan string {
 	msgs := make(chan string)
-	go c.sub(key, msgs)
+	go c.sub(ctx, key, msgs)
 	return msgs
 }
 
-// FIXME: This can't be shut down. Make sure that's not a problem
-func (c *ConsulBackend) sub(key string, msgs chan string) {
+// sub stops once ctx is cancelled, though not until the blocking query in
+// progress returns, since the client can't interrupt it.
+func (c *ConsulBackend) sub(ctx context.Context, key string, msgs chan string) {
+	defer close(msgs)
+
 	var events []*consul.UserEvent
 	var meta *consul.QueryMeta
 	var err error
 	for {
 		// No way to handle failure here, just keep trying to get our first set of events.
 		// We need a successful query to get the last index to search from.
-		events, meta, err = c.client.Event().List(key, nil)
+		events, meta, err = c.client.Event().List(c.eventName(key), nil)
 		if err != nil {
 			log.Println("Subscribe error:", err)
-			time.Sleep(5 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
 			continue
 		}
 		// cache all old events
@@ -447,12 +866,12 @@ func (c *ConsulBackend) sub(key string, msgs chan string) {
 	}
 
 	lastIndex := meta.LastIndex
-	for {
+	for ctx.Err() == nil {
 		opts := &consul.QueryOptions{
 			WaitIndex: lastIndex,
 			WaitTime:  30 * time.Second,
 		}
-		events, meta, err = c.client.Event().List(key, opts)
+		events, meta, err = c.client.Event().List(c.eventName(key), opts)
 		if err != nil {
 			log.Printf("Subscribe(%s): %s\n", key, err.Error())
 			continue
@@ -464,7 +883,11 @@ func (c *ConsulBackend) sub(key string, msgs chan string) {
 		}
 
 		for _, event := range c.seen.Filter(events) {
-			msgs <- string(event.Payload)
+			select {
+			case msgs <- string(event.Payload):
+			case <-ctx.Done():
+				return
+			}
 		}
 
 		lastIndex = meta.LastIndex
@@ -474,7 +897,7 @@ func (c *ConsulBackend) sub(key string, msgs chan string) {
 // Marshal a ServiceRegistry in consul, and associate it with a session so it
 // is deleted on expiration.
 func (c *ConsulBackend) RegisterService(env, pool string, reg *ServiceRegistration) error {
-	key := path.Join("galaxy", "services", env, pool, reg.ExternalIP, reg.Name, reg.ContainerID[0:12])
+	key := path.Join(c.prefix, "services", env, pool, reg.ExternalIP, reg.Name, reg.ContainerID[0:12])
 
 	// check for an existing value, so we don't try to re-acquire the lock
 	existing, _, err := c.client.KV().Get(key, nil)
@@ -519,7 +942,7 @@ func (c *ConsulBackend) RegisterService(env, pool string, reg *ServiceRegistrati
 
 // TODO: do we need to return a *ServiceRegistration?
 func (c *ConsulBackend) UnregisterService(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
-	key := path.Join("galaxy", "services", env, pool, hostIP, name, containerID[0:12])
+	key := path.Join(c.prefix, "services", env, pool, hostIP, name, containerID[0:12])
 
 	registration, err := c.GetServiceRegistration(env, pool, hostIP, name, containerID)
 	if err != nil || registration == nil {
@@ -539,7 +962,7 @@ func (c *ConsulBackend) UnregisterService(env, pool, hostIP, name, containerID s
 }
 
 func (c *ConsulBackend) GetServiceRegistration(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
-	key := path.Join("galaxy", "services", env, pool, hostIP, name, containerID[0:12])
+	key := path.Join(c.prefix, "services", env, pool, hostIP, name, containerID[0:12])
 
 	existingRegistration := ServiceRegistration{
 		Path: key,
@@ -567,7 +990,7 @@ func (c *ConsulBackend) GetServiceRegistration(env, pool, hostIP, name, containe
 }
 
 func (c *ConsulBackend) ListRegistrations(env string) ([]ServiceRegistration, error) {
-	prefix := path.Join("galaxy", "services", env)
+	prefix := path.Join(c.prefix, "services", env)
 
 	kvPairs, _, err := c.client.KV().List(prefix, nil)
 	if err != nil {
@@ -576,8 +999,14 @@ func (c *ConsulBackend) ListRegistrations(env string) ([]ServiceRegistration, er
 
 	regList := []ServiceRegistration{}
 	for _, kvp := range kvPairs {
+		// pool/host_ip/service_name/container_id
+		parts := strings.Split(strings.TrimPrefix(kvp.Key, prefix+"/"), "/")
+		if len(parts) != 4 {
+			continue
+		}
+
 		svcReg := ServiceRegistration{
-			Name: path.Base(kvp.Key),
+			Name: parts[2],
 		}
 		err = json.Unmarshal(kvp.Value, &svcReg)
 		if err != nil {
@@ -585,6 +1014,9 @@ func (c *ConsulBackend) ListRegistrations(env string) ([]ServiceRegistration, er
 			continue
 		}
 
+		// the stored JSON has an empty Pool, so set it from the key afterwards
+		svcReg.Pool = parts[0]
+		svcReg.Path = kvp.Key
 		regList = append(regList, svcReg)
 	}
 
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseConsulURL(t *testing.T) {
+	for _, test := range []struct {
+		url                             string
+		address, scheme, dc, token, pfx string
+		ttl                             time.Duration
+	}{
+		{"consul://", "", "", "", "", "galaxy", 15 * time.Second},
+		{"consul://127.0.0.1:8500", "127.0.0.1:8500", "", "", "", "galaxy", 15 * time.Second},
+		{"consul://secret@consul.example.com:8501/staging/galaxy?scheme=https&dc=east&ttl=30s",
+			"consul.example.com:8501", "https", "east", "secret", "staging/galaxy", 30 * time.Second},
+		{"consul://127.0.0.1:8500?token=secret", "127.0.0.1:8500", "", "", "secret", "galaxy", 15 * time.Second},
+	} {
+		u, _ := url.Parse(test.url)
+		config, prefix, ttl, err := parseConsulURL(u)
+		if err != nil {
+			t.Errorf("parseConsulURL(%q) = %v, want %v", test.url, err, nil)
+			continue
+		}
+
+		if config.Address != test.address || config.Scheme != test.scheme ||
+			config.Datacenter != test.dc || config.Token != test.token {
+			t.Errorf("parseConsulURL(%q) = %+v, want address %q scheme %q dc %q token %q",
+				test.url, config, test.address, test.scheme, test.dc, test.token)
+		}
+
+		if prefix != test.pfx || ttl != test.ttl {
+			t.Errorf("parseConsulURL(%q) = %q, %s, want %q, %s", test.url, prefix, ttl, test.pfx, test.ttl)
+		}
+	}
+
+	for _, bad := range []string{"consul://?ttl=5s", "consul://?ttl=forever", "consul://?scheme=ftp"} {
+		u, _ := url.Parse(bad)
+		if _, _, _, err := parseConsulURL(u); err == nil {
+			t.Errorf("parseConsulURL(%q) = %v, want error", bad, err)
+		}
+	}
+}
+
+func TestConsulEventName(t *testing.T) {
+	c := &ConsulBackend{prefix: "galaxy"}
+	if name := c.eventName("galaxy-dev"); name != "galaxy-dev" {
+		t.Fatalf("eventName(%q) = %q, want %q", "galaxy-dev", name, "galaxy-dev")
+	}
+
+	c.prefix = "staging/galaxy"
+	if name := c.eventName("galaxy-dev"); name != "staging-galaxy-galaxy-dev" {
+		t.Fatalf("eventName(%q) = %q, want %q", "galaxy-dev", name, "staging-galaxy-galaxy-dev")
+	}
+}
@@ -0,0 +1,860 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+/*
+The etcd tree mirrors the consul layout:
+	galaxy/apps/env/app_name
+	galaxy/releases/env/app_name/release_id
+	galaxy/shared/env
+	galaxy/shared/env/pool_name
+	galaxy/pools/env/pool_name
+	galaxy/hosts/env/pool/host_ip
+	galaxy/services/env/pool/host_ip/service_name/container_id
+	galaxy/events/channel
+
+Hosts and services are attached to a lease, which is kept alive for as long
+as this process is running. If the process goes away, the keys are removed
+once the lease TTL runs out.
+*/
+type EtcdBackend struct {
+	client *etcd.Client
+
+	// protects leaseID, which may be replaced if our lease expires
+	sync.Mutex
+	leaseID etcd.LeaseID
+
+	// stop the lease keepalive
+	cancel context.CancelFunc
+}
+
+// timeout for a single etcd request
+const etcdTimeout = 5 * time.Second
+
+func NewEtcdBackend(endpoints []string) (*EtcdBackend, error) {
+	client, err := etcd.New(etcd.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e := &EtcdBackend{
+		client: client,
+	}
+
+	if err := e.grantLease(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	go e.keepAlive(ctx)
+
+	return e, nil
+}
+
+// Close stops the lease keepalive, and closes the etcd client. Any hosts or
+// services registered through this backend will expire after the lease TTL.
+func (e *EtcdBackend) Close() error {
+	e.cancel()
+	return e.client.Close()
+}
+
+func (e *EtcdBackend) grantLease() error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+
+	resp, err := e.client.Grant(ctx, DefaultTTL)
+	if err != nil {
+		return err
+	}
+
+	e.Lock()
+	e.leaseID = resp.ID
+	e.Unlock()
+	return nil
+}
+
+func (e *EtcdBackend) lease() etcd.LeaseID {
+	e.Lock()
+	defer e.Unlock()
+	return e.leaseID
+}
+
+// keep our lease alive in the background, granting a new one if it expired
+// while we were unable to reach etcd.
+func (e *EtcdBackend) keepAlive(ctx context.Context) {
+	for {
+		ch, err := e.client.KeepAlive(ctx, e.lease())
+		if err == nil {
+			// the channel is closed when the lease expires or ctx is done
+			for range ch {
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Errorf("ERROR: etcd lease keepalive failed: %s", err)
+		}
+
+		for {
+			if err := e.grantLease(); err != nil {
+				log.Errorf("ERROR: unable to grant etcd lease: %s", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (e *EtcdBackend) get(key string, opts ...etcd.OpOption) (*etcd.GetResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	return e.client.Get(ctx, key, opts...)
+}
+
+func (e *EtcdBackend) put(key, value string, opts ...etcd.OpOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err := e.client.Put(ctx, key, value, opts...)
+	return err
+}
+
+func (e *EtcdBackend) del(key string, opts ...etcd.OpOption) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	resp, err := e.client.Delete(ctx, key, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Deleted, nil
+}
+
+// return the unique path elements directly under prefix
+func (e *EtcdBackend) children(prefix string) ([]string, error) {
+	prefix = prefix + "/"
+	resp, err := e.get(prefix, etcd.WithPrefix(), etcd.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, kv := range resp.Kvs {
+		name := strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 2)[0]
+		if name != "" && !utils.StringInSlice(name, names) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (e *EtcdBackend) AppExists(app, env string) (bool, error) {
+	resp, err := e.get(path.Join("galaxy", "apps", env, app), etcd.WithKeysOnly())
+	if err != nil {
+		return false, err
+	}
+	return len(resp.Kvs) > 0, nil
+}
+
+func (e *EtcdBackend) CreateApp(app, env string) (bool, error) {
+	emptyConfig := &AppDefinition{
+		AppName:     app,
+		Environment: make(map[string]string),
+	}
+
+	return e.UpdateApp(emptyConfig, env)
+}
+
+func (e *EtcdBackend) ListApps(env string) ([]App, error) {
+	resp, err := e.get(path.Join("galaxy", "apps", env)+"/", etcd.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	apps := []App{}
+	for _, kv := range resp.Kvs {
+		ad := &AppDefinition{}
+		err := json.Unmarshal(kv.Value, ad)
+		if err != nil {
+			log.Warnf("WARN: Unable to decode AppDefinition for %s: %s", kv.Key, err)
+			continue
+		}
+		ad.ConfigIndex = kv.ModRevision
+		apps = append(apps, ad)
+	}
+	return apps, nil
+}
+
+func (e *EtcdBackend) GetApp(app, env string) (App, error) {
+	resp, err := e.get(path.Join("galaxy", "apps", env, app))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, UnknownApp
+	}
+
+	ad := &AppDefinition{}
+	err = json.Unmarshal(resp.Kvs[0].Value, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	ad.ConfigIndex = resp.Kvs[0].ModRevision
+	return ad, nil
+}
+
+func (e *EtcdBackend) UpdateApp(app App, env string) (bool, error) {
+	ad := app.(*AppDefinition)
+
+	js, err := json.Marshal(ad)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+
+	// only write if the app hasn't changed since we loaded it. A missing key
+	// has a ModRevision of 0, same as a new AppDefinition.
+	key := path.Join("galaxy", "apps", env, ad.Name())
+	resp, err := e.client.Txn(ctx).
+		If(etcd.Compare(etcd.ModRevision(key), "=", ad.ConfigIndex)).
+		Then(etcd.OpPut(key, string(js))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+
+	if !resp.Succeeded {
+		return false, StaleConfig
+	}
+
+	ad.ConfigIndex = resp.Header.Revision
+	return true, nil
+}
+
+func (e *EtcdBackend) DeleteApp(app App, env string) (bool, error) {
+	deleted, err := e.del(path.Join("galaxy", "apps", env, app.Name()))
+	if err != nil {
+		return false, err
+	}
+
+	_, err = e.del(path.Join("galaxy", "releases", env, app.Name())+"/", etcd.WithPrefix())
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+func (e *EtcdBackend) AddRelease(app, env string, release *Release) error {
+	prefix := path.Join("galaxy", "releases", env, app) + "/"
+	for {
+		resp, err := e.get(prefix, etcd.WithPrefix(), etcd.WithKeysOnly(),
+			etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+		if err != nil {
+			return err
+		}
+
+		stored := copyRelease(*release)
+		stored.ID = 1
+		if len(resp.Kvs) > 0 {
+			last, err := strconv.ParseInt(path.Base(string(resp.Kvs[len(resp.Kvs)-1].Key)), 10, 64)
+			if err != nil {
+				return err
+			}
+			stored.ID = last + 1
+		}
+
+		js, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		key := prefix + releaseKey(stored.ID)
+		ops := []etcd.Op{etcd.OpPut(key, string(js))}
+		for i := 0; len(resp.Kvs)-i >= MaxReleases; i++ {
+			ops = append(ops, etcd.OpDelete(string(resp.Kvs[i].Key)))
+		}
+
+		// someone else may have added the same release ID first
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		txn, err := e.client.Txn(ctx).
+			If(etcd.Compare(etcd.CreateRevision(key), "=", 0)).
+			Then(ops...).
+			Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if txn.Succeeded {
+			release.ID = stored.ID
+			return nil
+		}
+	}
+}
+
+func (e *EtcdBackend) ListReleases(app, env string) ([]Release, error) {
+	resp, err := e.get(path.Join("galaxy", "releases", env, app)+"/", etcd.WithPrefix(),
+		etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	releases := []Release{}
+	for _, kv := range resp.Kvs {
+		release := Release{}
+		if err := json.Unmarshal(kv.Value, &release); err != nil {
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releases, nil
+}
+
+// AddChange stores a change under the next Seq for the env, like a release
+func (e *EtcdBackend) AddChange(env string, event *ChangeEvent) error {
+	prefix := path.Join("galaxy", "changes", env) + "/"
+	for {
+		resp, err := e.get(prefix, etcd.WithPrefix(), etcd.WithKeysOnly(),
+			etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+		if err != nil {
+			return err
+		}
+
+		stored := *event
+		stored.Seq = 1
+		if len(resp.Kvs) > 0 {
+			last, err := strconv.ParseInt(path.Base(string(resp.Kvs[len(resp.Kvs)-1].Key)), 10, 64)
+			if err != nil {
+				return err
+			}
+			stored.Seq = last + 1
+		}
+
+		js, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		key := prefix + changeKey(stored.Seq)
+		ops := []etcd.Op{etcd.OpPut(key, string(js))}
+		for i := 0; len(resp.Kvs)-i >= MaxChanges; i++ {
+			ops = append(ops, etcd.OpDelete(string(resp.Kvs[i].Key)))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		txn, err := e.client.Txn(ctx).
+			If(etcd.Compare(etcd.CreateRevision(key), "=", 0)).
+			Then(ops...).
+			Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if txn.Succeeded {
+			event.Seq = stored.Seq
+			return nil
+		}
+	}
+}
+
+func (e *EtcdBackend) ListChanges(env string, after int64) ([]ChangeEvent, error) {
+	prefix := path.Join("galaxy", "changes", env) + "/"
+
+	// from the change after the given one, to the end of the prefix
+	end := strings.TrimSuffix(prefix, "/") + "0"
+	resp, err := e.get(prefix+changeKey(after+1), etcd.WithRange(end),
+		etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []ChangeEvent{}
+	for _, kv := range resp.Kvs {
+		event := ChangeEvent{}
+		if err := json.Unmarshal(kv.Value, &event); err != nil {
+			return nil, err
+		}
+		changes = append(changes, event)
+	}
+	return changes, nil
+}
+
+func (e *EtcdBackend) AckChange(env, pool string, ack *ChangeAck) error {
+	js, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	return e.put(path.Join("galaxy", "acks", env, pool, ack.App, ack.HostIP), string(js))
+}
+
+func (e *EtcdBackend) ListAcks(env, pool, app string) ([]ChangeAck, error) {
+	resp, err := e.get(path.Join("galaxy", "acks", env, pool, app)+"/", etcd.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	acks := []ChangeAck{}
+	for _, kv := range resp.Kvs {
+		ack := ChangeAck{}
+		if err := json.Unmarshal(kv.Value, &ack); err != nil {
+			return nil, err
+		}
+		acks = append(acks, ack)
+	}
+	return acks, nil
+}
+
+// Audit entries are keyed by time, like the change log. The key is only
+// created if it doesn't exist, so entries made at the same time are moved
+// apart.
+func (e *EtcdBackend) AddAuditEntry(env string, entry *AuditEntry) error {
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	for t := entry.Time; ; t = t.Add(time.Nanosecond) {
+		key := path.Join("galaxy", "audit", env, auditKey(t))
+
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		txn, err := e.client.Txn(ctx).
+			If(etcd.Compare(etcd.CreateRevision(key), "=", 0)).
+			Then(etcd.OpPut(key, string(js))).
+			Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if txn.Succeeded {
+			return nil
+		}
+	}
+}
+
+func (e *EtcdBackend) ListAuditEntries(env string, since, until time.Time) ([]AuditEntry, error) {
+	prefix := path.Join("galaxy", "audit", env) + "/"
+	resp, err := e.get(prefix+auditKey(since), etcd.WithRange(prefix+auditKey(until)),
+		etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	for _, kv := range resp.Kvs {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(kv.Value, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (e *EtcdBackend) GetWebhooks(env string) ([]Webhook, error) {
+	resp, err := e.get(path.Join("galaxy", "webhooks", env))
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []Webhook{}
+	if len(resp.Kvs) == 0 {
+		return hooks, nil
+	}
+
+	err = json.Unmarshal(resp.Kvs[0].Value, &hooks)
+	return hooks, err
+}
+
+func (e *EtcdBackend) SetWebhooks(env string, hooks []Webhook) error {
+	js, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+	return e.put(path.Join("galaxy", "webhooks", env), string(js))
+}
+
+func (e *EtcdBackend) getSharedConfig(key string) (map[string]string, int64, error) {
+	resp, err := e.get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	shared := map[string]string{}
+	if len(resp.Kvs) == 0 {
+		return shared, 0, nil
+	}
+
+	err = json.Unmarshal(resp.Kvs[0].Value, &shared)
+	return shared, resp.Kvs[0].ModRevision, err
+}
+
+func (e *EtcdBackend) GetSharedConfig(env, pool string) (map[string]string, error) {
+	shared, _, err := e.getSharedConfig(path.Join("galaxy", "shared", env, pool))
+	return shared, err
+}
+
+func (e *EtcdBackend) UpdateSharedConfig(env, pool string, values map[string]string) error {
+	key := path.Join("galaxy", "shared", env, pool)
+	for {
+		shared, rev, err := e.getSharedConfig(key)
+		if err != nil {
+			return err
+		}
+
+		js, err := json.Marshal(applySharedConfig(shared, values))
+		if err != nil {
+			return err
+		}
+
+		// retry if someone else changed the config since we read it
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		txn, err := e.client.Txn(ctx).
+			If(etcd.Compare(etcd.ModRevision(key), "=", rev)).
+			Then(etcd.OpPut(key, string(js))).
+			Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if txn.Succeeded {
+			return nil
+		}
+	}
+}
+
+func (e *EtcdBackend) AssignApp(app, env, pool string) (bool, error) {
+	appCfg, err := e.GetApp(app, env)
+	if err != nil {
+		return false, err
+	}
+
+	ad := appCfg.(*AppDefinition)
+	for i := range ad.Assignments {
+		if ad.Assignments[i].Pool == pool {
+			return false, nil
+		}
+	}
+
+	// FIXME: Instances is hard-coded at -1 to match old behavior
+	ad.Assignments = append(ad.Assignments, AppAssignment{Pool: pool, Instances: -1})
+	return e.UpdateApp(ad, env)
+}
+
+func (e *EtcdBackend) UnassignApp(app, env, pool string) (bool, error) {
+	appCfg, err := e.GetApp(app, env)
+	if err == UnknownApp {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ad := appCfg.(*AppDefinition)
+	found := false
+	for i := range ad.Assignments {
+		if ad.Assignments[i].Pool == pool {
+			ad.Assignments = append(ad.Assignments[:i], ad.Assignments[i+1:]...)
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	return e.UpdateApp(ad, env)
+}
+
+func (e *EtcdBackend) ListAssignments(env, pool string) ([]string, error) {
+	apps, err := e.ListApps(env)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned := []string{}
+	for _, app := range apps {
+		for _, a := range app.(*AppDefinition).Assignments {
+			if a.Pool == pool {
+				assigned = append(assigned, app.Name())
+			}
+		}
+	}
+	return assigned, nil
+}
+
+func (e *EtcdBackend) CreatePool(env, pool string) (bool, error) {
+	key := path.Join("galaxy", "pools", env, pool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	txn, err := e.client.Txn(ctx).
+		If(etcd.Compare(etcd.CreateRevision(key), "=", 0)).
+		Then(etcd.OpPut(key, "")).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return txn.Succeeded, nil
+}
+
+func (e *EtcdBackend) DeletePool(env, pool string) (bool, error) {
+	_, err := e.del(path.Join("galaxy", "pools", env, pool))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (e *EtcdBackend) ListPools(env string) ([]string, error) {
+	return e.children(path.Join("galaxy", "pools", env))
+}
+
+func (e *EtcdBackend) ListEnvs() ([]string, error) {
+	envs, err := e.children(path.Join("galaxy", "apps"))
+	if err != nil {
+		return nil, err
+	}
+
+	poolEnvs, err := e.children(path.Join("galaxy", "pools"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, env := range poolEnvs {
+		if !utils.StringInSlice(env, envs) {
+			envs = append(envs, env)
+		}
+	}
+	return envs, nil
+}
+
+// Hosts are re-written on every update to make sure they are attached to our
+// current lease.
+func (e *EtcdBackend) UpdateHost(env, pool string, host HostInfo) error {
+	js, err := json.Marshal(host)
+	if err != nil {
+		return err
+	}
+
+	key := path.Join("galaxy", "hosts", env, pool, host.HostIP)
+	return e.put(key, string(js), etcd.WithLease(e.lease()))
+}
+
+func (e *EtcdBackend) ListHosts(env, pool string) ([]HostInfo, error) {
+	ips, err := e.children(path.Join("galaxy", "hosts", env, pool))
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]HostInfo, len(ips))
+	for i, ip := range ips {
+		hosts[i].HostIP = ip
+	}
+	return hosts, nil
+}
+
+func (e *EtcdBackend) DeleteHost(env, pool string, host HostInfo) error {
+	_, err := e.del(path.Join("galaxy", "hosts", env, pool, host.HostIP))
+	return err
+}
+
+// Every notification is written to the same key, and subscribers receive
+// each new revision of that key from a watch.
+func (e *EtcdBackend) Notify(key, value string) (int, error) {
+	err := e.put(path.Join("galaxy", "events", key), value)
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (e *EtcdBackend) Subscribe(ctx context.Context, key string) chan string {
+	msgs := make(chan string)
+	go e.sub(ctx, key, msgs)
+	return msgs
+}
+
+func (e *EtcdBackend) sub(ctx context.Context, key string, msgs chan string) {
+	defer close(msgs)
+	key = path.Join("galaxy", "events", key)
+
+	// only deliver events newer than when we subscribed, but resume from the
+	// last revision we've seen if the watch is interrupted.
+	var rev int64
+	for {
+		var watch etcd.WatchChan
+		if rev > 0 {
+			watch = e.client.Watch(ctx, key, etcd.WithRev(rev+1))
+		} else {
+			watch = e.client.Watch(ctx, key)
+		}
+
+		for resp := range watch {
+			if err := resp.Err(); err != nil {
+				log.Errorf("ERROR: Subscribe(%s): %s", key, err)
+				break
+			}
+
+			for _, ev := range resp.Events {
+				rev = ev.Kv.ModRevision
+				if ev.Type == etcd.EventTypePut {
+					select {
+					case msgs <- string(ev.Kv.Value):
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (e *EtcdBackend) RegisterService(env, pool string, reg *ServiceRegistration) error {
+	key := path.Join("galaxy", "services", env, pool, reg.ExternalIP, reg.Name, reg.ContainerID[0:12])
+
+	js, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+
+	return e.put(key, string(js), etcd.WithLease(e.lease()))
+}
+
+func (e *EtcdBackend) UnregisterService(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
+	key := path.Join("galaxy", "services", env, pool, hostIP, name, containerID[0:12])
+
+	registration, err := e.GetServiceRegistration(env, pool, hostIP, name, containerID)
+	if err != nil || registration == nil {
+		return registration, err
+	}
+
+	if registration.ContainerID != containerID {
+		return nil, nil
+	}
+
+	_, err = e.del(key)
+	if err != nil {
+		return registration, err
+	}
+
+	return registration, nil
+}
+
+func (e *EtcdBackend) GetServiceRegistration(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
+	key := path.Join("galaxy", "services", env, pool, hostIP, name, containerID[0:12])
+
+	resp, err := e.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	existingRegistration := ServiceRegistration{
+		Path: key,
+	}
+
+	err = json.Unmarshal(resp.Kvs[0].Value, &existingRegistration)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like consul, there's no cheap way to get the remaining lease time, and
+	// it can't be longer than the TTL.
+	existingRegistration.Expires = time.Now().UTC().Add(time.Duration(DefaultTTL) * time.Second)
+	return &existingRegistration, nil
+}
+
+func (e *EtcdBackend) ListRegistrations(env string) ([]ServiceRegistration, error) {
+	prefix := path.Join("galaxy", "services", env) + "/"
+	resp, err := e.get(prefix, etcd.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	regList := []ServiceRegistration{}
+	for _, kv := range resp.Kvs {
+		// pool/host_ip/service_name/container_id
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), prefix), "/")
+		if len(parts) != 4 {
+			continue
+		}
+
+		svcReg := ServiceRegistration{
+			Name: parts[2],
+		}
+		err = json.Unmarshal(kv.Value, &svcReg)
+		if err != nil {
+			log.Warnf("WARN: Unable to unmarshal JSON for %s: %s", kv.Key, err)
+			continue
+		}
+
+		// the stored JSON has an empty Pool, so set it from the key afterwards
+		svcReg.Pool = parts[0]
+		svcReg.Path = string(kv.Key)
+		regList = append(regList, svcReg)
+	}
+
+	return regList, nil
+}
+
+// Required for the interface, but not used by etcd
+func (e *EtcdBackend) connect()   {}
+func (e *EtcdBackend) reconnect() {}
+
+var _ Backend = &EtcdBackend{}
+
+// parse the etcd endpoints from a registry URL, e.g.
+// etcd://10.0.0.1:2379,10.0.0.2:2379
+func etcdEndpoints(host string) []string {
+	endpoints := []string{}
+	for _, h := range strings.Split(host, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			endpoints = append(endpoints, fmt.Sprintf("http://%s", h))
+		}
+	}
+	return endpoints
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// start an embedded etcd server, and return a backend connected to it along
+// with a function to shut both down.
+func newTestEtcdBackend(t *testing.T) (*EtcdBackend, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	peerURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("unable to start embedded etcd: %s", err)
+	}
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		server.Close()
+		os.RemoveAll(dir)
+		t.Skip("embedded etcd took too long to start")
+	}
+
+	backend, err := NewEtcdBackend([]string{clientURL.String()})
+	if err != nil {
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return backend, func() {
+		backend.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// The shared backend suite covers everything but lease expiry, which takes
+// the full TTL unless the lease is revoked.
+func TestEtcdLeaseExpiry(t *testing.T) {
+	e, stop := newTestEtcdBackend(t)
+	defer stop()
+
+	e.UpdateHost("dev", "web", HostInfo{HostIP: "10.0.0.1"})
+	e.RegisterService("dev", "web", &ServiceRegistration{
+		Name:        "app",
+		ExternalIP:  "10.0.0.1",
+		ContainerID: "0123456789abcdef0123",
+	})
+
+	if _, err := e.client.Revoke(context.Background(), e.lease()); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := e.ListHosts("dev", "web")
+	if len(hosts) != 0 || err != nil {
+		t.Fatalf("ListHosts() = %v, %v, want none", hosts, err)
+	}
+
+	regs, err := e.ListRegistrations("dev")
+	if len(regs) != 0 || err != nil {
+		t.Fatalf("ListRegistrations() = %v, %v, want none", regs, err)
+	}
+}
@@ -1,8 +1,13 @@
 package config
 
 import (
+	"context"
+	"encoding/json"
+	"path"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/litl/galaxy/utils"
 )
@@ -12,10 +17,30 @@ type Value struct {
 	ttl   int
 }
 
+// MemoryBackend keeps all state in this process. It's safe for concurrent
+// use, and apps are copied in and out so callers never share state with the
+// backend.
 type MemoryBackend struct {
-	maps        map[string]map[string]string
-	apps        map[string][]App // env -> []app
-	assignments map[string][]string
+	sync.Mutex
+	pubSub
+
+	maps          map[string]map[string]string
+	apps          map[string][]App // env -> []app
+	assignments   map[string][]string
+	hosts         map[string]memoryHost           // env/pool/host_ip -> host
+	registrations map[string]*ServiceRegistration // env/pool/host_ip/name/container_id -> registration
+	releases      map[string][]Release            // env/app -> releases
+	shared        map[string]map[string]string    // env or env/pool -> config
+	changes       map[string][]ChangeEvent        // env -> change log
+	acks          map[string]map[string]ChangeAck // env/pool/app -> host_ip -> ack
+	audit         map[string][]AuditEntry         // env -> audit log
+	webhooks      map[string][]Webhook            // env -> webhooks
+
+	// used to check expiration, so tests can control the clock
+	now func() time.Time
+
+	// last ConfigIndex assigned to an AppDefinition
+	configIndex int64
 
 	AppExistsFunc       func(app, env string) (bool, error)
 	CreateAppFunc       func(app, env string) (bool, error)
@@ -40,12 +65,65 @@ type MemoryBackend struct {
 	SetMultiFunc     func(key string, values map[string]string) (string, error)
 }
 
+type memoryHost struct {
+	host    HostInfo
+	expires time.Time
+}
+
 func NewMemoryBackend() *MemoryBackend {
 	return &MemoryBackend{
-		maps:        make(map[string]map[string]string),
-		apps:        make(map[string][]App),
-		assignments: make(map[string][]string),
+		maps:          make(map[string]map[string]string),
+		apps:          make(map[string][]App),
+		assignments:   make(map[string][]string),
+		hosts:         make(map[string]memoryHost),
+		registrations: make(map[string]*ServiceRegistration),
+		releases:      make(map[string][]Release),
+		shared:        make(map[string]map[string]string),
+		changes:       make(map[string][]ChangeEvent),
+		acks:          make(map[string]map[string]ChangeAck),
+		audit:         make(map[string][]AuditEntry),
+		webhooks:      make(map[string][]Webhook),
+		now:           time.Now,
+	}
+}
+
+// copyApp returns a deep copy of an app, so changes made by the caller aren't
+// visible until UpdateApp.
+func copyApp(app App) App {
+	switch cfg := app.(type) {
+	case *AppConfig:
+		c := &AppConfig{
+			name:            cfg.name,
+			versionVMap:     utils.NewVersionedMap(),
+			environmentVMap: utils.NewVersionedMap(),
+			portsVMap:       utils.NewVersionedMap(),
+			runtimeVMap:     utils.NewVersionedMap(),
+		}
+		c.versionVMap.UnmarshalMap(cfg.versionVMap.MarshalMap())
+		c.environmentVMap.UnmarshalMap(cfg.environmentVMap.MarshalMap())
+		c.portsVMap.UnmarshalMap(cfg.portsVMap.MarshalMap())
+		c.runtimeVMap.UnmarshalMap(cfg.runtimeVMap.MarshalMap())
+		c.configIndex = cfg.ID()
+		return c
+	case *AppDefinition:
+		c := &AppDefinition{}
+		js, _ := json.Marshal(cfg)
+		json.Unmarshal(js, c)
+		return c
 	}
+	return app
+}
+
+// configIndex returns the version of the stored config an app was loaded
+// from.
+func configIndex(app App) int64 {
+	switch cfg := app.(type) {
+	case *AppConfig:
+		return cfg.configIndex
+	case *AppDefinition:
+		return cfg.ConfigIndex
+	}
+	return 0
 }
 
 func (r *MemoryBackend) AppExists(app, env string) (bool, error) {
@@ -53,12 +131,18 @@ func (r *MemoryBackend) AppExists(app, env string) (bool, error) {
 		return r.AppExistsFunc(app, env)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+	return r.getApp(app, env) != nil, nil
+}
+
+func (r *MemoryBackend) getApp(app, env string) App {
 	for _, s := range r.apps[env] {
 		if s.Name() == app {
-			return true, nil
+			return s
 		}
 	}
-	return false, nil
+	return nil
 }
 
 func (r *MemoryBackend) CreateApp(app, env string) (bool, error) {
@@ -67,8 +151,11 @@ func (r *MemoryBackend) CreateApp(app, env string) (bool, error) {
 		return r.CreateAppFunc(app, env)
 	}
 
-	if exists, err := r.AppExists(app, env); !exists && err == nil {
-		r.apps[env] = append(r.apps[env], NewAppConfig(app, ""))
+	r.Lock()
+	defer r.Unlock()
+
+	if r.getApp(app, env) == nil {
+		r.apps[env] = append(r.apps[env], copyApp(NewAppConfig(app, "")))
 		return true, nil
 	}
 
@@ -76,7 +163,14 @@ func (r *MemoryBackend) CreateApp(app, env string) (bool, error) {
 }
 
 func (r *MemoryBackend) ListApps(env string) ([]App, error) {
-	return r.apps[env], nil
+	r.Lock()
+	defer r.Unlock()
+
+	apps := []App{}
+	for _, cfg := range r.apps[env] {
+		apps = append(apps, copyApp(cfg))
+	}
+	return apps, nil
 }
 
 func (r *MemoryBackend) GetApp(app, env string) (App, error) {
@@ -84,19 +178,51 @@ func (r *MemoryBackend) GetApp(app, env string) (App, error) {
 		return r.GetAppFunc(app, env)
 	}
 
-	for _, cfg := range r.apps[env] {
-		if cfg.Name() == app {
-			return cfg, nil
-		}
+	r.Lock()
+	defer r.Unlock()
+
+	if cfg := r.getApp(app, env); cfg != nil {
+		return copyApp(cfg), nil
 	}
-	return nil, nil
+	return nil, UnknownApp
 }
 
 func (r *MemoryBackend) UpdateApp(svcCfg App, env string) (bool, error) {
 	if r.UpdateAppFunc != nil {
 		return r.UpdateAppFunc(svcCfg, env)
 	}
-	return false, nil
+
+	r.Lock()
+	defer r.Unlock()
+
+	// the stored index is 0 for new apps, same as a new config
+	var storedIndex int64
+	existing := r.getApp(svcCfg.Name(), env)
+	if existing != nil {
+		storedIndex = configIndex(existing)
+	}
+
+	if configIndex(svcCfg) != storedIndex {
+		return false, StaleConfig
+	}
+
+	switch cfg := svcCfg.(type) {
+	case *AppConfig:
+		cfg.configIndex = cfg.ID()
+	case *AppDefinition:
+		r.configIndex++
+		cfg.ConfigIndex = r.configIndex
+	}
+
+	for i, cfg := range r.apps[env] {
+		if cfg.Name() == svcCfg.Name() {
+			r.apps[env][i] = copyApp(svcCfg)
+			return true, nil
+		}
+	}
+
+	r.apps[env] = append(r.apps[env], copyApp(svcCfg))
+	return true, nil
 }
 
 func (r *MemoryBackend) DeleteApp(svcCfg App, env string) (bool, error) {
@@ -104,6 +230,9 @@ func (r *MemoryBackend) DeleteApp(svcCfg App, env string) (bool, error) {
 		return r.DeleteAppFunc(svcCfg, env)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	cfgs := []App{}
 	for _, cfg := range r.apps[env] {
 		if cfg.Name() != svcCfg.Name() {
@@ -111,19 +240,159 @@ func (r *MemoryBackend) DeleteApp(svcCfg App, env string) (bool, error) {
 		}
 	}
 	r.apps[env] = cfgs
+	delete(r.releases, path.Join(env, svcCfg.Name()))
 	return true, nil
 }
 
+func (r *MemoryBackend) AddRelease(app, env string, release *Release) error {
+	r.Lock()
+	defer r.Unlock()
+
+	key := path.Join(env, app)
+	releases := r.releases[key]
+
+	release.ID = 1
+	if len(releases) > 0 {
+		release.ID = releases[len(releases)-1].ID + 1
+	}
+
+	releases = append(releases, copyRelease(*release))
+	if len(releases) > MaxReleases {
+		releases = releases[len(releases)-MaxReleases:]
+	}
+	r.releases[key] = releases
+	return nil
+}
+
+func (r *MemoryBackend) ListReleases(app, env string) ([]Release, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	releases := []Release{}
+	for _, release := range r.releases[path.Join(env, app)] {
+		releases = append(releases, copyRelease(release))
+	}
+	return releases, nil
+}
+
+func (r *MemoryBackend) AddChange(env string, event *ChangeEvent) error {
+	r.Lock()
+	defer r.Unlock()
+
+	changes := r.changes[env]
+
+	event.Seq = 1
+	if len(changes) > 0 {
+		event.Seq = changes[len(changes)-1].Seq + 1
+	}
+
+	changes = append(changes, *event)
+	if len(changes) > MaxChanges {
+		changes = changes[len(changes)-MaxChanges:]
+	}
+	r.changes[env] = changes
+	return nil
+}
+
+func (r *MemoryBackend) ListChanges(env string, after int64) ([]ChangeEvent, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	changes := []ChangeEvent{}
+	for _, event := range r.changes[env] {
+		if event.Seq > after {
+			changes = append(changes, event)
+		}
+	}
+	return changes, nil
+}
+
+func (r *MemoryBackend) AckChange(env, pool string, ack *ChangeAck) error {
+	r.Lock()
+	defer r.Unlock()
+
+	key := path.Join(env, pool, ack.App)
+	if r.acks[key] == nil {
+		r.acks[key] = make(map[string]ChangeAck)
+	}
+	r.acks[key][ack.HostIP] = *ack
+	return nil
+}
+
+func (r *MemoryBackend) ListAcks(env, pool, app string) ([]ChangeAck, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	acks := []ChangeAck{}
+	for _, ack := range r.acks[path.Join(env, pool, app)] {
+		acks = append(acks, ack)
+	}
+	return acks, nil
+}
+
+func (r *MemoryBackend) AddAuditEntry(env string, entry *AuditEntry) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.audit[env] = append(r.audit[env], *entry)
+	return nil
+}
+
+func (r *MemoryBackend) ListAuditEntries(env string, since, until time.Time) ([]AuditEntry, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	entries := []AuditEntry{}
+	for _, entry := range r.audit[env] {
+		if !entry.Time.Before(since) && entry.Time.Before(until) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (r *MemoryBackend) GetWebhooks(env string) ([]Webhook, error) {
+	r.Lock()
+	defer r.Unlock()
+	return append([]Webhook{}, r.webhooks[env]...), nil
+}
+
+func (r *MemoryBackend) SetWebhooks(env string, hooks []Webhook) error {
+	r.Lock()
+	defer r.Unlock()
+	r.webhooks[env] = append([]Webhook{}, hooks...)
+	return nil
+}
+
+func (r *MemoryBackend) GetSharedConfig(env, pool string) (map[string]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	return applySharedConfig(r.shared[path.Join(env, pool)], nil), nil
+}
+
+func (r *MemoryBackend) UpdateSharedConfig(env, pool string, values map[string]string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	key := path.Join(env, pool)
+	r.shared[key] = applySharedConfig(r.shared[key], values)
+	return nil
+}
+
 func (r *MemoryBackend) AssignApp(app, env, pool string) (bool, error) {
 	if r.AssignAppFunc != nil {
 		return r.AssignAppFunc(app, env, pool)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	key := env + "/" + pool
-	if !utils.StringInSlice(app, r.assignments[key]) {
-		r.assignments[key] = append(r.assignments[key], app)
+	if utils.StringInSlice(app, r.assignments[key]) {
+		return false, nil
 	}
 
+	r.assignments[key] = append(r.assignments[key], app)
 	return true, nil
 }
 
@@ -132,6 +401,9 @@ func (r *MemoryBackend) UnassignApp(app, env, pool string) (bool, error) {
 		return r.UnassignAppFunc(app, env, pool)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	key := env + "/" + pool
 	if !utils.StringInSlice(app, r.assignments[key]) {
 		return false, nil
@@ -146,8 +418,11 @@ func (r *MemoryBackend) ListAssignments(env, pool string) ([]string, error) {
 		return r.ListAssignmentsFunc(env, pool)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	key := env + "/" + pool
-	return r.assignments[key], nil
+	return append([]string{}, r.assignments[key]...), nil
 }
 
 func (r *MemoryBackend) CreatePool(env, pool string) (bool, error) {
@@ -155,7 +430,13 @@ func (r *MemoryBackend) CreatePool(env, pool string) (bool, error) {
 		return r.CreatePoolFunc(env, pool)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	key := env + "/" + pool
+	if _, ok := r.assignments[key]; ok {
+		return false, nil
+	}
 	r.assignments[key] = []string{}
 	return true, nil
 }
@@ -165,6 +446,9 @@ func (r *MemoryBackend) DeletePool(env, pool string) (bool, error) {
 		return r.DeletePoolFunc(env, pool)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	key := env + "/" + pool
 	delete(r.assignments, key)
 	return true, nil
@@ -172,13 +456,18 @@ func (r *MemoryBackend) DeletePool(env, pool string) (bool, error) {
 
 func (r *MemoryBackend) ListPools(env string) ([]string, error) {
 	if r.ListPoolsFunc != nil {
-		return r.ListPools(env)
+		return r.ListPoolsFunc(env)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	p := []string{}
 	for k, _ := range r.assignments {
 		parts := strings.Split(k, "/")
-		p = append(p, parts[1])
+		if parts[0] == env {
+			p = append(p, parts[1])
+		}
 	}
 	return p, nil
 }
@@ -188,6 +477,9 @@ func (r *MemoryBackend) ListEnvs() ([]string, error) {
 		return r.ListEnvsFunc()
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	p := []string{}
 	for k, _ := range r.assignments {
 		parts := strings.Split(k, "/")
@@ -210,6 +502,9 @@ func (r *MemoryBackend) Keys(key string) ([]string, error) {
 		return r.KeysFunc(key)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	keys := []string{}
 	rp := strings.NewReplacer("*", `.*`)
 	p := rp.Replace(key)
@@ -233,6 +528,9 @@ func (r *MemoryBackend) TTL(key string) (int, error) {
 }
 
 func (r *MemoryBackend) Delete(key string) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
 	if _, ok := r.maps[key]; ok {
 		delete(r.maps, key)
 		return 1, nil
@@ -245,6 +543,9 @@ func (r *MemoryBackend) AddMember(key, value string) (int, error) {
 		return r.AddMemberFunc(key, value)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	set := r.maps[key]
 	if set == nil {
 		set = make(map[string]string)
@@ -259,6 +560,9 @@ func (r *MemoryBackend) RemoveMember(key, value string) (int, error) {
 		return r.RemoveMemberFunc(key, value)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	set := r.maps[key]
 	if set == nil {
 		return 0, nil
@@ -277,6 +581,9 @@ func (r *MemoryBackend) Members(key string) ([]string, error) {
 		return r.MembersFunc(key)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	values := []string{}
 	set := r.maps[key]
 	for v := range set {
@@ -289,11 +596,11 @@ func (r *MemoryBackend) Notify(key, value string) (int, error) {
 	if r.NotifyFunc != nil {
 		return r.NotifyFunc(key, value)
 	}
-	return 0, nil
+	return r.publish(key, value), nil
 }
 
-func (r *MemoryBackend) Subscribe(key string) chan string {
-	return make(chan string)
+func (r *MemoryBackend) Subscribe(ctx context.Context, key string) chan string {
+	return r.subscribe(ctx, key)
 }
 
 func (r *MemoryBackend) Set(key, field string, value string) (string, error) {
@@ -305,6 +612,9 @@ func (r *MemoryBackend) Get(key, field string) (string, error) {
 }
 
 func (r *MemoryBackend) GetAll(key string) (map[string]string, error) {
+	r.Lock()
+	defer r.Unlock()
+
 	return r.maps[key], nil
 }
 
@@ -313,11 +623,17 @@ func (r *MemoryBackend) SetMulti(key string, values map[string]string) (string,
 		return r.SetMultiFunc(key, values)
 	}
 
+	r.Lock()
+	defer r.Unlock()
+
 	r.maps[key] = values
 	return "OK", nil
 }
 
 func (r *MemoryBackend) DeleteMulti(key string, fields ...string) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
 	m := r.maps[key]
 	for _, field := range fields {
 		delete(m, field)
@@ -326,32 +642,126 @@ func (r *MemoryBackend) DeleteMulti(key string, fields ...string) (int, error) {
 }
 
 func (r *MemoryBackend) UpdateHost(env, pool string, host HostInfo) error {
-	panic("not implemented")
+	r.Lock()
+	defer r.Unlock()
+
+	r.hosts[path.Join(env, pool, host.HostIP)] = memoryHost{
+		host:    host,
+		expires: r.now().UTC().Add(time.Duration(DefaultTTL) * time.Second),
+	}
+	r.expire()
+	return nil
 }
 
 func (r *MemoryBackend) ListHosts(env, pool string) ([]HostInfo, error) {
 	if r.ListHostsFunc != nil {
 		return r.ListHostsFunc(env, pool)
 	}
-	panic("not implemented")
+
+	r.Lock()
+	defer r.Unlock()
+
+	prefix := path.Join(env, pool) + "/"
+	hosts := []HostInfo{}
+	for key, h := range r.hosts {
+		if strings.HasPrefix(key, prefix) && h.expires.After(r.now()) {
+			hosts = append(hosts, h.host)
+		}
+	}
+	return hosts, nil
 }
 
 func (r *MemoryBackend) DeleteHost(env, pool string, host HostInfo) error {
-	panic("not implemented")
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.hosts, path.Join(env, pool, host.HostIP))
+	return nil
+}
+
+// remove expired hosts and registrations. Must be called with the lock held.
+func (r *MemoryBackend) expire() {
+	now := r.now()
+	for key, h := range r.hosts {
+		if !h.expires.After(now) {
+			delete(r.hosts, key)
+		}
+	}
+
+	for key, reg := range r.registrations {
+		if !reg.Expires.After(now) {
+			delete(r.registrations, key)
+		}
+	}
 }
 
 func (r *MemoryBackend) RegisterService(env, pool string, reg *ServiceRegistration) error {
-	panic("not implemented")
+	r.Lock()
+	defer r.Unlock()
+
+	key := path.Join(env, pool, reg.ExternalIP, reg.Name, reg.ContainerID[0:12])
+
+	registration := *reg
+	registration.Path = key
+	registration.Pool = pool
+	if registration.Expires.IsZero() {
+		registration.Expires = r.now().UTC().Add(time.Duration(DefaultTTL) * time.Second)
+	}
+
+	r.registrations[key] = &registration
+	r.expire()
+	return nil
+}
+
+// return a copy of an unexpired registration. Must be called with the lock
+// held.
+func (r *MemoryBackend) getRegistration(key string) *ServiceRegistration {
+	reg, ok := r.registrations[key]
+	if !ok || !reg.Expires.After(r.now()) {
+		return nil
+	}
+
+	registration := *reg
+	return &registration
 }
 
 func (r *MemoryBackend) UnregisterService(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
-	panic("not implemented")
+	r.Lock()
+	defer r.Unlock()
+
+	key := path.Join(env, pool, hostIP, name, containerID[0:12])
+
+	registration := r.getRegistration(key)
+	if registration == nil || registration.ContainerID != containerID {
+		return nil, nil
+	}
+
+	delete(r.registrations, key)
+	return registration, nil
 }
 
 func (r *MemoryBackend) GetServiceRegistration(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
-	panic("not implemented")
+	r.Lock()
+	defer r.Unlock()
+
+	return r.getRegistration(path.Join(env, pool, hostIP, name, containerID[0:12])), nil
 }
 
 func (r *MemoryBackend) ListRegistrations(env string) ([]ServiceRegistration, error) {
-	panic("not implemented")
+	r.Lock()
+	defer r.Unlock()
+
+	regList := []ServiceRegistration{}
+	for key := range r.registrations {
+		if !strings.HasPrefix(key, env+"/") {
+			continue
+		}
+
+		if reg := r.getRegistration(key); reg != nil {
+			regList = append(regList, *reg)
+		}
+	}
+	return regList, nil
 }
+
+var _ Backend = &MemoryBackend{}
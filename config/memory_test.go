@@ -0,0 +1,149 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryUpdateAppCopies(t *testing.T) {
+	b := NewMemoryBackend()
+	b.CreateApp("app", "dev")
+
+	app, _ := b.GetApp("app", "dev")
+	app.EnvSet("FOO", "bar")
+
+	stored, _ := b.GetApp("app", "dev")
+	if stored.EnvGet("FOO") != "" {
+		t.Fatalf("EnvGet(%q) = %q, want %q before UpdateApp", "FOO", stored.EnvGet("FOO"), "")
+	}
+
+	if updated, err := b.UpdateApp(app, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	stored, _ = b.GetApp("app", "dev")
+	if stored.EnvGet("FOO") != "bar" {
+		t.Fatalf("EnvGet(%q) = %q, want %q", "FOO", stored.EnvGet("FOO"), "bar")
+	}
+}
+
+func TestMemoryHostExpiry(t *testing.T) {
+	b := NewMemoryBackend()
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.UpdateHost("dev", "web", HostInfo{HostIP: "10.0.0.1"})
+	b.UpdateHost("dev", "batch", HostInfo{HostIP: "10.0.0.2"})
+
+	hosts, err := b.ListHosts("dev", "web")
+	if len(hosts) != 1 || hosts[0].HostIP != "10.0.0.1" || err != nil {
+		t.Fatalf("ListHosts() = %v, %v, want %v, %v", hosts, err, "10.0.0.1", nil)
+	}
+
+	now = now.Add(time.Duration(DefaultTTL+1) * time.Second)
+
+	hosts, err = b.ListHosts("dev", "web")
+	if len(hosts) != 0 || err != nil {
+		t.Fatalf("ListHosts() = %v, %v, want none", hosts, err)
+	}
+}
+
+func TestMemoryRegistrations(t *testing.T) {
+	b := NewMemoryBackend()
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	containerID := "0123456789abcdef0123"
+	b.RegisterService("dev", "web", &ServiceRegistration{
+		Name:        "app",
+		ExternalIP:  "10.0.0.1",
+		ContainerID: containerID,
+	})
+
+	reg, err := b.GetServiceRegistration("dev", "web", "10.0.0.1", "app", containerID)
+	if reg == nil || err != nil {
+		t.Fatalf("GetServiceRegistration() = %v, %v, want registration", reg, err)
+	}
+
+	regs, _ := b.ListRegistrations("dev")
+	if len(regs) != 1 || regs[0].Pool != "web" {
+		t.Fatalf("ListRegistrations() = %v, want 1 registration in pool %q", regs, "web")
+	}
+
+	// a different container with the same short ID isn't removed
+	reg, _ = b.UnregisterService("dev", "web", "10.0.0.1", "app", containerID[:12]+"ffff")
+	if reg != nil {
+		t.Fatalf("UnregisterService() = %v, want %v", reg, nil)
+	}
+
+	now = now.Add(time.Duration(DefaultTTL+1) * time.Second)
+
+	regs, _ = b.ListRegistrations("dev")
+	if len(regs) != 0 {
+		t.Fatalf("ListRegistrations() = %d, want %d", len(regs), 0)
+	}
+}
+
+func TestMemoryNotify(t *testing.T) {
+	b := NewMemoryBackend()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs := b.Subscribe(ctx, "galaxy-dev")
+
+	if received, err := b.Notify("galaxy-dev", "config"); received != 1 || err != nil {
+		t.Fatalf("Notify() = %d, %v, want %d, %v", received, err, 1, nil)
+	}
+
+	select {
+	case msg := <-msgs:
+		if msg != "config" {
+			t.Fatalf("Subscribe() = %q, want %q", msg, "config")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for notification")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-msgs:
+		if ok {
+			t.Fatal("Subscribe() still open after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the subscription to close")
+	}
+
+	if received, _ := b.Notify("galaxy-dev", "config"); received != 0 {
+		t.Fatalf("Notify() = %d after cancel, want %d", received, 0)
+	}
+}
+
+func TestMemoryConcurrentUpdates(t *testing.T) {
+	b := NewMemoryBackend()
+	b.CreateApp("app", "dev")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			app, _ := b.GetApp("app", "dev")
+			app.EnvSet(fmt.Sprintf("KEY%d", i), "value")
+			b.UpdateApp(app, "dev")
+			b.UpdateHost("dev", "web", HostInfo{HostIP: fmt.Sprintf("10.0.0.%d", i)})
+			b.ListApps("dev")
+			b.ListHosts("dev", "web")
+		}(i)
+	}
+	wg.Wait()
+
+	hosts, _ := b.ListHosts("dev", "web")
+	if len(hosts) != 10 {
+		t.Fatalf("ListHosts() = %d, want %d", len(hosts), 10)
+	}
+}
@@ -1,132 +1,350 @@
 package config
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"reflect"
 	"strings"
 	"time"
+
+	"github.com/litl/galaxy/log"
+)
+
+// ChangeKind says what changed about an app
+type ChangeKind string
+
+const (
+	// a new image version
+	ChangeDeploy ChangeKind = "deploy"
+	// the app's config, or shared config it uses
+	ChangeConfig ChangeKind = "config"
+	// runtime or container settings
+	ChangeRuntime ChangeKind = "runtime"
+	// restart the app without changing anything
+	ChangeRestart ChangeKind = "restart"
+	// the app was assigned to, or unassigned from, a pool
+	ChangeAssign ChangeKind = "assign"
+	// the app was deleted
+	ChangeDelete ChangeKind = "delete"
 )
 
+// MaxChanges is the number of changes kept in each env's change log
+const MaxChanges = 200
+
+// ChangeEvent is published to everything watching an env when one of its
+// apps changes. Each change is logged first, so watchers that miss the
+// notification can catch up from the log.
+type ChangeEvent struct {
+	// Seq numbers the changes in an env in order, starting at 1
+	Seq int64 `json:"seq,omitempty"`
+
+	Kind ChangeKind `json:"kind"`
+	App  string     `json:"app,omitempty"`
+	Env  string     `json:"env"`
+	Pool string     `json:"pool,omitempty"`
+
+	// ID of the app's config after the change, if known
+	ID int64 `json:"id,omitempty"`
+}
+
+func (e ChangeEvent) String() string {
+	js, _ := json.Marshal(e)
+	return string(js)
+}
+
+// changeKey formats a change's Seq so the keys sort in order
+func changeKey(seq int64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// ParseChangeEvent decodes a notification published to env. The plain
+// "config" and "restart <app>" messages sent by older versions are
+// understood too.
+func ParseChangeEvent(env, msg string) (ChangeEvent, error) {
+	event := ChangeEvent{}
+	switch {
+	case strings.HasPrefix(msg, "{"):
+		if err := json.Unmarshal([]byte(msg), &event); err != nil {
+			return event, err
+		}
+	case msg == "config":
+		event.Kind = ChangeConfig
+	case strings.HasPrefix(msg, "restart "):
+		event.Kind = ChangeRestart
+		event.App = strings.TrimPrefix(msg, "restart ")
+	default:
+		return event, fmt.Errorf("unknown notification %q", msg)
+	}
+
+	if event.Kind == "" {
+		return event, fmt.Errorf("notification %q has no kind", msg)
+	}
+
+	event.Env = env
+	return event, nil
+}
+
+// changeKind works out what kind of change turned old into new. A nil old
+// config means the app is new.
+func changeKind(old, new App) ChangeKind {
+	switch {
+	case old == nil || old.Version() != new.Version() || old.VersionID() != new.VersionID():
+		return ChangeDeploy
+	case !reflect.DeepEqual(old.Env(), new.Env()):
+		return ChangeConfig
+	}
+	return ChangeRuntime
+}
+
+// ConfigChange is sent to a watcher for each change to an app, along with
+// the app's config after the change. A change with an Error means the env
+// couldn't be checked.
 type ConfigChange struct {
+	Event     ChangeEvent
 	AppConfig App
-	Restart   bool
 	Error     error
 }
 
-func (s *Store) CheckForChangesNow() {
-	s.pollCh <- true
+// changesKey is the pub/sub key for changes in env
+func changesKey(env string) string {
+	return fmt.Sprintf("galaxy-%s", env)
 }
 
-func (s *Store) checkForChanges(env string) {
-	lastVersion := make(map[string]int64)
-	for {
-		appCfg, err := s.ListApps(env)
-		if err != nil {
-			s.restartChan <- &ConfigChange{
-				Error: err,
-			}
-			time.Sleep(5 * time.Second)
-			continue
-		}
+// NotifyChange adds a change to the env's change log, setting its Seq, and
+// publishes it to everything watching the env. Nobody may be listening when
+// it's published, so agents ack the changes they handle instead, and catch up
+// on what they missed from the log.
+func (s *Store) NotifyChange(event *ChangeEvent) error {
+	if err := s.Backend.AddChange(event.Env, event); err != nil {
+		return err
+	}
 
-		for _, config := range appCfg {
-			lastVersion[config.Name()] = config.ID()
-		}
-		break
+	_, err := s.Backend.Notify(changesKey(event.Env), event.String())
+	if err != nil {
+		return err
+	}
+	return nil
+}
 
+// NotifyRestart asks every host running the app to restart it, and returns
+// the Seq of the change, which the hosts ack once they have.
+func (s *Store) NotifyRestart(app, env string) (int64, error) {
+	event := &ChangeEvent{Kind: ChangeRestart, App: app, Env: env}
+	if err := s.NotifyChange(event); err != nil {
+		return 0, err
 	}
 
-	for {
-		<-s.pollCh
-		appCfg, err := s.ListApps(env)
-		if err != nil {
-			s.restartChan <- &ConfigChange{
-				Error: err,
-			}
-			continue
-		}
-		for _, changedConfig := range appCfg {
-			changeCopy := changedConfig
-			if changedConfig.ID() != lastVersion[changedConfig.Name()] {
-				log.Printf("%s changed from %d to %d", changedConfig.Name(),
-					lastVersion[changedConfig.Name()], changedConfig.ID())
-				lastVersion[changedConfig.Name()] = changedConfig.ID()
-				s.restartChan <- &ConfigChange{
-					AppConfig: changeCopy,
-				}
-			}
-		}
+	s.NotifyWebhooks(WebhookEvent{Event: WebhookRestart, Env: env, App: app, User: changedBy()})
+	return event.Seq, nil
+}
+
+// how often watchers check for changes they weren't notified of
+var watchPollInterval = 10 * time.Second
+
+type watcher struct {
+	store   *Store
+	env     string
+	changes chan *ConfigChange
+
+	// the last config seen for each app
+	apps map[string]App
+
+	// Seq of the last logged change handled
+	seq int64
+}
+
+// Watch sends a ConfigChange for every change to the apps in env, until ctx
+// is cancelled, and then closes the channel. Changes are read from the env's
+// change log whenever one is published, and every watchPollInterval in case
+// the notification was missed, so each is sent once and in order.
+func (s *Store) Watch(ctx context.Context, env string) chan *ConfigChange {
+	w := &watcher{
+		store:   s,
+		env:     env,
+		changes: make(chan *ConfigChange, 10),
+		apps:    make(map[string]App),
 	}
+	go w.run(ctx)
+	return w.changes
 }
 
-func (s *Store) checkForChangePeriodically(stop chan struct{}) {
-	// TODO: default polling interval
-	ticker := time.NewTicker(10 * time.Second)
+func (w *watcher) run(ctx context.Context) {
+	defer close(w.changes)
+
+	msgs := w.store.Backend.Subscribe(ctx, changesKey(w.env))
+
+	// start from the current configs, so only what changes from here is sent
+	for !w.load(ctx) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case <-stop:
-			ticker.Stop()
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			s.CheckForChangesNow()
+			w.catchUp(ctx)
+			w.checkForChanges(ctx)
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			w.handle(ctx, msg)
 		}
 	}
 }
 
-func (s *Store) restartApp(app, env string) {
-	appCfg, err := s.GetApp(app, env)
+func (w *watcher) load(ctx context.Context) bool {
+	// read the position in the log first, so nothing is missed in between
+	changes, err := w.store.Backend.ListChanges(w.env, 0)
 	if err != nil {
-		s.restartChan <- &ConfigChange{
-			Error: err,
-		}
-		return
+		w.send(ctx, &ConfigChange{Error: err})
+		return false
+	}
+
+	apps, err := w.store.ListApps(w.env)
+	if err != nil {
+		w.send(ctx, &ConfigChange{Error: err})
+		return false
 	}
 
-	s.restartChan <- &ConfigChange{
-		Restart:   true,
-		AppConfig: appCfg,
+	if len(changes) > 0 {
+		w.seq = changes[len(changes)-1].Seq
 	}
+	for _, app := range apps {
+		w.apps[app.Name()] = app
+	}
+	return true
 }
 
-func (s *Store) NotifyRestart(app, env string) error {
-	// TODO: received count ignored, use it somehow?
-	_, err := s.Backend.Notify(fmt.Sprintf("galaxy-%s", env), fmt.Sprintf("restart %s", app))
-	if err != nil {
-		return err
+// send delivers a change, unless the watch is cancelled first
+func (w *watcher) send(ctx context.Context, change *ConfigChange) bool {
+	select {
+	case w.changes <- change:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	return nil
 }
 
-func (s *Store) NotifyEnvChanged(env string) error {
-	// TODO: received count ignored, use it somehow?
-	_, err := s.Backend.Notify(fmt.Sprintf("galaxy-%s", env), "config")
+// checkForChanges sends a change for every app whose config ID differs
+// from the last one seen.
+func (w *watcher) checkForChanges(ctx context.Context) {
+	apps, err := w.store.ListApps(w.env)
 	if err != nil {
-		return err
+		w.send(ctx, &ConfigChange{Error: err})
+		return
+	}
+
+	for _, app := range apps {
+		last := w.apps[app.Name()]
+		if last != nil && last.ID() == app.ID() {
+			continue
+		}
+
+		lastID := int64(0)
+		if last != nil {
+			lastID = last.ID()
+		}
+		log.Printf("%s changed from %d to %d\n", app.Name(), lastID, app.ID())
+		w.apps[app.Name()] = app
+
+		event := ChangeEvent{
+			Kind: changeKind(last, app),
+			App:  app.Name(),
+			Env:  w.env,
+			ID:   app.ID(),
+		}
+		if !w.send(ctx, &ConfigChange{Event: event, AppConfig: app}) {
+			return
+		}
 	}
-	return nil
 }
 
-func (s *Store) subscribeChanges(env string) {
+// catchUp sends the logged changes since the last one handled, in order.
+func (w *watcher) catchUp(ctx context.Context) {
+	changes, err := w.store.Backend.ListChanges(w.env, w.seq)
+	if err != nil {
+		w.send(ctx, &ConfigChange{Error: err})
+		return
+	}
 
-	msgs := s.Backend.Subscribe(fmt.Sprintf("galaxy-%s", env))
-	for {
+	if len(changes) > 0 && changes[0].Seq > w.seq+1 {
+		// the log was trimmed past where we were, so look for what changed
+		log.Warnf("WARN: Missed changes %d to %d in %s", w.seq+1, changes[0].Seq-1, w.env)
+		w.checkForChanges(ctx)
+	}
 
-		msg := <-msgs
-		if msg == "config" {
-			s.CheckForChangesNow()
-		} else if strings.HasPrefix(msg, "restart") {
-			parts := strings.Split(msg, " ")
-			app := parts[1]
-			s.restartApp(app, env)
-		} else {
-			log.Printf("Ignoring notification: %s\n", msg)
+	for _, event := range changes {
+		if !w.deliver(ctx, event) {
+			return
 		}
+		w.seq = event.Seq
+	}
+}
+
+// deliver sends a logged change, unless the app's config was already sent
+func (w *watcher) deliver(ctx context.Context, event ChangeEvent) bool {
+	switch event.Kind {
+	case ChangeRestart, ChangeAssign:
+		// the config ID doesn't change, so these are always sent
+		app, err := w.store.GetApp(event.App, w.env)
+		if err != nil {
+			return w.send(ctx, &ConfigChange{Event: event, Error: err})
+		}
+		event.ID = app.ID()
+		return w.send(ctx, &ConfigChange{Event: event, AppConfig: app})
+	case ChangeDelete:
+		delete(w.apps, event.App)
+		return w.send(ctx, &ConfigChange{Event: event})
+	}
+
+	app, err := w.store.GetApp(event.App, w.env)
+	if err != nil {
+		// deleted since
+		return true
+	}
+
+	// a later change, or a poll, may have sent this config already
+	if last := w.apps[event.App]; last != nil && last.ID() == app.ID() {
+		return true
 	}
+
+	w.apps[event.App] = app
+	event.ID = app.ID()
+	return w.send(ctx, &ConfigChange{Event: event, AppConfig: app})
 }
 
-func (s *Store) Watch(env string, stop chan struct{}) chan *ConfigChange {
-	go s.checkForChanges(env)
-	go s.checkForChangePeriodically(stop)
-	go s.subscribeChanges(env)
-	return s.restartChan
+// handle reads the log for a published change. An empty message is sent by
+// backends when they resubscribe, since anything could have been missed.
+// Notifications from older versions aren't logged, so they're sent as they
+// are.
+func (w *watcher) handle(ctx context.Context, msg string) {
+	if msg == "" {
+		w.catchUp(ctx)
+		return
+	}
+
+	event, err := ParseChangeEvent(w.env, msg)
+	if err != nil {
+		log.Printf("Ignoring notification: %s\n", err)
+		return
+	}
+
+	switch {
+	case event.Seq > 0:
+		w.catchUp(ctx)
+	case event.Kind == ChangeRestart:
+		w.deliver(ctx, event)
+	default:
+		w.checkForChanges(ctx)
+	}
 }
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseChangeEvent(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want ChangeEvent
+	}{
+		{`{"kind":"deploy","app":"app","env":"dev","id":3}`, ChangeEvent{Kind: ChangeDeploy, App: "app", Env: "dev", ID: 3}},
+		{"config", ChangeEvent{Kind: ChangeConfig, Env: "dev"}},
+		{"restart app", ChangeEvent{Kind: ChangeRestart, App: "app", Env: "dev"}},
+	} {
+		got, err := ParseChangeEvent("dev", tc.msg)
+		if err != nil || got != tc.want {
+			t.Fatalf("ParseChangeEvent(%q) = %v, %v, want %v", tc.msg, got, err, tc.want)
+		}
+	}
+
+	for _, msg := range []string{"", "reload app", `{"app":"app"}`} {
+		if _, err := ParseChangeEvent("dev", msg); err == nil {
+			t.Fatalf("ParseChangeEvent(%q) = %v, want error", msg, err)
+		}
+	}
+}
+
+// waitSubscribed waits for a watcher to subscribe to changes in env
+func waitSubscribed(t *testing.T, b *MemoryBackend, env string) {
+	for i := 0; i < 100; i++ {
+		b.pubSub.Lock()
+		n := len(b.subs[changesKey(env)])
+		b.pubSub.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the watcher to subscribe")
+}
+
+func nextChange(t *testing.T, changes chan *ConfigChange) *ConfigChange {
+	select {
+	case change := <-changes:
+		if change == nil || change.Error != nil {
+			t.Fatalf("Watch() = %v, want a change", change)
+		}
+		return change
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a change")
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	s, b := NewTestStore()
+	assertAppCreated(t, s, "app")
+	assertPoolCreated(t, s, "web")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := s.Watch(ctx, "dev")
+	waitSubscribed(t, b, "dev")
+
+	app, _ := s.GetApp("app", "dev")
+	app.SetVersion("app:2")
+	s.UpdateApp(app, "dev")
+
+	change := nextChange(t, changes)
+	if change.Event.Kind != ChangeDeploy || change.AppConfig.Version() != "app:2" || change.Event.ID != app.ID() {
+		t.Fatalf("Watch() = %v, %s, want a deploy of app:2", change.Event, change.AppConfig.Version())
+	}
+
+	app, _ = s.GetApp("app", "dev")
+	app.EnvSet("FOO", "bar")
+	s.UpdateApp(app, "dev")
+
+	if change := nextChange(t, changes); change.Event.Kind != ChangeConfig {
+		t.Fatalf("Watch() = %v, want a %s change", change.Event, ChangeConfig)
+	}
+
+	s.AssignApp("app", "dev", "web")
+	change = nextChange(t, changes)
+	if change.Event.Kind != ChangeAssign || change.Event.Pool != "web" || change.AppConfig == nil {
+		t.Fatalf("Watch() = %v, want app assigned to web", change.Event)
+	}
+
+	s.NotifyRestart("app", "dev")
+	if change := nextChange(t, changes); change.Event.Kind != ChangeRestart || change.Event.App != "app" {
+		t.Fatalf("Watch() = %v, want app restarted", change.Event)
+	}
+
+	cancel()
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Watch() still open after cancel")
+		}
+	}
+}
+
+func TestWatchCatchUp(t *testing.T) {
+	s, b := NewTestStore()
+	assertAppCreated(t, s, "app")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := s.Watch(ctx, "dev")
+	waitSubscribed(t, b, "dev")
+
+	// lose the notifications, as if the watcher was reconnecting
+	b.NotifyFunc = func(key, value string) (int, error) {
+		return 0, nil
+	}
+	s.NotifyRestart("app", "dev")
+	app, _ := s.GetApp("app", "dev")
+	app.SetVersion("app:2")
+	s.UpdateApp(app, "dev")
+	b.NotifyFunc = nil
+
+	// the next notification delivers what was missed, in order
+	s.NotifyRestart("app", "dev")
+
+	for i, want := range []ChangeKind{ChangeRestart, ChangeDeploy, ChangeRestart} {
+		change := nextChange(t, changes)
+		if change.Event.Kind != want || change.Event.Seq != int64(i+1) {
+			t.Fatalf("Watch() = %v, want %s with seq %d", change.Event, want, i+1)
+		}
+	}
+
+	// resubscribing catches up too, without sending anything twice
+	b.publish(changesKey("dev"), "")
+	select {
+	case change := <-changes:
+		t.Fatalf("Watch() = %v, want nothing new", change.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchCatchUpTrimmed(t *testing.T) {
+	s, b := NewTestStore()
+	assertAppCreated(t, s, "app")
+
+	// start on an empty log
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := s.Watch(ctx, "dev")
+	waitSubscribed(t, b, "dev")
+
+	// miss so many changes that the first is trimmed from the log
+	b.NotifyFunc = func(key, value string) (int, error) {
+		return 0, nil
+	}
+	app, _ := s.GetApp("app", "dev")
+	app.SetVersion("app:2")
+	s.UpdateApp(app, "dev")
+	for i := 0; i < MaxChanges; i++ {
+		s.NotifyRestart("app", "dev")
+	}
+	b.NotifyFunc = nil
+	b.publish(changesKey("dev"), "")
+
+	// the trimmed deploy is found by looking, then the rest are sent in order
+	change := nextChange(t, changes)
+	if change.Event.Kind != ChangeDeploy || change.AppConfig.Version() != "app:2" {
+		t.Fatalf("Watch() = %v, want the missed deploy", change.Event)
+	}
+	for i := 0; i < MaxChanges; i++ {
+		change := nextChange(t, changes)
+		if want := int64(i + 2); change.Event.Kind != ChangeRestart || change.Event.Seq != want {
+			t.Fatalf("Watch() = %v, want restart with seq %d", change.Event, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"context"
+	"sync"
+
+	"github.com/litl/galaxy/log"
+)
+
+// pubSub delivers notifications between goroutines in a single process, for
+// backends that have no server to publish through.
+type pubSub struct {
+	sync.Mutex
+	subs map[string][]chan string
+}
+
+// buffered notifications per subscriber before messages are dropped
+const pubSubBuffer = 64
+
+// subscribe returns a channel of the values published to key, which is
+// closed once ctx is cancelled.
+func (p *pubSub) subscribe(ctx context.Context, key string) chan string {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.subs == nil {
+		p.subs = make(map[string][]chan string)
+	}
+
+	ch := make(chan string, pubSubBuffer)
+	p.subs[key] = append(p.subs[key], ch)
+
+	go func() {
+		<-ctx.Done()
+		p.unsubscribe(key, ch)
+	}()
+	return ch
+}
+
+func (p *pubSub) unsubscribe(key string, ch chan string) {
+	p.Lock()
+	defer p.Unlock()
+
+	subs := p.subs[key]
+	for i, sub := range subs {
+		if sub == ch {
+			p.subs[key] = append(subs[:i:i], subs[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// subscribers returns the number of open subscriptions, for any key
+func (p *pubSub) subscribers() int {
+	p.Lock()
+	defer p.Unlock()
+
+	n := 0
+	for _, subs := range p.subs {
+		n += len(subs)
+	}
+	return n
+}
+
+// publish sends value to every subscriber of key, and returns the number of
+// subscribers that received it.
+func (p *pubSub) publish(key, value string) int {
+	p.Lock()
+	defer p.Unlock()
+
+	received := 0
+	for _, ch := range p.subs[key] {
+		select {
+		case ch <- value:
+			received++
+		default:
+			log.Warnf("WARN: dropped notification %q for %s, subscriber is not keeping up", value, key)
+		}
+	}
+	return received
+}
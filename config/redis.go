@@ -1,9 +1,15 @@
 package config
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,14 +22,91 @@ import (
 type RedisBackend struct {
 	redisPool redis.Pool
 	RedisHost string
+
+	// Password and Database are sent with AUTH and SELECT on connect
+	Password string
+	Database int
+	TLS      bool
+
+	// With SentinelAddrs set, RedisHost is ignored and the current master
+	// for SentinelMaster is looked up from the sentinels.
+	SentinelAddrs  []string
+	SentinelMaster string
+
+	// Prefix namespaces every key and channel, so more than one galaxy
+	// installation can share a redis.
+	Prefix string
 }
 
-func (r *RedisBackend) AppExists(app, env string) (bool, error) {
-	matches, err := r.Keys(path.Join(env, app, "*"))
-	if err != nil {
-		return false, err
+// NewRedisBackend creates a backend from a registry URL:
+//	redis://[:password@]host[:port][/db][?prefix=name]
+//	rediss://...                                       (TLS)
+//	redis+sentinel://[:password@]host[:port][,host[:port]...]/master[/db][?prefix=name]
+func NewRedisBackend(u *url.URL) (*RedisBackend, error) {
+	r := &RedisBackend{
+		Prefix: strings.Trim(u.Query().Get("prefix"), "/"),
+	}
+
+	if u.User != nil {
+		r.Password, _ = u.User.Password()
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "redis", "rediss":
+		r.RedisHost = withDefaultPort(u.Host, "6379")
+		r.TLS = u.Scheme == "rediss"
+	case "redis+sentinel":
+		for _, addr := range strings.Split(u.Host, ",") {
+			r.SentinelAddrs = append(r.SentinelAddrs, withDefaultPort(addr, "26379"))
+		}
+
+		if len(parts) == 0 {
+			return nil, fmt.Errorf("no sentinel master name in %s", u.Path)
+		}
+		r.SentinelMaster = parts[0]
+		parts = parts[1:]
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+
+	if len(parts) > 1 {
+		return nil, fmt.Errorf("unexpected path %s", u.Path)
+	}
+
+	if len(parts) == 1 {
+		db, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid database %s", parts[0])
+		}
+		r.Database = db
+	}
+
+	r.connect()
+	return r, nil
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
 	}
-	return len(matches) > 0, nil
+	return net.JoinHostPort(host, port)
+}
+
+// key returns the key as stored in redis, with the namespace prefix
+func (r *RedisBackend) key(key string) string {
+	if r.Prefix == "" {
+		return key
+	}
+	return r.Prefix + "/" + key
+}
+
+func (r *RedisBackend) AppExists(app, env string) (bool, error) {
+	return r.IsMember(appsIndex(env), app)
 }
 
 func (r *RedisBackend) CreateApp(app, env string) (bool, error) {
@@ -32,8 +115,7 @@ func (r *RedisBackend) CreateApp(app, env string) (bool, error) {
 }
 
 func (r *RedisBackend) ListApps(env string) ([]App, error) {
-	// TODO: convert to scan
-	apps, err := r.Keys(path.Join(env, "*", "version"))
+	apps, err := r.Members(appsIndex(env))
 	if err != nil {
 		return nil, err
 	}
@@ -41,19 +123,12 @@ func (r *RedisBackend) ListApps(env string) ([]App, error) {
 	// TODO: is it OK to error out early?
 	var appList []App
 	for _, app := range apps {
-		parts := strings.Split(app, "/")
-
-		// app entries should be 3 parts, /env/pool/app
-		if len(parts) != 3 {
-			continue
-		}
-
-		// we don't want host keys
-		if parts[1] == "hosts" {
+		cfg, err := r.GetApp(app, env)
+		// deleted since we read the index
+		if err == UnknownApp {
 			continue
 		}
 
-		cfg, err := r.GetApp(parts[1], env)
 		if err != nil {
 			return nil, err
 		}
@@ -78,79 +153,469 @@ func (r *RedisBackend) UpdateApp(cfg App, env string) (bool, error) {
 		}
 	}
 
-	//TODO: user MULTI/EXEC
-	err := r.SaveVMap(path.Join(env, svcCfg.name, "environment"),
-		svcCfg.environmentVMap)
+	vmaps := r.appVMaps(env, svcCfg)
 
-	if err != nil {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
 		return false, err
 	}
 
-	err = r.SaveVMap(path.Join(env, svcCfg.name, "version"),
-		svcCfg.versionVMap)
+	// Watch the app keys, and make sure nobody has changed the app since we
+	// loaded it. If they change it before EXEC, the transaction is aborted.
+	keys := redis.Args{}
+	for key := range vmaps {
+		keys = keys.Add(key)
+	}
 
-	if err != nil {
+	if _, err := conn.Do("WATCH", keys...); err != nil {
 		return false, err
 	}
 
-	err = r.SaveVMap(path.Join(env, svcCfg.name, "ports"),
-		svcCfg.portsVMap)
+	// the stored ID is the highest version in any of its vmaps
+	storedID := int64(0)
+	for key := range vmaps {
+		serialized, err := hgetall(conn, key)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
 
-	if err != nil {
-		return false, err
+		stored := utils.NewVersionedMap()
+		stored.UnmarshalMap(serialized)
+		if stored.LatestVersion() > storedID {
+			storedID = stored.LatestVersion()
+		}
 	}
 
-	err = r.SaveVMap(path.Join(env, svcCfg.name, "runtime"),
-		svcCfg.runtimeVMap)
+	if storedID != svcCfg.configIndex {
+		conn.Do("UNWATCH")
+		return false, StaleConfig
+	}
 
+	// Write every part of the app, and drop superseded entries, in a single
+	// transaction so readers never see a new version with the old env.
+	conn.Send("MULTI")
+	for key, vmap := range vmaps {
+		serialized := vmap.MarshalMap()
+		if len(serialized) == 0 {
+			continue
+		}
+		conn.Send("HMSET", redis.Args{}.Add(key).AddFlat(serialized)...)
+
+		expired := vmap.MarshalExpiredMap(5)
+		if len(expired) == 0 {
+			continue
+		}
+
+		fields := redis.Args{}.Add(key)
+		for field := range expired {
+			fields = fields.Add(field)
+		}
+		conn.Send("HDEL", fields...)
+	}
+	conn.Send("SADD", r.key(appsIndex(env)), svcCfg.name)
+	conn.Send("SADD", r.key(redisEnvsKey), env)
+
+	reply, err := conn.Do("EXEC")
 	if err != nil {
 		return false, err
 	}
+
+	// a nil reply means a watched key changed, and nothing was written
+	if reply == nil {
+		return false, StaleConfig
+	}
+
+	svcCfg.configIndex = svcCfg.ID()
 	return true, nil
 }
 
+// appVMaps returns the VersionedMaps that make up an app config, by the redis
+// key they are stored under.
+func (r *RedisBackend) appVMaps(env string, svcCfg *AppConfig) map[string]*utils.VersionedMap {
+	return map[string]*utils.VersionedMap{
+		r.key(path.Join(env, svcCfg.name, "environment")): svcCfg.environmentVMap,
+		r.key(path.Join(env, svcCfg.name, "version")):     svcCfg.versionVMap,
+		r.key(path.Join(env, svcCfg.name, "ports")):       svcCfg.portsVMap,
+		r.key(path.Join(env, svcCfg.name, "runtime")):     svcCfg.runtimeVMap,
+	}
+}
+
 func (r *RedisBackend) GetApp(app, env string) (App, error) {
 	svcCfg := NewAppConfig(path.Base(app), "").(*AppConfig)
 
-	err := r.LoadVMap(path.Join(env, app, "environment"), svcCfg.environmentVMap)
-	if err != nil {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
 		return nil, err
 	}
-	err = r.LoadVMap(path.Join(env, app, "version"), svcCfg.versionVMap)
+
+	// Read all the parts in one transaction, so we get a consistent snapshot
+	// even if the app is being updated.
+	keys := []string{}
+	vmaps := []*utils.VersionedMap{}
+	conn.Send("MULTI")
+	for key, vmap := range r.appVMaps(env, svcCfg) {
+		keys = append(keys, key)
+		vmaps = append(vmaps, vmap)
+		conn.Send("HGETALL", key)
+	}
+
+	replies, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
 		return nil, err
 	}
 
-	err = r.LoadVMap(path.Join(env, app, "ports"), svcCfg.portsVMap)
+	if len(replies) != len(keys) {
+		return nil, fmt.Errorf("expected %d replies for %s, got %d", len(keys), app, len(replies))
+	}
+
+	for i, reply := range replies {
+		serialized, err := hashValues(reply, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load %s: %s", keys[i], err)
+		}
+		vmaps[i].UnmarshalMap(serialized)
+	}
+
+	// every app has at least a version entry once it's created
+	if svcCfg.ID() == 0 {
+		return nil, UnknownApp
+	}
+
+	svcCfg.configIndex = svcCfg.ID()
+	return svcCfg, nil
+}
+
+func (r *RedisBackend) DeleteApp(svcCfg App, env string) (bool, error) {
+	// remove every key in a single DEL, so the app is never half deleted
+	keys := redis.Args{}.Add(r.key(path.Join(env, svcCfg.Name())))
+	for _, k := range []string{"environment", "version", "ports", "runtime", "releases", "release_id"} {
+		keys = keys.Add(r.key(path.Join(env, svcCfg.Name(), k)))
+	}
+
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return false, err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", keys...)
+	conn.Send("SREM", r.key(appsIndex(env)), svcCfg.Name())
+	replies, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	return replies[0] > 0, nil
+}
+
+// Releases are kept in a list, and numbered from a counter, so the IDs are
+// never reused after the list is trimmed.
+func (r *RedisBackend) AddRelease(app, env string, release *Release) error {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return err
+	}
+
+	id, err := redis.Int64(conn.Do("INCR", r.key(path.Join(env, app, "release_id"))))
 	if err != nil {
+		return err
+	}
+
+	stored := copyRelease(*release)
+	stored.ID = id
+
+	js, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	key := r.key(path.Join(env, app, "releases"))
+	conn.Send("MULTI")
+	conn.Send("RPUSH", key, js)
+	conn.Send("LTRIM", key, -MaxReleases, -1)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	release.ID = id
+	return nil
+}
+
+func (r *RedisBackend) ListReleases(app, env string) ([]Release, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
 		return nil, err
 	}
 
-	err = r.LoadVMap(path.Join(env, app, "runtime"), svcCfg.runtimeVMap)
+	values, err := redis.Strings(conn.Do("LRANGE", r.key(path.Join(env, app, "releases")), 0, -1))
 	if err != nil {
 		return nil, err
 	}
-	return svcCfg, nil
+
+	releases := []Release{}
+	for _, js := range values {
+		release := Release{}
+		if err := json.Unmarshal([]byte(js), &release); err != nil {
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releases, nil
 }
 
-func (r *RedisBackend) DeleteApp(svcCfg App, env string) (bool, error) {
-	deletedOne := false
-	deleted, err := r.Delete(path.Join(env, svcCfg.Name()))
+// addChangeScript numbers a change and adds it to the env's log in one step,
+// so changes are always logged in the order they're numbered. The log is a
+// sorted set scored by Seq, and each member is prefixed with its Seq to keep
+// identical changes apart.
+var addChangeScript = redis.NewScript(2, `
+local seq = redis.call("INCR", KEYS[1])
+redis.call("ZADD", KEYS[2], seq, seq .. " " .. ARGV[1])
+redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -tonumber(ARGV[2]) - 1)
+return seq
+`)
+
+func (r *RedisBackend) AddChange(env string, event *ChangeEvent) error {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return err
+	}
+
+	stored := *event
+	stored.Seq = 0
+	js, err := json.Marshal(stored)
 	if err != nil {
-		return false, err
+		return err
+	}
+
+	seq, err := redis.Int64(addChangeScript.Do(conn, r.key(envKey(env, "change_id")),
+		r.key(envKey(env, "changes")), js, MaxChanges))
+	if err != nil {
+		return err
 	}
 
-	deletedOne = deletedOne || deleted == 1
+	event.Seq = seq
+	return nil
+}
 
-	for _, k := range []string{"environment", "version", "ports", "runtime"} {
-		deleted, err = r.Delete(path.Join(env, svcCfg.Name(), k))
+func (r *RedisBackend) ListChanges(env string, after int64) ([]ChangeEvent, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return nil, err
+	}
+
+	values, err := redis.Strings(conn.Do("ZRANGEBYSCORE", r.key(envKey(env, "changes")),
+		fmt.Sprintf("(%d", after), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []ChangeEvent{}
+	for _, value := range values {
+		parts := strings.SplitN(value, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad change log entry %q", value)
+		}
+
+		event := ChangeEvent{}
+		if err := json.Unmarshal([]byte(parts[1]), &event); err != nil {
+			return nil, err
+		}
+
+		event.Seq, err = strconv.ParseInt(parts[0], 10, 64)
 		if err != nil {
-			return false, err
+			return nil, err
+		}
+		changes = append(changes, event)
+	}
+	return changes, nil
+}
+
+// Acks are kept in a hash for each app in a pool, by host IP
+func (r *RedisBackend) AckChange(env, pool string, ack *ChangeAck) error {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return err
+	}
+
+	js, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", r.key(path.Join(env, pool, "acks", ack.App)), ack.HostIP, js)
+	return err
+}
+
+func (r *RedisBackend) ListAcks(env, pool, app string) ([]ChangeAck, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return nil, err
+	}
+
+	values, err := hgetall(conn, r.key(path.Join(env, pool, "acks", app)))
+	if err != nil {
+		return nil, err
+	}
+
+	acks := []ChangeAck{}
+	for _, value := range values {
+		ack := ChangeAck{}
+		if err := json.Unmarshal([]byte(value), &ack); err != nil {
+			return nil, err
+		}
+		acks = append(acks, ack)
+	}
+	return acks, nil
+}
+
+// The audit log is a sorted set scored by time. Each entry is stored with
+// its time, so identical entries aren't merged.
+func (r *RedisBackend) AddAuditEntry(env string, entry *AuditEntry) error {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return err
+	}
+
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("ZADD", r.key(envKey(env, "audit")), entry.Time.UnixNano(), js)
+	return err
+}
+
+func (r *RedisBackend) ListAuditEntries(env string, since, until time.Time) ([]AuditEntry, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return nil, err
+	}
+
+	values, err := redis.Strings(conn.Do("ZRANGEBYSCORE", r.key(envKey(env, "audit")),
+		since.UnixNano(), fmt.Sprintf("(%d", until.UnixNano())))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	for _, value := range values {
+		entry := AuditEntry{}
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			return nil, err
 		}
-		deletedOne = deletedOne || deleted == 1
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// An env's webhooks are kept as a JSON list
+func (r *RedisBackend) GetWebhooks(env string) ([]Webhook, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return nil, err
 	}
 
-	return deletedOne, nil
+	hooks := []Webhook{}
+	js, err := redis.Bytes(conn.Do("GET", r.key(envKey(env, "webhooks"))))
+	if err == redis.ErrNil {
+		return hooks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(js, &hooks)
+	return hooks, err
+}
+
+func (r *RedisBackend) SetWebhooks(env string, hooks []Webhook) error {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return err
+	}
+
+	js, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", r.key(envKey(env, "webhooks")), js)
+	return err
+}
+
+// envKey is the key for something kept for a whole env. It's outside the
+// env/ tree, where it could be mistaken for an app of the same name and
+// removed with it.
+func envKey(env, name string) string {
+	return "galaxy:" + env + ":" + name
+}
+
+// shared config is kept in a hash for the env, or for the pool
+func sharedConfigKey(env, pool string) string {
+	if pool == "" {
+		return envKey(env, "shared")
+	}
+	return path.Join(env, pool, "shared")
+}
+
+func (r *RedisBackend) GetSharedConfig(env, pool string) (map[string]string, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return nil, err
+	}
+
+	return hgetall(conn, r.key(sharedConfigKey(env, pool)))
+}
+
+func (r *RedisBackend) UpdateSharedConfig(env, pool string, values map[string]string) error {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return err
+	}
+
+	key := r.key(sharedConfigKey(env, pool))
+	conn.Send("MULTI")
+	for k, v := range values {
+		if v == "" {
+			conn.Send("HDEL", key, k)
+			continue
+		}
+		conn.Send("HSET", key, k, v)
+	}
+	conn.Send("SADD", r.key(redisEnvsKey), env)
+	_, err := conn.Do("EXEC")
+	return err
 }
 
 func (r *RedisBackend) AssignApp(app, env, pool string) (bool, error) {
@@ -158,6 +623,8 @@ func (r *RedisBackend) AssignApp(app, env, pool string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+
+	err = r.index(redisEnvsKey, env)
 	return added == 1, err
 }
 
@@ -174,7 +641,12 @@ func (r *RedisBackend) CreatePool(env, pool string) (bool, error) {
 	//FIXME: Create an associated auto-scaling groups tied to the
 	//pool
 
-	added, err := r.AddMember(path.Join(env, "pools", "*"), pool)
+	added, err := r.AddMember(poolsIndex(env), pool)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.index(redisEnvsKey, env)
 	return added == 1, err
 }
 
@@ -188,7 +660,7 @@ func (r *RedisBackend) DeletePool(env, pool string) (bool, error) {
 		return false, nil
 	}
 
-	_, err = r.RemoveMember(path.Join(env, "pools", "*"), pool)
+	_, err = r.RemoveMember(poolsIndex(env), pool)
 	if err != nil {
 		return false, err
 	}
@@ -196,71 +668,44 @@ func (r *RedisBackend) DeletePool(env, pool string) (bool, error) {
 }
 
 func (r *RedisBackend) ListPools(env string) ([]string, error) {
-	// This is the host entry created by commander
-	// when it starts up.  It can dynamically create
-	// a pool
-	key := path.Join(env, "*", "hosts", "*", "info")
-	keys, err := r.Keys(key)
+	// These are the pools that have been manually created.  It's
+	// possible to assign an app to a pool that has no running
+	// hosts so we list these as well.
+	pools, err := r.Members(poolsIndex(env))
 	if err != nil {
 		return nil, err
 	}
 
-	pools := []string{}
-
-	for _, k := range keys {
-		parts := strings.Split(k, "/")
-		pool := parts[1]
-		if !utils.StringInSlice(pool, pools) {
-			pools = append(pools, pool)
-		}
-	}
-
-	// This is the pools that have been manually created.  It's
-	// possible to assign an app to a pool that has no running
-	// hosts so we add these to the pools list as well.
-	key = path.Join(env, "pools", "*")
-	keys, err = r.Keys(key)
+	// These are the pools with hosts, which commander creates
+	// when it starts up.
+	hostPools, err := r.Members(hostPoolsIndex(env))
 	if err != nil {
 		return nil, err
 	}
 
-	for _, k := range keys {
-		parts := strings.Split(k, "/")
-		pool := parts[2]
-
-		if pool != "*" {
+	for _, pool := range hostPools {
+		if utils.StringInSlice(pool, pools) {
 			continue
 		}
 
-		members, err := r.Members(k)
+		hosts, err := r.ListHosts(env, pool)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, m := range members {
-			if !utils.StringInSlice(m, pools) {
-				pools = append(pools, m)
-			}
+		// all its hosts have expired
+		if len(hosts) == 0 {
+			r.RemoveMember(hostPoolsIndex(env), pool)
+			continue
 		}
+		pools = append(pools, pool)
 	}
 
 	return pools, nil
 }
 
 func (r *RedisBackend) ListEnvs() ([]string, error) {
-	envs := []string{}
-	pools, err := r.Keys(path.Join("*", "pools", "*"))
-	if err != nil {
-		return nil, err
-	}
-
-	for _, pool := range pools {
-		parts := strings.Split(pool, "/")
-		if !utils.StringInSlice(parts[0], envs) {
-			envs = append(envs, parts[0])
-		}
-	}
-	return envs, nil
+	return r.Members(redisEnvsKey)
 }
 
 func (r *RedisBackend) LoadVMap(key string, dest *utils.VersionedMap) error {
@@ -317,7 +762,88 @@ func (r *RedisBackend) GcVMap(key string, vmap *utils.VersionedMap) error {
 
 func (r *RedisBackend) dialTimeout() (redis.Conn, error) {
 	rwTimeout := 5 * time.Second
-	return redis.DialTimeout("tcp", r.RedisHost, rwTimeout, rwTimeout, rwTimeout)
+	return r.dial(rwTimeout, rwTimeout, rwTimeout)
+}
+
+// dial connects to the redis master, and authenticates and selects the
+// database if needed.
+func (r *RedisBackend) dial(connectTimeout, readTimeout, writeTimeout time.Duration) (redis.Conn, error) {
+	addr := r.RedisHost
+	if len(r.SentinelAddrs) > 0 {
+		var err error
+		addr, err = r.sentinelMaster(connectTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	var netConn net.Conn
+	var err error
+	if r.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		netConn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		netConn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn := redis.NewConn(netConn, readTimeout, writeTimeout)
+
+	if r.Password != "" {
+		if _, err := conn.Do("AUTH", r.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if r.Database != 0 {
+		if _, err := conn.Do("SELECT", r.Database); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// make sure the sentinels didn't hand us a master that was just demoted
+	if len(r.SentinelAddrs) > 0 {
+		role, err := redis.Values(conn.Do("ROLE"))
+		if err == nil && (len(role) == 0 || fmt.Sprintf("%s", role[0]) != "master") {
+			err = fmt.Errorf("%s is not the master", addr)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// sentinelMaster asks each sentinel in turn for the master address
+func (r *RedisBackend) sentinelMaster(timeout time.Duration) (string, error) {
+	var lastErr error
+	for _, sentinel := range r.SentinelAddrs {
+		conn, err := redis.DialTimeout("tcp", sentinel, timeout, timeout, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		master, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", r.SentinelMaster))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if len(master) != 2 {
+			lastErr = fmt.Errorf("unexpected reply from sentinel %s: %v", sentinel, master)
+			continue
+		}
+		return net.JoinHostPort(master[0], master[1]), nil
+	}
+	return "", fmt.Errorf("unable to find master %s: %s", r.SentinelMaster, lastErr)
 }
 
 func (r *RedisBackend) testOnBorrow(c redis.Conn, t time.Time) error {
@@ -340,17 +866,6 @@ func (r *RedisBackend) connect() {
 // not needed with a redis.Pool
 func (r *RedisBackend) reconnect() {}
 
-func (r *RedisBackend) Keys(key string) ([]string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if err := conn.Err(); err != nil {
-		return nil, err
-	}
-
-	return redis.Strings(conn.Do("KEYS", key))
-}
-
 func (r *RedisBackend) Expire(key string, ttl uint64) (int, error) {
 	conn := r.redisPool.Get()
 	defer conn.Close()
@@ -359,7 +874,7 @@ func (r *RedisBackend) Expire(key string, ttl uint64) (int, error) {
 		return 0, err
 	}
 
-	return redis.Int(conn.Do("EXPIRE", key, ttl))
+	return redis.Int(conn.Do("EXPIRE", r.key(key), ttl))
 }
 
 func (r *RedisBackend) TTL(key string) (int, error) {
@@ -370,10 +885,10 @@ func (r *RedisBackend) TTL(key string) (int, error) {
 		return 0, err
 	}
 
-	return redis.Int(conn.Do("TTL", key))
+	return redis.Int(conn.Do("TTL", r.key(key)))
 }
 
-func (r *RedisBackend) Delete(key string) (int, error) {
+func (r *RedisBackend) Delete(keys ...string) (int, error) {
 	conn := r.redisPool.Get()
 	defer conn.Close()
 
@@ -381,7 +896,11 @@ func (r *RedisBackend) Delete(key string) (int, error) {
 		return 0, err
 	}
 
-	return redis.Int(conn.Do("DEL", key))
+	args := redis.Args{}
+	for _, key := range keys {
+		args = args.Add(r.key(key))
+	}
+	return redis.Int(conn.Do("DEL", args...))
 }
 
 func (r *RedisBackend) AddMember(key, value string) (int, error) {
@@ -392,7 +911,7 @@ func (r *RedisBackend) AddMember(key, value string) (int, error) {
 		return 0, err
 	}
 
-	return redis.Int(conn.Do("SADD", key, value))
+	return redis.Int(conn.Do("SADD", r.key(key), value))
 }
 
 func (r *RedisBackend) RemoveMember(key, value string) (int, error) {
@@ -403,7 +922,7 @@ func (r *RedisBackend) RemoveMember(key, value string) (int, error) {
 		return 0, err
 	}
 
-	return redis.Int(conn.Do("SREM", key, value))
+	return redis.Int(conn.Do("SREM", r.key(key), value))
 }
 
 func (r *RedisBackend) Members(key string) ([]string, error) {
@@ -414,7 +933,7 @@ func (r *RedisBackend) Members(key string) ([]string, error) {
 		return nil, err
 	}
 
-	return redis.Strings(conn.Do("SMEMBERS", key))
+	return redis.Strings(conn.Do("SMEMBERS", r.key(key)))
 }
 
 func (r *RedisBackend) Notify(key, value string) (int, error) {
@@ -425,41 +944,72 @@ func (r *RedisBackend) Notify(key, value string) (int, error) {
 		return 0, err
 	}
 
-	return redis.Int(conn.Do("PUBLISH", key, value))
+	return redis.Int(conn.Do("PUBLISH", r.key(key), value))
 }
 
-func (r *RedisBackend) subscribeChannel(key string, msgs chan string) {
+func (r *RedisBackend) subscribeChannel(ctx context.Context, key string, msgs chan string) {
+	defer close(msgs)
+
 	var wg sync.WaitGroup
 
 	redisPool := redis.Pool{
 		MaxIdle:     1,
 		IdleTimeout: 0,
 		Dial: func() (redis.Conn, error) {
-			return redis.DialTimeout("tcp", r.RedisHost, time.Second, 0, 0)
+			return r.dial(time.Second, 0, 0)
 		},
 		// test every connection for now
 		TestOnBorrow: r.testOnBorrow,
 	}
+	defer redisPool.Close()
 
-	for {
+	for ctx.Err() == nil {
 		conn := redisPool.Get()
-		// no defer, doesn't return
 		if err := conn.Err(); err != nil {
 			conn.Close()
 			log.Printf("ERROR: %v\n", err)
-			time.Sleep(5 * time.Second)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
 			continue
 		}
 
-		wg.Add(1)
 		psc := redis.PubSubConn{Conn: conn}
+
+		// closing the connection is the only way to interrupt Receive
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				psc.Close()
+			case <-done:
+			}
+		}()
+
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for {
 				switch n := psc.Receive().(type) {
 				case redis.Message:
-					msg := string(n.Data)
-					msgs <- msg
+					select {
+					case msgs <- string(n.Data):
+					case <-ctx.Done():
+						return
+					}
+				case redis.Subscription:
+					if n.Kind != "subscribe" {
+						continue
+					}
+
+					// anything published while we weren't subscribed
+					// was missed, so let the subscriber catch up
+					select {
+					case msgs <- "":
+					case <-ctx.Done():
+						return
+					}
 				case error:
 					psc.Close()
 					log.Printf("ERROR: %v\n", n)
@@ -471,17 +1021,18 @@ func (r *RedisBackend) subscribeChannel(key string, msgs chan string) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			psc.Subscribe(key)
+			psc.Subscribe(r.key(key))
 			log.Printf("Monitoring for config changes on channel: %s\n", key)
 		}()
 		wg.Wait()
+		close(done)
 		conn.Close()
 	}
 }
 
-func (r *RedisBackend) Subscribe(key string) chan string {
+func (r *RedisBackend) Subscribe(ctx context.Context, key string) chan string {
 	msgs := make(chan string)
-	go r.subscribeChannel(key, msgs)
+	go r.subscribeChannel(ctx, key, msgs)
 	return msgs
 }
 
@@ -493,7 +1044,7 @@ func (r *RedisBackend) Set(key, field string, value string) (string, error) {
 		return "", err
 	}
 
-	return redis.String(conn.Do("HMSET", key, field, value))
+	return redis.String(conn.Do("HMSET", r.key(key), field, value))
 }
 
 func (r *RedisBackend) Get(key, field string) (string, error) {
@@ -504,7 +1055,7 @@ func (r *RedisBackend) Get(key, field string) (string, error) {
 		return "", err
 	}
 
-	ret, err := redis.String(conn.Do("HGET", key, field))
+	ret, err := redis.String(conn.Do("HGET", r.key(key), field))
 	if err != nil && err == redis.ErrNil {
 		return "", nil
 	}
@@ -520,7 +1071,16 @@ func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
 		return nil, err
 	}
 
-	matches, err := redis.Values(conn.Do("HGETALL", key))
+	return hgetall(conn, r.key(key))
+}
+
+func hgetall(conn redis.Conn, key string) (map[string]string, error) {
+	return hashValues(conn.Do("HGETALL", key))
+}
+
+// hashValues converts an HGETALL reply into a map
+func hashValues(reply interface{}, err error) (map[string]string, error) {
+	matches, err := redis.Values(reply, err)
 	if err != nil {
 		return nil, err
 	}
@@ -532,7 +1092,6 @@ func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
 		serialized[key] = value
 	}
 	return serialized, nil
-
 }
 
 func (r *RedisBackend) SetMulti(key string, values map[string]string) (string, error) {
@@ -543,7 +1102,7 @@ func (r *RedisBackend) SetMulti(key string, values map[string]string) (string, e
 		return "", err
 	}
 
-	redisArgs := redis.Args{}.Add(key).AddFlat(values)
+	redisArgs := redis.Args{}.Add(r.key(key)).AddFlat(values)
 	return redis.String(conn.Do("HMSET", redisArgs...))
 }
 
@@ -559,7 +1118,7 @@ func (r *RedisBackend) DeleteMulti(key string, fields ...string) (int, error) {
 	for _, field := range fields {
 		args = append(args, field)
 	}
-	redisArgs := redis.Args{}.Add(key).AddFlat(args)
+	redisArgs := redis.Args{}.Add(r.key(key)).AddFlat(args)
 	return redis.Int(conn.Do("HDEL", redisArgs...))
 
 }
@@ -567,6 +1126,11 @@ func (r *RedisBackend) DeleteMulti(key string, fields ...string) (int, error) {
 func (r *RedisBackend) DeleteHost(env, pool string, host HostInfo) error {
 	key := path.Join(env, pool, "hosts", host.HostIP, "info")
 	_, err := r.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.RemoveMember(hostsIndex(env, pool), host.HostIP)
 	return err
 }
 
@@ -593,25 +1157,39 @@ func (r *RedisBackend) UpdateHost(env, pool string, host HostInfo) error {
 	}
 
 	_, err = r.Expire(key, DefaultTTL)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return r.index(
+		redisEnvsKey, env,
+		hostPoolsIndex(env), pool,
+		hostsIndex(env, pool), host.HostIP,
+	)
 }
 
 func (r *RedisBackend) ListHosts(env, pool string) ([]HostInfo, error) {
-	key := path.Join(env, pool, "hosts", "*", "info")
-	keys, err := r.Keys(key)
+	hostIPs, err := r.Members(hostsIndex(env, pool))
 	if err != nil {
 		return nil, err
 	}
 
 	hosts := []HostInfo{}
 
-	for _, k := range keys {
+	for _, hostIP := range hostIPs {
 		existing := utils.NewVersionedMap()
 
-		err := r.LoadVMap(k, existing)
+		err := r.LoadVMap(path.Join(env, pool, "hosts", hostIP, "info"), existing)
 		if err != nil {
 			return nil, err
 		}
+
+		// the host entry expired
+		if existing.Get("HostIP") == "" {
+			r.RemoveMember(hostsIndex(env, pool), hostIP)
+			continue
+		}
+
 		hosts = append(hosts, HostInfo{
 			HostIP: existing.Get("HostIP"),
 		})
@@ -637,7 +1215,7 @@ func (r *RedisBackend) RegisterService(env, pool string, reg *ServiceRegistratio
 	if err != nil {
 		return err
 	}
-	return nil
+	return r.index(registrationsIndex(env), registrationPath)
 }
 
 func (r *RedisBackend) UnregisterService(env, pool, hostIP, name, containerID string) (*ServiceRegistration, error) {
@@ -657,6 +1235,11 @@ func (r *RedisBackend) UnregisterService(env, pool, hostIP, name, containerID st
 		return registration, err
 	}
 
+	_, err = r.RemoveMember(registrationsIndex(env), registrationPath)
+	if err != nil {
+		return registration, err
+	}
+
 	return registration, nil
 }
 
@@ -691,7 +1274,7 @@ func (r *RedisBackend) GetServiceRegistration(env, pool, hostIP, name, container
 }
 
 func (r *RedisBackend) ListRegistrations(env string) ([]ServiceRegistration, error) {
-	keys, err := r.Keys(path.Join(env, "*", "hosts", "*", "*", "*"))
+	keys, err := r.Members(registrationsIndex(env))
 	if err != nil {
 		return nil, err
 	}
@@ -699,7 +1282,9 @@ func (r *RedisBackend) ListRegistrations(env string) ([]ServiceRegistration, err
 	var regList []ServiceRegistration
 	for _, key := range keys {
 
-		pool := strings.Split(key, "/")[1]
+		// env/pool/hosts/host_ip/service_name/container_id
+		parts := strings.Split(key, "/")
+		pool := parts[1]
 
 		val, err := r.Get(key, "location")
 		if err != nil {
@@ -707,9 +1292,14 @@ func (r *RedisBackend) ListRegistrations(env string) ([]ServiceRegistration, err
 			continue
 		}
 
+		// the registration expired
+		if val == "" {
+			r.RemoveMember(registrationsIndex(env), key)
+			continue
+		}
+
 		svcReg := ServiceRegistration{
-			Name: path.Base(key),
-			Pool: pool,
+			Name: parts[4],
 		}
 		err = json.Unmarshal([]byte(val), &svcReg)
 		if err != nil {
@@ -717,6 +1307,8 @@ func (r *RedisBackend) ListRegistrations(env string) ([]ServiceRegistration, err
 			continue
 		}
 
+		// the stored JSON has an empty Pool, so set it from the key afterwards
+		svcReg.Pool = pool
 		svcReg.Path = key
 
 		regList = append(regList, svcReg)
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"path"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/litl/galaxy/log"
+)
+
+/*
+Listing in redis is done from index sets, so we never need KEYS:
+	galaxy:envs               all envs
+	env/apps/*                apps in an env
+	env/pools/*               pools created in an env
+	env/hosts/*               pools that have had hosts in an env
+	env/pool/hosts/*          host IPs in a pool
+	env/registrations/*       registration keys in an env
+
+Hosts and registrations expire, but their index entries don't, so stale
+members are removed when the index is read.
+
+Data written before the indexes existed is indexed once by migrateIndexes,
+which uses SCAN so it doesn't block redis.
+*/
+
+const (
+	redisEnvsKey   = "galaxy:envs"
+	redisLayoutKey = "galaxy:layout"
+
+	// bump this when the index layout changes, to re-run the migration
+	redisLayoutVersion = 2
+)
+
+func appsIndex(env string) string {
+	return path.Join(env, "apps", "*")
+}
+
+func poolsIndex(env string) string {
+	return path.Join(env, "pools", "*")
+}
+
+func hostPoolsIndex(env string) string {
+	return path.Join(env, "hosts", "*")
+}
+
+func hostsIndex(env, pool string) string {
+	return path.Join(env, pool, "hosts", "*")
+}
+
+func registrationsIndex(env string) string {
+	return path.Join(env, "registrations", "*")
+}
+
+// index adds members to index sets, in a single round trip. Index entries
+// are pairs of set key and member.
+func (r *RedisBackend) index(entries ...string) error {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	for i := 0; i+1 < len(entries); i += 2 {
+		conn.Send("SADD", r.key(entries[i]), entries[i+1])
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (r *RedisBackend) IsMember(key, value string) (bool, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return false, err
+	}
+
+	return redis.Bool(conn.Do("SISMEMBER", r.key(key), value))
+}
+
+// Scan returns all keys matching pattern, iterating with SCAN rather than
+// blocking redis with KEYS. The keys are returned without the prefix.
+func (r *RedisBackend) Scan(pattern string) ([]string, error) {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", r.key(pattern), "COUNT", "1000"))
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []string
+		if _, err := redis.Scan(reply, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		for _, key := range batch {
+			keys = append(keys, strings.TrimPrefix(key, r.key("")))
+		}
+
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// migrateIndexes builds the index sets from existing keys, if that hasn't
+// been done yet. It's safe to run more than once.
+func (r *RedisBackend) migrateIndexes() error {
+	conn := r.redisPool.Get()
+	defer conn.Close()
+
+	if err := conn.Err(); err != nil {
+		return err
+	}
+
+	version, err := redis.Int(conn.Do("GET", r.key(redisLayoutKey)))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	if version >= redisLayoutVersion {
+		return nil
+	}
+
+	log.Printf("Indexing existing redis keys...")
+
+	keys, err := r.Scan("*")
+	if err != nil {
+		return err
+	}
+
+	entries := []string{}
+	for _, key := range keys {
+		entries = append(entries, legacyIndexEntries(key)...)
+	}
+
+	if err := r.index(entries...); err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", r.key(redisLayoutKey), redisLayoutVersion)
+	return err
+}
+
+// legacyIndexEntries returns the index entries for a key in the original
+// layout, as (set key, member) pairs.
+func legacyIndexEntries(key string) []string {
+	parts := strings.Split(key, "/")
+	env := parts[0]
+
+	switch {
+	// env/pools/* holds the created pools
+	case len(parts) == 3 && parts[1] == "pools" && parts[2] == "*":
+		return []string{redisEnvsKey, env}
+
+	// env/app/version
+	case len(parts) == 3 && parts[2] == "version" && parts[1] != "hosts":
+		return []string{
+			redisEnvsKey, env,
+			appsIndex(env), parts[1],
+		}
+
+	// env/pool/hosts/host_ip/info
+	case len(parts) == 5 && parts[2] == "hosts" && parts[4] == "info":
+		return []string{
+			redisEnvsKey, env,
+			hostPoolsIndex(env), parts[1],
+			hostsIndex(env, parts[1]), parts[3],
+		}
+
+	// env/pool/hosts/host_ip/service_name/container_id
+	case len(parts) == 6 && parts[2] == "hosts":
+		return []string{registrationsIndex(env), key}
+	}
+	return nil
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"strings"
 	"testing"
 
@@ -24,7 +28,7 @@ func (t *TestConn) Record(cmd string, args ...interface{}) {
 		if v == nil {
 			continue
 		}
-		sa = append(sa, v.(string))
+		sa = append(sa, fmt.Sprint(v))
 	}
 	t.History = append(t.History, fmt.Sprintf("%s %s", cmd, strings.Join(sa, " ")))
 }
@@ -95,7 +99,7 @@ func TestAppExistsKeyFormat(t *testing.T) {
 
 	r, c := NewTestRedisBackend()
 	r.AppExists("foo", "dev")
-	assertInHistory(t, c.History, "KEYS dev/foo/*")
+	assertInHistory(t, c.History, "SISMEMBER dev/apps/* foo")
 }
 
 func assertInHistory(t *testing.T, history []string, cmd string) {
@@ -109,3 +113,375 @@ func assertInHistory(t *testing.T, history []string, cmd string) {
 		t.Fatalf("Expected %s in [%s]", cmd, strings.Join(history, ","))
 	}
 }
+
+func TestUpdateAppStale(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd == "HGETALL" && args[0] == "dev/foo/environment" {
+			// someone else set FOO since we loaded the app
+			return []interface{}{[]byte("FOO:s:7"), []byte("bar")}, nil
+		}
+		if cmd == "HGETALL" {
+			return []interface{}{}, nil
+		}
+		return nil, nil
+	}
+
+	app := NewAppConfig("foo", "")
+	if updated, err := r.UpdateApp(app, "dev"); updated || err != StaleConfig {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, false, StaleConfig)
+	}
+
+	assertInHistory(t, c.History, "UNWATCH ")
+	assertNotInHistory(t, c.History, "EXEC ")
+}
+
+func TestUpdateAppExecAborted(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd == "HGETALL" {
+			return []interface{}{}, nil
+		}
+		// EXEC returns nil when a watched key was changed
+		return nil, nil
+	}
+
+	app := NewAppConfig("foo", "")
+	if updated, err := r.UpdateApp(app, "dev"); updated || err != StaleConfig {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, false, StaleConfig)
+	}
+	assertInHistory(t, c.History, "MULTI ")
+}
+
+func TestUpdateAppWatched(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		switch cmd {
+		case "HGETALL":
+			return []interface{}{}, nil
+		case "EXEC":
+			return []interface{}{"OK"}, nil
+		}
+		return nil, nil
+	}
+
+	app := NewAppConfig("foo", "")
+	if updated, err := r.UpdateApp(app, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	assertInHistory(t, c.History, "HMSET dev/foo/version version:u:1 ")
+	assertInHistory(t, c.History, "EXEC ")
+}
+
+func assertNotInHistory(t *testing.T, history []string, cmd string) {
+	for _, v := range history {
+		if v == cmd {
+			t.Fatalf("Unexpected %s in [%s]", cmd, strings.Join(history, ","))
+		}
+	}
+}
+
+func historyIndex(history []string, prefix string) int {
+	for i, v := range history {
+		if strings.HasPrefix(v, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestUpdateAppGcInTransaction(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		switch cmd {
+		case "HGETALL":
+			return []interface{}{}, nil
+		case "EXEC":
+			return []interface{}{"OK"}, nil
+		}
+		return nil, nil
+	}
+
+	app := NewAppConfig("foo", "")
+	for i := 0; i < 10; i++ {
+		app.EnvSet("FOO", fmt.Sprintf("bar%d", i))
+	}
+
+	if updated, err := r.UpdateApp(app, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	multi := historyIndex(c.History, "MULTI")
+	hdel := historyIndex(c.History, "HDEL dev/foo/environment")
+	exec := historyIndex(c.History, "EXEC")
+	if multi < 0 || hdel < multi || exec < hdel {
+		t.Fatalf("Expected HDEL between MULTI and EXEC in [%s]", strings.Join(c.History, ","))
+	}
+}
+
+func TestGetAppSnapshot(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd != "EXEC" {
+			return nil, nil
+		}
+
+		// the replies come back in the order the HGETALLs were queued
+		replies := []interface{}{}
+		for _, v := range c.History {
+			if strings.HasPrefix(v, "HGETALL dev/foo/version") {
+				replies = append(replies, []interface{}{[]byte("version:s:3"), []byte("foo:v3")})
+			} else if strings.HasPrefix(v, "HGETALL") {
+				replies = append(replies, []interface{}{})
+			}
+		}
+		return replies, nil
+	}
+
+	app, err := r.GetApp("foo", "dev")
+	if err != nil || app.Version() != "foo:v3" {
+		t.Fatalf("GetApp() = %v, %v, want version %q", app, err, "foo:v3")
+	}
+	assertInHistory(t, c.History, "MULTI ")
+	assertInHistory(t, c.History, "EXEC ")
+}
+
+func TestDeleteAppSingleDel(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		// replies to DEL and SREM
+		return []interface{}{int64(5), int64(1)}, nil
+	}
+
+	app := NewAppConfig("foo", "")
+	if deleted, err := r.DeleteApp(app, "dev"); !deleted || err != nil {
+		t.Fatalf("DeleteApp() = %t, %v, want %t, %v", deleted, err, true, nil)
+	}
+	assertInHistory(t, c.History, "DEL dev/foo dev/foo/environment dev/foo/version dev/foo/ports dev/foo/runtime dev/foo/releases dev/foo/release_id")
+	assertInHistory(t, c.History, "SREM dev/apps/* foo")
+}
+
+func TestLegacyIndexEntries(t *testing.T) {
+	for _, test := range []struct {
+		key  string
+		want []string
+	}{
+		{"dev/pools/*", []string{"galaxy:envs", "dev"}},
+		{"dev/pools/web", nil},
+		{"dev/foo/version", []string{"galaxy:envs", "dev", "dev/apps/*", "foo"}},
+		{"dev/foo/environment", nil},
+		{"dev/web/hosts/10.0.0.1/info", []string{"galaxy:envs", "dev", "dev/hosts/*", "web", "dev/web/hosts/*", "10.0.0.1"}},
+		{"dev/web/hosts/10.0.0.1/foo/0123456789ab", []string{"dev/registrations/*", "dev/web/hosts/10.0.0.1/foo/0123456789ab"}},
+		{"galaxy:envs", nil},
+	} {
+		got := legacyIndexEntries(test.key)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("legacyIndexEntries(%q) = %v, want %v", test.key, got, test.want)
+		}
+	}
+}
+
+func TestScanCursor(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd != "SCAN" {
+			return nil, nil
+		}
+		if args[0] == "0" {
+			return []interface{}{[]byte("17"), []interface{}{[]byte("a")}}, nil
+		}
+		return []interface{}{[]byte("0"), []interface{}{[]byte("b")}}, nil
+	}
+
+	keys, err := r.Scan("*")
+	if strings.Join(keys, ",") != "a,b" || err != nil {
+		t.Fatalf("Scan() = %v, %v, want %v, %v", keys, err, []string{"a", "b"}, nil)
+	}
+	assertInHistory(t, c.History, "SCAN 17 MATCH * COUNT 1000")
+}
+
+func TestMigrateIndexes(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		switch cmd {
+		case "GET":
+			return nil, nil
+		case "SCAN":
+			return []interface{}{[]byte("0"), []interface{}{[]byte("dev/foo/version")}}, nil
+		}
+		return nil, nil
+	}
+
+	if err := r.migrateIndexes(); err != nil {
+		t.Fatalf("migrateIndexes() = %v, want %v", err, nil)
+	}
+	assertInHistory(t, c.History, "SADD dev/apps/* foo")
+	assertNotInHistory(t, c.History, "KEYS *")
+}
+
+func TestMigrateIndexesDone(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		return []byte("2"), nil
+	}
+
+	if err := r.migrateIndexes(); err != nil {
+		t.Fatalf("migrateIndexes() = %v, want %v", err, nil)
+	}
+
+	if historyIndex(c.History, "SCAN") >= 0 {
+		t.Fatalf("Unexpected SCAN in [%s]", strings.Join(c.History, ","))
+	}
+}
+
+func TestNewRedisBackendURL(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		want string
+	}{
+		{"redis://127.0.0.1:6379", "127.0.0.1:6379 db=0 tls=false prefix="},
+		{"redis://127.0.0.1", "127.0.0.1:6379 db=0 tls=false prefix="},
+		{"redis://:secret@127.0.0.1:6379/2", "127.0.0.1:6379 password=secret db=2 tls=false prefix="},
+		{"rediss://redis.example.com?prefix=staging", "redis.example.com:6379 db=0 tls=true prefix=staging"},
+		{"redis+sentinel://:secret@10.0.0.1,10.0.0.2:5000/mymaster/1",
+			"mymaster@[10.0.0.1:26379 10.0.0.2:5000] password=secret db=1 tls=false prefix="},
+	} {
+		u, _ := url.Parse(test.url)
+		r, err := NewRedisBackend(u)
+		if err != nil {
+			t.Errorf("NewRedisBackend(%q) = %v, want %v", test.url, err, nil)
+			continue
+		}
+
+		got := r.RedisHost
+		if r.SentinelMaster != "" {
+			got = fmt.Sprintf("%s@%v", r.SentinelMaster, r.SentinelAddrs)
+		}
+		if r.Password != "" {
+			got += " password=" + r.Password
+		}
+		got += fmt.Sprintf(" db=%d tls=%t prefix=%s", r.Database, r.TLS, r.Prefix)
+
+		if got != test.want {
+			t.Errorf("NewRedisBackend(%q) = %s, want %s", test.url, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"redis://127.0.0.1/db", "redis+sentinel://10.0.0.1", "redis://127.0.0.1/1/2"} {
+		u, _ := url.Parse(bad)
+		if _, err := NewRedisBackend(u); err == nil {
+			t.Errorf("NewRedisBackend(%q) = %v, want error", bad, err)
+		}
+	}
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	r.Prefix = "staging"
+
+	r.AppExists("foo", "dev")
+	assertInHistory(t, c.History, "SISMEMBER staging/dev/apps/* foo")
+
+	r.Notify("galaxy-dev", "config")
+	assertInHistory(t, c.History, "PUBLISH staging/galaxy-dev config")
+}
+
+// fakeRedis is a minimal redis server, that records the commands it's sent
+// and answers them with reply.
+func fakeRedis(t *testing.T, reply func(cmd []string) string) (addr string, cmds chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmds = make(chan []string, 16)
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					cmd, err := readCommand(rd)
+					if err != nil {
+						return
+					}
+					cmds <- cmd
+					conn.Write([]byte(reply(cmd)))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), cmds
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+
+	cmd := []string{}
+	for i := 0; i < n; i++ {
+		var size int
+		if _, err := fmt.Fscanf(rd, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, arg); err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, string(arg[:size]))
+	}
+	return cmd, nil
+}
+
+func TestRedisDialAuth(t *testing.T) {
+	addr, cmds := fakeRedis(t, func(cmd []string) string { return "+OK\r\n" })
+
+	r := &RedisBackend{RedisHost: addr, Password: "secret", Database: 2}
+	conn, err := r.dialTimeout()
+	if err != nil {
+		t.Fatalf("dialTimeout() = %v, want %v", err, nil)
+	}
+	conn.Close()
+
+	for _, want := range []string{"AUTH secret", "SELECT 2"} {
+		if got := strings.Join(<-cmds, " "); got != want {
+			t.Fatalf("sent %q, want %q", got, want)
+		}
+	}
+}
+
+func TestRedisSentinelDial(t *testing.T) {
+	masterAddr, masterCmds := fakeRedis(t, func(cmd []string) string {
+		return "*3\r\n$6\r\nmaster\r\n:0\r\n*0\r\n"
+	})
+	host, port, _ := net.SplitHostPort(masterAddr)
+
+	sentinelAddr, _ := fakeRedis(t, func(cmd []string) string {
+		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+	})
+
+	r := &RedisBackend{
+		// the first sentinel is down
+		SentinelAddrs:  []string{"127.0.0.1:1", sentinelAddr},
+		SentinelMaster: "mymaster",
+	}
+	conn, err := r.dialTimeout()
+	if err != nil {
+		t.Fatalf("dialTimeout() = %v, want %v", err, nil)
+	}
+	conn.Close()
+
+	if got := strings.Join(<-masterCmds, " "); got != "ROLE" {
+		t.Fatalf("sent %q to master, want %q", got, "ROLE")
+	}
+}
@@ -8,11 +8,38 @@ import (
 	"github.com/fsouza/go-dockerclient"
 )
 
-func newServiceRegistration(container *docker.Container, hostIP, galaxyPort string) *ServiceRegistration {
-	//FIXME: We're using the first found port and assuming it's tcp.
-	//How should we handle a service that exposes multiple ports
-	//as well as tcp vs udp ports.
-	var externalPort, internalPort string
+// PortBinding is a container port published on the host
+type PortBinding struct {
+	ContainerPort string `json:"CONTAINER_PORT"`
+	HostPort      string `json:"HOST_PORT"`
+	// tcp or udp
+	Protocol string `json:"PROTOCOL"`
+	// ServicePort is the port the service is reachable on through shuttle,
+	// if it has one
+	ServicePort string `json:"SERVICE_PORT,omitempty"`
+}
+
+// servicePort returns the port a container port is exposed on as a service.
+// GALAXY_PORT sets it for the main port, and GALAXY_PORT_<port> (or
+// GALAXY_PORT_<port>_UDP) for any others.
+func servicePort(environment map[string]string, port docker.Port) string {
+	key := "GALAXY_PORT_" + port.Port()
+	if port.Proto() == "udp" {
+		key += "_UDP"
+	}
+	return environment[key]
+}
+
+func newServiceRegistration(container *docker.Container, hostIP string, environment map[string]string) *ServiceRegistration {
+	galaxyPort := environment["GALAXY_PORT"]
+
+	serviceRegistration := ServiceRegistration{
+		ContainerName: container.Name,
+		ContainerID:   container.ID,
+		StartedAt:     container.Created,
+		Image:         container.Config.Image,
+		Port:          galaxyPort,
+	}
 
 	// sort the port bindings by internal port number so multiple ports are assigned deterministically
 	// (docker.Port is a string with a Port method)
@@ -23,32 +50,39 @@ func newServiceRegistration(container *docker.Container, hostIP, galaxyPort stri
 	}
 	sort.Strings(allPorts)
 
+	// The main port, which the EXTERNAL and INTERNAL addresses refer to, is
+	// the one matching GALAXY_PORT, or the last one if none do.
+	main := -1
 	for _, k := range allPorts {
 		v := cPorts[docker.Port(k)]
-		if len(v) > 0 {
-			externalPort = v[0].HostPort
-			internalPort = docker.Port(k).Port()
-			// Look for a match to GALAXY_PORT if we have multiple ports to
-			// choose from. (don't require this, or we may break existing services)
-			if len(allPorts) > 1 && internalPort == galaxyPort {
-				break
-			}
+		if len(v) == 0 {
+			continue
 		}
-	}
 
-	serviceRegistration := ServiceRegistration{
-		ContainerName: container.Name,
-		ContainerID:   container.ID,
-		StartedAt:     container.Created,
-		Image:         container.Config.Image,
-		Port:          galaxyPort,
+		port := docker.Port(k)
+		binding := PortBinding{
+			ContainerPort: port.Port(),
+			HostPort:      v[0].HostPort,
+			Protocol:      port.Proto(),
+			ServicePort:   servicePort(environment, port),
+		}
+		serviceRegistration.Ports = append(serviceRegistration.Ports, binding)
+
+		if main < 0 || serviceRegistration.Ports[main].ContainerPort != galaxyPort {
+			main = len(serviceRegistration.Ports) - 1
+		}
 	}
 
-	if externalPort != "" && internalPort != "" {
+	if main >= 0 {
+		binding := &serviceRegistration.Ports[main]
+		if binding.ServicePort == "" {
+			binding.ServicePort = galaxyPort
+		}
+
 		serviceRegistration.ExternalIP = hostIP
 		serviceRegistration.InternalIP = container.NetworkSettings.IPAddress
-		serviceRegistration.ExternalPort = externalPort
-		serviceRegistration.InternalPort = internalPort
+		serviceRegistration.ExternalPort = binding.HostPort
+		serviceRegistration.InternalPort = binding.ContainerPort
 	}
 	return &serviceRegistration
 }
@@ -69,6 +103,9 @@ type ServiceRegistration struct {
 	VirtualHosts  []string          `json:"VIRTUAL_HOSTS"`
 	Port          string            `json:"PORT"`
 	ErrorPages    map[string]string `json:"ERROR_PAGES,omitempty"`
+	// Every published port. The EXTERNAL and INTERNAL ports above are the
+	// main one.
+	Ports []PortBinding `json:"PORTS,omitempty"`
 	// pool is inserted only for commander dump and restore
 	Pool string
 }
@@ -87,6 +124,12 @@ func (s *ServiceRegistration) addr(ip, port string) string {
 	return ""
 
 }
+
+// IsMain reports whether a binding is for the main port
+func (s *ServiceRegistration) IsMain(binding PortBinding) bool {
+	return binding.HostPort == s.ExternalPort && binding.ContainerPort == s.InternalPort
+}
+
 func (s *ServiceRegistration) ExternalAddr() string {
 	return s.addr(s.ExternalIP, s.ExternalPort)
 }
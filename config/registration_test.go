@@ -0,0 +1,59 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestNewServiceRegistrationPorts(t *testing.T) {
+	container := &docker.Container{
+		ID:     "0123456789abcdef",
+		Name:   "/app_1.1",
+		Config: &docker.Config{Image: "app:v1"},
+		NetworkSettings: &docker.NetworkSettings{
+			IPAddress: "172.17.0.5",
+			Ports: map[docker.Port][]docker.PortBinding{
+				"8000/tcp": {{HostIP: "0.0.0.0", HostPort: "49153"}},
+				"9090/tcp": {{HostIP: "0.0.0.0", HostPort: "49154"}},
+				"9125/udp": {{HostIP: "0.0.0.0", HostPort: "49155"}},
+				"9999/tcp": nil,
+			},
+		},
+	}
+
+	reg := newServiceRegistration(container, "10.0.0.1", map[string]string{
+		"GALAXY_PORT":          "8000",
+		"GALAXY_PORT_9090":     "9090",
+		"GALAXY_PORT_9125_UDP": "8125",
+	})
+
+	if reg.ExternalAddr() != "10.0.0.1:49153" || reg.InternalAddr() != "172.17.0.5:8000" {
+		t.Fatalf("ExternalAddr(), InternalAddr() = %s, %s, want %s, %s",
+			reg.ExternalAddr(), reg.InternalAddr(), "10.0.0.1:49153", "172.17.0.5:8000")
+	}
+
+	want := []PortBinding{
+		{ContainerPort: "8000", HostPort: "49153", Protocol: "tcp", ServicePort: "8000"},
+		{ContainerPort: "9090", HostPort: "49154", Protocol: "tcp", ServicePort: "9090"},
+		{ContainerPort: "9125", HostPort: "49155", Protocol: "udp", ServicePort: "8125"},
+	}
+	if len(reg.Ports) != len(want) {
+		t.Fatalf("Ports = %v, want %v", reg.Ports, want)
+	}
+	for i := range want {
+		if reg.Ports[i] != want[i] {
+			t.Fatalf("Ports[%d] = %v, want %v", i, reg.Ports[i], want[i])
+		}
+	}
+
+	if !reg.IsMain(reg.Ports[0]) || reg.IsMain(reg.Ports[1]) {
+		t.Fatalf("IsMain() = %v, %v, want true, false", reg.IsMain(reg.Ports[0]), reg.IsMain(reg.Ports[1]))
+	}
+
+	// without GALAXY_PORT, the last port is the main one, as before
+	reg = newServiceRegistration(container, "10.0.0.1", map[string]string{})
+	if reg.InternalPort != "9125" {
+		t.Fatalf("InternalPort = %s, want %s", reg.InternalPort, "9125")
+	}
+}
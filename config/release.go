@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxReleases is the number of releases kept for each app
+const MaxReleases = 50
+
+// Release records a deploy of an app, so that it can be rolled back to.
+type Release struct {
+	// ID numbers the releases of an app in order, starting at 1
+	ID int64
+
+	// the image deployed, and its docker image ID
+	Version   string
+	VersionID string
+
+	// Env is the app's environment when it was deployed
+	Env map[string]string
+
+	Created time.Time
+
+	// who deployed it, and from where
+	User string
+	Host string
+}
+
+// releaseKey formats a release ID so the keys sort in release order
+func releaseKey(id int64) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+// copyRelease returns a copy that doesn't share the Env map
+func copyRelease(r Release) Release {
+	env := make(map[string]string, len(r.Env))
+	for k, v := range r.Env {
+		env[k] = v
+	}
+	r.Env = env
+	return r
+}
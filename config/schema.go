@@ -0,0 +1,134 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/utils"
+)
+
+// Schema describes the config an app expects, by variable name. It's
+// stored with the app, and checked before the config or version is changed.
+type Schema map[string]SchemaRule
+
+type SchemaRule struct {
+	// Required variables must be set, by the app or shared config
+	Required bool `json:"required,omitempty"`
+
+	// Type is one of string, int, bool, url or duration. The default is
+	// string.
+	Type string `json:"type,omitempty"`
+
+	// Values lists the allowed values, if set
+	Values []string `json:"values,omitempty"`
+}
+
+var schemaTypes = []string{"", "string", "int", "bool", "url", "duration"}
+
+// ParseSchema decodes and checks a JSON schema. The variable names are
+// upper-cased, like config names.
+func ParseSchema(data []byte) (Schema, error) {
+	schema := Schema{}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return schema, nil
+	}
+
+	raw := Schema{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	for k, rule := range raw {
+		if !utils.StringInSlice(rule.Type, schemaTypes) {
+			return nil, fmt.Errorf("%s: unknown type %q", k, rule.Type)
+		}
+		schema[strings.ToUpper(k)] = rule
+	}
+	return schema, nil
+}
+
+func (s Schema) String() string {
+	if len(s) == 0 {
+		return ""
+	}
+	js, _ := json.Marshal(s)
+	return string(js)
+}
+
+// SchemaError lists everything wrong with a config
+type SchemaError []string
+
+func (e SchemaError) Error() string {
+	return "config doesn't match the schema: " + strings.Join(e, "; ")
+}
+
+// Validate checks env against the schema. Secret values can only be checked
+// for being set, since they aren't decrypted here.
+func (s Schema) Validate(env map[string]string) error {
+	keys := []string{}
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	problems := SchemaError{}
+	for _, k := range keys {
+		rule := s[k]
+		value := env[k]
+
+		if value == "" {
+			if rule.Required {
+				problems = append(problems, fmt.Sprintf("%s is required", k))
+			}
+			continue
+		}
+
+		if IsSecret(value) {
+			continue
+		}
+
+		if len(rule.Values) > 0 && !utils.StringInSlice(value, rule.Values) {
+			problems = append(problems, fmt.Sprintf("%s must be one of %s", k, strings.Join(rule.Values, ", ")))
+			continue
+		}
+
+		if err := checkType(rule.Type, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be %s", k, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// checkType returns a description of the type if value doesn't match it
+func checkType(typ, value string) error {
+	var err error
+	switch typ {
+	case "int":
+		if _, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("an int")
+		}
+	case "bool":
+		if _, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("a bool")
+		}
+	case "duration":
+		if _, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("a duration, like 30s")
+		}
+	case "url":
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") {
+			return fmt.Errorf("a url")
+		}
+	}
+	return nil
+}
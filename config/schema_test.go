@@ -0,0 +1,75 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSchema(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{"database_url": {"required": true, "type": "url"}}`))
+	if err != nil || !schema["DATABASE_URL"].Required {
+		t.Fatalf("ParseSchema() = %v, %v, want DATABASE_URL required", schema, err)
+	}
+
+	if _, err := ParseSchema([]byte(`{"PORT": {"type": "float"}}`)); err == nil {
+		t.Fatalf("ParseSchema() = %v, want unknown type error", err)
+	}
+
+	if schema, err := ParseSchema(nil); len(schema) != 0 || err != nil {
+		t.Fatalf("ParseSchema(nil) = %v, %v, want empty", schema, err)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema := Schema{
+		"DATABASE_URL": {Required: true, Type: "url"},
+		"GALAXY_PORT":  {Type: "int"},
+		"DEBUG":        {Type: "bool"},
+		"TIMEOUT":      {Type: "duration"},
+		"LOG_LEVEL":    {Values: []string{"debug", "info"}},
+	}
+
+	valid := map[string]string{
+		"DATABASE_URL": "postgres://db/app",
+		"GALAXY_PORT":  "8000",
+		"DEBUG":        "true",
+		"TIMEOUT":      "30s",
+		"LOG_LEVEL":    "info",
+	}
+	if err := schema.Validate(valid); err != nil {
+		t.Fatalf("Validate(%v) = %v, want %v", valid, err, nil)
+	}
+
+	invalid := map[string]string{
+		"GALAXY_PORT": "80OO",
+		"DEBUG":       "maybe",
+		"TIMEOUT":     "30",
+		"LOG_LEVEL":   "trace",
+	}
+	err := schema.Validate(invalid)
+	problems, ok := err.(SchemaError)
+	if !ok || len(problems) != 5 {
+		t.Fatalf("Validate(%v) = %v, want 5 problems", invalid, err)
+	}
+
+	if !strings.Contains(err.Error(), "DATABASE_URL is required") {
+		t.Fatalf("Validate() = %q, want DATABASE_URL required", err)
+	}
+
+	// secrets can't be checked beyond being set
+	secret := map[string]string{"DATABASE_URL": "secret:1:abcd"}
+	if err := schema.Validate(secret); err != nil {
+		t.Fatalf("Validate(%v) = %v, want %v", secret, err, nil)
+	}
+}
+
+func TestAppSchemaStored(t *testing.T) {
+	schema := Schema{"GALAXY_PORT": {Required: true, Type: "int"}}
+
+	for _, app := range []App{NewAppConfig("app", ""), &AppDefinition{AppName: "app"}} {
+		app.SetSchema(schema)
+		if got := app.GetSchema(); got.String() != schema.String() {
+			t.Fatalf("GetSchema() = %v, want %v", got, schema)
+		}
+	}
+}
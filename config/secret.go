@@ -0,0 +1,204 @@
+package config
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/litl/galaxy/utils"
+)
+
+/*
+Secret config values are stored encrypted, as
+	secret:<key id>:<base64 nonce+ciphertext>
+
+so every backend keeps them without any schema change. The keys live in a
+local keyring file, one key per line:
+	<key id> <base64 256 bit key>
+
+New values are encrypted with the last key in the file, so keys can be
+rotated by appending a new one, while values encrypted with the older keys
+can still be read. The same keyring has to be copied to every agent host.
+*/
+
+const secretPrefix = "secret:"
+
+// Masked is shown in place of a secret value
+const Masked = "********"
+
+// IsSecret reports whether a config value is an encrypted secret
+func IsSecret(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+// DefaultKeyringPath returns $GALAXY_KEYRING, or ~/.galaxy/keyring
+func DefaultKeyringPath() string {
+	return utils.GetEnv("GALAXY_KEYRING", filepath.Join(utils.HomeDir(), ".galaxy", "keyring"))
+}
+
+type Keyring struct {
+	keys    map[string][]byte
+	current string
+}
+
+// LoadKeyring reads the keyring file at path.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &Keyring{
+		keys: make(map[string][]byte),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, fmt.Errorf("invalid keyring entry in %s", path)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid key %s in %s", fields[0], path)
+		}
+
+		k.keys[fields[0]] = key
+		k.current = fields[0]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if k.current == "" {
+		return nil, fmt.Errorf("no keys in %s", path)
+	}
+	return k, nil
+}
+
+// CreateKeyring writes a new keyring file at path with a single random key.
+// It fails if the file already exists.
+func CreateKeyring(path string) (*Keyring, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "1 %s\n", base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keyring{
+		keys:    map[string][]byte{"1": key},
+		current: "1",
+	}, nil
+}
+
+func (k *Keyring) gcm(id string) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %s is not in the keyring", id)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt returns value encrypted with the current key, in the form that's
+// stored in the config.
+func (k *Keyring) Encrypt(value string) (string, error) {
+	aead, err := k.gcm(k.current)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+	return secretPrefix + k.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of a secret value. Values that aren't secret
+// are returned unchanged.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsSecret(value) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, secretPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid secret value")
+	}
+
+	aead, err := k.gcm(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid secret value")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt secret with key %s", parts[0])
+	}
+	return string(plain), nil
+}
+
+// DecryptEnv returns a copy of env with the secret values decrypted. If
+// keyring is nil, the default keyring is loaded when env has any secrets.
+func DecryptEnv(keyring *Keyring, env map[string]string) (map[string]string, error) {
+	plain := make(map[string]string, len(env))
+	for k, v := range env {
+		if IsSecret(v) {
+			var err error
+			if keyring == nil {
+				keyring, err = LoadKeyring(DefaultKeyringPath())
+				if err != nil {
+					return nil, fmt.Errorf("unable to load keyring: %s", err)
+				}
+			}
+
+			v, err = keyring.Decrypt(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err)
+			}
+		}
+		plain[k] = v
+	}
+	return plain, nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyringEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring")
+	keyring, err := CreateKeyring(path)
+	if err != nil {
+		t.Fatalf("CreateKeyring(%q) = %v, want %v", path, err, nil)
+	}
+
+	if _, err := CreateKeyring(path); err == nil {
+		t.Fatalf("CreateKeyring(%q) overwrote the existing keyring", path)
+	}
+
+	secret, err := keyring.Encrypt("postgres://user:pass@db/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsSecret(secret) || strings.Contains(secret, "pass") {
+		t.Fatalf("Encrypt() = %q, want an encrypted value", secret)
+	}
+
+	loaded, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("LoadKeyring(%q) = %v, want %v", path, err, nil)
+	}
+
+	plain, err := loaded.Decrypt(secret)
+	if plain != "postgres://user:pass@db/app" || err != nil {
+		t.Fatalf("Decrypt(%q) = %q, %v, want %q", secret, plain, err, "postgres://user:pass@db/app")
+	}
+
+	// a value that was tampered with doesn't decrypt
+	tampered := secret[:len(secret)-4] + "AAA="
+	if _, err := loaded.Decrypt(tampered); err == nil {
+		t.Fatalf("Decrypt(%q) = %v, want error", tampered, err)
+	}
+
+	env, err := DecryptEnv(loaded, map[string]string{"A": "plain", "B": secret})
+	if err != nil || env["A"] != "plain" || env["B"] != "postgres://user:pass@db/app" {
+		t.Fatalf("DecryptEnv() = %v, %v, want A and B in plaintext", env, err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring")
+	old, err := CreateKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, _ := old.Encrypt("value")
+
+	// append a new key
+	other, _ := CreateKeyring(filepath.Join(dir, "other"))
+	otherData, _ := ioutil.ReadFile(filepath.Join(dir, "other"))
+	data, _ := ioutil.ReadFile(path)
+	data = append(data, []byte(strings.Replace(string(otherData), "1 ", "2 ", 1))...)
+	ioutil.WriteFile(path, data, 0600)
+
+	keyring, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("LoadKeyring(%q) = %v, want %v", path, err, nil)
+	}
+
+	if plain, err := keyring.Decrypt(secret); plain != "value" || err != nil {
+		t.Fatalf("Decrypt(%q) = %q, %v, want %q", secret, plain, err, "value")
+	}
+
+	rotated, _ := keyring.Encrypt("value")
+	if !strings.HasPrefix(rotated, "secret:2:") {
+		t.Fatalf("Encrypt() = %q, want it encrypted with key 2", rotated)
+	}
+
+	if _, err := other.Decrypt(secret); err == nil {
+		t.Fatalf("Decrypt(%q) with the wrong keyring = %v, want error", secret, err)
+	}
+}
@@ -0,0 +1,62 @@
+package config
+
+/*
+Shared config is set on a whole env, or on a pool within an env, and is
+passed to every app running there. When the same variable is set in more
+than one place, the most specific one wins:
+	app config > pool config > env config
+*/
+
+// MergeEnv returns the environment for an app running in a pool, from the
+// env-wide, pool-wide and app config.
+func MergeEnv(envConfig, poolConfig, appConfig map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, vars := range []map[string]string{envConfig, poolConfig, appConfig} {
+		for k, v := range vars {
+			if v != "" {
+				merged[k] = v
+			}
+		}
+	}
+	return merged
+}
+
+// applySharedConfig returns a copy of current with values set, removing any
+// that are set to "".
+func applySharedConfig(current, values map[string]string) map[string]string {
+	updated := make(map[string]string, len(current))
+	for k, v := range current {
+		updated[k] = v
+	}
+
+	for k, v := range values {
+		if v == "" {
+			delete(updated, k)
+			continue
+		}
+		updated[k] = v
+	}
+	return updated
+}
+
+// affectedBySharedConfig reports whether setting values changes any shared
+// variable that isn't overridden by a more specific config.
+func affectedBySharedConfig(old, values map[string]string, overrides ...map[string]string) bool {
+	for k, v := range values {
+		if old[k] == v {
+			continue
+		}
+
+		overridden := false
+		for _, vars := range overrides {
+			if vars[k] != "" {
+				overridden = true
+			}
+		}
+
+		if !overridden {
+			return true
+		}
+	}
+	return false
+}
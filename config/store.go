@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
@@ -23,17 +24,15 @@ type HostInfo struct {
 }
 
 type Store struct {
-	Backend     Backend
-	TTL         uint64
-	pollCh      chan bool
-	restartChan chan *ConfigChange
+	Backend Backend
+	TTL     uint64
+
+	webhooks webhookQueue
 }
 
 func NewStore(ttl uint64, registryURL string) *Store {
 	s := &Store{
-		TTL:         ttl,
-		pollCh:      make(chan bool),
-		restartChan: make(chan *ConfigChange, 10),
+		TTL: ttl,
 	}
 
 	u, err := url.Parse(registryURL)
@@ -42,13 +41,39 @@ func NewStore(ttl uint64, registryURL string) *Store {
 	}
 
 	switch strings.ToLower(u.Scheme) {
-	case "redis":
-		s.Backend = &RedisBackend{
-			RedisHost: u.Host,
+	case "redis", "rediss", "redis+sentinel":
+		backend, err := NewRedisBackend(u)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid redis registry URL: %s", err)
+		}
+
+		if err := backend.migrateIndexes(); err != nil {
+			log.Warnf("WARN: Unable to index existing redis keys: %s", err)
 		}
-		s.Backend.connect()
+		s.Backend = backend
 	case "consul":
-		s.Backend = NewConsulBackend()
+		s.Backend, err = NewConsulBackend(u)
+		if err != nil {
+			log.Fatalf("ERROR: Unable to connect to consul: %s", err)
+		}
+	case "etcd":
+		s.Backend, err = NewEtcdBackend(etcdEndpoints(u.Host))
+		if err != nil {
+			log.Fatalf("ERROR: Unable to connect to etcd: %s", err)
+		}
+	case "memory":
+		s.Backend = NewMemoryBackend()
+	case "file", "bolt":
+		// allow relative paths, e.g. bolt://galaxy.db
+		path := u.Opaque
+		if path == "" {
+			path = u.Host + u.Path
+		}
+
+		s.Backend, err = NewBoltBackend(path)
+		if err != nil {
+			log.Fatalf("ERROR: Unable to open %s: %s", path, err)
+		}
 	default:
 		log.Fatalf("ERROR: Unsupported registry backend: %s", u)
 	}
@@ -62,7 +87,7 @@ func NewStore(ttl uint64, registryURL string) *Store {
 func (s *Store) NewAppConfig(app, version string) App {
 	var appCfg App
 	switch s.Backend.(type) {
-	case *RedisBackend:
+	case *RedisBackend, *MemoryBackend:
 		appCfg = &AppConfig{
 			name:            app,
 			versionVMap:     utils.NewVersionedMap(),
@@ -70,7 +95,7 @@ func (s *Store) NewAppConfig(app, version string) App {
 			portsVMap:       utils.NewVersionedMap(),
 			runtimeVMap:     utils.NewVersionedMap(),
 		}
-	case *ConsulBackend:
+	case *ConsulBackend, *EtcdBackend, *BoltBackend:
 		appCfg = &AppDefinition{
 			AppName:     app,
 			Environment: make(map[string]string),
@@ -130,11 +155,18 @@ func (s *Store) AssignApp(app, env, pool string) (bool, error) {
 		return false, err
 	}
 
-	err = s.NotifyRestart(app, env)
+	if added {
+		s.audit("app:assign", env, app, pool, nil)
+	}
+
+	err = s.NotifyChange(&ChangeEvent{Kind: ChangeAssign, App: app, Env: env, Pool: pool})
 	if err != nil {
 		return added, err
 	}
 
+	if added {
+		s.NotifyWebhooks(WebhookEvent{Event: WebhookAssign, Env: env, App: app, Pool: pool, User: changedBy()})
+	}
 	return added, nil
 }
 
@@ -144,16 +176,27 @@ func (s *Store) UnassignApp(app, env, pool string) (bool, error) {
 		return removed, err
 	}
 
-	err = s.NotifyRestart(app, env)
+	s.audit("app:unassign", env, app, pool, nil)
+
+	err = s.NotifyChange(&ChangeEvent{Kind: ChangeAssign, App: app, Env: env, Pool: pool})
 	if err != nil {
 		return removed, err
 	}
 
+	s.NotifyWebhooks(WebhookEvent{Event: WebhookUnassign, Env: env, App: app, Pool: pool, User: changedBy()})
 	return removed, nil
 }
 
 func (s *Store) CreatePool(name, env string) (bool, error) {
-	return s.Backend.CreatePool(env, name)
+	// agents create their pool when they start, so only a new pool is
+	// audited
+	created, err := s.Backend.CreatePool(env, name)
+	if !created || err != nil {
+		return created, err
+	}
+
+	s.audit("pool:create", env, "", name, nil)
+	return true, nil
 }
 
 func (s *Store) DeletePool(pool, env string) (bool, error) {
@@ -166,7 +209,13 @@ func (s *Store) DeletePool(pool, env string) (bool, error) {
 		return false, nil
 	}
 
-	return s.Backend.DeletePool(env, pool)
+	deleted, err := s.Backend.DeletePool(env, pool)
+	if !deleted || err != nil {
+		return deleted, err
+	}
+
+	s.audit("pool:delete", env, "", pool, nil)
+	return true, nil
 }
 
 func (s *Store) ListPools(env string) ([]string, error) {
@@ -178,8 +227,13 @@ func (s *Store) CreateApp(app, env string) (bool, error) {
 		return false, err
 	}
 
-	return s.Backend.CreateApp(app, env)
+	created, err := s.Backend.CreateApp(app, env)
+	if !created || err != nil {
+		return created, err
+	}
 
+	s.audit("app:create", env, app, "", nil)
+	return true, nil
 }
 
 func (s *Store) DeleteApp(app, env string) (bool, error) {
@@ -200,20 +254,21 @@ func (s *Store) DeleteApp(app, env string) (bool, error) {
 	}
 
 	svcCfg, err := s.Backend.GetApp(app, env)
+	if err == UnknownApp {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
 
-	if svcCfg == nil {
-		return true, nil
-	}
-
 	deleted, err := s.Backend.DeleteApp(svcCfg, env)
 	if !deleted || err != nil {
 		return deleted, err
 	}
 
-	err = s.NotifyEnvChanged(env)
+	s.audit("app:delete", env, app, "", diffFields(appFields(svcCfg), appFields(nil)))
+
+	err = s.NotifyChange(&ChangeEvent{Kind: ChangeDelete, App: app, Env: env})
 	if err != nil {
 		return deleted, err
 	}
@@ -243,18 +298,181 @@ func (s *Store) GetApp(app, env string) (App, error) {
 }
 
 func (s *Store) UpdateApp(svcCfg App, env string) (bool, error) {
+	// the stored config, to tell watchers what kind of change this is, and
+	// for the audit log
+	old, err := s.Backend.GetApp(svcCfg.Name(), env)
+	if err != nil {
+		old = nil
+	}
+
 	updated, err := s.Backend.UpdateApp(svcCfg, env)
 	if !updated || err != nil {
 		return updated, err
 	}
 
-	err = s.NotifyEnvChanged(env)
+	kind := changeKind(old, svcCfg)
+	changes := diffFields(appFields(old), appFields(svcCfg))
+	s.audit("app:"+string(kind), env, svcCfg.Name(), "", changes)
+
+	// the update is stored by now, so report it even if notifying fails
+	err = s.NotifyChange(&ChangeEvent{
+		Kind: kind,
+		App:  svcCfg.Name(),
+		Env:  env,
+		ID:   svcCfg.ID(),
+	})
 	if err != nil {
-		return false, err
+		return true, err
+	}
+
+	if event := appWebhookEvent(kind, changes); event != "" {
+		s.NotifyWebhooks(WebhookEvent{
+			Event:   event,
+			Env:     env,
+			App:     svcCfg.Name(),
+			Version: svcCfg.Version(),
+			User:    changedBy(),
+			Changes: changes,
+		})
 	}
 	return true, nil
 }
 
+func (s *Store) AddRelease(app, env string, release *Release) error {
+	return s.Backend.AddRelease(app, env, release)
+}
+
+func (s *Store) ListReleases(app, env string) ([]Release, error) {
+	return s.Backend.ListReleases(app, env)
+}
+
+func (s *Store) GetSharedConfig(env, pool string) (map[string]string, error) {
+	return s.Backend.GetSharedConfig(env, pool)
+}
+
+// UpdateSharedConfig sets config values for a whole env, or for a pool if
+// pool isn't empty, and restarts the apps that now see different values.
+// It returns the names of the restarted apps. Nothing is changed if the new
+// values would break the schema of any of those apps.
+func (s *Store) UpdateSharedConfig(env, pool string, values map[string]string) ([]string, error) {
+	old, err := s.Backend.GetSharedConfig(env, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	// the pools each app runs in
+	pools := []string{pool}
+	if pool == "" {
+		pools, err = s.ListPools(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	assigned := make(map[string][]string)
+	for _, p := range pools {
+		apps, err := s.ListAssignments(env, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			assigned[app] = append(assigned[app], p)
+		}
+	}
+
+	updated := applySharedConfig(old, values)
+
+	// work out which apps see a different config, and check it against their
+	// schemas before anything is written
+	affected := []string{}
+	for app, appPools := range assigned {
+		appCfg, err := s.Backend.GetApp(app, env)
+		if err == UnknownApp {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		appAffected := false
+		for _, p := range appPools {
+			overrides := []map[string]string{appCfg.Env()}
+
+			envConfig, poolConfig := updated, map[string]string{}
+			if pool == "" {
+				// env-wide values can be overridden by the pool too
+				poolConfig, err = s.Backend.GetSharedConfig(env, p)
+				if err != nil {
+					return nil, err
+				}
+				overrides = append(overrides, poolConfig)
+			} else {
+				envConfig, err = s.Backend.GetSharedConfig(env, "")
+				if err != nil {
+					return nil, err
+				}
+				poolConfig = updated
+			}
+
+			if !affectedBySharedConfig(old, values, overrides...) {
+				continue
+			}
+			appAffected = true
+
+			schema := appCfg.GetSchema()
+			if len(schema) == 0 {
+				continue
+			}
+			if err := schema.Validate(MergeEnv(envConfig, poolConfig, appCfg.Env())); err != nil {
+				return nil, fmt.Errorf("%s: %s (in pool %s)", app, err, p)
+			}
+		}
+
+		if appAffected {
+			affected = append(affected, app)
+		}
+	}
+	sort.Strings(affected)
+
+	if err := s.Backend.UpdateSharedConfig(env, pool, values); err != nil {
+		return nil, err
+	}
+
+	changes := diffFields(old, updated)
+	if len(changes) > 0 {
+		s.audit("config:shared", env, "", pool, changes)
+		s.NotifyWebhooks(WebhookEvent{Event: WebhookConfig, Env: env, Pool: pool, User: changedBy(), Changes: changes})
+	}
+
+	restarted := []string{}
+	for _, app := range affected {
+		if _, err := s.NotifyRestart(app, env); err != nil {
+			return restarted, err
+		}
+		restarted = append(restarted, app)
+	}
+	return restarted, nil
+}
+
+// AppEnv returns the environment for an app running in a pool, including
+// the shared config. Pool may be empty to only include the env-wide config.
+func (s *Store) AppEnv(appCfg App, env, pool string) (map[string]string, error) {
+	envConfig, err := s.Backend.GetSharedConfig(env, "")
+	if err != nil {
+		return nil, err
+	}
+
+	poolConfig := map[string]string{}
+	if pool != "" {
+		poolConfig, err = s.Backend.GetSharedConfig(env, pool)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return MergeEnv(envConfig, poolConfig, appCfg.Env()), nil
+}
+
 func (s *Store) UpdateHost(env, pool string, host HostInfo) error {
 	return s.Backend.UpdateHost(env, pool, host)
 }
@@ -276,7 +494,7 @@ func (s *Store) RegisterService(env, pool, hostIP string, container *docker.Cont
 		return nil, fmt.Errorf("GALAXY_APP not set on container %s", container.ID[0:12])
 	}
 
-	serviceRegistration := newServiceRegistration(container, hostIP, environment["GALAXY_PORT"])
+	serviceRegistration := newServiceRegistration(container, hostIP, environment)
 	serviceRegistration.Name = name
 	serviceRegistration.ImageId = container.Config.Image
 
@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -186,8 +187,10 @@ func TestUnassignAppAddMemberNotifyRestart(t *testing.T) {
 			t.Errorf("UnassignApp(%q) wrong notify key, want %s. got %s", "app", key, "galaxy-dev")
 		}
 
-		if value != "restart app" {
-			t.Errorf("UnassignApp(%q) wrong notify value, want %s. got %s", "app", value, "restart app")
+		// the assignment was the second logged change
+		want := ChangeEvent{Seq: 2, Kind: ChangeAssign, App: "app", Env: "dev", Pool: "web"}
+		if value != want.String() {
+			t.Errorf("UnassignApp(%q) wrong notify value, want %s. got %s", "app", want, value)
 		}
 		return 1, nil
 	}
@@ -379,6 +382,90 @@ func TestListEnvs(t *testing.T) {
 	}
 }
 
+func TestUpdateSharedConfigRestartsAffected(t *testing.T) {
+	r, _ := NewTestStore()
+
+	for _, app := range []string{"api", "worker", "own", "idle"} {
+		assertAppCreated(t, r, app)
+	}
+	assertPoolCreated(t, r, "web")
+	assertPoolCreated(t, r, "batch")
+
+	r.AssignApp("api", "dev", "web")
+	r.AssignApp("own", "dev", "web")
+	r.AssignApp("worker", "dev", "batch")
+
+	own, _ := r.GetApp("own", "dev")
+	own.EnvSet("STATSD_HOST", "own-statsd")
+	r.UpdateApp(own, "dev")
+
+	restarted, err := r.UpdateSharedConfig("dev", "", map[string]string{"STATSD_HOST": "statsd"})
+	if strings.Join(restarted, ",") != "api,worker" || err != nil {
+		t.Fatalf("UpdateSharedConfig() = %v, %v, want %v, %v", restarted, err, []string{"api", "worker"}, nil)
+	}
+
+	// setting the same value again doesn't restart anything
+	restarted, err = r.UpdateSharedConfig("dev", "", map[string]string{"STATSD_HOST": "statsd"})
+	if len(restarted) != 0 || err != nil {
+		t.Fatalf("UpdateSharedConfig() = %v, %v, want none", restarted, err)
+	}
+
+	restarted, err = r.UpdateSharedConfig("dev", "web", map[string]string{"STATSD_HOST": "web-statsd"})
+	if strings.Join(restarted, ",") != "api" || err != nil {
+		t.Fatalf("UpdateSharedConfig(%q) = %v, %v, want %v, %v", "web", restarted, err, []string{"api"}, nil)
+	}
+
+	// the pool overrides the env for api, so only worker sees this
+	restarted, err = r.UpdateSharedConfig("dev", "", map[string]string{"STATSD_HOST": "new-statsd"})
+	if strings.Join(restarted, ",") != "worker" || err != nil {
+		t.Fatalf("UpdateSharedConfig() = %v, %v, want %v, %v", restarted, err, []string{"worker"}, nil)
+	}
+
+	api, _ := r.GetApp("api", "dev")
+	if env, _ := r.AppEnv(api, "dev", "web"); env["STATSD_HOST"] != "web-statsd" {
+		t.Fatalf("AppEnv(%q, %q) = %v, want STATSD_HOST=web-statsd", "api", "web", env)
+	}
+
+	if env, _ := r.AppEnv(own, "dev", "web"); env["STATSD_HOST"] != "own-statsd" {
+		t.Fatalf("AppEnv(%q, %q) = %v, want STATSD_HOST=own-statsd", "own", "web", env)
+	}
+
+	if env, _ := r.AppEnv(api, "dev", ""); env["STATSD_HOST"] != "new-statsd" {
+		t.Fatalf("AppEnv(%q, %q) = %v, want STATSD_HOST=new-statsd", "api", "", env)
+	}
+}
+
+func TestUpdateSharedConfigValidatesSchema(t *testing.T) {
+	r, _ := NewTestStore()
+
+	assertAppCreated(t, r, "api")
+	assertPoolCreated(t, r, "web")
+	r.AssignApp("api", "dev", "web")
+
+	r.UpdateSharedConfig("dev", "", map[string]string{"STATSD_HOST": "statsd"})
+
+	api, _ := r.GetApp("api", "dev")
+	api.SetSchema(Schema{"STATSD_HOST": {Required: true}})
+	r.UpdateApp(api, "dev")
+
+	restarted, err := r.UpdateSharedConfig("dev", "", map[string]string{"STATSD_HOST": ""})
+	if len(restarted) != 0 || err == nil {
+		t.Fatalf("UpdateSharedConfig() = %v, %v, want an error for the required STATSD_HOST", restarted, err)
+	}
+
+	if shared, _ := r.GetSharedConfig("dev", ""); shared["STATSD_HOST"] != "statsd" {
+		t.Fatalf("GetSharedConfig() = %v, want STATSD_HOST unchanged", shared)
+	}
+
+	// the pool can still provide it
+	if _, err := r.UpdateSharedConfig("dev", "web", map[string]string{"STATSD_HOST": "web-statsd"}); err != nil {
+		t.Fatalf("UpdateSharedConfig(%q) = %v, want %v", "web", err, nil)
+	}
+	if _, err := r.UpdateSharedConfig("dev", "", map[string]string{"STATSD_HOST": ""}); err != nil {
+		t.Fatalf("UpdateSharedConfig() = %v, want %v when the pool sets it", err, nil)
+	}
+}
+
 func assertAppCreated(t *testing.T, r *Store, app string) {
 	if created, err := r.CreateApp(app, "dev"); !created || err != nil {
 		t.Fatalf("CreateApp(%q) = %t, %v, want %t, %v", app,
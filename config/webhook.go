@@ -0,0 +1,355 @@
+package config
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// The events sent to webhooks
+const (
+	WebhookDeploy   = "deploy"
+	WebhookConfig   = "config"
+	WebhookRestart  = "restart"
+	WebhookScale    = "scale"
+	WebhookAssign   = "assign"
+	WebhookUnassign = "unassign"
+	// a container exited without being stopped
+	WebhookCrash = "crash"
+	// a host couldn't deploy or restart an app
+	WebhookFailed = "failed"
+)
+
+// WebhookEvents lists every event that can be sent to a webhook
+var WebhookEvents = []string{
+	WebhookDeploy, WebhookConfig, WebhookRestart, WebhookScale,
+	WebhookAssign, WebhookUnassign, WebhookCrash, WebhookFailed,
+}
+
+// Webhook is a URL that's sent a JSON POST for events in an env.
+type Webhook struct {
+	URL string
+
+	// Secret signs each request body with HMAC-SHA256, sent hex encoded in
+	// the X-Galaxy-Signature header as "sha256=<signature>"
+	Secret string
+
+	// Events to send, or all of them if empty
+	Events []string
+}
+
+// Wants reports whether the webhook should be sent an event
+func (w Webhook) Wants(event string) bool {
+	return len(w.Events) == 0 || utils.StringInSlice(event, w.Events)
+}
+
+// WebhookEvent is the body POSTed to webhooks
+type WebhookEvent struct {
+	Event string    `json:"event"`
+	Env   string    `json:"env"`
+	App   string    `json:"app,omitempty"`
+	Pool  string    `json:"pool,omitempty"`
+	Time  time.Time `json:"time"`
+
+	// the image running, if there's an app
+	Version string `json:"version,omitempty"`
+
+	// the host it happened on, for events from agents
+	HostIP string `json:"host_ip,omitempty"`
+
+	// who made the change, for changes made through the Store
+	User string `json:"user,omitempty"`
+
+	// Message says more about what happened, such as an error
+	Message string `json:"message,omitempty"`
+
+	// Changes lists the fields that changed, like the audit log
+	Changes []AuditChange `json:"changes,omitempty"`
+}
+
+// how webhook requests are sent and retried
+var (
+	webhookClient     = &http.Client{Timeout: 5 * time.Second}
+	webhookAttempts   = 3
+	webhookRetryDelay = time.Second
+
+	// how many events can wait to be sent before more are dropped
+	webhookQueueSize = 256
+)
+
+// webhookQueue holds the events waiting to be sent, which are sent in the
+// background in the order they were queued.
+type webhookQueue struct {
+	start  sync.Once
+	events chan queuedWebhook
+}
+
+// queuedWebhook is an event to send, or a flush waiting on the events
+// queued before it.
+type queuedWebhook struct {
+	event   WebhookEvent
+	flushed chan struct{}
+}
+
+// SignWebhook returns the signature sent with a webhook body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewWebhookSecret returns a random secret for signing webhooks
+func NewWebhookSecret() (string, error) {
+	return randomHex(20)
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// appWebhookEvent returns the webhook event for a change to an app's
+// config, or "" if there isn't one. Runtime changes are only sent when the
+// number of processes changes.
+func appWebhookEvent(kind ChangeKind, changes []AuditChange) string {
+	switch kind {
+	case ChangeDeploy:
+		return WebhookDeploy
+	case ChangeConfig:
+		return WebhookConfig
+	}
+
+	for _, c := range changes {
+		if strings.HasPrefix(c.Field, "processes.") {
+			return WebhookScale
+		}
+	}
+	return ""
+}
+
+// changedBy says who is making changes from this process, for webhooks
+func changedBy() string {
+	user, host := auditIdentity()
+	return user + "@" + host
+}
+
+func (s *Store) ListWebhooks(env string) ([]Webhook, error) {
+	return s.Backend.GetWebhooks(env)
+}
+
+// AddWebhook adds a webhook to env, replacing any with the same URL.
+func (s *Store) AddWebhook(env string, hook Webhook) error {
+	hooks, err := s.Backend.GetWebhooks(env)
+	if err != nil {
+		return err
+	}
+
+	updated := []Webhook{}
+	for _, h := range hooks {
+		if h.URL != hook.URL {
+			updated = append(updated, h)
+		}
+	}
+	updated = append(updated, hook)
+
+	if err := s.Backend.SetWebhooks(env, updated); err != nil {
+		return err
+	}
+
+	s.audit("webhook:add", env, "", "", []AuditChange{{Field: "url", After: hook.URL}})
+	return nil
+}
+
+// RemoveWebhook removes the webhook with the URL from env, and reports
+// whether there was one.
+func (s *Store) RemoveWebhook(env, url string) (bool, error) {
+	hooks, err := s.Backend.GetWebhooks(env)
+	if err != nil {
+		return false, err
+	}
+
+	updated := []Webhook{}
+	for _, h := range hooks {
+		if h.URL != url {
+			updated = append(updated, h)
+		}
+	}
+
+	if len(updated) == len(hooks) {
+		return false, nil
+	}
+
+	if err := s.Backend.SetWebhooks(env, updated); err != nil {
+		return false, err
+	}
+
+	s.audit("webhook:remove", env, "", "", []AuditChange{{Field: "url", Before: url}})
+	return true, nil
+}
+
+// NotifyWebhooks queues an event to be sent to every webhook in its env
+// that wants it, and returns without waiting for it to be sent, so a slow
+// webhook doesn't hold up the change that caused the event. Failures are
+// only logged, since whatever caused the event has already happened.
+func (s *Store) NotifyWebhooks(event WebhookEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	select {
+	case s.webhookQueue() <- queuedWebhook{event: event}:
+	default:
+		log.Warnf("WARN: Dropping %s webhook for %s: too many waiting to be sent", event.Event, event.Env)
+	}
+}
+
+// FlushWebhooks waits up to timeout for the events already queued to be
+// sent or given up on, and reports whether they were. Commands call it
+// before exiting, since the events are sent in the background.
+func (s *Store) FlushWebhooks(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	flushed := make(chan struct{})
+	select {
+	case s.webhookQueue() <- queuedWebhook{flushed: flushed}:
+	case <-timer.C:
+		return false
+	}
+
+	select {
+	case <-flushed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// webhookQueue returns the store's queue, starting to send what's queued the
+// first time it's needed.
+func (s *Store) webhookQueue() chan queuedWebhook {
+	s.webhooks.start.Do(func() {
+		s.webhooks.events = make(chan queuedWebhook, webhookQueueSize)
+		go s.sendQueuedWebhooks()
+	})
+	return s.webhooks.events
+}
+
+func (s *Store) sendQueuedWebhooks() {
+	for queued := range s.webhooks.events {
+		if queued.flushed != nil {
+			close(queued.flushed)
+			continue
+		}
+		s.sendWebhooks(queued.event)
+	}
+}
+
+// sendWebhooks sends an event to every webhook in its env that wants it,
+// and returns once they've all been sent or given up on.
+func (s *Store) sendWebhooks(event WebhookEvent) {
+	hooks, err := s.Backend.GetWebhooks(event.Env)
+	if err != nil {
+		log.Warnf("WARN: Unable to load webhooks for %s: %s", event.Env, err)
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Warnf("WARN: Unable to encode %s webhook: %s", event.Event, err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, hook := range hooks {
+		if !hook.Wants(event.Event) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(hook Webhook) {
+			defer wg.Done()
+			if err := sendWebhook(hook, event.Event, body); err != nil {
+				log.Warnf("WARN: Unable to send %s webhook to %s: %s", event.Event, hook.URL, err)
+			}
+		}(hook)
+	}
+	wg.Wait()
+}
+
+// sendWebhook POSTs the body, retrying connection errors and server errors
+// with a growing delay. Each attempt has the same delivery ID, so receivers
+// can tell a retry from a new event.
+func sendWebhook(hook Webhook, event string, body []byte) error {
+	delivery, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(hook, event, delivery, body)
+		if err == nil {
+			return nil
+		}
+
+		if _, retry := err.(retryableError); !retry || attempt >= webhookAttempts {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// retryableError is a failure that may succeed when tried again
+type retryableError struct {
+	error
+}
+
+func postWebhook(hook Webhook, event, delivery string, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "galaxy-webhook")
+	req.Header.Set("X-Galaxy-Event", event)
+	req.Header.Set("X-Galaxy-Delivery", delivery)
+	if hook.Secret != "" {
+		req.Header.Set("X-Galaxy-Signature", SignWebhook(hook.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == 429:
+		return retryableError{fmt.Errorf("%s", resp.Status)}
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records the requests sent to it, failing the first few
+type webhookServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	fail     int
+	status   int
+}
+
+func newWebhookServer(fail, status int) *webhookServer {
+	ws := &webhookServer{fail: fail, status: status}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		ws.Lock()
+		defer ws.Unlock()
+		ws.requests = append(ws.requests, r)
+		ws.bodies = append(ws.bodies, body)
+		if len(ws.requests) <= ws.fail {
+			w.WriteHeader(ws.status)
+		}
+	}))
+	return ws
+}
+
+// received returns the requests and bodies received so far
+func (ws *webhookServer) received() ([]*http.Request, [][]byte) {
+	ws.Lock()
+	defer ws.Unlock()
+	return ws.requests, ws.bodies
+}
+
+// events returns the events received, in order
+func (ws *webhookServer) events(t *testing.T) []WebhookEvent {
+	ws.Lock()
+	defer ws.Unlock()
+
+	events := []WebhookEvent{}
+	for _, body := range ws.bodies {
+		event := WebhookEvent{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatalf("webhook body %q: %s", body, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func fastWebhookRetries() func() {
+	delay := webhookRetryDelay
+	webhookRetryDelay = time.Millisecond
+	return func() {
+		webhookRetryDelay = delay
+	}
+}
+
+// flushWebhooks waits for the events queued so far to be sent
+func flushWebhooks(t *testing.T, s *Store) {
+	if !s.FlushWebhooks(5 * time.Second) {
+		t.Fatalf("FlushWebhooks() = false, want true")
+	}
+}
+
+func TestWebhookSignedAndRetried(t *testing.T) {
+	defer fastWebhookRetries()()
+
+	ws := newWebhookServer(2, http.StatusBadGateway)
+	defer ws.Close()
+
+	s, _ := NewTestStore()
+	s.AddWebhook("dev", Webhook{URL: ws.URL, Secret: "sekrit", Events: []string{WebhookCrash}})
+
+	// not wanted
+	s.NotifyWebhooks(WebhookEvent{Event: WebhookDeploy, Env: "dev", App: "app"})
+	s.NotifyWebhooks(WebhookEvent{Event: WebhookCrash, Env: "dev", App: "app", HostIP: "10.0.0.1"})
+	flushWebhooks(t, s)
+
+	requests, bodies := ws.received()
+	if len(requests) != 3 {
+		t.Fatalf("webhook requests = %d, want 3", len(requests))
+	}
+
+	delivery := requests[0].Header.Get("X-Galaxy-Delivery")
+	for i, r := range requests {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("webhook request = %s %s, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if got := r.Header.Get("X-Galaxy-Delivery"); got != delivery || got == "" {
+			t.Fatalf("X-Galaxy-Delivery = %q, want %q for every attempt", got, delivery)
+		}
+		if got, want := r.Header.Get("X-Galaxy-Signature"), SignWebhook("sekrit", bodies[i]); got != want {
+			t.Fatalf("X-Galaxy-Signature = %q, want %q", got, want)
+		}
+	}
+
+	event := ws.events(t)[2]
+	if event.Event != WebhookCrash || event.App != "app" || event.HostIP != "10.0.0.1" || event.Time.IsZero() {
+		t.Fatalf("webhook event = %+v, want app crashed on 10.0.0.1", event)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	defer fastWebhookRetries()()
+
+	for _, tc := range []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusInternalServerError, webhookAttempts},
+		{http.StatusNotFound, 1},
+	} {
+		ws := newWebhookServer(10, tc.status)
+
+		s, _ := NewTestStore()
+		s.AddWebhook("dev", Webhook{URL: ws.URL})
+		s.NotifyWebhooks(WebhookEvent{Event: WebhookRestart, Env: "dev", App: "app"})
+		flushWebhooks(t, s)
+		ws.Close()
+
+		requests, _ := ws.received()
+		if len(requests) != tc.attempts {
+			t.Fatalf("webhook requests for %d = %d, want %d", tc.status, len(requests), tc.attempts)
+		}
+		if sig := requests[0].Header.Get("X-Galaxy-Signature"); sig != "" {
+			t.Fatalf("X-Galaxy-Signature = %q, want none without a secret", sig)
+		}
+	}
+}
+
+func TestStoreWebhooks(t *testing.T) {
+	ws := newWebhookServer(0, 0)
+	defer ws.Close()
+
+	s, _ := NewTestStore()
+	assertPoolCreated(t, s, "web")
+	assertAppCreated(t, s, "app")
+	s.AddWebhook("dev", Webhook{URL: ws.URL})
+
+	app, _ := s.GetApp("app", "dev")
+	app.SetVersion("app:2")
+	s.UpdateApp(app, "dev")
+
+	app, _ = s.GetApp("app", "dev")
+	app.SetProcesses("web", 3)
+	s.UpdateApp(app, "dev")
+
+	// other runtime changes aren't sent
+	app, _ = s.GetApp("app", "dev")
+	app.SetMemory("web", "512m")
+	s.UpdateApp(app, "dev")
+
+	s.AssignApp("app", "dev", "web")
+	s.NotifyRestart("app", "dev")
+	s.UpdateSharedConfig("dev", "", map[string]string{"STATSD_HOST": "statsd"})
+	flushWebhooks(t, s)
+
+	events := ws.events(t)
+	kinds := []string{}
+	for _, event := range events {
+		kinds = append(kinds, event.Event)
+	}
+
+	want := []string{WebhookDeploy, WebhookScale, WebhookAssign, WebhookRestart, WebhookConfig, WebhookRestart}
+	if len(kinds) != len(want) {
+		t.Fatalf("webhook events = %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Fatalf("webhook events = %v, want %v", kinds, want)
+		}
+	}
+
+	if events[0].Version != "app:2" || events[0].App != "app" || events[0].User == "" {
+		t.Fatalf("deploy webhook = %+v, want app:2 and who deployed it", events[0])
+	}
+	if c := events[1].Changes; len(c) != 1 || c[0].Field != "processes.web" || c[0].After != "3" {
+		t.Fatalf("scale webhook changes = %v, want processes.web set to 3", c)
+	}
+	if events[2].Pool != "web" {
+		t.Fatalf("assign webhook = %+v, want pool web", events[2])
+	}
+}
+
+func TestWebhooksDontHoldUpChanges(t *testing.T) {
+	hung := make(chan struct{})
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer ws.Close()
+
+	s, _ := NewTestStore()
+	assertPoolCreated(t, s, "web")
+	assertAppCreated(t, s, "app")
+	s.AddWebhook("dev", Webhook{URL: ws.URL})
+
+	start := time.Now()
+	if assigned, err := s.AssignApp("app", "dev", "web"); !assigned || err != nil {
+		t.Fatalf("AssignApp() = %t, %v, want %t, %v", assigned, err, true, nil)
+	}
+	app, _ := s.GetApp("app", "dev")
+	app.SetVersion("app:2")
+	if updated, err := s.UpdateApp(app, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("changes took %s, want them made without waiting for the webhook", elapsed)
+	}
+
+	if s.FlushWebhooks(10 * time.Millisecond) {
+		t.Fatalf("FlushWebhooks() = true, want false while the webhook hangs")
+	}
+
+	close(hung)
+	flushWebhooks(t, s)
+}
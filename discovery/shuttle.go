@@ -2,6 +2,7 @@ package discovery
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
@@ -11,8 +12,43 @@ import (
 
 var (
 	client *shuttle.Client
+
+	// the services registered for extra ports, which are removed once no
+	// registration has the port
+	portServices   = make(map[string]bool)
+	portServicesMu sync.Mutex
 )
 
+// registrationPorts returns the published ports for a registration.
+// Registrations from before ports were recorded only have the main one.
+func registrationPorts(r *config.ServiceRegistration) []config.PortBinding {
+	if len(r.Ports) > 0 {
+		return r.Ports
+	}
+
+	return []config.PortBinding{{
+		ContainerPort: r.InternalPort,
+		HostPort:      r.ExternalPort,
+		Protocol:      "tcp",
+		ServicePort:   r.Port,
+	}}
+}
+
+// serviceName returns the shuttle service for a port. The main port is
+// registered under the app's name, and any others as <app>-<port>, with a
+// -udp suffix for udp ports.
+func serviceName(r *config.ServiceRegistration, binding config.PortBinding) string {
+	if r.IsMain(binding) {
+		return r.Name
+	}
+
+	name := r.Name + "-" + binding.ContainerPort
+	if binding.Protocol == "udp" {
+		name += "-udp"
+	}
+	return name
+}
+
 func registerShuttle(configStore *config.Store, env, pool, shuttleAddr string) {
 	if client == nil {
 		return
@@ -26,54 +62,78 @@ func registerShuttle(configStore *config.Store, env, pool, shuttleAddr string) {
 
 	backends := make(map[string]*shuttle.ServiceConfig)
 
-	for _, r := range registrations {
+	for i := range registrations {
+		r := &registrations[i]
 
 		// No service ports exposed on the host, skip it.
 		if r.ExternalAddr() == "" {
 			continue
 		}
 
-		service := backends[r.Name]
-		if service == nil {
-			service = &shuttle.ServiceConfig{
-				Name:         r.Name,
-				VirtualHosts: r.VirtualHosts,
+		app, err := configStore.GetApp(r.Name, env)
+		if err != nil {
+			log.Errorf("ERROR: Unable to get app for service %s: %s", r.Name, err)
+		}
+
+		// one service for each port
+		for _, binding := range registrationPorts(r) {
+			name := serviceName(r, binding)
+			service := backends[name]
+			if service == nil {
+				service = &shuttle.ServiceConfig{
+					Name:    name,
+					Network: binding.Protocol,
+				}
+				if binding.ServicePort != "" {
+					service.Addr = "0.0.0.0:" + binding.ServicePort
+				}
+
+				// virtual hosts only route to the main port
+				if r.IsMain(binding) {
+					service.VirtualHosts = r.VirtualHosts
+				} else {
+					portServicesMu.Lock()
+					portServices[name] = true
+					portServicesMu.Unlock()
+				}
+				backends[name] = service
 			}
-			if r.Port != "" {
-				service.Addr = "0.0.0.0:" + r.Port
+
+			addr := r.ExternalIP + ":" + binding.HostPort
+			b := shuttle.BackendConfig{
+				Name: r.ContainerID[0:12],
+				Addr: addr,
 			}
-			backends[r.Name] = service
-		}
-		b := shuttle.BackendConfig{
-			Name:      r.ContainerID[0:12],
-			Addr:      r.ExternalAddr(),
-			CheckAddr: r.ExternalAddr(),
-		}
-		service.Backends = append(service.Backends, b)
-
-		// lookup the VIRTUAL_HOST_%d environment variables and load them into the ServiceConfig
-		errorPages := make(map[string][]int)
-		for vhostCode, url := range r.ErrorPages {
-			code := 0
-			n, err := fmt.Sscanf(vhostCode, "VIRTUAL_HOST_%d", &code)
-			if err != nil || n == 0 {
+			// shuttle can only check tcp backends
+			if binding.Protocol != "udp" {
+				b.CheckAddr = addr
+			}
+			service.Backends = append(service.Backends, b)
+
+			if app != nil {
+				service.MaintenanceMode = app.GetMaintenanceMode(pool)
+			}
+
+			if !r.IsMain(binding) {
 				continue
 			}
 
-			errorPages[url] = append(errorPages[url], code)
-		}
+			// lookup the VIRTUAL_HOST_%d environment variables and load them into the ServiceConfig
+			errorPages := make(map[string][]int)
+			for vhostCode, url := range r.ErrorPages {
+				code := 0
+				n, err := fmt.Sscanf(vhostCode, "VIRTUAL_HOST_%d", &code)
+				if err != nil || n == 0 {
+					continue
+				}
 
-		if len(errorPages) > 0 {
-			service.ErrorPages = errorPages
-		}
+				errorPages[url] = append(errorPages[url], code)
+			}
 
-		app, err := configStore.GetApp(service.Name, env)
-		if err != nil {
-			log.Errorf("ERROR: Unable to get app for service %s: %s", service.Name, err)
-			continue
+			if len(errorPages) > 0 {
+				service.ErrorPages = errorPages
+			}
 		}
-
-		service.MaintenanceMode = app.GetMaintenanceMode(pool)
 	}
 
 	for _, service := range backends {
@@ -97,9 +157,10 @@ func unregisterShuttle(configStore *config.Store, env, hostIP, shuttleAddr strin
 		return
 	}
 
-	backends := make(map[string]*shuttle.ServiceConfig)
+	services := make(map[string]bool)
 
-	for _, r := range registrations {
+	for i := range registrations {
+		r := &registrations[i]
 
 		// Registration for a container on a different host? Skip it.
 		if r.ExternalIP != hostIP {
@@ -107,31 +168,20 @@ func unregisterShuttle(configStore *config.Store, env, hostIP, shuttleAddr strin
 		}
 
 		// No service ports exposed on the host, skip it.
-		if r.ExternalAddr() == "" || r.Port == "" {
+		if r.ExternalAddr() == "" {
 			continue
 		}
 
-		service := backends[r.Name]
-		if service == nil {
-			service = &shuttle.ServiceConfig{
-				Name:         r.Name,
-				VirtualHosts: r.VirtualHosts,
+		for _, binding := range registrationPorts(r) {
+			if binding.ServicePort != "" {
+				services[serviceName(r, binding)] = true
 			}
-			if r.Port != "" {
-				service.Addr = "0.0.0.0:" + r.Port
-			}
-			backends[r.Name] = service
-		}
-		b := shuttle.BackendConfig{
-			Name: r.ContainerID[0:12],
-			Addr: r.ExternalAddr(),
 		}
-		service.Backends = append(service.Backends, b)
 	}
 
-	for _, service := range backends {
+	for name := range services {
 
-		err := client.RemoveService(service.Name)
+		err := client.RemoveService(name)
 		if err != nil {
 			log.Errorf("ERROR: Unable to remove shuttle service: %s", err)
 		}
@@ -139,6 +189,13 @@ func unregisterShuttle(configStore *config.Store, env, hostIP, shuttleAddr strin
 
 }
 
+// isPortService reports whether a service was registered for an extra port
+func isPortService(name string) bool {
+	portServicesMu.Lock()
+	defer portServicesMu.Unlock()
+	return portServices[name]
+}
+
 func pruneShuttleBackends(configStore *config.Store, env, shuttleAddr string) {
 	if client == nil {
 		return
@@ -164,15 +221,43 @@ func pruneShuttleBackends(configStore *config.Store, env, shuttleAddr string) {
 		return
 	}
 
+	// services for extra ports are named after the app and port
+	serviceApps := make(map[string]string)
+	for i := range registrations {
+		r := &registrations[i]
+		for _, binding := range registrationPorts(r) {
+			serviceApps[serviceName(r, binding)] = r.Name
+		}
+	}
+
 	for _, service := range config.Services {
 
-		app, err := configStore.GetApp(service.Name, env)
+		appName, ok := serviceApps[service.Name]
+		if !ok && isPortService(service.Name) {
+			// the port was removed, or its containers are gone
+			err := client.RemoveService(service.Name)
+			if err != nil {
+				log.Errorf("ERROR: Unable to remove service %s from shuttle: %s", service.Name, err)
+				continue
+			}
+			portServicesMu.Lock()
+			delete(portServices, service.Name)
+			portServicesMu.Unlock()
+			log.Printf("Unregisterred shuttle service %s", service.Name)
+			continue
+		}
+
+		if !ok {
+			appName = service.Name
+		}
+
+		app, err := configStore.GetApp(appName, env)
 		if err != nil {
 			log.Errorf("ERROR: Unable to load app %s: %s", app, err)
 			continue
 		}
 
-		pools, err := configStore.ListAssignedPools(env, service.Name)
+		pools, err := configStore.ListAssignedPools(env, appName)
 		if err != nil {
 			log.Errorf("ERROR: Unable to list pool assignments for %s: %s", service.Name, err)
 			continue
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/litl/galaxy/commander"
 	gconfig "github.com/litl/galaxy/config"
@@ -37,6 +38,24 @@ func initStore(c *cli.Context) {
 	configStore = gconfig.NewStore(uint64(c.Int("ttl")), utils.GalaxyRedisHost(c))
 }
 
+// how long a command waits for the webhooks it caused to be sent
+const webhookFlushTimeout = 10 * time.Second
+
+// flushWebhooks waits for queued webhooks to be sent before exiting, since
+// they're sent in the background.
+func flushWebhooks() {
+	if configStore != nil && !configStore.FlushWebhooks(webhookFlushTimeout) {
+		log.Warnf("WARN: Gave up waiting for webhooks to be sent")
+	}
+}
+
+// fatalf exits with an error, after sending the webhooks queued so far,
+// since the command may have changed something before it failed.
+func fatalf(format string, args ...interface{}) {
+	flushWebhooks()
+	log.Fatalf(format, args...)
+}
+
 // ensure the registry as a redis host, but only once
 func initRuntime(c *cli.Context) {
 	serviceRuntime = runtime.NewServiceRuntime(
@@ -55,11 +74,11 @@ func ensureAppParam(c *cli.Context, command string) string {
 
 	exists, err := appExists(app, utils.GalaxyEnv(c))
 	if err != nil {
-		log.Fatalf("ERROR: can't deteremine if %s exists: %s", app, err)
+		fatalf("ERROR: can't deteremine if %s exists: %s", app, err)
 	}
 
 	if !exists {
-		log.Fatalf("ERROR: %s does not exist. Create it first.", app)
+		fatalf("ERROR: %s does not exist. Create it first.", app)
 	}
 
 	return app
@@ -85,7 +104,7 @@ func appList(c *cli.Context) {
 	initStore(c)
 	err := commander.AppList(configStore, utils.GalaxyEnv(c))
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
 	}
 }
 
@@ -101,7 +120,7 @@ func appCreate(c *cli.Context) {
 
 	err := commander.AppCreate(configStore, app, utils.GalaxyEnv(c))
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
 	}
 }
 
@@ -113,7 +132,7 @@ func appDelete(c *cli.Context) {
 
 	err := commander.AppDelete(configStore, app, utils.GalaxyEnv(c))
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
 	}
 }
 
@@ -135,9 +154,47 @@ func appDeploy(c *cli.Context) {
 		return
 	}
 
-	err := commander.AppDeploy(configStore, serviceRuntime, app, utils.GalaxyEnv(c), version)
+	err := commander.AppDeploy(configStore, serviceRuntime, app, utils.GalaxyEnv(c), version, waitTimeout(c))
+	if err != nil {
+		fatalf("ERROR: %s", err)
+	}
+}
+
+// waitTimeout is how long to wait for the hosts to handle a change, 0 if
+// --wait wasn't given
+func waitTimeout(c *cli.Context) time.Duration {
+	if !c.Bool("wait") {
+		return 0
+	}
+	return time.Duration(c.Int("timeout")) * time.Second
+}
+
+func appReleases(c *cli.Context) {
+	ensureEnvArg(c)
+	initStore(c)
+
+	app := ensureAppParam(c, "app:releases")
+
+	err := commander.AppReleases(configStore, app, utils.GalaxyEnv(c))
+	if err != nil {
+		fatalf("ERROR: %s", err)
+	}
+}
+
+func appRollback(c *cli.Context) {
+	ensureEnvArg(c)
+	initStore(c)
+
+	app := ensureAppParam(c, "app:rollback")
+
+	release := ""
+	if len(c.Args().Tail()) == 1 {
+		release = c.Args().Tail()[0]
+	}
+
+	err := commander.AppRollback(configStore, app, utils.GalaxyEnv(c), release)
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
 	}
 }
 
@@ -146,9 +203,9 @@ func appRestart(c *cli.Context) {
 
 	app := ensureAppParam(c, "app:restart")
 
-	err := commander.AppRestart(configStore, app, utils.GalaxyEnv(c))
+	err := commander.AppRestart(configStore, app, utils.GalaxyEnv(c), waitTimeout(c))
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
 	}
 }
 
@@ -160,13 +217,13 @@ func appRun(c *cli.Context) {
 	app := ensureAppParam(c, "app:run")
 
 	if len(c.Args()) < 2 {
-		log.Fatalf("ERROR: Missing command to run.")
+		fatalf("ERROR: Missing command to run.")
 		return
 	}
 
-	err := commander.AppRun(configStore, serviceRuntime, app, utils.GalaxyEnv(c), c.Args()[1:])
+	err := commander.AppRun(configStore, serviceRuntime, app, utils.GalaxyEnv(c), utils.GalaxyPool(c), c.Args()[1:])
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
 	}
 }
 
@@ -180,18 +237,37 @@ func appShell(c *cli.Context) {
 	err := commander.AppShell(configStore, serviceRuntime, app,
 		utils.GalaxyEnv(c), utils.GalaxyPool(c))
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
+	}
+}
+
+// sharedConfigScope returns the pool for the --env-wide or --pool-wide config
+// flags, and whether either was given.
+func sharedConfigScope(c *cli.Context) (string, bool) {
+	if c.Bool("pool-wide") {
+		ensurePoolArg(c)
+		return utils.GalaxyPool(c), true
 	}
+	return "", c.Bool("env-wide")
 }
 
 func configList(c *cli.Context) {
 	ensureEnvArg(c)
 	initStore(c)
+
+	if pool, shared := sharedConfigScope(c); shared {
+		err := commander.SharedConfigList(configStore, utils.GalaxyEnv(c), pool, c.Bool("reveal"))
+		if err != nil {
+			fatalf("ERROR: Unable to list config: %s.", err)
+		}
+		return
+	}
+
 	app := ensureAppParam(c, "config")
 
-	err := commander.ConfigList(configStore, app, utils.GalaxyEnv(c))
+	err := commander.ConfigList(configStore, app, utils.GalaxyEnv(c), c.Bool("reveal"))
 	if err != nil {
-		log.Fatalf("ERROR: Unable to list config: %s.", err)
+		fatalf("ERROR: Unable to list config: %s.", err)
 		return
 	}
 }
@@ -199,13 +275,22 @@ func configList(c *cli.Context) {
 func configSet(c *cli.Context) {
 	ensureEnvArg(c)
 	initStore(c)
+
+	if pool, shared := sharedConfigScope(c); shared {
+		err := commander.SharedConfigSet(configStore, utils.GalaxyEnv(c), pool, c.Args(), c.Bool("secret"))
+		if err != nil {
+			fatalf("ERROR: Unable to update config: %s.", err)
+		}
+		return
+	}
+
 	app := ensureAppParam(c, "config:set")
 
 	args := c.Args().Tail()
-	err := commander.ConfigSet(configStore, app, utils.GalaxyEnv(c), args)
+	err := commander.ConfigSet(configStore, app, utils.GalaxyEnv(c), args, c.Bool("secret"))
 
 	if err != nil {
-		log.Fatalf("ERROR: Unable to update config: %s.", err)
+		fatalf("ERROR: Unable to update config: %s.", err)
 		return
 	}
 }
@@ -213,11 +298,20 @@ func configSet(c *cli.Context) {
 func configUnset(c *cli.Context) {
 	ensureEnvArg(c)
 	initStore(c)
+
+	if pool, shared := sharedConfigScope(c); shared {
+		err := commander.SharedConfigUnset(configStore, utils.GalaxyEnv(c), pool, c.Args())
+		if err != nil {
+			fatalf("ERROR: Unable to unset config: %s.", err)
+		}
+		return
+	}
+
 	app := ensureAppParam(c, "config:unset")
 
 	err := commander.ConfigUnset(configStore, app, utils.GalaxyEnv(c), c.Args().Tail())
 	if err != nil {
-		log.Fatalf("ERROR: Unable to unset config: %s.", err)
+		fatalf("ERROR: Unable to unset config: %s.", err)
 		return
 	}
 }
@@ -227,14 +321,59 @@ func configGet(c *cli.Context) {
 	initStore(c)
 	app := ensureAppParam(c, "config:get")
 
-	err := commander.ConfigGet(configStore, app, utils.GalaxyEnv(c), c.Args().Tail())
+	err := commander.ConfigGet(configStore, app, utils.GalaxyEnv(c), c.Args().Tail(), c.Bool("reveal"))
 
 	if err != nil {
-		log.Fatalf("ERROR: Unable to get config: %s.", err)
+		fatalf("ERROR: Unable to get config: %s.", err)
 		return
 	}
 }
 
+func configImport(c *cli.Context) {
+	ensureEnvArg(c)
+	initStore(c)
+	app := ensureAppParam(c, "config:import")
+
+	err := commander.ConfigImport(configStore, app, utils.GalaxyEnv(c),
+		c.String("file"), c.String("format"), c.Bool("replace"))
+	if err != nil {
+		fatalf("ERROR: Unable to import config: %s.", err)
+	}
+}
+
+func configExport(c *cli.Context) {
+	ensureEnvArg(c)
+	initStore(c)
+	app := ensureAppParam(c, "config:export")
+
+	err := commander.ConfigExport(configStore, app, utils.GalaxyEnv(c), c.String("format"), c.Bool("reveal"))
+	if err != nil {
+		fatalf("ERROR: Unable to export config: %s.", err)
+	}
+}
+
+func configSchema(c *cli.Context) {
+	ensureEnvArg(c)
+	initStore(c)
+	app := ensureAppParam(c, "config:schema")
+
+	err := commander.ConfigSchema(configStore, app, utils.GalaxyEnv(c), c.String("file"))
+	if err != nil {
+		fatalf("ERROR: %s.", err)
+	}
+}
+
+func configValidate(c *cli.Context) {
+	ensureEnvArg(c)
+	initStore(c)
+	app := ensureAppParam(c, "config:validate")
+
+	err := commander.ConfigValidate(configStore, app, utils.GalaxyEnv(c))
+	if err != nil {
+		fatalf("ERROR: %s.", err)
+	}
+}
+
 // Return the path for the config directory, and create it if it doesn't exist
 func cfgDir() string {
 	homeDir := utils.HomeDir()
@@ -262,7 +401,7 @@ func poolAssign(c *cli.Context) {
 
 	err := commander.AppAssign(configStore, app, utils.GalaxyEnv(c), utils.GalaxyPool(c))
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
 	}
 }
 
@@ -279,7 +418,7 @@ func poolUnassign(c *cli.Context) {
 
 	err := commander.AppUnassign(configStore, app, utils.GalaxyEnv(c), utils.GalaxyPool(c))
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		fatalf("ERROR: %s", err)
 	}
 }
 
@@ -289,7 +428,7 @@ func poolCreate(c *cli.Context) {
 	initStore(c)
 	created, err := configStore.CreatePool(utils.GalaxyPool(c), utils.GalaxyEnv(c))
 	if err != nil {
-		log.Fatalf("ERROR: Could not create pool: %s", err)
+		fatalf("ERROR: Could not create pool: %s", err)
 		return
 	}
 
@@ -305,6 +444,25 @@ func poolUpdate(c *cli.Context) {
 	ensurePoolArg(c)
 }
 
+func audit(c *cli.Context) {
+	initStore(c)
+
+	since, err := commander.ParseAuditTime(c.String("since"))
+	if err != nil {
+		fatalf("ERROR: %s", err)
+	}
+
+	until, err := commander.ParseAuditTime(c.String("until"))
+	if err != nil {
+		fatalf("ERROR: %s", err)
+	}
+
+	err = commander.Audit(configStore, utils.GalaxyEnv(c), c.String("app"), since, until)
+	if err != nil {
+		fatalf("ERROR: %s", err)
+	}
+}
+
 func poolList(c *cli.Context) {
 	initStore(c)
 
@@ -313,7 +471,7 @@ func poolList(c *cli.Context) {
 		var err error
 		envs, err = configStore.ListEnvs()
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fatalf("ERROR: %s", err)
 		}
 	}
 
@@ -322,7 +480,7 @@ func poolList(c *cli.Context) {
 	for _, env := range envs {
 		pools, err := configStore.ListPools(env)
 		if err != nil {
-			log.Fatalf("ERROR: cannot list pools: %s", err)
+			fatalf("ERROR: cannot list pools: %s", err)
 			return
 		}
 
@@ -338,7 +496,7 @@ func poolList(c *cli.Context) {
 
 			assigments, err := configStore.ListAssignments(env, pool)
 			if err != nil {
-				log.Fatalf("ERROR: cannot list pool assignments: %s", err)
+				fatalf("ERROR: cannot list pool assignments: %s", err)
 			}
 
 			columns = append(columns, strings.Join([]string{
@@ -358,7 +516,7 @@ func poolDelete(c *cli.Context) {
 	initStore(c)
 	empty, err := configStore.DeletePool(utils.GalaxyPool(c), utils.GalaxyEnv(c))
 	if err != nil {
-		log.Fatalf("ERROR: Could not delete pool: %s", err)
+		fatalf("ERROR: Could not delete pool: %s", err)
 		return
 	}
 
@@ -370,13 +528,49 @@ func poolDelete(c *cli.Context) {
 	}
 }
 
+func loadManifest(c *cli.Context, command string) *commander.Manifest {
+	fileName := c.String("f")
+	if fileName == "" {
+		cli.ShowCommandHelp(c, command)
+		log.Fatal("ERROR: manifest file missing")
+	}
+
+	m, err := commander.LoadManifest(fileName)
+	if err != nil {
+		fatalf("ERROR: Unable to read %s: %s", fileName, err)
+	}
+	return m
+}
+
+func manifestPlan(c *cli.Context) {
+	initStore(c)
+	initRuntime(c)
+	m := loadManifest(c, "plan")
+
+	err := commander.ManifestPlan(configStore, utils.GalaxyEnv(c), m, commander.PullImages(serviceRuntime))
+	if err != nil {
+		fatalf("ERROR: %s", err)
+	}
+}
+
+func manifestApply(c *cli.Context) {
+	initStore(c)
+	initRuntime(c)
+	m := loadManifest(c, "apply")
+
+	err := commander.ManifestApply(configStore, utils.GalaxyEnv(c), m, c.Bool("y"), commander.PullImages(serviceRuntime))
+	if err != nil {
+		fatalf("ERROR: Unable to apply %s: %s", c.String("f"), err)
+	}
+}
+
 func loadConfig() {
 	configFile := filepath.Join(cfgDir(), "galaxy.toml")
 
 	_, err := os.Stat(configFile)
 	if err == nil {
 		if _, err := toml.DecodeFile(configFile, &config); err != nil {
-			log.Fatalf("ERROR: Unable to logout: %s", err)
+			fatalf("ERROR: Unable to logout: %s", err)
 			return
 		}
 	}
@@ -390,11 +584,23 @@ func pgPsql(c *cli.Context) {
 
 	appCfg, err := configStore.GetApp(app, utils.GalaxyEnv(c))
 	if err != nil {
-		log.Fatalf("ERROR: Unable to run command: %s.", err)
+		fatalf("ERROR: Unable to run command: %s.", err)
 		return
 	}
 
 	database_url := appCfg.Env()["DATABASE_URL"]
+	if gconfig.IsSecret(database_url) {
+		keyring, err := gconfig.LoadKeyring(gconfig.DefaultKeyringPath())
+		if err != nil {
+			fatalf("ERROR: Unable to load keyring: %s.", err)
+		}
+
+		database_url, err = keyring.Decrypt(database_url)
+		if err != nil {
+			fatalf("ERROR: Unable to decrypt DATABASE_URL: %s.", err)
+		}
+	}
+
 	if database_url == "" {
 		log.Printf("No DATABASE_URL configured.  Set one with config:set first.")
 		return
@@ -497,6 +703,7 @@ func main() {
 			Description: "app:backup [app[,app2]]",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "file", Usage: "backup filename"},
+				cli.BoolFlag{Name: "reveal", Usage: "write secret values decrypted"},
 			},
 		},
 		{
@@ -507,6 +714,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "file", Usage: "backup filename"},
 				cli.BoolFlag{Name: "force", Usage: "force overwrite of existing config"},
+				cli.BoolFlag{Name: "dry-run", Usage: "only show what would change"},
 			},
 		},
 		{
@@ -528,13 +736,31 @@ func main() {
 			Description: "app:deploy <app> <version>",
 			Flags: []cli.Flag{
 				cli.BoolFlag{Name: "force", Usage: "force pulling the image"},
+				cli.BoolFlag{Name: "wait", Usage: "wait for every host to deploy it"},
+				cli.IntFlag{Name: "timeout", Value: 300, Usage: "seconds to wait for the hosts"},
 			},
 		},
+		{
+			Name:        "app:releases",
+			Usage:       "list the releases of an app",
+			Action:      appReleases,
+			Description: "app:releases <app>",
+		},
+		{
+			Name:        "app:rollback",
+			Usage:       "roll back an app to an earlier release",
+			Action:      appRollback,
+			Description: "app:rollback <app> [release]",
+		},
 		{
 			Name:        "app:restart",
 			Usage:       "restart an app",
 			Action:      appRestart,
 			Description: "app:restart <app>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "wait", Usage: "wait for every host to restart it"},
+				cli.IntFlag{Name: "timeout", Value: 300, Usage: "seconds to wait for the hosts"},
+			},
 		},
 		{
 			Name:        "app:run",
@@ -553,24 +779,77 @@ func main() {
 			Usage:       "list the config values for an app",
 			Action:      configList,
 			Description: "config <app>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "reveal", Usage: "show secret values"},
+				cli.BoolFlag{Name: "env-wide", Usage: "list the config shared by the env"},
+				cli.BoolFlag{Name: "pool-wide", Usage: "list the config shared by the pool"},
+			},
 		},
 		{
 			Name:        "config:set",
 			Usage:       "set one or more configuration variables",
 			Action:      configSet,
 			Description: "config:set <app> KEY=VALUE [KEY=VALUE ...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "secret", Usage: "encrypt the values with the local keyring"},
+				cli.BoolFlag{Name: "env-wide", Usage: "set config for every app in the env"},
+				cli.BoolFlag{Name: "pool-wide", Usage: "set config for every app in the pool"},
+			},
 		},
 		{
 			Name:        "config:unset",
 			Usage:       "unset one or more configuration variables",
 			Action:      configUnset,
 			Description: "config:unset <app> KEY [KEY ...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "env-wide", Usage: "unset config for every app in the env"},
+				cli.BoolFlag{Name: "pool-wide", Usage: "unset config for every app in the pool"},
+			},
 		},
 		{
 			Name:        "config:get",
 			Usage:       "display the config value for an app",
 			Action:      configGet,
 			Description: "config:get <app> KEY [KEY ...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "reveal", Usage: "show secret values"},
+			},
+		},
+		{
+			Name:        "config:import",
+			Usage:       "import configuration variables from a dotenv or JSON file",
+			Action:      configImport,
+			Description: "config:import <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file", Usage: "file to import (default stdin)"},
+				cli.StringFlag{Name: "format", Usage: "dotenv or json (default from the file name)"},
+				cli.BoolFlag{Name: "replace", Usage: "unset config missing from the file"},
+			},
+		},
+		{
+			Name:        "config:export",
+			Usage:       "export configuration variables",
+			Action:      configExport,
+			Description: "config:export <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: commander.FormatDotenv, Usage: "dotenv, json or shell"},
+				cli.BoolFlag{Name: "reveal", Usage: "export secret values decrypted"},
+			},
+		},
+		{
+			Name:        "config:schema",
+			Usage:       "show or set the config schema for an app",
+			Action:      configSchema,
+			Description: "config:schema <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file", Usage: "JSON schema to set"},
+			},
+		},
+		{
+			Name:        "config:validate",
+			Usage:       "check the config for an app against its schema",
+			Action:      configValidate,
+			Description: "config:validate <app>",
 		},
 		{
 			Name:        "pool",
@@ -606,6 +885,36 @@ func main() {
 				cli.BoolFlag{Name: "y", Usage: "skip confirmation"},
 			},
 		},
+		{
+			Name:        "plan",
+			Usage:       "show the changes needed for an env to match a manifest",
+			Action:      manifestPlan,
+			Description: "plan -f env.toml",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "f", Usage: "manifest file"},
+			},
+		},
+		{
+			Name:        "apply",
+			Usage:       "change an env to match a manifest",
+			Action:      manifestApply,
+			Description: "apply -f env.toml",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "f", Usage: "manifest file"},
+				cli.BoolFlag{Name: "y", Usage: "skip confirmation"},
+			},
+		},
+		{
+			Name:        "audit",
+			Usage:       "list the changes made to apps, pools and config",
+			Action:      audit,
+			Description: "audit [--app <app>] [--since <time>] [--until <time>]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "app", Usage: "only list changes to this app"},
+				cli.StringFlag{Name: "since", Usage: "time, date or duration ago (24h)"},
+				cli.StringFlag{Name: "until", Usage: "time, date or duration ago"},
+			},
+		},
 		{
 			Name:        "pg:psql",
 			Usage:       "connect to database using psql",
@@ -617,4 +926,6 @@ func main() {
 		},
 	}
 	app.Run(os.Args)
+
+	flushWebhooks()
 }
@@ -10,6 +10,7 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -20,6 +21,27 @@ import (
 
 var blacklistedContainerId = make(map[string]bool)
 
+// containers stopped by the runtime, so their exit isn't taken for a crash
+var stoppedContainers = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+func markStopped(id string) {
+	stoppedContainers.Lock()
+	defer stoppedContainers.Unlock()
+	stoppedContainers.ids[id] = true
+}
+
+// wasStopped reports whether the runtime stopped a container, and forgets it
+func wasStopped(id string) bool {
+	stoppedContainers.Lock()
+	defer stoppedContainers.Unlock()
+	stopped := stoppedContainers.ids[id]
+	delete(stoppedContainers.ids, id)
+	return stopped
+}
+
 // the deafult docker index server
 var defaultIndexServer = "https://index.docker.io/v1/"
 
@@ -29,6 +51,10 @@ type ServiceRuntime struct {
 	configStore  *config.Store
 	dockerIP     string
 	hostIP       string
+
+	// loaded on first use, only on hosts running apps with secrets
+	keyringMu sync.Mutex
+	keyring   *config.Keyring
 }
 
 type ContainerEvent struct {
@@ -222,6 +248,7 @@ func (s *ServiceRuntime) stopContainer(container *docker.Container) error {
 
 	log.Printf("Stopping %s container %s\n", strings.TrimPrefix(container.Name, "/"), container.ID[0:12])
 
+	markStopped(container.ID)
 	c := make(chan error, 1)
 	go func() { c <- s.dockerClient.StopContainer(container.ID, 10) }()
 	select {
@@ -431,7 +458,7 @@ func (s *ServiceRuntime) GetImageByName(img string) (*docker.APIImages, error) {
 
 }
 
-func (s *ServiceRuntime) RunCommand(env string, appCfg config.App, cmd []string) (*docker.Container, error) {
+func (s *ServiceRuntime) RunCommand(env, pool string, appCfg config.App, cmd []string) (*docker.Container, error) {
 
 	// see if we have the image locally
 	fmt.Fprintf(os.Stderr, "Pulling latest image for %s\n", appCfg.Version())
@@ -445,9 +472,14 @@ func (s *ServiceRuntime) RunCommand(env string, appCfg config.App, cmd []string)
 		return nil, err
 	}
 
+	appEnv, err := s.containerEnv(env, pool, appCfg)
+	if err != nil {
+		return nil, err
+	}
+
 	envVars := []string{"ENV=" + env}
 
-	for key, value := range appCfg.Env() {
+	for key, value := range appEnv {
 		if key == "ENV" {
 			continue
 		}
@@ -459,9 +491,9 @@ func (s *ServiceRuntime) RunCommand(env string, appCfg config.App, cmd []string)
 
 	runCmd := []string{"/bin/sh", "-c", strings.Join(cmd, " ")}
 
-	hostConfig := &docker.HostConfig{}
-	if s.dns != "" {
-		hostConfig.DNS = []string{s.dns}
+	hostConfig := &docker.HostConfig{
+		DNS:        s.dnsServers(appCfg),
+		ExtraHosts: extraHosts(appCfg),
 	}
 
 	container, err := s.dockerClient.CreateContainer(docker.CreateContainerOptions{
@@ -470,6 +502,7 @@ func (s *ServiceRuntime) RunCommand(env string, appCfg config.App, cmd []string)
 			Env:          envVars,
 			AttachStdout: true,
 			AttachStderr: true,
+			Entrypoint:   appCfg.GetEntryPoint(),
 			Cmd:          runCmd,
 			OpenStdin:    false,
 		},
@@ -541,20 +574,42 @@ func (s *ServiceRuntime) StartInteractive(env, pool string, appCfg config.App) e
 	args = append(args, "-e")
 	args = append(args, "ENV"+"="+env)
 
-	for key, value := range appCfg.Env() {
+	appEnv, err := s.containerEnv(env, pool, appCfg)
+	if err != nil {
+		return err
+	}
+
+	// secrets are passed through the docker client's environment, so they
+	// don't show up in its arguments
+	rawEnv, err := s.configStore.AppEnv(appCfg, env, pool)
+	if err != nil {
+		return err
+	}
+
+	secretEnv := []string{}
+	for key, value := range appEnv {
 		if key == "ENV" {
 			continue
 		}
 
 		args = append(args, "-e")
+		if config.IsSecret(rawEnv[key]) {
+			args = append(args, strings.ToUpper(key))
+			secretEnv = append(secretEnv, strings.ToUpper(key)+"="+s.replaceVarEnv(value, s.hostIP))
+			continue
+		}
 		args = append(args, strings.ToUpper(key)+"="+s.replaceVarEnv(value, s.hostIP))
 	}
 
 	args = append(args, "-e")
 	args = append(args, fmt.Sprintf("HOST_IP=%s", s.hostIP))
-	if s.dns != "" {
+	for _, dns := range s.dnsServers(appCfg) {
 		args = append(args, "--dns")
-		args = append(args, s.dns)
+		args = append(args, dns)
+	}
+	for _, host := range extraHosts(appCfg) {
+		args = append(args, "--add-host")
+		args = append(args, host)
 	}
 	args = append(args, "-e")
 	args = append(args, fmt.Sprintf("GALAXY_APP=%s", appCfg.Name()))
@@ -589,10 +644,23 @@ func (s *ServiceRuntime) StartInteractive(env, pool string, appCfg config.App) e
 		args = append(args, cpu)
 	}
 
-	args = append(args, []string{"-t", appCfg.Version(), "/bin/sh"}...)
+	// docker run only takes the first part of the entrypoint, the rest goes
+	// before the command
+	entryPoint := appCfg.GetEntryPoint()
+	if len(entryPoint) > 0 {
+		args = append(args, "--entrypoint")
+		args = append(args, entryPoint[0])
+	}
+
+	args = append(args, []string{"-t", appCfg.Version()}...)
+	if len(entryPoint) > 1 {
+		args = append(args, entryPoint[1:]...)
+	}
+	args = append(args, "/bin/sh")
 	// shell out to docker run to get signal forwarded and terminal setup correctly
 	//cmd := exec.Command("docker", "run", "-rm", "-i", "-t", appCfg.Version(), "/bin/bash")
 	cmd := exec.Command("docker", args...)
+	cmd.Env = append(os.Environ(), secretEnv...)
 
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -623,11 +691,16 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg config.App) (*docker.Con
 		log.Warnf("warning: ID for image %s doesn't match configuration", img)
 	}
 
+	appEnv, err := s.containerEnv(env, pool, appCfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// setup env vars from etcd
 	var envVars []string
 	envVars = append(envVars, "ENV"+"="+env)
 
-	for key, value := range appCfg.Env() {
+	for key, value := range appEnv {
 		if key == "ENV" {
 			continue
 		}
@@ -662,6 +735,7 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg config.App) (*docker.Con
 	if container != nil {
 		if container.State.Running || container.State.Restarting || container.State.Paused {
 			log.Printf("Stopping %s version %s running as %s", appCfg.Name(), appCfg.Version(), container.ID[0:12])
+			markStopped(container.ID)
 			err := s.dockerClient.StopContainer(container.ID, 10)
 			if err != nil {
 				return nil, err
@@ -680,9 +754,19 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg config.App) (*docker.Con
 
 	if container == nil {
 
+		err = s.freeHostPorts(appCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		exposedPorts, portBindings := portBindings(appCfg)
+
 		config := &docker.Config{
-			Image: img,
-			Env:   envVars,
+			Image:        img,
+			Env:          envVars,
+			Entrypoint:   appCfg.GetEntryPoint(),
+			Cmd:          appCfg.GetCommand(),
+			ExposedPorts: exposedPorts,
 		}
 
 		mem := appCfg.GetMemory(pool)
@@ -701,8 +785,11 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg config.App) (*docker.Con
 			}
 		}
 
+		// Ports without an explicit mapping are still published on a random
+		// host port, and registered from there.
 		hostConfig := &docker.HostConfig{
 			PublishAllPorts: true,
+			PortBindings:    portBindings,
 			RestartPolicy: docker.RestartPolicy{
 				Name:              "on-failure",
 				MaximumRetryCount: 16,
@@ -713,9 +800,8 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg config.App) (*docker.Con
 			},
 		}
 
-		if s.dns != "" {
-			hostConfig.DNS = []string{s.dns}
-		}
+		hostConfig.DNS = s.dnsServers(appCfg)
+		hostConfig.ExtraHosts = extraHosts(appCfg)
 
 		log.Printf("Creating %s version %s", appCfg.Name(), appCfg.Version())
 		container, err = s.dockerClient.CreateContainer(docker.CreateContainerOptions{
@@ -959,6 +1045,10 @@ func (s *ServiceRuntime) RegisterEvents(env, pool, hostIP string, listener chan
 
 					name := s.EnvFor(container)["GALAXY_APP"]
 					if name != "" {
+						if e.Status == "die" {
+							s.reportCrash(env, pool, hostIP, name, container)
+						}
+
 						registration, err := s.configStore.GetServiceRegistration(env, pool, hostIP, container)
 						if err != nil {
 							log.Printf("WARN: Could not find service registration for %s/%s: %s", name, container.ID[:12], err)
@@ -994,6 +1084,195 @@ func (s *ServiceRuntime) RegisterEvents(env, pool, hostIP string, listener chan
 	return nil
 }
 
+// reportCrash tells the env's webhooks when one of an app's service
+// containers exits without the runtime stopping it. Containers started by
+// app:run aren't named for the app, and are expected to exit.
+func (s *ServiceRuntime) reportCrash(env, pool, hostIP, app string, container *docker.Container) {
+	if wasStopped(container.ID) || !strings.HasPrefix(strings.TrimPrefix(container.Name, "/"), app+"_") {
+		return
+	}
+
+	message := fmt.Sprintf("%s exited with status %d", container.ID[:12], container.State.ExitCode)
+	if container.State.Restarting {
+		message += " and is restarting"
+	}
+	log.Warnf("WARN: %s %s", app, message)
+
+	event := config.WebhookEvent{
+		Event:   config.WebhookCrash,
+		Env:     env,
+		App:     app,
+		Pool:    pool,
+		HostIP:  hostIP,
+		Message: message,
+	}
+	if container.Config != nil {
+		event.Version = container.Config.Image
+	}
+	s.configStore.NotifyWebhooks(event)
+}
+
+// containerEnv returns the app's config merged with the config shared by its
+// env and pool, with the secret values decrypted. This is the only place
+// secrets are decrypted for a container.
+func (s *ServiceRuntime) containerEnv(envName, pool string, appCfg config.App) (map[string]string, error) {
+	env, err := s.configStore.AppEnv(appCfg, envName, pool)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load shared config: %s", err)
+	}
+
+	for _, value := range env {
+		if !config.IsSecret(value) {
+			continue
+		}
+
+		keyring, err := s.loadKeyring()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load keyring for %s secrets: %s", appCfg.Name(), err)
+		}
+
+		env, err = config.DecryptEnv(keyring, env)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", appCfg.Name(), err)
+		}
+		return env, nil
+	}
+
+	return env, nil
+}
+
+// dnsServers returns the app's DNS servers, or the agent's if the app doesn't
+// set any.
+func (s *ServiceRuntime) dnsServers(appCfg config.App) []string {
+	if dns := appCfg.GetDNS(); len(dns) > 0 {
+		return dns
+	}
+
+	if s.dns != "" {
+		return []string{s.dns}
+	}
+	return nil
+}
+
+// extraHosts returns the app's /etc/hosts entries in docker's host:ip format
+func extraHosts(appCfg config.App) []string {
+	var hosts []string
+	for _, entry := range appCfg.GetHosts() {
+		hosts = append(hosts, entry.Host+":"+entry.Address)
+	}
+	return hosts
+}
+
+// portBindings returns the app's port mappings as docker's exposed ports and
+// host port bindings.
+func portBindings(appCfg config.App) (map[docker.Port]struct{}, map[docker.Port][]docker.PortBinding) {
+	mappings := appCfg.GetPortMappings()
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+
+	exposed := map[docker.Port]struct{}{}
+	bindings := map[docker.Port][]docker.PortBinding{}
+	for _, m := range mappings {
+		port := docker.Port(m.ContainerPort + "/" + m.Protocol())
+		exposed[port] = struct{}{}
+		bindings[port] = append(bindings[port], docker.PortBinding{HostPort: m.HostPort})
+	}
+	return exposed, bindings
+}
+
+// freeHostPorts makes sure the host ports mapped by the app aren't bound by
+// any other container on this host. Older versions of the same app are
+// stopped to free their ports, but another app, or another instance of this
+// version, holding one of the ports is a conflict.
+func (s *ServiceRuntime) freeHostPorts(appCfg config.App) error {
+	claimed := map[string]bool{}
+	for _, m := range appCfg.GetPortMappings() {
+		claimed[m.HostPort+"/"+m.Protocol()] = true
+	}
+	if len(claimed) == 0 {
+		return nil
+	}
+
+	containers, err := s.ManagedContainers()
+	if err != nil {
+		return err
+	}
+
+	version := strconv.FormatInt(appCfg.ID(), 10)
+	for _, container := range containers {
+		if container.NetworkSettings == nil {
+			continue
+		}
+
+		env := s.EnvFor(container)
+		for port, bindings := range container.NetworkSettings.Ports {
+			for _, binding := range bindings {
+				hostPort := binding.HostPort + "/" + port.Proto()
+				if !claimed[hostPort] {
+					continue
+				}
+
+				if env["GALAXY_APP"] != appCfg.Name() {
+					return fmt.Errorf("host port %s for %s is already used by %s as %s",
+						hostPort, appCfg.Name(), env["GALAXY_APP"], container.ID[0:12])
+				}
+
+				if env["GALAXY_VERSION"] == version {
+					return fmt.Errorf("host port %s is already used by another instance of %s as %s",
+						hostPort, appCfg.Name(), container.ID[0:12])
+				}
+			}
+		}
+	}
+
+	// only the old versions of this app are left holding the ports
+	for _, container := range containers {
+		env := s.EnvFor(container)
+		if env["GALAXY_APP"] != appCfg.Name() || env["GALAXY_VERSION"] == version || !holdsPorts(container, claimed) {
+			continue
+		}
+
+		log.Printf("Freeing host ports for %s held by version %s\n", appCfg.Name(), env["GALAXY_VERSION"])
+		err := s.stopContainer(container)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holdsPorts returns true if the container has any of the host ports bound
+func holdsPorts(container *docker.Container, ports map[string]bool) bool {
+	if container.NetworkSettings == nil {
+		return false
+	}
+	for port, bindings := range container.NetworkSettings.Ports {
+		for _, binding := range bindings {
+			if ports[binding.HostPort+"/"+port.Proto()] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *ServiceRuntime) loadKeyring() (*config.Keyring, error) {
+	s.keyringMu.Lock()
+	defer s.keyringMu.Unlock()
+
+	if s.keyring != nil {
+		return s.keyring, nil
+	}
+
+	keyring, err := config.LoadKeyring(config.DefaultKeyringPath())
+	if err != nil {
+		return nil, err
+	}
+	s.keyring = keyring
+	return keyring, nil
+}
+
 func (s *ServiceRuntime) EnvFor(container *docker.Container) map[string]string {
 	env := map[string]string{}
 	for _, item := range container.Config.Env {
@@ -1074,7 +1353,7 @@ func (s *ServiceRuntime) NextInstanceSlot(app, versionId string) (int, error) {
 	return utils.NextSlot(instances), nil
 }
 
-func (s ServiceRuntime) replaceVarEnv(in, hostIp string) string {
+func (s *ServiceRuntime) replaceVarEnv(in, hostIp string) string {
 	out := strings.Replace(in, "$HOST_IP", hostIp, -1)
 	return strings.Replace(out, "$DOCKER_IP", s.dockerIP, -1)
 }